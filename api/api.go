@@ -2,165 +2,466 @@ package api
 
 import (
 	"context"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/renproject/mercury/auth"
 	"github.com/renproject/mercury/cache"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/metrics"
 	"github.com/renproject/mercury/proxy"
-	"github.com/renproject/mercury/stat"
+	"github.com/renproject/mercury/stats"
+	"github.com/renproject/mercury/subscription"
 	"github.com/renproject/mercury/types"
+	"github.com/renproject/phi"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/sha3"
 )
 
+// Error codes defined by the JSON-RPC 2.0 specification. See `types` for the codes used when upstreams fail.
 const (
-	ErrorCodeInvalidJSON    = -32700
-	ErrorCodeInvalidRequest = -32600
+	ErrorCodeInvalidJSON    = types.ErrorCodeParse
+	ErrorCodeInvalidRequest = types.ErrorCodeInvalidRequest
+	ErrorCodeMethodNotFound = types.ErrorCodeMethodNotFound
+	ErrorCodeInvalidParams  = types.ErrorCodeInvalidParams
+	ErrorCodeInternal       = types.ErrorCodeInternal
 )
 
 type Api struct {
-	network types.Network
-	proxy   *proxy.Proxy
-	cache   *cache.Cache
-	logger  logrus.FieldLogger
+	network     types.Network
+	proxy       *proxy.Proxy
+	cache       *cache.Cache
+	mu          *sync.RWMutex
+	whitelist   Whitelist
+	maxLogRange uint64
+	// confirmations is the number of blocks above a block after which responses about it are cached indefinitely.
+	confirmations uint64
+	hub           *subscription.Hub
+	follower      *chain.Follower
+	logger        logrus.FieldLogger
 }
 
-// NewApi returns a new Api.
+// NewApi returns a new Api which serves the default whitelist of the network.
 func NewApi(network types.Network, proxy *proxy.Proxy, cache *cache.Cache, logger logrus.FieldLogger) *Api {
+	return NewApiWithWhitelist(network, proxy, cache, DefaultWhitelist(network), logger)
+}
+
+// NewApiWithWhitelist returns a new Api which serves the given whitelist.
+func NewApiWithWhitelist(network types.Network, proxy *proxy.Proxy, cache *cache.Cache, whitelist Whitelist, logger logrus.FieldLogger) *Api {
 	return &Api{
-		network: network,
-		proxy:   proxy,
-		cache:   cache,
-		logger:  logger,
+		network:       network,
+		proxy:         proxy,
+		cache:         cache,
+		mu:            new(sync.RWMutex),
+		whitelist:     whitelist,
+		maxLogRange:   DefaultMaxLogRange,
+		confirmations: MinConfirmations,
+		logger:        logger,
+	}
+}
+
+// SetWhitelist replaces the methods served by the Api. Requests that are in flight are not affected.
+func (api *Api) SetWhitelist(whitelist Whitelist) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.whitelist = whitelist
+}
+
+// SetMaxLogRange sets the number of blocks that callers below the internal role can query logs over in a single
+// eth_getLogs request.
+func (api *Api) SetMaxLogRange(maxLogRange uint64) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.maxLogRange = maxLogRange
+}
+
+// SetConfirmations sets the number of blocks that must be mined on top of a block before responses for it, and for the
+// transactions included in it, are cached indefinitely. Recent blocks can still be reorganised out of the chain.
+func (api *Api) SetConfirmations(confirmations uint64) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.confirmations = confirmations
+}
+
+// method returns how the method is served.
+func (api *Api) method(name string) Method {
+	api.mu.RLock()
+	defer api.mu.RUnlock()
+	return api.whitelist[name]
+}
+
+// AddHandler implements the `BlockchainApi` interface. Requests to the Api and to its upstreams are recorded in the
+// metrics, and requests to the Api are also counted in the stats. Ethereum networks are also served over websocket, and
+// other networks stream new blocks and reorgs on `/events`.
+func (api *Api) AddHandler(r *mux.Router, m *metrics.Metrics, s *stats.Store) {
+	api.proxy.SetObserver(upstreamObserver{metrics: m, network: route(api.network)})
+	rec := recorder{network: route(api.network), metrics: m, stats: s}
+	r.HandleFunc(fmt.Sprintf("/%s", route(api.network)), api.jsonRPCHandler(rec)).Methods("POST")
+	if api.network.Chain() == types.Ethereum {
+		r.HandleFunc(fmt.Sprintf("/%s", route(api.network)), api.websocketHandler(rec)).Methods("GET")
+	} else {
+		r.HandleFunc(fmt.Sprintf("/%s/events", route(api.network)), api.eventsHandler(rec)).Methods("GET")
 	}
 }
 
-// AddHandler implements the `BlockchainApi` interface.
-func (api *Api) AddHandler(r *mux.Router, s *stat.Stat) {
-	r.HandleFunc(fmt.Sprintf("/%s/%s", api.network.Chain(), api.network), api.jsonRPCHandler(s)).Methods("POST")
+// Network implements the `BlockchainApi` interface.
+func (api *Api) Network() types.Network {
+	return api.network
+}
+
+// CacheStats implements the `BlockchainApi` interface.
+func (api *Api) CacheStats() cache.Stats {
+	return api.cache.Stats()
 }
 
-func (api *Api) jsonRPCHandler(s *stat.Stat) http.HandlerFunc {
+// Upstreams implements the `BlockchainApi` interface.
+func (api *Api) Upstreams() []proxy.UpstreamStatus {
+	return api.proxy.Status()
+}
+
+// route returns the route of the network, relative to the root of the server.
+func route(network types.Network) string {
+	return fmt.Sprintf("%s/%s", network.Chain(), network)
+}
+
+func (api *Api) jsonRPCHandler(rec recorder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		data, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			writeError(w, r, api.logger, http.StatusBadRequest, ErrorCodeInvalidJSON, err)
-			return
-		}
+		rec.metrics.InFlight.WithLabelValues(rec.network).Inc()
+		defer rec.metrics.InFlight.WithLabelValues(rec.network).Dec()
 
-		method, id, err := GetMethodAndID(data)
+		data, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			writeError(w, r, api.logger, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Errorf("cannot get the method: %v", err))
+			writeError(w, r, api.logger, nil, newRPCError(ErrorCodeInvalidJSON, err))
 			return
 		}
 
-		level := WhitelistLevel(api.network, method)
-		if level == 0 {
-			writeError(w, r, api.logger, http.StatusMethodNotAllowed, id, fmt.Errorf("method unavailable: %s", method))
+		// Batch requests are JSON arrays, so we handle each of the elements separately.
+		if IsBatch(data) {
+			api.handleBatch(w, r, rec, data)
 			return
 		}
 
-		s.Insert(method)
-
-		hash, err := HashData(data)
+		method, id, err := parseRequest(data)
 		if err != nil {
-			writeError(w, r, api.logger, http.StatusInternalServerError, id, err)
+			writeError(w, r, api.logger, nil, err)
 			return
 		}
 
-		// Check if the result has been cached and if not retrieve it (or wait if it is already being retrieved).
-		resp, err := api.cache.Get(level, hash, FetchResponse(api.proxy, r, data))
-		if err != nil {
-			writeError(w, r, api.logger, http.StatusInternalServerError, id, err)
+		result, err := api.forward(r, rec, method, id, data)
+		if err == nil {
+			err = validResponse(result)
+		}
+		if id == nil {
+			// Notifications are served but not answered, as in batch requests.
+			setRetryAfter(w, retryAfter(err))
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-
-		var result Result
-		if err := json.Unmarshal(resp, &result); err != nil {
-			writeError(w, r, api.logger, http.StatusInternalServerError, id, fmt.Errorf(string(resp)))
+		if err != nil {
+			writeError(w, r, api.logger, id, err)
 			return
 		}
 
+		// JSON-RPC errors are part of the response, so the status is OK even if the upstream responded with another
+		// status, as Bitcoin nodes do for errors caused by the request.
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(result.StatusCode)
+		w.WriteHeader(http.StatusOK)
 		w.Write(result.Data)
 	}
 }
 
-type Result struct {
-	Data       []byte
-	StatusCode int
+// handleBatch serves each element of a JSON-RPC batch request separately and writes the responses as a single array in
+// the same order as the requests. Elements which cannot be served have an error object in place of their response.
+// Notifications are served but not answered, and a batch of only notifications is answered with no content.
+func (api *Api) handleBatch(w http.ResponseWriter, r *http.Request, rec recorder, data []byte) {
+	var reqs []json.RawMessage
+	if err := json.Unmarshal(data, &reqs); err != nil {
+		writeError(w, r, api.logger, nil, newRPCError(ErrorCodeInvalidJSON, err))
+		return
+	}
+	if len(reqs) == 0 {
+		writeError(w, r, api.logger, nil, newRPCError(ErrorCodeInvalidRequest, errors.New("empty batch")))
+		return
+	}
+
+	responses := make([]json.RawMessage, len(reqs))
+	errs := make([]error, len(reqs))
+	phi.ParForAll(len(reqs), func(i int) {
+		responses[i], errs[i] = api.batchResponse(r, rec, reqs[i])
+	})
+
+	// Callers are asked to wait until every element that was limited would be allowed.
+	var wait time.Duration
+	for _, err := range errs {
+		if d := retryAfter(err); d > wait {
+			wait = d
+		}
+	}
+
+	answered := make([]json.RawMessage, 0, len(responses))
+	for _, response := range responses {
+		if response != nil {
+			answered = append(answered, response)
+		}
+	}
+	if len(answered) == 0 {
+		setRetryAfter(w, wait)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	respData, err := json.Marshal(answered)
+	if err != nil {
+		writeError(w, r, api.logger, nil, err)
+		return
+	}
+	setRetryAfter(w, wait)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respData)
+}
+
+// batchResponse returns the response for a single element of a batch request, along with the error it describes if
+// the element could not be served. Notifications, which have no ID, are served but have no response.
+func (api *Api) batchResponse(r *http.Request, rec recorder, data []byte) (json.RawMessage, error) {
+	method, id, err := parseRequest(data)
+	if err != nil {
+		return errorResponse(api.logger, r, nil, err), err
+	}
+
+	result, err := api.forward(r, rec, method, id, data)
+	if err == nil {
+		err = validResponse(result)
+	}
+	if id == nil {
+		return nil, err
+	}
+	if err != nil {
+		return errorResponse(api.logger, r, id, err), err
+	}
+	return result.Data, nil
+}
+
+// validResponse returns an error if the response from the upstream is not JSON, such as an error page from a proxy in
+// front of the upstream.
+func validResponse(result Result) error {
+	if !json.Valid(result.Data) {
+		return fmt.Errorf("invalid response from upstream: status=%v", result.StatusCode)
+	}
+	return nil
 }
 
-func HashData(data []byte) (string, error) {
-	h := sha3.New256()
-	h.Write(data)
-	hash := hex.EncodeToString(h.Sum(nil))
-	return hash, nil
+// parseRequest returns the method and ID of a single JSON-RPC request, or an error with the JSON-RPC error code
+// describing why the request is invalid.
+func parseRequest(data []byte) (string, json.RawMessage, error) {
+	if !json.Valid(data) {
+		return "", nil, newRPCError(ErrorCodeInvalidJSON, errors.New("invalid json"))
+	}
+	method, id, err := GetMethodAndID(data)
+	if err != nil {
+		return "", nil, newRPCError(ErrorCodeInvalidRequest, fmt.Errorf("cannot get the method: %v", err))
+	}
+	if method == "" {
+		return "", nil, newRPCError(ErrorCodeInvalidRequest, errors.New("missing method"))
+	}
+	return method, id, nil
 }
 
-func GetMethodAndID(data []byte) (string, int, error) {
-	req := struct {
-		Method string `json:"method"`
-		ID     int    `json:"id"`
-	}{}
-	if err := json.Unmarshal(data, &req); err != nil {
-		return "", -1, err
+// forward checks the method against the whitelist and retrieves the response for the request, either from the cache
+// or from the proxy. The response is given the ID of the request, regardless of which request it was originally
+// retrieved for. The request is recorded by the status of its response.
+func (api *Api) forward(r *http.Request, rec recorder, method string, id json.RawMessage, data []byte) (Result, error) {
+	// Subscriptions are rejected before the caller is charged for a request that cannot be served.
+	if subscriptionMethods[method] && api.method(method).Level != types.NoAccess {
+		err := newRPCError(ErrorCodeMethodNotFound, fmt.Errorf("method %s is only available over websocket", method))
+		rec.record(r, method, status(Result{}, err))
+		return Result{}, err
+	}
+	whitelisted, err := api.authorize(r, rec, method, data)
+	if err != nil {
+		return Result{}, err
 	}
-	return req.Method, req.ID, nil
+
+	result, err := api.fetch(r, whitelisted, id, data)
+	rec.record(r, method, status(result, err))
+	return result, err
 }
 
-func FetchResponse(proxy *proxy.Proxy, r *http.Request, data []byte) func() ([]byte, error) {
-	return func() ([]byte, error) {
-		// TODO: Update the timeout as per requirements.
-		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+// authorize returns how the method is served if the caller can make the request: the method must be whitelisted, the
+// caller must have the role needed for the method, and it must be allowed to make the request by its API key. Requests
+// that are not authorized are recorded by the status of their error.
+func (api *Api) authorize(r *http.Request, rec recorder, method string, data []byte) (Method, error) {
+	whitelisted := api.method(method)
+	if whitelisted.Level == types.NoAccess {
+		// Methods that are not whitelisted are counted together, so that callers cannot create arbitrary series.
+		rec.record(r, unavailableMethod, strconv.Itoa(ErrorCodeMethodNotFound))
+		return Method{}, newRPCError(ErrorCodeMethodNotFound, fmt.Errorf("method unavailable: %s", method))
+	}
+
+	role := auth.Role(r)
+	if role < whitelisted.Role {
+		rec.record(r, method, strconv.Itoa(types.ErrorCodeUnauthorized))
+		return Method{}, newRPCError(types.ErrorCodeUnauthorized, fmt.Errorf("method %s is not available to %v callers", method, role))
+	}
+	if method == "eth_getLogs" && role < types.RoleInternal {
+		if err := api.checkLogRange(GetParams(data)); err != nil {
+			rec.record(r, method, status(Result{}, err))
+			return Method{}, err
+		}
+	}
+
+	if err := auth.Allow(r, rec.network, class(whitelisted.Level)); err != nil {
+		rec.record(r, method, status(Result{}, err))
+		return Method{}, err
+	}
+	return whitelisted, nil
+}
+
+// class returns the class of methods with the given access level, which selects the rate limits of the caller.
+func class(level types.AccessLevel) string {
+	if level == types.FullAccess {
+		return auth.ClassFull
+	}
+	return auth.ClassCached
+}
+
+// fetch retrieves the response for a whitelisted request.
+func (api *Api) fetch(r *http.Request, whitelisted Method, id json.RawMessage, data []byte) (Result, error) {
+	hash, err := HashData(data)
+	if err != nil {
+		return Result{}, newRPCError(ErrorCodeInvalidParams, err)
+	}
+
+	// Check if the result has been cached and if not retrieve it (or wait if it is already being retrieved).
+	api.mu.RLock()
+	confirmations := api.confirmations
+	api.mu.RUnlock()
+	policy := whitelisted.Policy.Resolve(GetParams(data), api.proxy.Tip(), confirmations)
+	resp, err := api.cache.Get(policy, hash, FetchResponse(api.proxy, r, data))
+	if err != nil {
+		return Result{}, err
+	}
+
+	var result Result
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return Result{}, fmt.Errorf("invalid cached response: %v", err)
+	}
+	result.Data = SetID(result.Data, id)
+	return result, nil
+}
+
+// unavailableMethod is the method label of requests for methods that are not whitelisted.
+const unavailableMethod = "unavailable"
+
+// status returns the status of a request in the metrics: either `metrics.StatusOK`, or the JSON-RPC error code of the
+// response.
+func status(result Result, err error) string {
+	if err != nil {
+		return strconv.Itoa(jsonError(err).Code)
+	}
+	var resp types.JSONResponse
+	if err := json.Unmarshal(result.Data, &resp); err != nil {
+		return strconv.Itoa(ErrorCodeInternal)
+	}
+	if resp.Error != nil {
+		return strconv.Itoa(resp.Error.Code)
+	}
+	if result.StatusCode != http.StatusOK {
+		return strconv.Itoa(ErrorCodeInternal)
+	}
+	return metrics.StatusOK
+}
+
+// recorder records the requests served by the Api of a network.
+type recorder struct {
+	network string
+	metrics *metrics.Metrics
+	stats   *stats.Store
+}
+
+// record counts a request in the metrics, and in the stats along with the tag and API key of the caller.
+func (rec recorder) record(r *http.Request, method, status string) {
+	rec.metrics.Requests.WithLabelValues(rec.network, method, status).Inc()
+	rec.stats.Record(time.Now(), stats.Labels{
+		Network: rec.network,
+		Method:  method,
+		Tag:     r.URL.Query().Get(auth.TagParam),
+		Key:     auth.Name(r),
+		Status:  status,
+	})
+}
+
+// upstreamObserver records the requests to the upstreams of a network in the metrics.
+type upstreamObserver struct {
+	metrics *metrics.Metrics
+	network string
+}
+
+// ObserveAttempt implements the `proxy.Observer` interface.
+func (observer upstreamObserver) ObserveAttempt(upstream string, duration time.Duration, err error) {
+	observer.metrics.UpstreamLatency.WithLabelValues(observer.network, upstream).Observe(duration.Seconds())
+	if err != nil {
+		observer.metrics.UpstreamErrors.WithLabelValues(observer.network, upstream).Inc()
+	}
+}
+
+type Result struct {
+	Data       []byte
+	StatusCode int
+}
+
+// proxyTimeout is how long the proxy has to serve a request, including retries and the backoff between them. It is
+// shorter than DefaultWriteTimeout, so that the response or the error can still be written once it gives up.
+const proxyTimeout = DefaultWriteTimeout - 10*time.Second
+
+// FetchResponse returns a fetcher which retrieves the response for the request from the proxy. Only successful
+// JSON-RPC results are reported as successful, so that upstream failures are never cached. The proxy gives up after
+// proxyTimeout, regardless of its retry policy.
+func FetchResponse(proxy *proxy.Proxy, r *http.Request, data []byte) cache.Fetcher {
+	return func() ([]byte, bool, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), proxyTimeout)
 		defer cancel()
 
 		// Fetch the response from the API.
 		resp, err := proxy.ProxyRequest(ctx, r, data)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
+		defer resp.Body.Close()
 
 		// Read the response and return it.
 		respData, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 
 		result := Result{
 			Data:       respData,
 			StatusCode: resp.StatusCode,
 		}
-
-		return json.Marshal(result)
+		resultData, err := json.Marshal(result)
+		if err != nil {
+			return nil, false, err
+		}
+		return resultData, IsSuccessful(result), nil
 	}
 }
 
-func writeError(w http.ResponseWriter, r *http.Request, logger logrus.FieldLogger, statusCode, id int, err error) {
-	resp := struct {
-		Error string `json:"error"`
-		ID    int    `json:"id"`
-	}{
-		Error: err.Error(),
-		ID:    id,
-	}
-
-	if statusCode >= 500 {
-		logger.Errorf("failed to call %s: %v", r.URL.String(), err)
-	} else if statusCode >= 400 {
-		logger.Warningf("failed to call %s: %v", r.URL.String(), err)
+// IsSuccessful returns whether the result is a successful JSON-RPC response.
+func IsSuccessful(result Result) bool {
+	if result.StatusCode != http.StatusOK {
+		return false
 	}
-
-	errMsg, err := json.Marshal(resp)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to marshal the error message: %v", err), statusCode)
-		return
+	var resp types.JSONResponse
+	if err := json.Unmarshal(result.Data, &resp); err != nil {
+		return false
 	}
-	http.Error(w, string(errMsg), statusCode)
+	return resp.Error == nil
 }
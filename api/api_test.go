@@ -1,9 +1,32 @@
 package api_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gorilla/mux"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/renproject/mercury/api"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/renproject/kv"
+	"github.com/renproject/mercury/cache"
+	"github.com/renproject/mercury/metrics"
+	"github.com/renproject/mercury/proxy"
+	"github.com/renproject/mercury/rpc"
+	"github.com/renproject/mercury/stats"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/types/ethtypes"
+	"github.com/sirupsen/logrus"
 )
 
 var _ = Describe("APIs", func() {
@@ -19,5 +42,523 @@ var _ = Describe("APIs", func() {
 
 			Expect(fstHash).To(Equal(sndHash))
 		})
+
+		It("should return the same hash for requests with different ids", func() {
+			fstHash, err := HashData([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_gasPrice","params":[]}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			sndHash, err := HashData([]byte(`{"jsonrpc":"2.0","id":"abc","method":"eth_gasPrice","params":[]}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fstHash).To(Equal(sndHash))
+		})
+
+		It("should return the same hash for equivalent params", func() {
+			fstHash, err := HashData([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{"to":"0x1","data":"0x2"},"latest"]}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			sndHash, err := HashData([]byte(`{"id":2,"params":[ { "data":"0x2", "to":"0x1" }, "latest" ],"method":"eth_call"}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fstHash).To(Equal(sndHash))
+		})
+
+		It("should return different hashes for different params", func() {
+			fstHash, err := HashData([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x1","latest"]}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			sndHash, err := HashData([]byte(`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x2","latest"]}`))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fstHash).ToNot(Equal(sndHash))
+		})
+	})
+
+	Context("when reading request ids", func() {
+		It("should accept number, string and null ids", func() {
+			for _, id := range []string{`1`, `"abc"`, `null`} {
+				method, reqID, err := GetMethodAndID([]byte(`{"jsonrpc":"2.0","id":` + id + `,"method":"eth_gasPrice"}`))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(method).To(Equal("eth_gasPrice"))
+				Expect(string(reqID)).To(Equal(id))
+			}
+		})
+
+		It("should reject object ids", func() {
+			_, _, err := GetMethodAndID([]byte(`{"jsonrpc":"2.0","id":{},"method":"eth_gasPrice"}`))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("when responding to requests", func() {
+		It("should return the id of the caller for cached responses", func() {
+			client := newEchoClient()
+			router := newRouter(client)
+
+			for _, id := range []string{`1`, `"abc"`, `null`, `2`} {
+				req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`{"jsonrpc":"2.0","id":`+id+`,"method":"eth_chainId","params":[]}`))
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				resp := map[string]json.RawMessage{}
+				Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+				Expect(string(resp["id"])).To(Equal(id))
+			}
+			Expect(client.Calls()).To(Equal(int64(1)))
+		})
+
+		It("should respond with an OK status to JSON-RPC errors with a server error status", func() {
+			client := newErrorClient()
+			client.status = http.StatusInternalServerError
+			router := newRouter(client)
+
+			req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_call","params":[{},"latest"]}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var resp types.JSONResponse
+			Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp.Error).ToNot(BeNil())
+			Expect(resp.Error.Code).To(Equal(-32000))
+		})
+
+		It("should not cache upstream errors", func() {
+			client := newErrorClient()
+			router := newRouter(client)
+
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":["0x1"]}`))
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				var resp types.JSONResponse
+				Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+				Expect(resp.Error).ToNot(BeNil())
+			}
+			Expect(client.Calls()).To(Equal(int64(2)))
+		})
+
+		It("should only cache requests for explicit blocks with enough confirmations", func() {
+			client := newChainClient(0x20)
+			router, _ := newChainRouter(client)
+			getBalance := func(block string) {
+				req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_getBalance","params":["0x1",`+block+`]}`))
+				router.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			for _, block := range []string{`"latest"`, `"0x1f"`} {
+				getBalance(block)
+				getBalance(block)
+			}
+			Expect(client.Calls("eth_getBalance")).To(Equal(int64(4)))
+
+			getBalance(`"0x10"`)
+			getBalance(`"0x10"`)
+			Expect(client.Calls("eth_getBalance")).To(Equal(int64(5)))
+		})
+
+		It("should not cache null results for blocks that do not exist yet", func() {
+			client := newChainClient(0x20)
+			router, _ := newChainRouter(client)
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_getBlockByNumber","params":["0x30",false]}`))
+				router.ServeHTTP(httptest.NewRecorder(), req)
+			}
+			Expect(client.Calls("eth_getBlockByNumber")).To(Equal(int64(2)))
+		})
+
+		It("should only cache receipts once their block has enough confirmations", func() {
+			client := newChainClient(0x12)
+			router, monitor := newChainRouter(client)
+			getReceipt := func() {
+				req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_getTransactionReceipt","params":["0x1"]}`))
+				router.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			getReceipt()
+			getReceipt()
+			Expect(client.Calls("eth_getTransactionReceipt")).To(Equal(int64(2)))
+
+			client.SetHeight(0x10 + MinConfirmations)
+			monitor.Poll(context.Background())
+			getReceipt()
+			getReceipt()
+			Expect(client.Calls("eth_getTransactionReceipt")).To(Equal(int64(3)))
+		})
+	})
+
+	Context("when sending batch requests", func() {
+		It("should return the responses in the same order as the requests", func() {
+			router := newRouter(newEchoClient())
+
+			resps := sendBatch(router, `[
+				{"jsonrpc":"2.0","id":1,"method":"eth_gasPrice","params":[]},
+				{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber","params":[]},
+				{"jsonrpc":"2.0","id":3,"method":"eth_getBalance","params":["0x0","latest"]}
+			]`)
+			Expect(resps).To(HaveLen(3))
+			for i, method := range []string{"eth_gasPrice", "eth_blockNumber", "eth_getBalance"} {
+				Expect(resps[i].Error).To(BeNil())
+				Expect(resps[i].ID).To(BeNumerically("==", i+1))
+				Expect(string(resps[i].Result)).To(Equal(`"` + method + `"`))
+			}
+		})
+
+		It("should deny individual elements which are not whitelisted", func() {
+			router := newRouter(newEchoClient())
+
+			resps := sendBatch(router, `[
+				{"jsonrpc":"2.0","id":1,"method":"eth_gasPrice","params":[]},
+				{"jsonrpc":"2.0","id":2,"method":"eth_accounts","params":[]},
+				{"jsonrpc":"2.0","id":3,"method":"eth_blockNumber","params":[]}
+			]`)
+			Expect(resps).To(HaveLen(3))
+			Expect(resps[0].Error).To(BeNil())
+			Expect(resps[1].Error).ToNot(BeNil())
+			Expect(resps[1].Error.Code).To(Equal(ErrorCodeMethodNotFound))
+			Expect(resps[1].ID).To(BeNumerically("==", 2))
+			Expect(resps[2].Error).To(BeNil())
+		})
+
+		It("should not respond to notifications", func() {
+			client := newEchoClient()
+			router := newRouter(client)
+
+			resps := sendBatch(router, `[
+				{"jsonrpc":"2.0","method":"eth_gasPrice","params":[]},
+				{"jsonrpc":"2.0","id":null,"method":"eth_blockNumber","params":[]},
+				{"jsonrpc":"2.0","method":"eth_accounts","params":[]}
+			]`)
+			Expect(resps).To(HaveLen(1))
+			Expect(string(resps[0].Result)).To(Equal(`"eth_blockNumber"`))
+			Expect(client.Calls()).To(Equal(int64(2)))
+		})
+
+		It("should respond with no content to single notifications", func() {
+			client := newEchoClient()
+			router := newRouter(client)
+
+			req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_gasPrice","params":[]}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusNoContent))
+			Expect(w.Body.Len()).To(Equal(0))
+			Expect(client.Calls()).To(Equal(int64(1)))
+		})
+
+		It("should respond with no content to batches of notifications", func() {
+			client := newEchoClient()
+			router := newRouter(client)
+
+			req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`[
+				{"jsonrpc":"2.0","method":"eth_gasPrice","params":[]},
+				{"jsonrpc":"2.0","method":"eth_blockNumber","params":[]}
+			]`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusNoContent))
+			Expect(w.Body.Len()).To(Equal(0))
+			Expect(client.Calls()).To(Equal(int64(2)))
+		})
+
+		It("should reject empty batches", func() {
+			router := newRouter(newEchoClient())
+
+			req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(`[]`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var resp types.JSONResponse
+			Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp.Error.Code).To(Equal(ErrorCodeInvalidRequest))
+		})
+	})
+
+	Context("when a request cannot be served", func() {
+		send := func(router *mux.Router, body string) types.JSONResponse {
+			req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var resp types.JSONResponse
+			Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp.JSONRPC).To(Equal("2.0"))
+			Expect(resp.Error).ToNot(BeNil())
+			return resp
+		}
+
+		It("should return a parse error for invalid JSON", func() {
+			resp := send(newRouter(newEchoClient()), `{"jsonrpc":`)
+			Expect(resp.Error.Code).To(Equal(types.ErrorCodeParse))
+			Expect(resp.ID).To(BeNil())
+		})
+
+		It("should return an invalid request error for requests without a method", func() {
+			resp := send(newRouter(newEchoClient()), `{"jsonrpc":"2.0","id":1}`)
+			Expect(resp.Error.Code).To(Equal(types.ErrorCodeInvalidRequest))
+		})
+
+		It("should return a method not found error for methods that are not whitelisted", func() {
+			resp := send(newRouter(newEchoClient()), `{"jsonrpc":"2.0","id":"a","method":"personal_unlockAccount","params":[]}`)
+			Expect(resp.Error.Code).To(Equal(types.ErrorCodeMethodNotFound))
+			Expect(resp.ID).To(Equal("a"))
+		})
+
+		It("should say which upstreams failed", func() {
+			router := newRouter(failingClient{})
+
+			resp := send(router, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)
+			Expect(resp.Error.Code).To(Equal(types.ErrorCodeUpstream))
+			var data types.ErrorData
+			Expect(json.Unmarshal(resp.Error.Data, &data)).To(Succeed())
+			Expect(data.Upstreams).To(HaveLen(3))
+			Expect(data.Upstreams[0].Upstream).To(Equal("0"))
+			Expect(data.Upstreams[0].Error).To(Equal("connection refused"))
+
+			// The circuit breaker of the upstream is now open.
+			resp = send(router, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)
+			Expect(resp.Error.Code).To(Equal(types.ErrorCodeUnavailable))
+		})
+	})
+	Context("when recording metrics", func() {
+		It("should count requests by method and status", func() {
+			m := metrics.New()
+			router := newRouterWithMetrics(newEchoClient(), m)
+
+			sendBatch(router, `[{"jsonrpc":"2.0","id":1,"method":"personal_unlockAccount","params":[]}]`)
+			sendBatch(router, `[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]},{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber","params":[]}]`)
+			Expect(testutil.ToFloat64(m.Requests.WithLabelValues("eth/kovan", "eth_blockNumber", metrics.StatusOK))).To(Equal(2.0))
+			Expect(testutil.ToFloat64(m.Requests.WithLabelValues("eth/kovan", "unavailable", "-32601"))).To(Equal(1.0))
+			Expect(testutil.CollectAndCount(m.UpstreamLatency)).To(Equal(1))
+
+			failing := metrics.New()
+			router = newRouterWithMetrics(failingClient{}, failing)
+			sendBatch(router, `[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}]`)
+			Expect(testutil.ToFloat64(failing.Requests.WithLabelValues("eth/kovan", "eth_blockNumber", metrics.StatusOK))).To(Equal(0.0))
+			Expect(testutil.ToFloat64(failing.UpstreamErrors.WithLabelValues("eth/kovan", "0"))).To(BeNumerically(">", 0))
+		})
+	})
+
+	Context("when the whitelist is replaced", func() {
+		It("should serve the new whitelist", func() {
+			logger := logrus.StandardLogger()
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			api := NewApi(ethtypes.Kovan, proxy.NewProxy(newEchoClient()), cache.New(store, logger), logger)
+			router := mux.NewRouter().StrictSlash(true)
+			api.AddHandler(router, metrics.New(), newStats())
+
+			body := `[{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}]`
+			resps := sendBatch(router, body)
+			Expect(resps[0].Error).To(BeNil())
+
+			api.SetWhitelist(DefaultWhitelist(ethtypes.Kovan).Merge(Whitelist{
+				"eth_blockNumber": {types.NoAccess, types.RolePublic, cache.NoCache()},
+			}))
+			resps = sendBatch(router, body)
+			Expect(resps[0].Error.Code).To(Equal(types.ErrorCodeMethodNotFound))
+		})
+	})
+
+	Context("when checking the access level of callers", func() {
+		It("should deny methods that need a higher role", func() {
+			Expect(WhitelistLevel(ethtypes.Kovan, "eth_blockNumber", types.RolePublic)).To(Equal(types.FullAccess))
+			Expect(WhitelistLevel(ethtypes.Kovan, "eth_sendRawTransaction", types.RolePublic)).To(Equal(types.NoAccess))
+			Expect(WhitelistLevel(ethtypes.Kovan, "eth_sendRawTransaction", types.RoleInternal)).To(Equal(types.CachedAccess))
+			Expect(EthWhitelistLevel("debug_traceTransaction", types.RoleInternal)).To(Equal(types.NoAccess))
+			Expect(EthWhitelistLevel("debug_traceTransaction", types.RoleAdmin)).To(Equal(types.FullAccess))
+			Expect(BtcWhitelistLevel("sendrawtransaction", types.RoleAdmin)).To(Equal(types.CachedAccess))
+			Expect(BtcWhitelistLevel("stop", types.RoleAdmin)).To(Equal(types.NoAccess))
+		})
 	})
 })
+
+func newRouter(client rpc.Client) *mux.Router {
+	return newRouterWithMetrics(client, metrics.New())
+}
+
+func newRouterWithMetrics(client rpc.Client, m *metrics.Metrics) *mux.Router {
+	logger := logrus.StandardLogger()
+	store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+	api := NewApi(ethtypes.Kovan, proxy.NewProxy(client), cache.New(store, logger), logger)
+
+	router := mux.NewRouter().StrictSlash(true)
+	api.AddHandler(router, m, newStats())
+	return router
+}
+
+// newChainRouter returns a router for an Api whose proxy knows the chain tip of the client, using the monitor.
+func newChainRouter(client *chainClient) (*mux.Router, *proxy.TipMonitor) {
+	logger := logrus.StandardLogger()
+	store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+	p := proxy.NewProxy(client)
+	monitor := proxy.NewTipMonitor(p, TipOptions(ethtypes.Kovan), logger)
+	monitor.Poll(context.Background())
+	api := NewApi(ethtypes.Kovan, p, cache.New(store, logger), logger)
+
+	router := mux.NewRouter().StrictSlash(true)
+	api.AddHandler(router, metrics.New(), newStats())
+	return router, monitor
+}
+
+func newStats() *stats.Store {
+	return stats.New(kv.NewTable(kv.NewMemDB(kv.JSONCodec), "stats"), stats.DefaultOptions(), logrus.StandardLogger())
+}
+
+func sendBatch(router *mux.Router, body string) []types.JSONResponse {
+	req := httptest.NewRequest("POST", "/eth/kovan", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	Expect(w.Code).To(Equal(http.StatusOK))
+
+	var resps []types.JSONResponse
+	Expect(json.Unmarshal(w.Body.Bytes(), &resps)).To(Succeed())
+	return resps
+}
+
+// echoClient responds to each request with the name of the requested method.
+type echoClient struct {
+	calls *int64
+}
+
+func newEchoClient() echoClient {
+	return echoClient{
+		calls: new(int64),
+	}
+}
+
+func (client echoClient) Calls() int64 {
+	return atomic.LoadInt64(client.calls)
+}
+
+func (client echoClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	atomic.AddInt64(client.calls, 1)
+
+	var req types.JSONRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	result, err := json.Marshal(req.Method)
+	if err != nil {
+		return nil, err
+	}
+	respData, err := json.Marshal(types.JSONResponse{
+		JSONRPC: "2.0",
+		Result:  result,
+		ID:      req.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(respData)),
+	}, nil
+}
+
+// chainClient serves a chain of Ethereum blocks, in which every transaction is included in block 0x10.
+type chainClient struct {
+	mu     *sync.Mutex
+	height uint64
+	calls  map[string]int64
+}
+
+func newChainClient(height uint64) *chainClient {
+	return &chainClient{
+		mu:     new(sync.Mutex),
+		height: height,
+		calls:  map[string]int64{},
+	}
+}
+
+// SetHeight sets the height of the chain tip.
+func (client *chainClient) SetHeight(height uint64) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.height = height
+}
+
+// Calls returns the number of requests for the method.
+func (client *chainClient) Calls(method string) int64 {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.calls[method]
+}
+
+func (client *chainClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	var req types.JSONRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	client.calls[req.Method]++
+
+	var result interface{}
+	switch req.Method {
+	case "eth_blockNumber":
+		result = hexutil.Uint64(client.height)
+	case "eth_getTransactionReceipt":
+		result = map[string]interface{}{"blockNumber": "0x10"}
+	case "eth_getBlockByNumber":
+		var params []interface{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+		if height, err := hexutil.DecodeUint64(params[0].(string)); err == nil && height <= client.height {
+			result = map[string]interface{}{"number": params[0]}
+		}
+	default:
+		result = "0x1"
+	}
+	resultData, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	respData, err := json.Marshal(types.JSONResponse{JSONRPC: "2.0", Result: resultData, ID: req.ID})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader(respData)),
+	}, nil
+}
+
+// failingClient cannot reach its node.
+type failingClient struct{}
+
+func (client failingClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+// errorClient responds to each request with a JSON-RPC error, and the given status.
+type errorClient struct {
+	calls  *int64
+	status int
+}
+
+func newErrorClient() errorClient {
+	return errorClient{
+		calls:  new(int64),
+		status: http.StatusOK,
+	}
+}
+
+func (client errorClient) Calls() int64 {
+	return atomic.LoadInt64(client.calls)
+}
+
+func (client errorClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	atomic.AddInt64(client.calls, 1)
+
+	respData := []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"execution reverted"}}`)
+	return &http.Response{
+		StatusCode: client.status,
+		Body:       ioutil.NopCloser(bytes.NewReader(respData)),
+	}, nil
+}
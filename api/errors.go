@@ -0,0 +1,202 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/renproject/mercury/auth"
+	"github.com/renproject/mercury/proxy"
+	"github.com/renproject/mercury/subscription"
+	"github.com/renproject/mercury/types"
+	"github.com/sirupsen/logrus"
+)
+
+// rpcError is an error caused by the request, along with its JSON-RPC error code.
+type rpcError struct {
+	code int
+	err  error
+}
+
+// Error implements the error interface.
+func (err rpcError) Error() string {
+	return err.err.Error()
+}
+
+func newRPCError(code int, err error) error {
+	return rpcError{code: code, err: err}
+}
+
+// timeout is implemented by network errors that are caused by a timeout.
+type timeout interface {
+	Timeout() bool
+}
+
+// jsonError returns the JSON-RPC error object describing the error. Errors from the proxy are given a code describing
+// why the upstreams could not serve the request, and data listing each upstream that failed.
+func jsonError(err error) *types.JSONError {
+	switch err := err.(type) {
+	case rpcError:
+		return &types.JSONError{Code: err.code, Message: err.Error()}
+	case types.ErrList:
+		code, message := upstreamErrorCode(err)
+		return &types.JSONError{Code: code, Message: message, Data: errorData(upstreamErrors(err))}
+	case proxy.ErrNoQuorum:
+		errs := make([]types.UpstreamError, len(err.Responses))
+		for i, response := range err.Responses {
+			errs[i] = types.UpstreamError{Upstream: response.Upstream, Result: response.Result}
+			if response.Err != nil {
+				errs[i].Error = response.Err.Error()
+			}
+		}
+		message := fmt.Sprintf("no quorum for %v: %d upstreams must agree", err.Method, err.Threshold)
+		return &types.JSONError{Code: types.ErrorCodeNoQuorum, Message: message, Data: errorData(errs)}
+	case proxy.ErrFilterLost:
+		return &types.JSONError{Code: types.ErrorCodeUpstream, Message: err.Error()}
+	case auth.ErrLimitExceeded:
+		return &types.JSONError{Code: types.ErrorCodeLimitExceeded, Message: err.Error()}
+	case subscription.ErrUpstream:
+		return &types.JSONError{Code: err.Code, Message: err.Message}
+	}
+
+	switch {
+	case err == auth.ErrUnauthorized:
+		return &types.JSONError{Code: types.ErrorCodeUnauthorized, Message: err.Error()}
+	case err == proxy.ErrNoUpstreams, err == subscription.ErrUnavailable, err == subscription.ErrDisconnected:
+		return &types.JSONError{Code: types.ErrorCodeUnavailable, Message: err.Error()}
+	case isTimeout(err):
+		return &types.JSONError{Code: types.ErrorCodeTimeout, Message: "upstream request timed out"}
+	default:
+		return &types.JSONError{Code: types.ErrorCodeInternal, Message: err.Error()}
+	}
+}
+
+// upstreamErrorCode returns the code and message describing why every attempt to serve a request failed. If the
+// attempts failed for different reasons, they are described as generic upstream failures.
+func upstreamErrorCode(errs types.ErrList) (int, string) {
+	unavailable, timedOut, rateLimited := 0, 0, 0
+	for _, err := range errs {
+		if err, ok := err.(types.ErrUpstream); ok {
+			switch inner := err.Err.(type) {
+			case proxy.ErrBadResponse:
+				if inner.RateLimited() {
+					rateLimited++
+				}
+			default:
+				if inner == proxy.ErrBreakerOpen || inner == proxy.ErrLagging {
+					unavailable++
+				} else if isTimeout(inner) {
+					timedOut++
+				}
+			}
+			continue
+		}
+		if isTimeout(err) {
+			timedOut++
+		}
+	}
+
+	switch len(errs) {
+	case unavailable:
+		return types.ErrorCodeUnavailable, "no upstream is available"
+	case timedOut:
+		return types.ErrorCodeTimeout, "upstream request timed out"
+	case rateLimited:
+		return types.ErrorCodeRateLimited, "upstream rate limit exceeded"
+	default:
+		return types.ErrorCodeUpstream, "upstream request failed"
+	}
+}
+
+// upstreamErrors describes each failed attempt to serve a request.
+func upstreamErrors(errs types.ErrList) []types.UpstreamError {
+	upstreamErrs := make([]types.UpstreamError, 0, len(errs))
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if err, ok := err.(types.ErrUpstream); ok {
+			upstreamErrs = append(upstreamErrs, types.UpstreamError{
+				Upstream: err.Upstream,
+				Attempt:  err.Attempt,
+				Error:    err.Err.Error(),
+			})
+			continue
+		}
+		upstreamErrs = append(upstreamErrs, types.UpstreamError{Error: err.Error()})
+	}
+	return upstreamErrs
+}
+
+// errorData returns the data of a JSON-RPC error listing the upstreams that failed.
+func errorData(errs []types.UpstreamError) json.RawMessage {
+	data, err := json.Marshal(types.ErrorData{Upstreams: errs})
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// isTimeout returns whether the error was caused by a timeout.
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	t, ok := err.(timeout)
+	return ok && t.Timeout()
+}
+
+// errorResponse returns a JSON-RPC response for the error. Errors caused by the request are logged as warnings, and
+// errors caused by mercury or the upstreams as errors.
+func errorResponse(logger logrus.FieldLogger, r *http.Request, id json.RawMessage, err error) json.RawMessage {
+	jsonErr := jsonError(err)
+	switch jsonErr.Code {
+	case types.ErrorCodeParse, types.ErrorCodeInvalidRequest, types.ErrorCodeMethodNotFound, types.ErrorCodeInvalidParams,
+		types.ErrorCodeUnauthorized, types.ErrorCodeLimitExceeded:
+		logger.Warningf("failed to call %s: %v", r.URL.String(), err)
+	default:
+		logger.Errorf("failed to call %s: %v", r.URL.String(), err)
+	}
+
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	resp, err := json.Marshal(types.JSONResponse{
+		JSONRPC: "2.0",
+		Error:   jsonErr,
+		ID:      id,
+	})
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return resp
+}
+
+// writeError writes a JSON-RPC response for the error. The HTTP status is always 200, so that clients read the error
+// object rather than treating the response as a transport failure.
+func writeError(w http.ResponseWriter, r *http.Request, logger logrus.FieldLogger, id json.RawMessage, err error) {
+	setRetryAfter(w, retryAfter(err))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(errorResponse(logger, r, id, err))
+}
+
+// retryAfter returns how long the caller must wait before retrying a request that failed with the error, or zero if
+// the request was not limited.
+func retryAfter(err error) time.Duration {
+	if err, ok := err.(auth.ErrLimitExceeded); ok {
+		return err.RetryAfter
+	}
+	return 0
+}
+
+// setRetryAfter sets the Retry-After header, in whole seconds, if the duration is positive.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10))
+}
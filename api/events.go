@@ -0,0 +1,195 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/renproject/mercury/auth"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/metrics"
+	"github.com/renproject/mercury/types"
+)
+
+// eventsMethod is the method label of requests to stream events.
+const eventsMethod = "events"
+
+// errEventsUnavailable is returned when streaming events from a network without a chain follower.
+var errEventsUnavailable = newRPCError(types.ErrorCodeUnavailable, errors.New("events are unavailable for this network"))
+
+// SetFollower sets the Follower whose events are streamed to callers. Responses cached until a new block are also
+// invalidated whenever its tip changes. Events are unavailable until it is set.
+func (api *Api) SetFollower(follower *chain.Follower) {
+	if tip, ok := follower.Tip(); ok {
+		api.cache.SetTip(tip.Hash)
+	}
+	follower.OnTip(func(tip chain.Block) {
+		api.cache.SetTip(tip.Hash)
+	})
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.follower = follower
+}
+
+// eventsHandler streams the `newBlock` and `reorg` events of the chain follower. Each event is sent as a JSON message
+// over websocket connections, and as a Server-Sent Event otherwise. Callers that cannot keep up with the events are
+// disconnected. The stream is closed when the context of the request is done.
+func (api *Api) eventsHandler(rec recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		api.mu.RLock()
+		follower := api.follower
+		api.mu.RUnlock()
+		if follower == nil {
+			rec.record(r, eventsMethod, status(Result{}, errEventsUnavailable))
+			writeError(w, r, api.logger, nil, errEventsUnavailable)
+			return
+		}
+		if err := auth.Allow(r, rec.network, auth.ClassCached); err != nil {
+			rec.record(r, eventsMethod, status(Result{}, err))
+			writeError(w, r, api.logger, nil, err)
+			return
+		}
+
+		sub := follower.Subscribe()
+		defer sub.Unsubscribe()
+		if websocket.IsWebSocketUpgrade(r) {
+			api.websocketEvents(w, r, rec, sub)
+		} else {
+			api.serverSentEvents(w, r, rec, sub)
+		}
+	}
+}
+
+// websocketEvents streams the events of the subscription over a websocket connection.
+func (api *Api) websocketEvents(w http.ResponseWriter, r *http.Request, rec recorder, sub *chain.Subscription) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already responded with the error.
+		api.logger.Warningf("cannot upgrade %s to websocket: %v", r.URL.String(), err)
+		return
+	}
+	defer ws.Close()
+	rec.record(r, eventsMethod, metrics.StatusOK)
+
+	// Messages from the caller are ignored, but must be read for the connection to notice pongs and closes.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		ws.SetReadLimit(wsMaxMessageSize)
+		ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		})
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = streamEvents(r, sub, closed, func(event chain.Event) error {
+		ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return ws.WriteJSON(event)
+	}, func() error {
+		return ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+	})
+	switch err {
+	case nil:
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(wsWriteTimeout))
+	case chain.ErrTooSlow:
+		ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()), time.Now().Add(wsWriteTimeout))
+	}
+}
+
+// serverSentEvents streams the events of the subscription as Server-Sent Events. The connection is hijacked, since the
+// deadlines of the server do not apply to event streams, and is closed once the stream ends.
+func (api *Api) serverSentEvents(w http.ResponseWriter, r *http.Request, rec recorder, sub *chain.Subscription) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err := errors.New("event streams are not supported by the connection")
+		rec.record(r, eventsMethod, status(Result{}, err))
+		writeError(w, r, api.logger, nil, err)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		api.logger.Warningf("cannot stream events to %s: %v", r.URL.String(), err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	rec.record(r, eventsMethod, metrics.StatusOK)
+
+	// Headers set by the middleware, such as for cross-origin requests, are kept.
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "close")
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", http.StatusOK, http.StatusText(http.StatusOK))
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	if err := flush(conn, buf.Writer); err != nil {
+		return
+	}
+
+	// Nothing more is expected from the caller, so reading only notices when it disconnects.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		io.Copy(ioutil.Discard, buf.Reader)
+	}()
+
+	streamEvents(r, sub, closed, func(event chain.Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "event: %s\ndata: %s\n\n", event.Type, data)
+		return flush(conn, buf.Writer)
+	}, func() error {
+		buf.WriteString(": ping\n\n")
+		return flush(conn, buf.Writer)
+	})
+}
+
+// streamEvents sends the events of the subscription and pings the caller until the context of the request is done, the
+// caller disconnects, or sending fails. It returns nil if the context is done, and otherwise the reason the stream
+// ended.
+func streamEvents(r *http.Request, sub *chain.Subscription, closed <-chan struct{}, send func(chain.Event) error, ping func() error) error {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-closed:
+			return errors.New("connection closed")
+		case event, ok := <-sub.Events():
+			if !ok {
+				return sub.Err()
+			}
+			err = send(event)
+		case <-ticker.C:
+			err = ping()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flush writes the buffered data to the hijacked connection, which must accept it within the write timeout.
+func flush(conn net.Conn, w *bufio.Writer) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return w.Flush()
+}
@@ -0,0 +1,185 @@
+package api_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/api"
+
+	"github.com/gorilla/websocket"
+	"github.com/renproject/kv"
+	"github.com/renproject/mercury/cache"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/proxy"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/types/btctypes"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Events", func() {
+	var (
+		node     *blocksNode
+		client   echoClient
+		follower *chain.Follower
+		server   *Server
+	)
+
+	BeforeEach(func() {
+		node = newBlocksNode()
+		follower = chain.New(node.Call, chain.Options{}, logrus.StandardLogger())
+		Expect(follower.Poll(context.Background())).To(Succeed())
+
+		logger := logrus.StandardLogger()
+		client = newEchoClient()
+		store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+		api := NewApi(btctypes.BtcTestnet, proxy.NewProxy(client), cache.New(store, logger), logger)
+		api.SetFollower(follower)
+		server = NewServer(logger, "0", api)
+		Expect(server.Start()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Shutdown(context.Background())
+	})
+
+	mine := func() chain.Block {
+		node.Mine()
+		Expect(follower.Poll(context.Background())).To(Succeed())
+		tip, _ := follower.Tip()
+		return tip
+	}
+
+	Context("when streaming Server-Sent Events", func() {
+		It("should send each new block until the server shuts down", func() {
+			resp, err := http.Get(serverURL(server) + "/btc/testnet/events")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+			Eventually(follower.Subscribers).Should(Equal(1))
+
+			block := mine()
+			reader := bufio.NewReader(resp.Body)
+			line, err := reader.ReadString('\n')
+			Expect(err).ToNot(HaveOccurred())
+			Expect(line).To(Equal("event: newBlock\n"))
+			line, err = reader.ReadString('\n')
+			Expect(err).ToNot(HaveOccurred())
+			var event chain.Event
+			Expect(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event)).To(Succeed())
+			Expect(event).To(Equal(chain.Event{Type: chain.EventNewBlock, Block: block}))
+
+			Expect(server.Shutdown(context.Background())).To(Succeed())
+			Expect(reader.ReadString('\n')).To(Equal("\n"))
+			_, err = reader.ReadString('\n')
+			Expect(err).To(Equal(io.EOF))
+			Eventually(follower.Subscribers).Should(Equal(0))
+		})
+	})
+
+	Context("when streaming events over a websocket", func() {
+		It("should send each event as a message", func() {
+			url := "ws" + strings.TrimPrefix(serverURL(server), "http") + "/btc/testnet/events"
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(follower.Subscribers).Should(Equal(1))
+
+			block := mine()
+			var event chain.Event
+			Expect(conn.ReadJSON(&event)).To(Succeed())
+			Expect(event).To(Equal(chain.Event{Type: chain.EventNewBlock, Block: block}))
+
+			conn.Close()
+			Eventually(follower.Subscribers).Should(Equal(0))
+		})
+	})
+
+	Context("when the network has no follower", func() {
+		It("should respond with an error", func() {
+			logger := logrus.StandardLogger()
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			api := NewApi(btctypes.BtcTestnet, proxy.NewProxy(newEchoClient()), cache.New(store, logger), logger)
+			other := NewServer(logger, "0", api)
+			Expect(other.Start()).To(Succeed())
+			defer other.Shutdown(context.Background())
+
+			resp, err := http.Get(serverURL(other) + "/btc/testnet/events")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			var body types.JSONResponse
+			Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+			Expect(body.Error.Code).To(Equal(types.ErrorCodeUnavailable))
+		})
+	})
+
+	Context("when caching responses until a new block", func() {
+		It("should retrieve the response again once the follower finds a new block", func() {
+			getBlockCount := func() {
+				body := bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"getblockcount","params":[]}`)
+				resp, err := http.Post(serverURL(server)+"/btc/testnet", "application/json", body)
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+			}
+
+			getBlockCount()
+			getBlockCount()
+			Expect(client.Calls()).To(Equal(int64(1)))
+
+			mine()
+			getBlockCount()
+			Expect(client.Calls()).To(Equal(int64(2)))
+		})
+	})
+})
+
+// blocksNode is a chain of blocks served using the methods of a Bitcoin node.
+type blocksNode struct {
+	mu     *sync.Mutex
+	hashes []string
+}
+
+func newBlocksNode() *blocksNode {
+	return &blocksNode{
+		mu:     new(sync.Mutex),
+		hashes: []string{"block0"},
+	}
+}
+
+// Mine adds a block to the chain.
+func (node *blocksNode) Mine() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.hashes = append(node.hashes, fmt.Sprintf("block%d", len(node.hashes)))
+}
+
+// Call implements the `chain.Caller` type.
+func (node *blocksNode) Call(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	switch method {
+	case "getbestblockhash":
+		return json.Marshal(node.hashes[len(node.hashes)-1])
+	case "getblockheader":
+		for height, hash := range node.hashes {
+			if hash != params[0] {
+				continue
+			}
+			header := map[string]interface{}{"hash": hash, "height": height, "time": height}
+			if height > 0 {
+				header["previousblockhash"] = node.hashes[height-1]
+			}
+			return json.Marshal(header)
+		}
+	}
+	return nil, fmt.Errorf("unsupported request %v %v", method, params)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// ErrInvalidID is returned when the ID of a request is not a string, number or null.
+var ErrInvalidID = errors.New("invalid id: must be a string, number or null")
+
+// HashData returns the hash of a normalised version of the request. The ID is not included in the hash and the params
+// are canonicalised, so that identical calls share the same hash regardless of the ID used by the caller or how the
+// request was formatted.
+func HashData(data []byte) (string, error) {
+	req := struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return "", err
+	}
+
+	params, err := canonicalParams(req.Params)
+	if err != nil {
+		return "", err
+	}
+	normalised, err := json.Marshal(struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}{
+		Method: req.Method,
+		Params: params,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	h := sha3.New256()
+	h.Write(normalised)
+	hash := hex.EncodeToString(h.Sum(nil))
+	return hash, nil
+}
+
+// IsBatch returns whether the request data is a JSON-RPC batch request.
+func IsBatch(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '['
+}
+
+// GetMethodAndID returns the method and the raw ID of the request. The ID is returned as it was sent by the caller so
+// that it can be written into the response unchanged. A missing ID is returned as nil.
+func GetMethodAndID(data []byte) (string, json.RawMessage, error) {
+	req := struct {
+		Method string          `json:"method"`
+		ID     json.RawMessage `json:"id"`
+	}{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return "", nil, err
+	}
+	if !validID(req.ID) {
+		return "", nil, ErrInvalidID
+	}
+	return req.Method, req.ID, nil
+}
+
+// GetParams returns the raw params of the request, or nil if they cannot be read.
+func GetParams(data []byte) json.RawMessage {
+	req := struct {
+		Params json.RawMessage `json:"params"`
+	}{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil
+	}
+	return req.Params
+}
+
+// SetID replaces the ID in the response with the given ID. A nil ID is written as null. Responses that are not JSON
+// objects are returned unchanged.
+func SetID(data []byte, id json.RawMessage) []byte {
+	resp := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return data
+	}
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	resp["id"] = id
+
+	respData, err := json.Marshal(resp)
+	if err != nil {
+		return data
+	}
+	return respData
+}
+
+// canonicalParams returns the params in a canonical form: without insignificant whitespace and with object keys
+// sorted. Missing and null params are treated as an empty list.
+func canonicalParams(params json.RawMessage) (json.RawMessage, error) {
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return json.RawMessage("[]"), nil
+	}
+
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func validID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	default:
+		return false
+	}
+}
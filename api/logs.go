@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// logRange returns the number of blocks that an eth_getLogs request queries logs over, using the best known tip for
+// the "latest" and "pending" tags. Filters by block hash query a single block. It returns false if the range cannot be
+// determined, e.g. because it ends at the tip and the tip is not known.
+func logRange(params json.RawMessage, tip uint64) (uint64, bool) {
+	var filters []struct {
+		FromBlock *string `json:"fromBlock"`
+		ToBlock   *string `json:"toBlock"`
+		BlockHash *string `json:"blockHash"`
+	}
+	if err := json.Unmarshal(params, &filters); err != nil || len(filters) == 0 {
+		return 0, false
+	}
+	filter := filters[0]
+	if filter.BlockHash != nil {
+		return 1, true
+	}
+
+	// Blocks default to the latest block, so ranges between two tags are a single block regardless of the tip.
+	from, fromTip, ok := blockNumber(filter.FromBlock)
+	if !ok {
+		return 0, false
+	}
+	to, toTip, ok := blockNumber(filter.ToBlock)
+	if !ok {
+		return 0, false
+	}
+	if fromTip && toTip {
+		return 1, true
+	}
+	if fromTip || toTip {
+		if tip == 0 {
+			return 0, false
+		}
+		if fromTip {
+			from = tip
+		} else {
+			to = tip
+		}
+	}
+	if to < from {
+		return 0, true
+	}
+	return to - from + 1, true
+}
+
+// blockNumber parses a block parameter, returning whether it refers to the tip of the chain.
+func blockNumber(block *string) (uint64, bool, bool) {
+	if block == nil {
+		return 0, true, true
+	}
+	switch *block {
+	case "latest", "pending":
+		return 0, true, true
+	case "earliest":
+		return 0, false, true
+	}
+	if !strings.HasPrefix(*block, "0x") {
+		return 0, false, false
+	}
+	number, err := strconv.ParseUint(strings.TrimPrefix(*block, "0x"), 16, 64)
+	if err != nil {
+		return 0, false, false
+	}
+	return number, false, true
+}
+
+// checkLogRange returns an error if an eth_getLogs request queries logs over more than the maximum number of blocks,
+// or over a range that cannot be determined.
+func (api *Api) checkLogRange(params json.RawMessage) error {
+	api.mu.RLock()
+	maxRange := api.maxLogRange
+	api.mu.RUnlock()
+
+	blocks, ok := logRange(params, api.proxy.Tip())
+	if !ok {
+		return newRPCError(ErrorCodeInvalidParams, fmt.Errorf("cannot determine the block range of the filter, give explicit block numbers"))
+	}
+	if blocks > maxRange {
+		return newRPCError(ErrorCodeInvalidParams, fmt.Errorf("block range of %d exceeds the maximum of %d", blocks, maxRange))
+	}
+	return nil
+}
@@ -1,74 +1,300 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/renproject/mercury/stat"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/renproject/kv"
+	"github.com/renproject/mercury/auth"
+	"github.com/renproject/mercury/cache"
+	"github.com/renproject/mercury/metrics"
+	"github.com/renproject/mercury/proxy"
+	"github.com/renproject/mercury/stats"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/watch"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
 )
 
 type BlockchainApi interface {
-	AddHandler(r *mux.Router, s *stat.Stat)
+	AddHandler(r *mux.Router, m *metrics.Metrics, s *stats.Store)
+	Network() types.Network
+	CacheStats() cache.Stats
+	Upstreams() []proxy.UpstreamStatus
 }
 
 // DefaultMaxHeaderBytes is the maximum permitted size of the headers in an HTTP request.
 const DefaultMaxHeaderBytes = 1 << 10 // 1 KB
 
+// DefaultWriteTimeout is how long the server has to read a request and write its response. It covers every attempt
+// the proxy makes to serve the request.
+const DefaultWriteTimeout = time.Minute
+
+// DefaultShutdownTimeout is how long Run waits for requests in flight to finish once it is stopped.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// DefaultStatsWindow is the window queried by `GET /stats` when no start time is given.
+const DefaultStatsWindow = 24 * time.Hour
+
+// ErrServerStarted is returned when starting a server that is already running.
+var ErrServerStarted = errors.New("server already started")
+
 type Server struct {
-	apis   []BlockchainApi
-	port   string
-	logger logrus.FieldLogger
-	stat   *stat.Stat
+	apis    []BlockchainApi
+	port    string
+	logger  logrus.FieldLogger
+	metrics *metrics.Metrics
+	stats   *stats.Store
+	auth    *auth.Authenticator
+	watches *watch.Notifier
+
+	adminToken string
+	reload     func() error
+
+	mu         *sync.Mutex
+	httpServer *http.Server
+	listener   net.Listener
+	done       chan error
+	closing    chan struct{}
 }
 
-// NewServer returns a server which supports the given blockchain APIs.
+// NewServer returns a server which supports the given blockchain APIs. Request stats are kept in memory unless another
+// store is set using SetStats, and callers are not authenticated unless an Authenticator is set using SetAuth.
 func NewServer(logger logrus.FieldLogger, port string, apis ...BlockchainApi) *Server {
-	s := stat.New()
-	return &Server{
-		apis:   apis,
-		port:   port,
-		logger: logger,
-		stat:   &s,
+	server := &Server{
+		apis:    apis,
+		port:    port,
+		logger:  logger,
+		metrics: metrics.New(),
+		stats:   stats.New(kv.NewTable(kv.NewMemDB(kv.JSONCodec), "stats"), stats.DefaultOptions(), logger),
+		auth:    auth.New(kv.NewTable(kv.NewMemDB(kv.JSONCodec), "usage"), auth.Options{}, logger),
+		mu:      new(sync.Mutex),
 	}
+	server.metrics.OnCollect(server.collect)
+	return server
 }
 
-// Run starts the server.
-func (server *Server) Run() {
-	// Add handlers for each blockchain.
-	r := mux.NewRouter().StrictSlash(true)
+// Metrics returns the metrics recorded by the server.
+func (server *Server) Metrics() *metrics.Metrics {
+	return server.metrics
+}
+
+// Stats returns the store in which request stats are recorded.
+func (server *Server) Stats() *stats.Store {
+	return server.stats
+}
+
+// SetStats sets the store in which request stats are recorded. It must be called before the server is started.
+func (server *Server) SetStats(store *stats.Store) {
+	server.stats = store
+}
+
+// SetAuth sets the Authenticator which identifies and limits the callers of the server. It must be called before the
+// server is started.
+func (server *Server) SetAuth(authenticator *auth.Authenticator) {
+	server.auth = authenticator
+}
+
+// collect sends the metrics of the caches and upstreams of each network, which are maintained by the caches and
+// proxies themselves. Upstreams which have been removed by a reload are no longer sent.
+func (server *Server) collect(ch chan<- prometheus.Metric) {
+	m := server.metrics
 	for _, api := range server.apis {
-		api.AddHandler(r, server.stat)
+		network := route(api.Network())
+
+		stats := api.CacheStats()
+		ch <- prometheus.MustNewConstMetric(m.CacheRequests, prometheus.CounterValue, float64(stats.Hits), network, metrics.CacheHit)
+		ch <- prometheus.MustNewConstMetric(m.CacheRequests, prometheus.CounterValue, float64(stats.Misses), network, metrics.CacheMiss)
+		ch <- prometheus.MustNewConstMetric(m.CacheRequests, prometheus.CounterValue, float64(stats.Coalesced), network, metrics.CacheCoalesced)
+		ch <- prometheus.MustNewConstMetric(m.CacheEntries, prometheus.GaugeValue, float64(stats.Entries), network)
+		ch <- prometheus.MustNewConstMetric(m.CacheBytes, prometheus.GaugeValue, float64(stats.Bytes), network)
+
+		for _, upstream := range api.Upstreams() {
+			for _, state := range []proxy.BreakerState{proxy.BreakerClosed, proxy.BreakerOpen, proxy.BreakerHalfOpen} {
+				ch <- prometheus.MustNewConstMetric(m.UpstreamBreaker, prometheus.GaugeValue, boolToFloat(upstream.Breaker == state), network, upstream.Name, state.String())
+			}
+			healthy := upstream.Breaker != proxy.BreakerOpen && !upstream.Lagging
+			ch <- prometheus.MustNewConstMetric(m.UpstreamHealthy, prometheus.GaugeValue, boolToFloat(healthy), network, upstream.Name)
+			ch <- prometheus.MustNewConstMetric(m.UpstreamOutstanding, prometheus.GaugeValue, float64(upstream.Outstanding), network, upstream.Name)
+			ch <- prometheus.MustNewConstMetric(m.UpstreamLag, prometheus.GaugeValue, float64(upstream.Lag), network, upstream.Name)
+		}
 	}
-	r.HandleFunc("/health", server.health()).Methods("GET")
-	r.HandleFunc("/stats", server.stats()).Methods("GET")
+}
 
-	// Use recovery handler and provide cross-origin support.
-	r.Use(server.recoveryHandler)
-	handler := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST"},
-	}).Handler(r)
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// EnableReload adds the `POST /admin/reload` endpoint, which calls the reload function. Requests must send the token as
+// a bearer token in their `Authorization` header. The endpoint is not added if the token is empty. The token also gives
+// access to the endpoints restricted to admins, such as `GET /stats`. It must be called before the server is started.
+func (server *Server) EnableReload(token string, reload func() error) {
+	server.adminToken = token
+	server.reload = reload
+}
 
-	// Set-up request timeout and header size limit for the server.
+// Run starts the server and serves requests until the context is done. It then stops accepting requests and waits up
+// to DefaultShutdownTimeout for requests in flight to finish. It returns an error if the server cannot start, stops
+// serving unexpectedly, or cannot finish its requests in time.
+func (server *Server) Run(ctx context.Context) error {
+	if err := server.Start(); err != nil {
+		return err
+	}
+	server.mu.Lock()
+	done := server.done
+	server.mu.Unlock()
+
+	select {
+	case err := <-done:
+		addr := server.Addr()
+		server.Shutdown(context.Background())
+		return fmt.Errorf("cannot serve on %v: %v", addr, err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), DefaultShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// Start listens on the port of the server and serves requests in the background until Shutdown is called. If the port
+// is "0", a random port is chosen, which can be read using Addr.
+func (server *Server) Start() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.httpServer != nil {
+		return ErrServerStarted
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", server.port))
+	if err != nil {
+		return fmt.Errorf("cannot listen on port %v: %v", server.port, err)
+	}
+
+	// Set-up request timeout and header size limit for the server. Websocket connections set their own deadlines.
+	closing := make(chan struct{})
 	httpServer := &http.Server{
-		Addr:              fmt.Sprintf(":%v", server.port),
-		Handler:           handler,
+		Handler:           server.handler(closing),
 		ReadTimeout:       5 * time.Second,
 		ReadHeaderTimeout: 3 * time.Second,
-		WriteTimeout:      5 * time.Second,
+		WriteTimeout:      DefaultWriteTimeout,
 		IdleTimeout:       1 * time.Minute,
 		MaxHeaderBytes:    DefaultMaxHeaderBytes,
 	}
+	done := make(chan error, 1)
+	go func() {
+		if err := httpServer.Serve(listener); err != http.ErrServerClosed {
+			done <- err
+		}
+		close(done)
+	}()
+
+	server.httpServer, server.listener, server.done, server.closing = httpServer, listener, done, closing
+	server.logger.Infof("mercury listening on %v...", listener.Addr())
+	return nil
+}
+
+// Addr returns the address the server is listening on, or an empty string if it has not been started.
+func (server *Server) Addr() string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.listener == nil {
+		return ""
+	}
+	return server.listener.Addr().String()
+}
 
-	server.logger.Infof("mercury listening on 0.0.0.0:%v...", server.port)
-	// Start running the server.
-	if err := httpServer.ListenAndServe(); err != nil {
-		server.logger.Errorf("failed to listen and serve on port: %v", server.port)
+// Shutdown stops accepting requests and waits for requests in flight to finish. If the context is done first, the
+// remaining connections are closed and an error is returned. The server can be started again once it has shut down.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	httpServer, done, closing := server.httpServer, server.done, server.closing
+	server.httpServer, server.listener, server.done, server.closing = nil, nil, nil, nil
+	server.mu.Unlock()
+
+	if httpServer == nil {
+		return nil
+	}
+	server.logger.Infof("mercury shutting down...")
+	close(closing)
+	if err := httpServer.Shutdown(ctx); err != nil {
+		httpServer.Close()
+		return fmt.Errorf("cannot finish requests in flight: %v", err)
+	}
+	if err := <-done; err != nil {
+		return fmt.Errorf("cannot serve: %v", err)
+	}
+	return nil
+}
+
+// handler returns the handler for every endpoint of the server. Websocket connections and event streams are closed
+// once closing is closed.
+func (server *Server) handler(closing <-chan struct{}) http.Handler {
+	// Add handlers for each blockchain.
+	r := mux.NewRouter().StrictSlash(true)
+	for _, api := range server.apis {
+		api.AddHandler(r, server.metrics, server.stats)
+	}
+	r.HandleFunc("/health", server.health()).Methods("GET")
+	r.Handle("/metrics", server.metrics.Handler()).Methods("GET")
+	r.HandleFunc("/stats", server.restricted(server.statsHandler())).Methods("GET")
+	r.HandleFunc("/stats/cache", server.cacheStats()).Methods("GET")
+	r.HandleFunc("/stats/upstreams", server.upstreamStats()).Methods("GET")
+	if server.adminToken != "" && server.reload != nil {
+		r.HandleFunc("/admin/reload", server.admin(server.reloadHandler())).Methods("POST")
+	}
+	if server.watches != nil {
+		server.addWatchHandlers(r)
+	}
+
+	// Use recovery handler and provide cross-origin support.
+	r.Use(server.recoveryHandler)
+	r.Use(streamContext(closing))
+	r.Use(server.auth.Middleware)
+	return cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "POST", "DELETE"},
+		AllowedHeaders: []string{"Content-Type", "Authorization", auth.KeyHeader},
+		ExposedHeaders: []string{"Retry-After"},
+	}).Handler(r)
+}
+
+// streamContext cancels the context of websocket requests and event streams once closing is closed. Their connections
+// are hijacked, so they are not closed when shutting down the HTTP server, and their handlers must close them.
+func streamContext(closing <-chan struct{}) mux.MiddlewareFunc {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !websocket.IsWebSocketUpgrade(r) && !strings.HasSuffix(r.URL.Path, "/events") {
+				h.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			go func() {
+				select {
+				case <-closing:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
 	}
 }
 
@@ -78,14 +304,176 @@ func (server *Server) health() http.HandlerFunc {
 	}
 }
 
-func (server *Server) stats() http.HandlerFunc {
+// statsHandler returns the number of requests made within a window, optionally for a single network, and grouped by
+// any of network, method, tag, key and status. The window is given by the `from` and `to` query parameters, as RFC
+// 3339 timestamps or unix times in seconds, and defaults to the last DefaultStatsWindow. Windows end no later than the
+// current time, and cannot be longer than stats.MaxWindow. The `groupBy` parameter is a comma separated list of
+// dimensions, and defaults to `method`. If none of these parameters are given, the number of requests for each
+// whitelisted method over the last DefaultStatsWindow is returned as a flat map, as it was before the parameters were
+// added.
+func (server *Server) statsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !hasStatsQuery(r) {
+			counts, err := server.methodCounts(time.Now())
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			json.NewEncoder(w).Encode(counts)
+			return
+		}
+		query, err := parseStatsQuery(r, time.Now())
+		if err == nil {
+			var result stats.Result
+			if result, err = server.stats.Query(query); err == nil {
+				json.NewEncoder(w).Encode(result)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	}
+}
+
+// hasStatsQuery returns whether the request has any of the parameters of a stats query.
+func hasStatsQuery(r *http.Request) bool {
+	params := r.URL.Query()
+	for _, param := range []string{"from", "to", "network", "groupBy"} {
+		if _, ok := params[param]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// methodCounts returns the number of requests for each whitelisted method, across every network, over the
+// DefaultStatsWindow before the given time.
+func (server *Server) methodCounts(now time.Time) (map[string]uint64, error) {
+	result, err := server.stats.Query(stats.Query{
+		From:    now.Add(-DefaultStatsWindow),
+		To:      now,
+		GroupBy: []string{stats.DimensionMethod},
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]uint64{}
+	for _, group := range result.Groups {
+		if method := group.Labels[stats.DimensionMethod]; method != unavailableMethod {
+			counts[method] = group.Count
+		}
+	}
+	return counts, nil
+}
+
+// parseStatsQuery returns the stats query given by the query parameters of the request.
+func parseStatsQuery(r *http.Request, now time.Time) (stats.Query, error) {
+	params := r.URL.Query()
+	query := stats.Query{
+		To:      now,
+		Network: params.Get("network"),
+		GroupBy: []string{stats.DimensionMethod},
+	}
+
+	var err error
+	if to := params.Get("to"); to != "" {
+		if query.To, err = parseTime(to); err != nil {
+			return stats.Query{}, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	query.From = query.To.Add(-DefaultStatsWindow)
+	if from := params.Get("from"); from != "" {
+		if query.From, err = parseTime(from); err != nil {
+			return stats.Query{}, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if groupBy, ok := params["groupBy"]; ok {
+		query.GroupBy = nil
+		for _, dimension := range strings.Split(strings.Join(groupBy, ","), ",") {
+			if dimension = strings.TrimSpace(dimension); dimension != "" {
+				query.GroupBy = append(query.GroupBy, dimension)
+			}
+		}
+	}
+	return query, nil
+}
+
+// parseTime parses an RFC 3339 timestamp or a unix time in seconds.
+func parseTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (server *Server) cacheStats() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		data := server.stat.Get()
+		data := map[string]cache.Stats{}
+		for _, api := range server.apis {
+			data[route(api.Network())] = api.CacheStats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+}
+
+func (server *Server) upstreamStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := map[string][]proxy.UpstreamStatus{}
+		for _, api := range server.apis {
+			data[route(api.Network())] = api.Upstreams()
+		}
+		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(data)
+	}
+}
+
+func (server *Server) reloadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		if err := server.reload(); err != nil {
+			server.logger.Errorf("cannot reload: %v", err)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		server.logger.Infof("reloaded config")
+		json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
+	}
+}
+
+// admin only allows requests that send the admin token as a bearer token.
+func (server *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !server.hasAdminToken(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
 	}
 }
 
+// restricted only allows requests from admins: callers whose API key has the admin role, or that send the admin token
+// as a bearer token.
+func (server *Server) restricted(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth.Role(r) != types.RoleAdmin && !server.hasAdminToken(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// hasAdminToken returns whether the request sends the admin token as a bearer token. No request has it if the token is
+// empty.
+func (server *Server) hasAdminToken(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return server.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(server.adminToken)) == 1
+}
+
 func (server *Server) recoveryHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -2,22 +2,32 @@ package api_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 	"github.com/renproject/kv"
 	"github.com/renproject/mercury/api"
 	. "github.com/renproject/mercury/api"
+	"github.com/renproject/mercury/auth"
 	"github.com/renproject/mercury/cache"
 	"github.com/renproject/mercury/proxy"
 	"github.com/renproject/mercury/rpc"
 	"github.com/renproject/mercury/rpcclient/btcrpcclient"
+	"github.com/renproject/mercury/stats"
+	"github.com/renproject/mercury/types"
 	"github.com/renproject/mercury/types/btctypes"
+	"github.com/renproject/mercury/types/ethtypes"
+	"github.com/renproject/mercury/watch"
 	"github.com/renproject/phi"
 	"github.com/sirupsen/logrus"
 )
@@ -35,13 +45,13 @@ var _ = Describe("Server", func() {
 			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
 			btcCache := cache.New(store, logger)
 			btcTestnetAPI := api.NewApi(btctypes.BtcTestnet, btcTestnetProxy, btcCache, logger)
-			server := NewServer(logrus.StandardLogger(), "5000", btcTestnetAPI)
-			go server.Run()
-			time.Sleep(2 * time.Second)
+			server := NewServer(logrus.StandardLogger(), "0", btcTestnetAPI)
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
 
 			phi.ParForAll(5, func(i int) {
 				buf := bytes.NewBuffer([]byte(`{"jsonrpc": "2.0", "method": "listunspent", "id": 1, "params": [0, 999999, "mwdXtp8ow61jcG1EXYVy5aZqksxvtrnNsL"]}`))
-				resp, err := http.Post("http://127.0.0.1:5000/btc/testnet/", "application/json", buf)
+				resp, err := http.Post(serverURL(server)+"/btc/testnet/", "application/json", buf)
 				if err != nil {
 					logger.Println(err)
 					return
@@ -56,4 +66,498 @@ var _ = Describe("Server", func() {
 			})
 		})
 	})
+
+	Context("when reloading the config", func() {
+		It("should only reload for requests with the admin token", func() {
+			reloads, fail := int64(0), int64(0)
+			server := NewServer(logrus.StandardLogger(), "0")
+			server.EnableReload("secret", func() error {
+				atomic.AddInt64(&reloads, 1)
+				if atomic.LoadInt64(&fail) != 0 {
+					return errors.New("invalid config")
+				}
+				return nil
+			})
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			reload := func(token string) int {
+				req, err := http.NewRequest("POST", serverURL(server)+"/admin/reload", nil)
+				Expect(err).ToNot(HaveOccurred())
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				return resp.StatusCode
+			}
+
+			Expect(reload("")).To(Equal(http.StatusUnauthorized))
+			Expect(reload("wrong")).To(Equal(http.StatusUnauthorized))
+			Expect(atomic.LoadInt64(&reloads)).To(Equal(int64(0)))
+
+			Expect(reload("secret")).To(Equal(http.StatusOK))
+			Expect(atomic.LoadInt64(&reloads)).To(Equal(int64(1)))
+
+			atomic.StoreInt64(&fail, 1)
+			Expect(reload("secret")).To(Equal(http.StatusUnprocessableEntity))
+			Expect(atomic.LoadInt64(&reloads)).To(Equal(int64(2)))
+		})
+	})
+
+	Context("when scraping metrics", func() {
+		It("should expose requests, caches and upstreams in the Prometheus format", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			for i := 0; i < 2; i++ {
+				buf := bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`)
+				resp, err := http.Post(serverURL(server)+"/eth/kovan", "application/json", buf)
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+			}
+
+			resp, err := http.Get(serverURL(server) + "/metrics")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			data, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			body := string(data)
+			Expect(body).To(ContainSubstring(`mercury_requests_total{method="eth_chainId",network="eth/kovan",status="ok"} 2`))
+			Expect(body).To(ContainSubstring(`mercury_requests_in_flight{network="eth/kovan"} 0`))
+			Expect(body).To(ContainSubstring(`mercury_cache_requests_total{network="eth/kovan",result="hit"} 1`))
+			Expect(body).To(ContainSubstring(`mercury_cache_requests_total{network="eth/kovan",result="miss"} 1`))
+			Expect(body).To(ContainSubstring(`mercury_upstream_request_duration_seconds_count{network="eth/kovan",upstream="0"} 1`))
+			Expect(body).To(ContainSubstring(`mercury_upstream_breaker_state{network="eth/kovan",state="closed",upstream="0"} 1`))
+			Expect(body).To(ContainSubstring(`mercury_upstream_healthy{network="eth/kovan",upstream="0"} 1`))
+		})
+	})
+
+	Context("when querying stats", func() {
+		It("should count requests within the window by the given dimensions", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			server.EnableReload("token", func() error { return nil })
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			for _, body := range []string{
+				`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`,
+				`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`,
+				`{"jsonrpc":"2.0","id":1,"method":"personal_unlockAccount","params":[]}`,
+			} {
+				resp, err := http.Post(serverURL(server)+"/eth/kovan?tag=darknode", "application/json", bytes.NewBufferString(body))
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+			}
+
+			query := func(params string) (int, stats.Result) {
+				req, err := http.NewRequest("GET", serverURL(server)+"/stats"+params, nil)
+				Expect(err).ToNot(HaveOccurred())
+				req.Header.Set("Authorization", "Bearer token")
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				var result stats.Result
+				if resp.StatusCode == http.StatusOK {
+					Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+				}
+				return resp.StatusCode, result
+			}
+
+			status, result := query("?groupBy=method")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(result.Total).To(Equal(uint64(3)))
+			Expect(result.Groups).To(Equal([]stats.Group{
+				{Labels: map[string]string{"method": "eth_blockNumber"}, Count: 2},
+				{Labels: map[string]string{"method": "unavailable"}, Count: 1},
+			}))
+
+			_, result = query("?network=eth/kovan&groupBy=tag,status")
+			Expect(result.Groups).To(Equal([]stats.Group{
+				{Labels: map[string]string{"tag": "darknode", "status": "ok"}, Count: 2},
+				{Labels: map[string]string{"tag": "darknode", "status": "-32601"}, Count: 1},
+			}))
+
+			_, result = query("?network=btc/mainnet")
+			Expect(result.Total).To(BeZero())
+			_, result = query(fmt.Sprintf("?from=%d&to=%d", time.Now().Add(-2*time.Hour).Unix(), time.Now().Add(-time.Hour).Unix()))
+			Expect(result.Total).To(BeZero())
+
+			status, _ = query("?groupBy=upstream")
+			Expect(status).To(Equal(http.StatusBadRequest))
+			status, _ = query("?from=yesterday")
+			Expect(status).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should return the number of requests for each method without query parameters", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			server.EnableReload("token", func() error { return nil })
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			for _, body := range []string{
+				`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`,
+				`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`,
+				`{"jsonrpc":"2.0","id":1,"method":"eth_chainId","params":[]}`,
+				`{"jsonrpc":"2.0","id":1,"method":"personal_unlockAccount","params":[]}`,
+			} {
+				resp, err := http.Post(serverURL(server)+"/eth/kovan", "application/json", bytes.NewBufferString(body))
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+			}
+
+			req, err := http.NewRequest("GET", serverURL(server)+"/stats", nil)
+			Expect(err).ToNot(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer token")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			counts := map[string]uint64{}
+			Expect(json.NewDecoder(resp.Body).Decode(&counts)).To(Succeed())
+			Expect(counts).To(Equal(map[string]uint64{"eth_blockNumber": 2, "eth_chainId": 1}))
+		})
+
+		It("should only return stats to admins", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			server.SetAuth(auth.New(kv.NewTable(kv.NewMemDB(kv.JSONCodec), "usage"), auth.Options{
+				Keys: []auth.Key{
+					{Name: "darknode", Key: "internal", Role: types.RoleInternal},
+					{Name: "admin", Key: "admin", Role: types.RoleAdmin},
+				},
+			}, logrus.StandardLogger()))
+			server.EnableReload("token", func() error { return nil })
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			get := func(key, token string) int {
+				req, err := http.NewRequest("GET", serverURL(server)+"/stats", nil)
+				Expect(err).ToNot(HaveOccurred())
+				if key != "" {
+					req.Header.Set(auth.KeyHeader, key)
+				}
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			Expect(get("", "")).To(Equal(http.StatusUnauthorized))
+			Expect(get("internal", "")).To(Equal(http.StatusUnauthorized))
+			Expect(get("", "wrong")).To(Equal(http.StatusUnauthorized))
+			Expect(get("admin", "")).To(Equal(http.StatusOK))
+			Expect(get("", "token")).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when callers are rate limited", func() {
+		It("should return an error with a Retry-After header", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "usage")
+			server.SetAuth(auth.New(store, auth.Options{
+				Keys: []auth.Key{{Name: "darknode", Key: "secret", Limits: []auth.Limit{{Rate: 0.1, Burst: 1}}}},
+			}, logrus.StandardLogger()))
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			post := func(key, body string) (*http.Response, types.JSONResponse) {
+				req, err := http.NewRequest("POST", serverURL(server)+"/eth/kovan", bytes.NewBufferString(body))
+				Expect(err).ToNot(HaveOccurred())
+				req.Header.Set(auth.KeyHeader, key)
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				var jsonResp types.JSONResponse
+				json.NewDecoder(resp.Body).Decode(&jsonResp)
+				return resp, jsonResp
+			}
+
+			body := `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`
+			resp, jsonResp := post("secret", body)
+			Expect(jsonResp.Error).To(BeNil())
+			Expect(resp.Header.Get("Retry-After")).To(BeEmpty())
+
+			resp, jsonResp = post("secret", body)
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(jsonResp.Error.Code).To(Equal(types.ErrorCodeLimitExceeded))
+			Expect(resp.Header.Get("Retry-After")).To(Equal("10"))
+
+			resp, _ = post("secret", "["+body+"]")
+			Expect(resp.Header.Get("Retry-After")).To(Equal("10"))
+
+			_, jsonResp = post("wrong", body)
+			Expect(jsonResp.Error.Code).To(Equal(types.ErrorCodeUnauthorized))
+
+			result, err := server.Stats().Query(stats.Query{
+				From:    time.Now().Add(-time.Hour),
+				To:      time.Now().Add(time.Minute),
+				GroupBy: []string{stats.DimensionKey, stats.DimensionStatus},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Groups).To(ConsistOf(
+				stats.Group{Labels: map[string]string{"key": "darknode", "status": "ok"}, Count: 1},
+				stats.Group{Labels: map[string]string{"key": "darknode", "status": "-32021"}, Count: 2},
+				stats.Group{Labels: map[string]string{"key": "", "status": "-32020"}, Count: 1},
+			))
+		})
+
+		It("should not charge callers for subscriptions over HTTP", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			server.SetAuth(auth.New(kv.NewTable(kv.NewMemDB(kv.JSONCodec), "usage"), auth.Options{
+				Keys: []auth.Key{{Name: "darknode", Key: "secret", Limits: []auth.Limit{{Rate: 0.1, Burst: 1}}}},
+			}, logrus.StandardLogger()))
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			post := func(body string) types.JSONResponse {
+				req, err := http.NewRequest("POST", serverURL(server)+"/eth/kovan", bytes.NewBufferString(body))
+				Expect(err).ToNot(HaveOccurred())
+				req.Header.Set(auth.KeyHeader, "secret")
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				var jsonResp types.JSONResponse
+				Expect(json.NewDecoder(resp.Body).Decode(&jsonResp)).To(Succeed())
+				return jsonResp
+			}
+
+			for i := 0; i < 3; i++ {
+				jsonResp := post(`{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)
+				Expect(jsonResp.Error.Message).To(ContainSubstring("only available over websocket"))
+			}
+			jsonResp := post(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)
+			Expect(jsonResp.Error).To(BeNil())
+		})
+	})
+
+	Context("when callers have different roles", func() {
+		It("should only serve the methods and log ranges allowed for the role of the caller", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "usage")
+			server.SetAuth(auth.New(store, auth.Options{
+				Keys: []auth.Key{{Name: "darknode", Key: "secret", Role: types.RoleInternal}},
+			}, logrus.StandardLogger()))
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			post := func(key, body string) types.JSONResponse {
+				req, err := http.NewRequest("POST", serverURL(server)+"/eth/kovan", bytes.NewBufferString(body))
+				Expect(err).ToNot(HaveOccurred())
+				if key != "" {
+					req.Header.Set(auth.KeyHeader, key)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				var jsonResp types.JSONResponse
+				Expect(json.NewDecoder(resp.Body).Decode(&jsonResp)).To(Succeed())
+				return jsonResp
+			}
+
+			send := `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0x00"]}`
+			Expect(post("", send).Error.Code).To(Equal(types.ErrorCodeUnauthorized))
+			Expect(post("secret", send).Error).To(BeNil())
+
+			narrow := `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"0x3e8"}]}`
+			wide := `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1","toBlock":"0x3e9"}]}`
+			latest := `{"jsonrpc":"2.0","id":1,"method":"eth_getLogs","params":[{"fromBlock":"0x1"}]}`
+			Expect(post("", narrow).Error).To(BeNil())
+			Expect(post("", wide).Error.Code).To(Equal(types.ErrorCodeInvalidParams))
+			// The tip is not monitored, so ranges that end at the tip are unknown.
+			Expect(post("", latest).Error.Code).To(Equal(types.ErrorCodeInvalidParams))
+			Expect(post("secret", wide).Error).To(BeNil())
+			Expect(post("secret", latest).Error).To(BeNil())
+		})
+	})
+
+	Context("when managing watches", func() {
+		It("should only let internal callers manage their own watches", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			server.SetAuth(auth.New(kv.NewTable(kv.NewMemDB(kv.JSONCodec), "usage"), auth.Options{
+				Keys: []auth.Key{
+					{Name: "gateway", Key: "gateway", Role: types.RoleInternal},
+					{Name: "darknode", Key: "darknode", Role: types.RoleInternal},
+					{Name: "admin", Key: "admin", Role: types.RoleAdmin},
+				},
+			}, logrus.StandardLogger()))
+			db := kv.NewMemDB(kv.JSONCodec)
+			notifier := watch.New(kv.NewTable(db, "watches"), kv.NewTable(db, "deliveries"), watch.DefaultOptions(), logrus.StandardLogger())
+			notifier.AddNetwork(ethtypes.Kovan, nil, time.Second)
+			server.SetWatches(notifier)
+			Expect(server.Start()).To(Succeed())
+			defer server.Shutdown(context.Background())
+
+			do := func(method, path, key, body string) (int, map[string]interface{}) {
+				req, err := http.NewRequest(method, serverURL(server)+path, bytes.NewBufferString(body))
+				Expect(err).ToNot(HaveOccurred())
+				if key != "" {
+					req.Header.Set(auth.KeyHeader, key)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer resp.Body.Close()
+				result := map[string]interface{}{}
+				if resp.StatusCode != http.StatusNoContent {
+					Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+				}
+				return resp.StatusCode, result
+			}
+
+			registration := `{"network":"eth/kovan","contract":"0x0A9ADD98C076448CBcFAcf5E457DA12ddbEF4A8f","recipient":"0x00000000000000000000000000000000000000aa","url":"https://example.com/hook","confirmations":[12,1]}`
+			status, _ := do("POST", "/watches", "", registration)
+			Expect(status).To(Equal(http.StatusForbidden))
+			status, result := do("POST", "/watches", "gateway", `{"network":"eth/kovan","url":"https://example.com/hook"}`)
+			Expect(status).To(Equal(http.StatusBadRequest))
+			Expect(result["error"]).ToNot(BeEmpty())
+
+			status, result = do("POST", "/watches", "gateway", registration)
+			Expect(status).To(Equal(http.StatusCreated))
+			Expect(result["secret"]).ToNot(BeEmpty())
+			Expect(result["owner"]).To(Equal("gateway"))
+			Expect(result["contract"]).To(Equal("0x0a9add98c076448cbcfacf5e457da12ddbef4a8f"))
+			Expect(result["confirmations"]).To(Equal([]interface{}{1.0, 12.0}))
+			path := "/watches/" + result["id"].(string)
+
+			status, result = do("GET", path, "gateway", "")
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(result).ToNot(HaveKey("secret"))
+			status, _ = do("GET", path, "darknode", "")
+			Expect(status).To(Equal(http.StatusNotFound))
+			status, _ = do("GET", path, "admin", "")
+			Expect(status).To(Equal(http.StatusOK))
+
+			status, _ = do("DELETE", path, "darknode", "")
+			Expect(status).To(Equal(http.StatusNotFound))
+			status, _ = do("DELETE", path, "gateway", "")
+			Expect(status).To(Equal(http.StatusNoContent))
+			status, _ = do("GET", path, "gateway", "")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Context("when starting and stopping a server", func() {
+		It("should serve requests until it is shut down", func() {
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(newEchoClient()))
+			Expect(server.Addr()).To(BeEmpty())
+			Expect(server.Start()).To(Succeed())
+			Expect(server.Addr()).ToNot(BeEmpty())
+			Expect(server.Start()).To(Equal(ErrServerStarted))
+
+			resp, err := http.Get(serverURL(server) + "/health")
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			url := serverURL(server)
+			Expect(server.Shutdown(context.Background())).To(Succeed())
+			Expect(server.Addr()).To(BeEmpty())
+			_, err = http.Get(url + "/health")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should finish requests in flight before shutting down", func() {
+			client := newSlowClient(500 * time.Millisecond)
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(client))
+			Expect(server.Start()).To(Succeed())
+
+			status := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				buf := bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)
+				resp, err := http.Post(serverURL(server)+"/eth/kovan", "application/json", buf)
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				status <- resp.StatusCode
+			}()
+			Eventually(client.Calls).Should(Equal(int64(1)))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(server.Shutdown(ctx)).To(Succeed())
+			Expect(<-status).To(Equal(http.StatusOK))
+		})
+
+		It("should return an error if requests do not finish before the deadline", func() {
+			client := newSlowClient(2 * time.Second)
+			server := NewServer(logrus.StandardLogger(), "0", newTestApi(client))
+			Expect(server.Start()).To(Succeed())
+
+			go func() {
+				buf := bytes.NewBufferString(`{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)
+				if resp, err := http.Post(serverURL(server)+"/eth/kovan", "application/json", buf); err == nil {
+					resp.Body.Close()
+				}
+			}()
+			Eventually(client.Calls).Should(Equal(int64(1)))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			Expect(server.Shutdown(ctx)).ToNot(Succeed())
+		})
+
+		It("should stop running when the context is done", func() {
+			server := NewServer(logrus.StandardLogger(), "0")
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() {
+				done <- server.Run(ctx)
+			}()
+			Eventually(server.Addr).ShouldNot(BeEmpty())
+
+			cancel()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("should return an error if it cannot listen", func() {
+			first := NewServer(logrus.StandardLogger(), "0")
+			Expect(first.Start()).To(Succeed())
+			defer first.Shutdown(context.Background())
+
+			_, port, err := net.SplitHostPort(first.Addr())
+			Expect(err).ToNot(HaveOccurred())
+			second := NewServer(logrus.StandardLogger(), port)
+			Expect(second.Run(context.Background())).ToNot(Succeed())
+		})
+	})
 })
+
+// serverURL returns the URL of a running server.
+func serverURL(server *Server) string {
+	_, port, err := net.SplitHostPort(server.Addr())
+	Expect(err).ToNot(HaveOccurred())
+	return "http://127.0.0.1:" + port
+}
+
+func newTestApi(client rpc.Client) *Api {
+	logger := logrus.StandardLogger()
+	store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+	return NewApi(ethtypes.Kovan, proxy.NewProxy(client), cache.New(store, logger), logger)
+}
+
+// slowClient responds to each request with the name of the requested method after a delay.
+type slowClient struct {
+	calls *int64
+	delay time.Duration
+}
+
+func newSlowClient(delay time.Duration) slowClient {
+	return slowClient{
+		calls: new(int64),
+		delay: delay,
+	}
+}
+
+func (client slowClient) Calls() int64 {
+	return atomic.LoadInt64(client.calls)
+}
+
+func (client slowClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	atomic.AddInt64(client.calls, 1)
+	time.Sleep(client.delay)
+	return newEchoClient().HandleRequest(r, data)
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/renproject/mercury/auth"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/watch"
+)
+
+// maxWatchSize is the maximum size of the body of a request to register a watch.
+const maxWatchSize = 1 << 12 // 4 KB
+
+// errForbidden is returned when the caller is not allowed to manage watches, or the watch is owned by another caller.
+var errForbidden = errors.New("forbidden")
+
+// SetWatches sets the Notifier which holds the watches registered using the `/watches` endpoints. The endpoints are
+// not added until it is set. It must be called before the server is started.
+func (server *Server) SetWatches(notifier *watch.Notifier) {
+	server.watches = notifier
+}
+
+// addWatchHandlers adds the endpoints to register, read and delete watches. Watches make mercury send requests to the
+// URLs of their webhooks, so they can only be managed by internal callers, and only the caller that registered a watch
+// can read or delete it, unless it is an admin.
+func (server *Server) addWatchHandlers(r *mux.Router) {
+	r.HandleFunc("/watches", server.registerWatch()).Methods("POST")
+	r.HandleFunc("/watches/{id}", server.getWatch()).Methods("GET")
+	r.HandleFunc("/watches/{id}", server.deleteWatch()).Methods("DELETE")
+}
+
+// registerWatch registers the watch in the body of the request, and responds with the watch including its ID and the
+// secret which signs its webhooks. The addresses of Bitcoin-family watches are imported into the wallet of an upstream
+// without a rescan, so only outputs sent from then on are notified, and watches are rejected with a bad request if the
+// upstream cannot import them.
+func (server *Server) registerWatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth.Role(r) < types.RoleInternal {
+			writeWatchError(w, errForbidden)
+			return
+		}
+		var registration watch.Watch
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxWatchSize)).Decode(&registration); err != nil {
+			writeWatchError(w, watch.ErrInvalid{Reason: err.Error()})
+			return
+		}
+		registration.Owner = auth.Name(r)
+
+		registered, err := server.watches.Register(registration)
+		if err != nil {
+			writeWatchError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(registered)
+	}
+}
+
+func (server *Server) getWatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		watched, err := server.ownedWatch(r)
+		if err != nil {
+			writeWatchError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(watched)
+	}
+}
+
+func (server *Server) deleteWatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		watched, err := server.ownedWatch(r)
+		if err == nil {
+			err = server.watches.Delete(watched.ID)
+		}
+		if err != nil {
+			writeWatchError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ownedWatch returns the watch with the ID in the path of the request, if the caller is allowed to manage it.
+func (server *Server) ownedWatch(r *http.Request) (watch.Watch, error) {
+	role := auth.Role(r)
+	if role < types.RoleInternal {
+		return watch.Watch{}, errForbidden
+	}
+	watched, err := server.watches.Get(mux.Vars(r)["id"])
+	if err != nil {
+		return watch.Watch{}, err
+	}
+	if role != types.RoleAdmin && watched.Owner != auth.Name(r) {
+		// Watches of other callers are hidden, rather than revealing that they exist.
+		return watch.Watch{}, watch.ErrNotFound
+	}
+	return watched, nil
+}
+
+// writeWatchError responds with the error and its status code.
+func writeWatchError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch err.(type) {
+	case watch.ErrInvalid:
+		code = http.StatusBadRequest
+	default:
+		switch err {
+		case errForbidden:
+			code = http.StatusForbidden
+		case watch.ErrNotFound:
+			code = http.StatusNotFound
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,348 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/renproject/mercury/metrics"
+	"github.com/renproject/mercury/subscription"
+	"github.com/renproject/mercury/types"
+)
+
+// DefaultMaxSubscriptions is the number of subscriptions a websocket connection can have at once.
+const DefaultMaxSubscriptions = 100
+
+const (
+	// wsMaxMessageSize limits the size of the requests sent over a websocket connection.
+	wsMaxMessageSize = 1 << 20 // 1 MB
+	// wsSendBuffer is the number of messages that can be waiting to be written to a connection. Connections are closed
+	// if notifications arrive faster than they can be written.
+	wsSendBuffer = 256
+	// wsPingInterval is how often connections are pinged. Connections are closed if nothing is received for two
+	// intervals.
+	wsPingInterval = 30 * time.Second
+	// wsWriteTimeout limits how long a message can take to be written.
+	wsWriteTimeout = 10 * time.Second
+)
+
+// upgrader upgrades requests to websocket connections. Requests from any origin are accepted, as for POST requests.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// SetHub sets the Hub used to subscribe to notifications from the upstreams. Subscriptions are unavailable until it is
+// set.
+func (api *Api) SetHub(hub *subscription.Hub) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.hub = hub
+}
+
+// websocketHandler serves JSON-RPC requests over websocket connections. Subscriptions are made using `eth_subscribe`
+// and shared with other callers by the Hub, and every other method is served in the same way as over HTTP. Requests on
+// a connection are served in order. The connection is closed when the context of the request is done.
+func (api *Api) websocketHandler(rec recorder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// The upgrader has already responded with the error.
+			api.logger.Warningf("cannot upgrade %s to websocket: %v", r.URL.String(), err)
+			return
+		}
+		newWSConn(api, rec, r, ws).serve()
+	}
+}
+
+// wsConn is a websocket connection of a caller and its subscriptions.
+type wsConn struct {
+	api  *Api
+	rec  recorder
+	r    *http.Request
+	ws   *websocket.Conn
+	send chan []byte
+
+	done      chan struct{}
+	closeOnce *sync.Once
+
+	mu            *sync.Mutex
+	subscriptions map[string]*subscription.Subscription
+}
+
+func newWSConn(api *Api, rec recorder, r *http.Request, ws *websocket.Conn) *wsConn {
+	return &wsConn{
+		api:           api,
+		rec:           rec,
+		r:             r,
+		ws:            ws,
+		send:          make(chan []byte, wsSendBuffer),
+		done:          make(chan struct{}),
+		closeOnce:     new(sync.Once),
+		mu:            new(sync.Mutex),
+		subscriptions: map[string]*subscription.Subscription{},
+	}
+}
+
+// serve reads requests until the connection is closed.
+func (conn *wsConn) serve() {
+	defer conn.close(websocket.CloseNormalClosure, "")
+	go conn.write()
+	go func() {
+		select {
+		case <-conn.r.Context().Done():
+			conn.close(websocket.CloseGoingAway, "server shutting down")
+		case <-conn.done:
+		}
+	}()
+
+	// The deadlines of the server do not apply to websocket connections.
+	conn.ws.SetReadLimit(wsMaxMessageSize)
+	conn.ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	conn.ws.SetPongHandler(func(string) error {
+		return conn.ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+	})
+	for {
+		_, data, err := conn.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.ws.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+
+		conn.rec.metrics.InFlight.WithLabelValues(conn.rec.network).Inc()
+		resp := conn.handle(data)
+		conn.rec.metrics.InFlight.WithLabelValues(conn.rec.network).Dec()
+		if resp == nil {
+			continue
+		}
+		select {
+		case conn.send <- resp:
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// write writes messages to the connection and pings the caller until the connection is closed.
+func (conn *wsConn) write() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.done:
+			return
+		case data := <-conn.send:
+			conn.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+				conn.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			if err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				conn.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		}
+	}
+}
+
+// close closes the connection with the given code and reason, and closes its subscriptions.
+func (conn *wsConn) close(code int, reason string) {
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+		if code != websocket.CloseAbnormalClosure {
+			conn.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+		}
+		conn.ws.Close()
+
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		for id, sub := range conn.subscriptions {
+			sub.Unsubscribe()
+			delete(conn.subscriptions, id)
+		}
+	})
+}
+
+// handle returns the response to a single or batch request, or nil if the request only contains notifications.
+func (conn *wsConn) handle(data []byte) []byte {
+	if !IsBatch(data) {
+		return conn.respond(data)
+	}
+
+	var reqs []json.RawMessage
+	if err := json.Unmarshal(data, &reqs); err != nil {
+		return errorResponse(conn.api.logger, conn.r, nil, newRPCError(ErrorCodeInvalidJSON, err))
+	}
+	if len(reqs) == 0 {
+		return errorResponse(conn.api.logger, conn.r, nil, newRPCError(ErrorCodeInvalidRequest, errors.New("empty batch")))
+	}
+	responses := make([]json.RawMessage, 0, len(reqs))
+	for _, req := range reqs {
+		if resp := conn.respond(req); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	resp, err := json.Marshal(responses)
+	if err != nil {
+		return errorResponse(conn.api.logger, conn.r, nil, err)
+	}
+	return resp
+}
+
+// respond returns the response to a single request, or nil if the request is a notification.
+func (conn *wsConn) respond(data []byte) json.RawMessage {
+	method, id, err := parseRequest(data)
+	if err != nil {
+		return errorResponse(conn.api.logger, conn.r, nil, err)
+	}
+	if !subscriptionMethods[method] {
+		resp, _ := conn.api.batchResponse(conn.r, conn.rec, data)
+		return resp
+	}
+
+	if _, err := conn.api.authorize(conn.r, conn.rec, method, data); err != nil {
+		return errorResponse(conn.api.logger, conn.r, id, err)
+	}
+	var result interface{}
+	if method == "eth_subscribe" {
+		result, err = conn.subscribe(GetParams(data))
+	} else {
+		result, err = conn.unsubscribe(GetParams(data))
+	}
+	if err != nil {
+		conn.rec.record(conn.r, method, status(Result{}, err))
+		return errorResponse(conn.api.logger, conn.r, id, err)
+	}
+	conn.rec.record(conn.r, method, metrics.StatusOK)
+
+	resp, err := json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  interface{}     `json:"result"`
+	}{"2.0", id, result})
+	if err != nil {
+		return errorResponse(conn.api.logger, conn.r, id, err)
+	}
+	return resp
+}
+
+// subscribe subscribes the caller using the Hub, and returns the ID of the subscription. The ID is chosen by mercury,
+// since upstream subscriptions are shared.
+func (conn *wsConn) subscribe(params json.RawMessage) (string, error) {
+	var args []json.RawMessage
+	var kind string
+	if err := json.Unmarshal(params, &args); err != nil || len(args) == 0 || json.Unmarshal(args[0], &kind) != nil {
+		return "", newRPCError(ErrorCodeInvalidParams, errors.New("expected the kind of subscription"))
+	}
+	if !subscriptionKinds[kind] {
+		return "", newRPCError(ErrorCodeInvalidParams, fmt.Errorf("unsupported subscription %q", kind))
+	}
+
+	conn.api.mu.RLock()
+	hub := conn.api.hub
+	conn.api.mu.RUnlock()
+	if hub == nil {
+		return "", subscription.ErrUnavailable
+	}
+
+	conn.mu.Lock()
+	full := len(conn.subscriptions) >= DefaultMaxSubscriptions
+	conn.mu.Unlock()
+	if full {
+		return "", newRPCError(types.ErrorCodeLimitExceeded, fmt.Errorf("at most %d subscriptions per connection", DefaultMaxSubscriptions))
+	}
+
+	ctx, cancel := context.WithTimeout(conn.r.Context(), subscription.DefaultCallTimeout)
+	defer cancel()
+	sub, err := hub.Subscribe(ctx, params)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := subscriptionID()
+	if err != nil {
+		sub.Unsubscribe()
+		return "", err
+	}
+	conn.mu.Lock()
+	select {
+	case <-conn.done:
+		// The connection was closed while subscribing.
+		conn.mu.Unlock()
+		sub.Unsubscribe()
+		return "", errors.New("connection closed")
+	default:
+	}
+	conn.subscriptions[id] = sub
+	conn.mu.Unlock()
+
+	go conn.notify(id, sub)
+	return id, nil
+}
+
+// unsubscribe closes the subscription with the ID given in the params, and returns whether it existed.
+func (conn *wsConn) unsubscribe(params json.RawMessage) (bool, error) {
+	var args []string
+	if err := json.Unmarshal(params, &args); err != nil || len(args) != 1 {
+		return false, newRPCError(ErrorCodeInvalidParams, errors.New("expected the id of the subscription"))
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	sub, ok := conn.subscriptions[args[0]]
+	if ok {
+		sub.Unsubscribe()
+		delete(conn.subscriptions, args[0])
+	}
+	return ok, nil
+}
+
+// notify sends the notifications of the subscription to the caller until it is closed. The connection is closed if
+// the caller cannot keep up with its notifications, or if the Hub closes the subscription.
+func (conn *wsConn) notify(id string, sub *subscription.Subscription) {
+	for result := range sub.Notifications() {
+		data, err := json.Marshal(struct {
+			JSONRPC string      `json:"jsonrpc"`
+			Method  string      `json:"method"`
+			Params  interface{} `json:"params"`
+		}{"2.0", "eth_subscription", struct {
+			Subscription string          `json:"subscription"`
+			Result       json.RawMessage `json:"result"`
+		}{id, result}})
+		if err != nil {
+			continue
+		}
+
+		select {
+		case conn.send <- data:
+		default:
+			conn.close(websocket.ClosePolicyViolation, subscription.ErrTooSlow.Error())
+			return
+		}
+	}
+	if err := sub.Err(); err != nil {
+		// The reason of a close message is limited in length, so the error itself is only logged.
+		conn.api.logger.Warningf("subscription of %s closed: %v", conn.r.URL.String(), err)
+		conn.close(websocket.CloseTryAgainLater, "subscription closed by mercury")
+	}
+}
+
+// subscriptionID returns a random subscription ID, in the same format as the IDs of Ethereum nodes.
+func subscriptionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "0x" + hex.EncodeToString(id), nil
+}
@@ -0,0 +1,235 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/api"
+
+	"github.com/gorilla/websocket"
+	"github.com/renproject/mercury/subscription"
+	"github.com/renproject/mercury/types"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Websocket", func() {
+	var (
+		node   *headsNode
+		server *Server
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		node = newHeadsNode()
+		hub := subscription.New([]string{node.URL()}, logrus.StandardLogger())
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go hub.Run(ctx)
+		Eventually(hub.Connected).Should(BeTrue())
+
+		api := newTestApi(newEchoClient())
+		api.SetHub(hub)
+		server = NewServer(logrus.StandardLogger(), "0", api)
+		Expect(server.Start()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		server.Shutdown(context.Background())
+		cancel()
+		node.Close()
+	})
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(serverURL(server), "http")+"/eth/kovan", nil)
+		Expect(err).ToNot(HaveOccurred())
+		return conn
+	}
+	call := func(conn *websocket.Conn, req string) types.JSONResponse {
+		Expect(conn.WriteMessage(websocket.TextMessage, []byte(req))).To(Succeed())
+		var resp types.JSONResponse
+		Expect(conn.ReadJSON(&resp)).To(Succeed())
+		return resp
+	}
+	subscribe := func(conn *websocket.Conn) string {
+		resp := call(conn, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}`)
+		Expect(resp.Error).To(BeNil())
+		var id string
+		Expect(json.Unmarshal(resp.Result, &id)).To(Succeed())
+		return id
+	}
+	type notification struct {
+		Method string `json:"method"`
+		Params struct {
+			Subscription string          `json:"subscription"`
+			Result       json.RawMessage `json:"result"`
+		} `json:"params"`
+	}
+
+	Context("when calling methods over a websocket", func() {
+		It("should serve whitelisted methods in the same way as over HTTP", func() {
+			conn := dial()
+			defer conn.Close()
+
+			resp := call(conn, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`)
+			Expect(resp.Error).To(BeNil())
+			Expect(resp.Result).To(MatchJSON(`"eth_blockNumber"`))
+
+			resp = call(conn, `{"jsonrpc":"2.0","id":2,"method":"eth_mining","params":[]}`)
+			Expect(resp.Error.Code).To(Equal(types.ErrorCodeMethodNotFound))
+		})
+
+		It("should not respond to notifications", func() {
+			conn := dial()
+			defer conn.Close()
+
+			Expect(conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"eth_gasPrice","params":[]}`))).To(Succeed())
+			Expect(conn.WriteMessage(websocket.TextMessage, []byte(`[{"jsonrpc":"2.0","method":"eth_gasPrice","params":[]}]`))).To(Succeed())
+			Expect(conn.WriteMessage(websocket.TextMessage, []byte(`[
+				{"jsonrpc":"2.0","method":"eth_gasPrice","params":[]},
+				{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}
+			]`))).To(Succeed())
+
+			var resps []types.JSONResponse
+			Expect(conn.ReadJSON(&resps)).To(Succeed())
+			Expect(resps).To(HaveLen(1))
+			Expect(resps[0].Result).To(MatchJSON(`"eth_blockNumber"`))
+		})
+	})
+
+	Context("when subscribing over a websocket", func() {
+		It("should share the upstream subscription between callers and notify each of them", func() {
+			first, second := dial(), dial()
+			defer first.Close()
+			defer second.Close()
+
+			firstID, secondID := subscribe(first), subscribe(second)
+			Expect(firstID).ToNot(Equal(secondID))
+			Expect(node.Subscriptions()).To(Equal(1))
+
+			node.Publish(`{"number":"0x1"}`)
+			for conn, id := range map[*websocket.Conn]string{first: firstID, second: secondID} {
+				var n notification
+				Expect(conn.ReadJSON(&n)).To(Succeed())
+				Expect(n.Method).To(Equal("eth_subscription"))
+				Expect(n.Params.Subscription).To(Equal(id))
+				Expect(n.Params.Result).To(MatchJSON(`{"number":"0x1"}`))
+			}
+
+			resp := call(first, fmt.Sprintf(`{"jsonrpc":"2.0","id":2,"method":"eth_unsubscribe","params":[%q]}`, firstID))
+			Expect(resp.Result).To(MatchJSON(`true`))
+			Expect(node.Subscriptions()).To(Equal(1))
+
+			second.Close()
+			Eventually(node.Subscriptions).Should(Equal(0))
+		})
+
+		It("should reject unsupported subscriptions and subscriptions over HTTP", func() {
+			conn := dial()
+			defer conn.Close()
+
+			resp := call(conn, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["syncing"]}`)
+			Expect(resp.Error.Code).To(Equal(types.ErrorCodeInvalidParams))
+
+			resps := sendBatch(newRouter(newEchoClient()), `[{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["newHeads"]}]`)
+			Expect(resps[0].Error.Code).To(Equal(types.ErrorCodeMethodNotFound))
+		})
+
+		It("should close the connection when the server shuts down", func() {
+			conn := dial()
+			defer conn.Close()
+			subscribe(conn)
+
+			Expect(server.Shutdown(context.Background())).To(Succeed())
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, _, err := conn.ReadMessage()
+			Expect(websocket.IsCloseError(err, websocket.CloseGoingAway)).To(BeTrue())
+			Eventually(node.Subscriptions).Should(Equal(0))
+		})
+	})
+})
+
+// headsNode is an upstream which supports `newHeads` subscriptions, and publishes new heads on demand.
+type headsNode struct {
+	server *httptest.Server
+
+	mu            *sync.Mutex
+	nextID        int
+	subscriptions map[string]*websocket.Conn
+}
+
+func newHeadsNode() *headsNode {
+	node := &headsNode{
+		mu:            new(sync.Mutex),
+		subscriptions: map[string]*websocket.Conn{},
+	}
+	node.server = httptest.NewServer(http.HandlerFunc(node.serve))
+	return node
+}
+
+func (node *headsNode) URL() string {
+	return "ws" + strings.TrimPrefix(node.server.URL, "http")
+}
+
+func (node *headsNode) Close() {
+	node.server.CloseClientConnections()
+	node.server.Close()
+}
+
+func (node *headsNode) Subscriptions() int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return len(node.subscriptions)
+}
+
+func (node *headsNode) Publish(head string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for id, conn := range node.subscriptions {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+			`{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":%q,"result":%s}}`, id, head)))
+	}
+}
+
+func (node *headsNode) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		var req struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+			Params []string        `json:"params"`
+		}
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+
+		node.mu.Lock()
+		var resp string
+		switch {
+		case req.Method == "eth_subscribe" && len(req.Params) == 1 && req.Params[0] == "newHeads":
+			node.nextID++
+			id := fmt.Sprintf("0x%x", node.nextID)
+			node.subscriptions[id] = conn
+			resp = fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":%q}`, req.ID, id)
+		case req.Method == "eth_unsubscribe" && len(req.Params) == 1:
+			delete(node.subscriptions, req.Params[0])
+			resp = fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":true}`, req.ID)
+		default:
+			resp = fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"error":{"code":-32602,"message":"unsupported"}}`, req.ID)
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(resp))
+		node.mu.Unlock()
+	}
+}
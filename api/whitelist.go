@@ -1,43 +1,279 @@
 package api
 
-import "github.com/renproject/mercury/types"
+import (
+	"encoding/json"
+	"time"
 
-func WhitelistLevel(network types.Network, method string) types.AccessLevel {
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/renproject/mercury/cache"
+	"github.com/renproject/mercury/proxy"
+	"github.com/renproject/mercury/types"
+)
+
+// MinConfirmations is the default number of confirmations after which a block or transaction is considered final and
+// can be cached indefinitely.
+const MinConfirmations = 6
+
+// SubmissionTTL is how long responses to transaction submissions are cached for, so that repeated submissions of the
+// same transaction are not forwarded.
+const SubmissionTTL = 10 * time.Minute
+
+// DefaultMaxLogRange is the number of blocks that callers below the internal role can query logs over in a single
+// eth_getLogs request.
+const DefaultMaxLogRange = 1000
+
+// Method describes how a whitelisted method is served, and which callers can call it.
+type Method struct {
+	Level types.AccessLevel
+	// Role is the role a caller needs to call the method.
+	Role   types.Role
+	Policy cache.Policy
+}
+
+// Whitelist maps the name of each available method to how it is served.
+type Whitelist map[string]Method
+
+var ethWhitelist = Whitelist{
+	"eth_gasPrice":            {types.FullAccess, types.RolePublic, cache.CacheFor(15 * time.Second)},
+	"eth_blockNumber":         {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"eth_getBalance":          {types.FullAccess, types.RolePublic, cache.CacheByBlockNumber(1, resultNotNull)},
+	"eth_getBlockByNumber":    {types.FullAccess, types.RolePublic, cache.CacheByBlockNumber(0, resultNotNull)},
+	"eth_getTransactionCount": {types.FullAccess, types.RolePublic, cache.CacheByBlockNumber(1, resultNotNull)},
+	"eth_call":                {types.FullAccess, types.RolePublic, cache.CacheByBlockNumber(1, resultNotNull)},
+	"eth_estimateGas":         {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"eth_pendingTransactions": {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"eth_getFilterChanges":    {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"eth_getFilterLogs":       {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"eth_getLogs":             {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"eth_getWork":             {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"eth_getProof":            {types.FullAccess, types.RoleInternal, cache.CacheByBlockNumber(2, resultNotNull)},
+
+	"net_version":                             {types.CachedAccess, types.RolePublic, cache.CacheForever()},
+	"eth_chainId":                             {types.CachedAccess, types.RolePublic, cache.CacheForever()},
+	"eth_getBlockTransactionCountByHash":      {types.CachedAccess, types.RolePublic, cache.CacheOnceFinal(resultNotNull, 0)},
+	"eth_getBlockTransactionCountByNumber":    {types.CachedAccess, types.RolePublic, cache.CacheByBlockNumber(0, resultNotNull)},
+	"eth_getStorageAt":                        {types.CachedAccess, types.RolePublic, cache.CacheByBlockNumber(2, resultNotNull)},
+	"eth_getUncleCountByBlockHash":            {types.CachedAccess, types.RolePublic, cache.CacheOnceFinal(resultNotNull, 0)},
+	"eth_getUncleCountByBlockNumber":          {types.CachedAccess, types.RolePublic, cache.CacheByBlockNumber(0, resultNotNull)},
+	"eth_getUncleByBlockHashAndIndex":         {types.CachedAccess, types.RolePublic, cache.CacheOnceFinal(resultNotNull, 0)},
+	"eth_getUncleByBlockNumberAndIndex":       {types.CachedAccess, types.RolePublic, cache.CacheByBlockNumber(0, resultNotNull)},
+	"eth_sign":                                {types.CachedAccess, types.RoleInternal, cache.CacheForever()},
+	"eth_getCode":                             {types.CachedAccess, types.RolePublic, cache.CacheByBlockNumber(1, resultNotNull)},
+	"eth_sendTransaction":                     {types.CachedAccess, types.RoleInternal, cache.CacheFor(SubmissionTTL)},
+	"eth_sendRawTransaction":                  {types.CachedAccess, types.RoleInternal, cache.CacheFor(SubmissionTTL)},
+	"eth_getBlockByHash":                      {types.CachedAccess, types.RolePublic, cache.CacheOnceFinal(resultNotNull, 0)},
+	"eth_getTransactionByHash":                {types.CachedAccess, types.RolePublic, cache.CacheOnceConfirmed(ethTxHeight)},
+	"eth_getTransactionByBlockHashAndIndex":   {types.CachedAccess, types.RolePublic, cache.CacheOnceFinal(resultNotNull, 0)},
+	"eth_getTransactionByBlockNumberAndIndex": {types.CachedAccess, types.RolePublic, cache.CacheByBlockNumber(0, resultNotNull)},
+	"eth_getTransactionReceipt":               {types.CachedAccess, types.RolePublic, cache.CacheOnceConfirmed(ethTxHeight)},
+	"eth_newFilter":                           {types.CachedAccess, types.RolePublic, cache.NoCache()},
+	"eth_newBlockFilter":                      {types.CachedAccess, types.RolePublic, cache.NoCache()},
+	"eth_newPendingTransactionFilter":         {types.CachedAccess, types.RolePublic, cache.NoCache()},
+	"eth_uninstallFilter":                     {types.CachedAccess, types.RolePublic, cache.NoCache()},
+	"eth_submitWork":                          {types.CachedAccess, types.RoleInternal, cache.NoCache()},
+	"eth_submitHashrate":                      {types.CachedAccess, types.RoleInternal, cache.NoCache()},
+
+	// Subscriptions are only available over websocket, and are shared between callers.
+	"eth_subscribe":   {types.CachedAccess, types.RolePublic, cache.NoCache()},
+	"eth_unsubscribe": {types.CachedAccess, types.RolePublic, cache.NoCache()},
+
+	// Trace methods need archive nodes, which keep the state of every block.
+	"trace_transaction": {types.FullAccess, types.RoleInternal, cache.NoCache()},
+	"trace_block":       {types.FullAccess, types.RoleInternal, cache.CacheByBlockNumber(0, resultNotNull)},
+
+	// Debug methods are expensive and expose the internals of the nodes.
+	"debug_traceTransaction":   {types.FullAccess, types.RoleAdmin, cache.NoCache()},
+	"debug_traceBlockByNumber": {types.FullAccess, types.RoleAdmin, cache.NoCache()},
+	"debug_traceBlockByHash":   {types.FullAccess, types.RoleAdmin, cache.NoCache()},
+}
+
+var btcWhitelist = Whitelist{
+	"getblockcount":      {types.FullAccess, types.RolePublic, cache.CacheUntilNewBlock()},
+	"getbestblockhash":   {types.FullAccess, types.RolePublic, cache.CacheUntilNewBlock()},
+	"listunspent":        {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"gettxout":           {types.FullAccess, types.RolePublic, cache.NoCache()},
+	"getrawtransaction":  {types.FullAccess, types.RolePublic, cache.CacheOnceConfirmations(btcTxConfirmed)},
+	"sendrawtransaction": {types.CachedAccess, types.RoleInternal, cache.CacheFor(SubmissionTTL)},
+
+	// Debug methods expose the internals of the nodes.
+	"getpeerinfo":    {types.FullAccess, types.RoleAdmin, cache.NoCache()},
+	"getnetworkinfo": {types.FullAccess, types.RoleAdmin, cache.NoCache()},
+	"getmempoolinfo": {types.FullAccess, types.RoleAdmin, cache.NoCache()},
+}
+
+// subscriptionMethods are the methods which manage subscriptions, which are served by the websocket endpoint rather
+// than forwarded to the upstreams.
+var subscriptionMethods = map[string]bool{
+	"eth_subscribe":   true,
+	"eth_unsubscribe": true,
+}
+
+// subscriptionKinds are the kinds of subscriptions that can be made using `eth_subscribe`.
+var subscriptionKinds = map[string]bool{
+	"newHeads":               true,
+	"logs":                   true,
+	"newPendingTransactions": true,
+}
+
+// DefaultWhitelist returns the methods available for the given network.
+func DefaultWhitelist(network types.Network) Whitelist {
 	switch network.Chain() {
 	case types.Bitcoin, types.ZCash, types.BitcoinCash:
-		return BtcWhitelistLevel(method)
+		return btcWhitelist
 	case types.Ethereum:
-		return EthWhitelistLevel(method)
+		return ethWhitelist
 	default:
-		return types.NoAccess
+		return Whitelist{}
 	}
 }
 
-func EthWhitelistLevel(method string) types.AccessLevel {
-	switch method {
-	case "eth_gasPrice", "eth_blockNumber", "eth_getBalance", "eth_getBlockByNumber", "eth_getTransactionCount",
-		"eth_call", "eth_estimateGas", "eth_pendingTransactions", "eth_getFilterChanges", "eth_getFilterLogs",
-		"eth_getLogs", "eth_getWork", "eth_getProof":
-		return types.FullAccess
-	case "net_version", "eth_chainId", "eth_getBlockTransactionCountByHash", "eth_getBlockTransactionCountByNumber", "eth_getStorageAt",
-		"eth_getUncleCountByBlockHash", "eth_getUncleCountByBlockNumber", "eth_getUncleByBlockHashAndIndex",
-		"eth_getUncleByBlockNumberAndIndex", "eth_sign", "eth_getCode", "eth_sendTransaction", "eth_sendRawTransaction",
-		"eth_getBlockByHash", "eth_getTransactionByHash", "eth_getTransactionByBlockHashAndIndex",
-		"eth_getTransactionByBlockNumberAndIndex", "eth_getTransactionReceipt", "eth_newFilter", "eth_newBlockFilter",
-		"eth_newPendingTransactionFilter", "eth_uninstallFilter", "eth_submitWork", "eth_submitHashrate":
-		return types.CachedAccess
-	default:
+// Merge returns a copy of the whitelist with the given methods added or replaced.
+func (whitelist Whitelist) Merge(methods Whitelist) Whitelist {
+	merged := make(Whitelist, len(whitelist)+len(methods))
+	for name, method := range whitelist {
+		merged[name] = method
+	}
+	for name, method := range methods {
+		merged[name] = method
+	}
+	return merged
+}
+
+// Level returns the access level of the method for a caller with the given role. Methods that need a higher role are
+// not accessible.
+func (whitelist Whitelist) Level(method string, role types.Role) types.AccessLevel {
+	m := whitelist[method]
+	if role < m.Role {
 		return types.NoAccess
 	}
+	return m.Level
 }
 
-func BtcWhitelistLevel(method string) types.AccessLevel {
-	switch method {
-	case "listunspent", "gettxout", "getrawtransaction":
-		return types.FullAccess
-	case "sendrawtransaction":
-		return types.CachedAccess
+// WhitelistLevel returns the access level of the method for a caller with the given role, using the default whitelist
+// of the network.
+func WhitelistLevel(network types.Network, method string, role types.Role) types.AccessLevel {
+	return DefaultWhitelist(network).Level(method, role)
+}
+
+func EthWhitelistLevel(method string, role types.Role) types.AccessLevel {
+	return ethWhitelist.Level(method, role)
+}
+
+func BtcWhitelistLevel(method string, role types.Role) types.AccessLevel {
+	return btcWhitelist.Level(method, role)
+}
+
+// CachePolicy returns the cache policy of the method for the given network. Methods that are not whitelisted are never
+// cached.
+func CachePolicy(network types.Network, method string) cache.Policy {
+	return DefaultWhitelist(network)[method].Policy
+}
+
+// quorumFields lists, for each method whose result is used to move funds, the fields of its result that are expected
+// to differ between upstreams.
+var quorumFields = map[types.Chain]map[string][]string{
+	types.Bitcoin: {
+		"gettxout":          {"bestblock", "confirmations"},
+		"getrawtransaction": {"confirmations"},
+	},
+	types.ZCash: {
+		"gettxout":          {"bestblock", "confirmations"},
+		"getrawtransaction": {"confirmations"},
+	},
+	types.BitcoinCash: {
+		"gettxout":          {"bestblock", "confirmations"},
+		"getrawtransaction": {"confirmations"},
+	},
+	types.Ethereum: {
+		"eth_getTransactionReceipt": nil,
+	},
+}
+
+// QuorumMethods returns the quorum needed by each method of the network whose result is used to move funds: the
+// request is sent to size upstreams, and threshold of them must agree on the result.
+func QuorumMethods(network types.Network, size, threshold int) map[string]proxy.Quorum {
+	methods := map[string]proxy.Quorum{}
+	for method, ignore := range quorumFields[network.Chain()] {
+		methods[method] = proxy.Quorum{
+			Size:      size,
+			Threshold: threshold,
+			Ignore:    ignore,
+		}
+	}
+	return methods
+}
+
+// TipOptions returns how the chain tip of the upstreams of the network is monitored. Upstreams more than a couple of
+// blocks behind are not used, allowing for the blocks that arrive between polls.
+func TipOptions(network types.Network) proxy.TipOptions {
+	switch network.Chain() {
+	case types.Ethereum:
+		return proxy.TipOptions{
+			Method:   "eth_blockNumber",
+			Interval: 15 * time.Second,
+			MaxLag:   5,
+		}
 	default:
-		return types.NoAccess
+		return proxy.TipOptions{
+			Method:   "getblockcount",
+			Interval: 30 * time.Second,
+			MaxLag:   1,
+		}
+	}
+}
+
+// resultNotNull returns whether the cached response has a result that is not null.
+func resultNotNull(data []byte) bool {
+	result, ok := cachedResult(data)
+	return ok && string(result) != "null"
+}
+
+// ethTxHeight returns the height of the block that the cached response, an Ethereum transaction or receipt, was
+// included in. It returns false if it has not been included in a block.
+func ethTxHeight(data []byte) (uint64, bool) {
+	result, ok := cachedResult(data)
+	if !ok {
+		return 0, false
+	}
+	tx := struct {
+		BlockNumber *hexutil.Uint64 `json:"blockNumber"`
+	}{}
+	if err := json.Unmarshal(result, &tx); err != nil || tx.BlockNumber == nil {
+		return 0, false
+	}
+	return uint64(*tx.BlockNumber), true
+}
+
+// btcTxConfirmed returns whether the cached response is a raw Bitcoin transaction, or a verbose transaction with at
+// least the given number of confirmations.
+func btcTxConfirmed(data []byte, confirmations uint64) bool {
+	result, ok := cachedResult(data)
+	if !ok {
+		return false
+	}
+	var rawTx string
+	if err := json.Unmarshal(result, &rawTx); err == nil {
+		return rawTx != ""
+	}
+	tx := struct {
+		Confirmations int64 `json:"confirmations"`
+	}{}
+	if err := json.Unmarshal(result, &tx); err != nil {
+		return false
+	}
+	return tx.Confirmations >= 0 && uint64(tx.Confirmations) >= confirmations
+}
+
+// cachedResult returns the JSON-RPC result of a response stored by the cache. It returns false if the response was not
+// successful.
+func cachedResult(data []byte) (json.RawMessage, bool) {
+	var result Result
+	if err := json.Unmarshal(data, &result); err != nil || result.StatusCode != 200 {
+		return nil, false
+	}
+	var resp types.JSONResponse
+	if err := json.Unmarshal(result.Data, &resp); err != nil || resp.Error != nil || len(resp.Result) == 0 {
+		return nil, false
 	}
+	return resp.Result, true
 }
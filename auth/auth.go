@@ -0,0 +1,347 @@
+// Package auth identifies the callers of mercury by their API keys, and limits how many requests they can make. Each
+// key has token bucket rate limits for each network and class of method, and an optional daily quota which is stored
+// in a kv table so that it is kept across restarts. Callers without a key share the anonymous limits, which apply to
+// each IP address separately.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/renproject/kv"
+	"github.com/renproject/mercury/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Classes of methods, which correspond to their access level in the whitelist.
+const (
+	ClassCached = "cached"
+	ClassFull   = "full"
+)
+
+// Names of the header and query parameter which contain the API key of the caller.
+const (
+	KeyHeader = "X-Api-Key"
+	KeyParam  = "apiKey"
+)
+
+// TagParam is the query parameter which selects the Infura key used for a request. When keys are configured, it is
+// set from the API key of the caller rather than by the caller.
+const TagParam = "tag"
+
+// DefaultFlushInterval is how often usage is written to the table by Run.
+const DefaultFlushInterval = time.Minute
+
+// maxAnonymousBuckets is the number of anonymous callers above which the buckets of idle callers are removed.
+const maxAnonymousBuckets = 10000
+
+// ErrUnauthorized is returned when the API key of the caller is unknown, or a key is required and none was given.
+var ErrUnauthorized = errors.New("unauthorized: missing or unknown api key")
+
+// ErrLimitExceeded is returned when the caller has exceeded a rate limit or its daily quota.
+type ErrLimitExceeded struct {
+	// Reason describes which limit was exceeded.
+	Reason string
+	// RetryAfter is how long the caller must wait before the request would be allowed.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (err ErrLimitExceeded) Error() string {
+	return fmt.Sprintf("%v exceeded, retry after %v", err.Reason, err.RetryAfter.Round(time.Second))
+}
+
+// Limit is a token bucket rate limit for the requests to a network and class of methods.
+type Limit struct {
+	// Network and Class select the requests the limit applies to. Empty values match every network or class.
+	Network string
+	Class   string
+	// Rate is the number of requests allowed per second, and Burst is the number of requests that can be made at once.
+	// Burst defaults to the rate, rounded up.
+	Rate  float64
+	Burst int
+}
+
+// matches returns whether the limit applies to requests to the network and class.
+func (limit Limit) matches(network, class string) bool {
+	return (limit.Network == "" || limit.Network == network) && (limit.Class == "" || limit.Class == class)
+}
+
+func (limit Limit) burst() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, math.Ceil(limit.Rate))
+}
+
+// Key is an API key and the limits of the caller using it.
+type Key struct {
+	// Name identifies the caller in logs and stats.
+	Name string
+	Key  string
+	// Tag is the Infura tag used for requests with the key.
+	Tag string
+	// Role decides the methods the caller can call.
+	Role types.Role
+	// Limits are checked in order, and only the first that matches a request applies. Requests that match no limit
+	// are not rate limited.
+	Limits []Limit
+	// DailyQuota is the number of requests allowed per UTC day. Zero means there is no quota.
+	DailyQuota int64
+}
+
+// Options configure an Authenticator. Callers are only authenticated if keys are given or required; otherwise every
+// caller is anonymous and chooses its own tag.
+type Options struct {
+	// Required rejects callers without an API key.
+	Required bool
+	// TrustProxy identifies anonymous callers by the last address in the X-Forwarded-For header, which must then be
+	// set by a trusted proxy.
+	TrustProxy bool
+	// Anonymous are the limits of callers without an API key, applied to each IP address separately, and AnonymousRole
+	// is their role.
+	Anonymous     []Limit
+	AnonymousRole types.Role
+	Keys          []Key
+}
+
+// enabled returns whether callers are authenticated.
+func (options Options) enabled() bool {
+	return options.Required || len(options.Keys) > 0
+}
+
+// Authenticator identifies callers and limits their requests.
+type Authenticator struct {
+	mu        *sync.Mutex
+	options   Options
+	keys      map[string]Key
+	buckets   map[string]*bucket
+	anonymous map[string]*bucket
+	usage     map[string]*usage
+	table     kv.Table
+	logger    logrus.FieldLogger
+}
+
+// New returns an Authenticator which stores the daily usage of each key in the table.
+func New(table kv.Table, options Options, logger logrus.FieldLogger) *Authenticator {
+	authenticator := &Authenticator{
+		mu:     new(sync.Mutex),
+		usage:  map[string]*usage{},
+		table:  table,
+		logger: logger,
+	}
+	authenticator.SetOptions(options)
+	return authenticator
+}
+
+// SetOptions replaces the keys and limits. Rate limits start again from full buckets; daily usage is kept.
+func (authenticator *Authenticator) SetOptions(options Options) {
+	keys := make(map[string]Key, len(options.Keys))
+	for _, key := range options.Keys {
+		keys[key.Key] = key
+	}
+
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+
+	authenticator.options = options
+	authenticator.keys = keys
+	authenticator.buckets = map[string]*bucket{}
+	authenticator.anonymous = map[string]*bucket{}
+}
+
+// caller is the identity of the caller of a request, stored in its context.
+type caller struct {
+	authenticator *Authenticator
+	key           string
+	address       string
+}
+
+type contextKey struct{}
+
+// Middleware identifies the caller of each request, so that its requests can be checked using Allow. The API key is
+// removed from the URL, and when authentication is enabled the tag is replaced by the tag of the key.
+func (authenticator *Authenticator) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		c := caller{
+			authenticator: authenticator,
+			key:           r.Header.Get(KeyHeader),
+			address:       authenticator.address(r),
+		}
+		if c.key == "" {
+			c.key = query.Get(KeyParam)
+		}
+		query.Del(KeyParam)
+
+		authenticator.mu.Lock()
+		enabled := authenticator.options.enabled()
+		key, ok := authenticator.keys[c.key]
+		authenticator.mu.Unlock()
+		if enabled {
+			query.Del(TagParam)
+			if ok && key.Tag != "" {
+				query.Set(TagParam, key.Tag)
+			}
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), contextKey{}, c))
+		url := *r.URL
+		url.RawQuery = query.Encode()
+		r.URL = &url
+		h.ServeHTTP(w, r)
+	})
+}
+
+// address returns the IP address of the caller.
+func (authenticator *Authenticator) address(r *http.Request) string {
+	authenticator.mu.Lock()
+	trustProxy := authenticator.options.TrustProxy
+	authenticator.mu.Unlock()
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); trustProxy && forwarded != "" {
+		addresses := strings.Split(forwarded, ",")
+		return strings.TrimSpace(addresses[len(addresses)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Allow returns an error if the caller of the request is not allowed to make a request to the network for a method of
+// the given class: either ErrUnauthorized, or ErrLimitExceeded. Allowed requests count towards the limits. Requests
+// that did not pass through the Middleware are always allowed.
+func Allow(r *http.Request, network, class string) error {
+	c, ok := r.Context().Value(contextKey{}).(caller)
+	if !ok {
+		return nil
+	}
+	return c.authenticator.allow(c, network, class, time.Now())
+}
+
+// Role returns the role of the caller of the request. Requests that did not pass through the Middleware have the public
+// role.
+func Role(r *http.Request) types.Role {
+	c, ok := r.Context().Value(contextKey{}).(caller)
+	if !ok {
+		return types.RolePublic
+	}
+
+	c.authenticator.mu.Lock()
+	defer c.authenticator.mu.Unlock()
+	if key, ok := c.authenticator.keys[c.key]; ok {
+		return key.Role
+	}
+	return c.authenticator.options.AnonymousRole
+}
+
+// Name returns the name of the key used by the caller of the request, or an empty string for anonymous callers.
+func Name(r *http.Request) string {
+	c, ok := r.Context().Value(contextKey{}).(caller)
+	if !ok || c.key == "" {
+		return ""
+	}
+
+	c.authenticator.mu.Lock()
+	defer c.authenticator.mu.Unlock()
+	return c.authenticator.keys[c.key].Name
+}
+
+func (authenticator *Authenticator) allow(c caller, network, class string, now time.Time) error {
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+
+	options := authenticator.options
+	key, ok := authenticator.keys[c.key]
+	if !ok {
+		if options.enabled() && (c.key != "" || options.Required) {
+			return ErrUnauthorized
+		}
+		for i, limit := range options.Anonymous {
+			if limit.matches(network, class) {
+				return authenticator.take(authenticator.anonymous, fmt.Sprintf("%v/%d", c.address, i), limit, now)
+			}
+		}
+		return nil
+	}
+
+	u, err := authenticator.usageOf(key.Name, now)
+	if err != nil {
+		// Requests are not rejected because the usage cannot be read.
+		authenticator.logger.Errorf("cannot read usage of %v: %v", key.Name, err)
+	}
+	if key.DailyQuota > 0 && u.count >= key.DailyQuota {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return ErrLimitExceeded{Reason: "daily quota", RetryAfter: tomorrow.Sub(now)}
+	}
+	for i, limit := range key.Limits {
+		if limit.matches(network, class) {
+			if err := authenticator.take(authenticator.buckets, fmt.Sprintf("%v/%d", key.Name, i), limit, now); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	u.count++
+	u.dirty = true
+	return nil
+}
+
+// take takes a token from the bucket with the given name, creating it if it does not exist.
+func (authenticator *Authenticator) take(buckets map[string]*bucket, name string, limit Limit, now time.Time) error {
+	b, ok := buckets[name]
+	if !ok {
+		if len(buckets) >= maxAnonymousBuckets {
+			pruneBuckets(buckets, now)
+		}
+		b = &bucket{tokens: limit.burst(), last: now, limit: limit}
+		buckets[name] = b
+	}
+	if retryAfter := b.take(now); retryAfter > 0 {
+		return ErrLimitExceeded{Reason: "rate limit", RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// take takes a token from the bucket, or returns how long it will take until a token is available.
+func (b *bucket) take(now time.Time) time.Duration {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / b.limit.Rate * float64(time.Second)))
+}
+
+// full returns whether the bucket would be full at the given time.
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= b.limit.burst()
+}
+
+// pruneBuckets removes the buckets which are full, since they behave the same as new buckets.
+func pruneBuckets(buckets map[string]*bucket, now time.Time) {
+	for name, b := range buckets {
+		if b.full(now) {
+			delete(buckets, name)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/auth"
+
+	"github.com/renproject/kv"
+	"github.com/renproject/mercury/types"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Auth", func() {
+	newTable := func() kv.Table {
+		return kv.NewTable(kv.NewMemDB(kv.JSONCodec), "usage")
+	}
+
+	// identify passes the request through the middleware and returns the request seen by the handler.
+	identify := func(authenticator *Authenticator, r *http.Request) *http.Request {
+		var identified *http.Request
+		authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identified = r
+		})).ServeHTTP(httptest.NewRecorder(), r)
+		return identified
+	}
+	request := func(url, key string) *http.Request {
+		r := httptest.NewRequest("POST", url, nil)
+		if key != "" {
+			r.Header.Set(KeyHeader, key)
+		}
+		return r
+	}
+
+	darknode := Key{
+		Name:   "darknode",
+		Key:    "secret",
+		Tag:    "darknode",
+		Limits: []Limit{{Network: "eth/mainnet", Class: ClassFull, Rate: 1, Burst: 2}},
+	}
+
+	Context("when identifying callers", func() {
+		It("should replace the tag by the tag of the key and remove the key from the url", func() {
+			authenticator := New(newTable(), Options{Keys: []Key{darknode}}, logrus.StandardLogger())
+
+			r := identify(authenticator, request("/eth/mainnet?apiKey=secret&tag=swapperd", ""))
+			Expect(r.URL.Query().Get(TagParam)).To(Equal("darknode"))
+			Expect(r.URL.Query().Get(KeyParam)).To(BeEmpty())
+			Expect(Name(r)).To(Equal("darknode"))
+
+			r = identify(authenticator, request("/eth/mainnet?tag=swapperd", ""))
+			Expect(r.URL.Query().Get(TagParam)).To(BeEmpty())
+			Expect(Name(r)).To(BeEmpty())
+		})
+
+		It("should keep the tag of the caller if no keys are configured", func() {
+			authenticator := New(newTable(), Options{}, logrus.StandardLogger())
+			r := identify(authenticator, request("/eth/mainnet?tag=swapperd", ""))
+			Expect(r.URL.Query().Get(TagParam)).To(Equal("swapperd"))
+			Expect(Allow(r, "eth/mainnet", ClassFull)).To(Succeed())
+		})
+
+		It("should reject unknown keys, and anonymous callers if keys are required", func() {
+			authenticator := New(newTable(), Options{Keys: []Key{darknode}}, logrus.StandardLogger())
+			Expect(Allow(identify(authenticator, request("/eth/mainnet", "wrong")), "eth/mainnet", ClassCached)).To(Equal(ErrUnauthorized))
+			Expect(Allow(identify(authenticator, request("/eth/mainnet", "")), "eth/mainnet", ClassCached)).To(Succeed())
+
+			authenticator.SetOptions(Options{Required: true, Keys: []Key{darknode}})
+			Expect(Allow(identify(authenticator, request("/eth/mainnet", "")), "eth/mainnet", ClassCached)).To(Equal(ErrUnauthorized))
+			Expect(Allow(identify(authenticator, request("/eth/mainnet", "secret")), "eth/mainnet", ClassCached)).To(Succeed())
+		})
+
+		It("should return the role of the key, or the anonymous role", func() {
+			key := darknode
+			key.Role = types.RoleAdmin
+			authenticator := New(newTable(), Options{AnonymousRole: types.RoleInternal, Keys: []Key{key}}, logrus.StandardLogger())
+			Expect(Role(identify(authenticator, request("/eth/mainnet", "secret")))).To(Equal(types.RoleAdmin))
+			Expect(Role(identify(authenticator, request("/eth/mainnet", "")))).To(Equal(types.RoleInternal))
+			Expect(Role(request("/eth/mainnet", "secret"))).To(Equal(types.RolePublic))
+		})
+
+		It("should allow requests that did not pass through the middleware", func() {
+			Expect(Allow(request("/eth/mainnet", "wrong"), "eth/mainnet", ClassFull)).To(Succeed())
+		})
+	})
+
+	Context("when limiting the rate of requests", func() {
+		It("should only apply the first matching limit of the key", func() {
+			authenticator := New(newTable(), Options{Keys: []Key{darknode}}, logrus.StandardLogger())
+			r := identify(authenticator, request("/eth/mainnet", "secret"))
+
+			Expect(Allow(r, "eth/mainnet", ClassFull)).To(Succeed())
+			Expect(Allow(r, "eth/mainnet", ClassFull)).To(Succeed())
+			err := Allow(r, "eth/mainnet", ClassFull)
+			Expect(err).To(BeAssignableToTypeOf(ErrLimitExceeded{}))
+			Expect(err.(ErrLimitExceeded).RetryAfter).To(BeNumerically("~", time.Second, 100*time.Millisecond))
+
+			// Other networks and classes are not limited.
+			for i := 0; i < 10; i++ {
+				Expect(Allow(r, "eth/mainnet", ClassCached)).To(Succeed())
+				Expect(Allow(r, "eth/kovan", ClassFull)).To(Succeed())
+			}
+
+			time.Sleep(time.Second)
+			Expect(Allow(r, "eth/mainnet", ClassFull)).To(Succeed())
+		})
+
+		It("should limit each anonymous address separately", func() {
+			authenticator := New(newTable(), Options{Anonymous: []Limit{{Rate: 1}}}, logrus.StandardLogger())
+			first := request("/btc/mainnet", "")
+			first.RemoteAddr = "10.0.0.1:1234"
+			second := request("/btc/mainnet", "")
+			second.RemoteAddr = "10.0.0.2:1234"
+
+			Expect(Allow(identify(authenticator, first), "btc/mainnet", ClassCached)).To(Succeed())
+			Expect(Allow(identify(authenticator, first), "btc/mainnet", ClassCached)).ToNot(Succeed())
+			Expect(Allow(identify(authenticator, second), "btc/mainnet", ClassCached)).To(Succeed())
+		})
+
+		It("should identify anonymous callers by the forwarded address if the proxy is trusted", func() {
+			authenticator := New(newTable(), Options{TrustProxy: true, Anonymous: []Limit{{Rate: 1}}}, logrus.StandardLogger())
+			first := request("/btc/mainnet", "")
+			first.Header.Set("X-Forwarded-For", "1.1.1.1, 10.0.0.1")
+			second := request("/btc/mainnet", "")
+			second.Header.Set("X-Forwarded-For", "1.1.1.1, 10.0.0.2")
+
+			Expect(Allow(identify(authenticator, first), "btc/mainnet", ClassCached)).To(Succeed())
+			Expect(Allow(identify(authenticator, second), "btc/mainnet", ClassCached)).To(Succeed())
+			Expect(Allow(identify(authenticator, first), "btc/mainnet", ClassCached)).ToNot(Succeed())
+		})
+	})
+
+	Context("when limiting the daily usage of keys", func() {
+		It("should reject requests over the quota until the next day", func() {
+			key := darknode
+			key.Limits = nil
+			key.DailyQuota = 3
+			authenticator := New(newTable(), Options{Keys: []Key{key}}, logrus.StandardLogger())
+			r := identify(authenticator, request("/eth/mainnet", "secret"))
+
+			for i := 0; i < 3; i++ {
+				Expect(Allow(r, "eth/mainnet", ClassCached)).To(Succeed())
+			}
+			err := Allow(r, "eth/mainnet", ClassCached)
+			Expect(err).To(BeAssignableToTypeOf(ErrLimitExceeded{}))
+			tomorrow := time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			Expect(err.(ErrLimitExceeded).RetryAfter).To(BeNumerically("~", time.Until(tomorrow), time.Second))
+			Expect(authenticator.Usage()).To(Equal(map[string]int64{"darknode": 3}))
+		})
+
+		It("should keep the usage across restarts once it is flushed", func() {
+			table := newTable()
+			key := darknode
+			key.DailyQuota = 2
+			authenticator := New(table, Options{Keys: []Key{key}}, logrus.StandardLogger())
+			Expect(Allow(identify(authenticator, request("/eth/kovan", "secret")), "eth/kovan", ClassCached)).To(Succeed())
+			Expect(authenticator.Flush()).To(Succeed())
+
+			restarted := New(table, Options{Keys: []Key{key}}, logrus.StandardLogger())
+			r := identify(restarted, request("/eth/kovan", "secret"))
+			Expect(Allow(r, "eth/kovan", ClassCached)).To(Succeed())
+			Expect(Allow(r, "eth/kovan", ClassCached)).ToNot(Succeed())
+		})
+
+		It("should keep the usage when the options are replaced", func() {
+			key := darknode
+			key.DailyQuota = 1
+			authenticator := New(newTable(), Options{Keys: []Key{key}}, logrus.StandardLogger())
+			Expect(Allow(identify(authenticator, request("/eth/kovan", "secret")), "eth/kovan", ClassCached)).To(Succeed())
+
+			authenticator.SetOptions(Options{Keys: []Key{key}})
+			Expect(Allow(identify(authenticator, request("/eth/kovan", "secret")), "eth/kovan", ClassCached)).ToNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/renproject/kv"
+)
+
+// usageRetention is how many days of usage are kept in the table.
+const usageRetention = 7
+
+// usage is the number of requests made with a key during a day.
+type usage struct {
+	day   string
+	count int64
+	dirty bool
+}
+
+// day returns the UTC day of the time, which is part of the key of the usage in the table.
+func day(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// usageKey returns the key of the usage of the key with the given name in the table.
+func usageKey(name, day string) string {
+	return fmt.Sprintf("%v/%v", day, name)
+}
+
+// usageOf returns the usage of the key with the given name during the day of the given time, reading it from the
+// table if it is not in memory. The caller must hold the mutex.
+func (authenticator *Authenticator) usageOf(name string, now time.Time) (*usage, error) {
+	today := day(now)
+	if u, ok := authenticator.usage[name]; ok && u.day == today {
+		return u, nil
+	}
+
+	u := &usage{day: today}
+	authenticator.usage[name] = u
+	if err := authenticator.table.Get(usageKey(name, today), &u.count); err != nil && err != kv.ErrKeyNotFound {
+		return u, err
+	}
+	return u, nil
+}
+
+// Usage returns the number of requests made with each key today, by the name of the key.
+func (authenticator *Authenticator) Usage() map[string]int64 {
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+
+	now := time.Now()
+	usage := make(map[string]int64, len(authenticator.options.Keys))
+	for _, key := range authenticator.options.Keys {
+		u, err := authenticator.usageOf(key.Name, now)
+		if err != nil {
+			authenticator.logger.Errorf("cannot read usage of %v: %v", key.Name, err)
+		}
+		usage[key.Name] = u.count
+	}
+	return usage
+}
+
+// Run flushes the usage of each key periodically until the context is done. Usage recorded after the last flush must
+// be flushed by calling Flush.
+func (authenticator *Authenticator) Run(ctx context.Context) {
+	ticker := time.NewTicker(DefaultFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := authenticator.Flush(); err != nil {
+			authenticator.logger.Errorf("cannot flush usage: %v", err)
+		}
+		authenticator.prune(time.Now())
+	}
+}
+
+// Flush writes the usage of each key which has changed since the last flush to the table.
+func (authenticator *Authenticator) Flush() error {
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+
+	for name, u := range authenticator.usage {
+		if !u.dirty {
+			continue
+		}
+		if err := authenticator.table.Insert(usageKey(name, u.day), u.count); err != nil {
+			return fmt.Errorf("cannot write usage of %v: %v", name, err)
+		}
+		u.dirty = false
+	}
+	return nil
+}
+
+// prune removes the usage of days older than the retention from the table.
+func (authenticator *Authenticator) prune(now time.Time) {
+	oldest := day(now.AddDate(0, 0, -usageRetention))
+
+	authenticator.mu.Lock()
+	defer authenticator.mu.Unlock()
+
+	var expired []string
+	iter := authenticator.table.Iterator()
+	for iter.Next() {
+		key, err := iter.Key()
+		if err != nil {
+			authenticator.logger.Errorf("cannot read usage: %v", err)
+			continue
+		}
+		if i := strings.Index(key, "/"); i < 0 || key[:i] < oldest {
+			expired = append(expired, key)
+		}
+	}
+	iter.Close()
+
+	for _, key := range expired {
+		if err := authenticator.table.Delete(key); err != nil {
+			authenticator.logger.Errorf("cannot remove usage: %v", err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"fmt"
+
+	"github.com/renproject/kv"
+)
+
+// Backend is the storage backend used for the cache.
+type Backend string
+
+const (
+	// BackendMemory stores responses in memory. They are lost on restart.
+	BackendMemory Backend = "memory"
+	// BackendLevelDB stores responses on disk using LevelDB.
+	BackendLevelDB Backend = "leveldb"
+	// BackendBadgerDB stores responses on disk using BadgerDB.
+	BackendBadgerDB Backend = "badgerdb"
+)
+
+// OpenDB opens a database for the given backend. The path is ignored by the memory backend.
+func OpenDB(backend Backend, path string) (db kv.DB, err error) {
+	// The on-disk databases panic if they cannot be opened.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot open %v database at %v: %v", backend, path, r)
+		}
+	}()
+
+	switch backend {
+	case BackendMemory, "":
+		return kv.NewMemDB(kv.JSONCodec), nil
+	case BackendLevelDB:
+		return kv.NewLevelDB(path, kv.JSONCodec), nil
+	case BackendBadgerDB:
+		return kv.NewBadgerDB(path, kv.JSONCodec), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %v", backend)
+	}
+}
@@ -1,83 +1,265 @@
 // Package cache allows clients to fetch result from a store without having to execute intensive code numerous times. An
 // incoming request first checks to see if the result already exists in the store, if not it executes a function that
-// returns the result. Any additional incoming requests wait until this function has finished executing before
-// attempting to retrieve data from the store.
+// returns the result. Any additional incoming requests wait until this function has finished executing and receive the
+// same result. Only successful results are written to the store.
 package cache
 
 import (
+	"encoding/base64"
 	"errors"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/renproject/kv"
-	"github.com/renproject/mercury/types"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	// ErrNoResponse is returned when one task is waiting for another to retrieve a response, but the first one fails.
+	// ErrNoResponse is returned when one task is waiting for another to retrieve a response, but the first one does not
+	// return.
 	ErrNoResponse = errors.New("cannot get response, please try again later")
 )
 
+// Options limit the size of a Cache. Once either limit is exceeded, the least recently used responses are removed from
+// the store. Sizes are measured as the responses are encoded in the store. Zero values mean there is no limit.
+type Options struct {
+	MaxEntries int
+	MaxBytes   int64
+}
+
 type Cache struct {
-	locks  sync.Map
-	store  kv.Table
-	logger logrus.FieldLogger
+	// hits, misses and coalesced count the requests that were answered from the store, fetched, or answered by a fetch
+	// that was already in flight. They are accessed atomically.
+	hits      uint64
+	misses    uint64
+	coalesced uint64
+
+	// tip is the hash of the chain tip that responses stored using PolicyTip are valid for.
+	tip atomic.Value
+
+	calls   sync.Map
+	store   kv.Table
+	options Options
+	lru     *lru
+	logger  logrus.FieldLogger
 }
 
-// New returns a new Cache.
+// New returns a new Cache with no size limits.
 func New(store kv.Table, logger logrus.FieldLogger) *Cache {
-	return &Cache{
-		locks:  sync.Map{},
-		store:  store,
-		logger: logger,
+	return NewWithOptions(store, Options{}, logger)
+}
+
+// NewWithOptions returns a new Cache with the given size limits. Responses already in the store (e.g. from a previous
+// run using an on-disk backend) are counted towards the limits; expired responses are removed.
+func NewWithOptions(store kv.Table, options Options, logger logrus.FieldLogger) *Cache {
+	cache := &Cache{
+		calls:   sync.Map{},
+		store:   store,
+		options: options,
+		lru:     newLRU(),
+		logger:  logger,
+	}
+	cache.restore()
+	return cache
+}
+
+// Stats returns the number of responses in the cache, their total size in bytes, and how requests to the cache were
+// answered.
+func (cache *Cache) Stats() Stats {
+	stats := cache.lru.stats()
+	stats.Hits = atomic.LoadUint64(&cache.hits)
+	stats.Misses = atomic.LoadUint64(&cache.misses)
+	stats.Coalesced = atomic.LoadUint64(&cache.coalesced)
+	return stats
+}
+
+// entry is a response stored in the cache.
+type entry struct {
+	Data []byte `json:"data"`
+	// Expiry is the unix time in nanoseconds after which the entry is no longer valid. Zero means it never expires.
+	Expiry int64 `json:"expiry"`
+	// Tip is the hash of the chain tip the entry was stored at, for entries that are only valid until it changes.
+	Tip string `json:"tip,omitempty"`
+}
+
+// expired returns whether the entry is no longer valid at the given time and chain tip.
+func (e entry) expired(now time.Time, tip string) bool {
+	return (e.Expiry != 0 && now.UnixNano() >= e.Expiry) || (e.Tip != "" && e.Tip != tip)
+}
+
+// size returns the approximate number of bytes used to store the entry under the given key. Entries are stored as JSON,
+// in which the data is base64 encoded.
+func (e entry) size(key string) int64 {
+	size := len(key) + len(`{"data":"","expiry":}`) + base64.StdEncoding.EncodedLen(len(e.Data)) + len(strconv.FormatInt(e.Expiry, 10))
+	if e.Tip != "" {
+		size += len(`,"tip":""`) + len(e.Tip)
 	}
+	return int64(size)
+}
+
+// SetTip sets the hash of the chain tip. Responses stored using PolicyTip at a different tip are no longer valid, and are
+// removed when they are next read.
+func (cache *Cache) SetTip(hash string) {
+	cache.tip.Store(hash)
+}
+
+// currentTip returns the hash of the chain tip, or an empty string if it has not been set.
+func (cache *Cache) currentTip() string {
+	tip, _ := cache.tip.Load().(string)
+	return tip
+}
+
+// A Fetcher retrieves the response for a request. It also returns whether the response was successful: unsuccessful
+// responses are returned to the caller, but are never stored.
+type Fetcher func() ([]byte, bool, error)
+
+// call is an in-flight execution of a Fetcher. The result is shared with every request waiting on the same hash.
+type call struct {
+	done chan struct{}
+	data []byte
+	err  error
 }
 
 // Get checks if the data for a given hash exists in the store, and if not, uses f() to retrieve the result. Any
-// requests that are sent while the result is being retrieved, wait until the first function call returns. This prevents
-// the function f() from being called multiple times for the same request.
-func (cache *Cache) Get(level types.AccessLevel, hash string, f func() ([]byte, error)) ([]byte, error) {
-	if level == 2 {
-		return f()
+// requests that are sent while the result is being retrieved, wait until the first function call returns and receive
+// the same result (or error). This prevents the function f() from being called multiple times for the same request.
+// The policy determines whether the result is read from and written to the store, and for how long it remains valid.
+func (cache *Cache) Get(policy Policy, hash string, f Fetcher) ([]byte, error) {
+	tip := cache.currentTip()
+	switch policy.Kind {
+	case PolicyTTL, PolicyFinal, PolicyForever:
+	case PolicyTip:
+		if tip == "" {
+			data, _, err := f()
+			return data, err
+		}
+	default:
+		data, _, err := f()
+		return data, err
 	}
 
 	// Check if the result already exists in the store.
-	var data []byte
-	if err := cache.store.Get(hash, &data); err == nil {
+	if data, ok := cache.read(hash); ok {
+		atomic.AddUint64(&cache.hits, 1)
 		return data, nil
 	}
 
-	// If not, check to see if a mutex exists.
-	v, ok := cache.locks.Load(hash)
-	if !ok {
-		mu := new(sync.RWMutex)
-		mu.Lock()
-		defer mu.Unlock()
-		defer cache.locks.Delete(hash)
+	// If not, wait for the result if it is already being retrieved.
+	c := &call{done: make(chan struct{})}
+	if v, loaded := cache.calls.LoadOrStore(hash, c); loaded {
+		atomic.AddUint64(&cache.coalesced, 1)
+		c = v.(*call)
+		<-c.done
+		return c.data, c.err
+	}
 
-		// Store mutex.
-		cache.locks.Store(hash, mu)
+	// Otherwise, retrieve it ourselves. If f() panics, waiting requests receive ErrNoResponse.
+	c.err = ErrNoResponse
+	defer func() {
+		cache.calls.Delete(hash)
+		close(c.done)
+	}()
 
-		data, err := f()
-		if err != nil {
-			return nil, err
-		}
+	// The result may have been stored after we checked but before we started retrieving it.
+	if data, ok := cache.read(hash); ok {
+		atomic.AddUint64(&cache.hits, 1)
+		c.data, c.err = data, nil
+		return data, nil
+	}
 
-		if err := cache.store.Insert(hash, data); err != nil {
-			cache.logger.Errorf("cannot store response data: %v", err)
+	atomic.AddUint64(&cache.misses, 1)
+	data, ok, err := f()
+	c.data, c.err = data, err
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		cache.write(policy, hash, data, tip)
+	}
+	return data, nil
+}
+
+// read returns the data stored for the given hash if it exists and has not expired. Expired entries are removed.
+func (cache *Cache) read(hash string) ([]byte, bool) {
+	var e entry
+	if err := cache.store.Get(hash, &e); err != nil {
+		return nil, false
+	}
+	if e.expired(time.Now(), cache.currentTip()) {
+		cache.delete(hash)
+		return nil, false
+	}
+	cache.lru.touch(hash)
+	return e.Data, true
+}
+
+// write writes the data to the store if the policy allows it, and evicts the least recently used entries if the store
+// has grown beyond its limits. The tip is the chain tip the data was retrieved at.
+func (cache *Cache) write(policy Policy, hash string, data []byte, tip string) {
+	expiry, ok := policy.expiry(data, time.Now())
+	if !ok {
+		return
+	}
+
+	e := entry{Data: data}
+	if !expiry.IsZero() {
+		e.Expiry = expiry.UnixNano()
+	}
+	if policy.Kind == PolicyTip {
+		e.Tip = tip
+	}
+	if err := cache.store.Insert(hash, e); err != nil {
+		cache.logger.Errorf("cannot store response data: %v", err)
+		return
+	}
+	cache.lru.add(hash, e.size(hash))
+
+	for _, key := range cache.lru.evict(cache.options.MaxEntries, cache.options.MaxBytes) {
+		if err := cache.store.Delete(key); err != nil {
+			cache.logger.Errorf("cannot evict response data: %v", err)
 		}
+	}
+}
 
-		return data, nil
+// delete removes the entry for the given hash from the store.
+func (cache *Cache) delete(hash string) {
+	cache.lru.remove(hash)
+	if err := cache.store.Delete(hash); err != nil {
+		cache.logger.Errorf("cannot delete response data: %v", err)
 	}
+}
+
+// restore records the entries that are already in the store, removing those that have expired, and then evicts entries
+// until the store is within its limits. Entries stored until the chain tip changes are also removed, since the tip is
+// not known until it is set.
+func (cache *Cache) restore() {
+	now := time.Now()
+	var expired []string
 
-	// Wait for the response to be written to the store.
-	mu := v.(*sync.RWMutex)
-	mu.RLock()
-	if err := cache.store.Get(hash, &data); err != nil {
-		mu.RUnlock()
-		return nil, ErrNoResponse
+	iter := cache.store.Iterator()
+	for iter.Next() {
+		key, err := iter.Key()
+		if err != nil {
+			cache.logger.Errorf("cannot read cached key: %v", err)
+			continue
+		}
+		var e entry
+		if err := iter.Value(&e); err != nil || e.expired(now, "") {
+			expired = append(expired, key)
+			continue
+		}
+		cache.lru.add(key, e.size(key))
 	}
-	mu.RUnlock()
+	iter.Close()
 
-	return data, nil
+	for _, key := range expired {
+		cache.delete(key)
+	}
+	for _, key := range cache.lru.evict(cache.options.MaxEntries, cache.options.MaxBytes) {
+		if err := cache.store.Delete(key); err != nil {
+			cache.logger.Errorf("cannot evict response data: %v", err)
+		}
+	}
 }
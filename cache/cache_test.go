@@ -3,10 +3,14 @@ package cache_test
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -36,35 +40,35 @@ var _ = Describe("Cache", func() {
 			numRequests := 0
 			phi.ParBegin(func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				_, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				_, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				_, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				_, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				_, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				_, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				_, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				_, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				_, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				_, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				_, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				_, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				_, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				_, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				_, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				_, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 			})
 
@@ -86,51 +90,246 @@ var _ = Describe("Cache", func() {
 			numRequests := 0
 			phi.ParBegin(func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				resp, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				resp, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp).To(Equal(response))
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				resp, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				resp, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp).To(Equal(response))
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				resp, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				resp, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp).To(Equal(response))
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				resp, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				resp, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp).To(Equal(response))
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				resp, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				resp, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp).To(Equal(response))
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				resp, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				resp, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp).To(Equal(response))
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				resp, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				resp, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp).To(Equal(response))
 			}, func() {
 				time.Sleep(time.Duration(rand.Intn(5000)) * time.Millisecond)
-				resp, err := cache.Get(1, "hash", getResponse(server.URL, &numRequests))
+				resp, err := cache.Get(CacheForever(), "hash", getResponse(server.URL, &numRequests))
 				Expect(err).ToNot(HaveOccurred())
 				Expect(resp).To(Equal(response))
 			})
 		})
 	})
+
+	Context("when hammering a single key from many goroutines", func() {
+		It("should only call the fetcher once and share the result", func() {
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			cache := New(store, logrus.StandardLogger())
+
+			var numRequests int64
+			results := make([][]byte, 100)
+			errs := make([]error, 100)
+			phi.ParForAll(100, func(i int) {
+				results[i], errs[i] = cache.Get(CacheForever(), "hash", func() ([]byte, bool, error) {
+					atomic.AddInt64(&numRequests, 1)
+					time.Sleep(100 * time.Millisecond)
+					return []byte("response"), true, nil
+				})
+			})
+
+			Expect(atomic.LoadInt64(&numRequests)).To(Equal(int64(1)))
+			for i := range results {
+				Expect(errs[i]).ToNot(HaveOccurred())
+				Expect(results[i]).To(Equal([]byte("response")))
+			}
+		})
+
+		It("should count hits, misses and coalesced requests", func() {
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			cache := New(store, logrus.StandardLogger())
+
+			phi.ParForAll(10, func(i int) {
+				_, err := cache.Get(CacheForever(), "hash", func() ([]byte, bool, error) {
+					time.Sleep(100 * time.Millisecond)
+					return []byte("response"), true, nil
+				})
+				Expect(err).ToNot(HaveOccurred())
+			})
+			_, err := cache.Get(CacheForever(), "hash", func() ([]byte, bool, error) {
+				return []byte("refetched"), true, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			stats := cache.Stats()
+			Expect(stats.Misses).To(Equal(uint64(1)))
+			Expect(stats.Hits + stats.Coalesced).To(Equal(uint64(10)))
+			Expect(stats.Hits).To(BeNumerically(">=", 1))
+		})
+
+		It("should share the error of the first request and not cache it", func() {
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			cache := New(store, logrus.StandardLogger())
+
+			var numRequests int64
+			fetchErr := errors.New("upstream failure")
+			errs := make([]error, 100)
+			phi.ParForAll(100, func(i int) {
+				_, errs[i] = cache.Get(CacheForever(), "hash", func() ([]byte, bool, error) {
+					atomic.AddInt64(&numRequests, 1)
+					time.Sleep(100 * time.Millisecond)
+					return nil, false, fetchErr
+				})
+			})
+
+			Expect(atomic.LoadInt64(&numRequests)).To(Equal(int64(1)))
+			for i := range errs {
+				Expect(errs[i]).To(Equal(fetchErr))
+			}
+
+			resp, err := cache.Get(CacheForever(), "hash", func() ([]byte, bool, error) {
+				atomic.AddInt64(&numRequests, 1)
+				return []byte("response"), true, nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("response")))
+			Expect(atomic.LoadInt64(&numRequests)).To(Equal(int64(2)))
+		})
+
+		It("should share unsuccessful responses without storing them", func() {
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			cache := New(store, logrus.StandardLogger())
+
+			var numRequests int64
+			results := make([][]byte, 100)
+			phi.ParForAll(100, func(i int) {
+				resp, err := cache.Get(CacheForever(), "hash", func() ([]byte, bool, error) {
+					atomic.AddInt64(&numRequests, 1)
+					time.Sleep(100 * time.Millisecond)
+					return []byte("error"), false, nil
+				})
+				Expect(err).ToNot(HaveOccurred())
+				results[i] = resp
+			})
+
+			Expect(atomic.LoadInt64(&numRequests)).To(Equal(int64(1)))
+			for i := range results {
+				Expect(results[i]).To(Equal([]byte("error")))
+			}
+
+			size, err := store.Size()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(0))
+		})
+	})
+})
+
+var _ = Describe("Bounded caches", func() {
+	fetch := func(data []byte) Fetcher {
+		return func() ([]byte, bool, error) {
+			return data, true, nil
+		}
+	}
+
+	Context("when the cache has a maximum number of entries", func() {
+		It("should evict the least recently used entries", func() {
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			cache := NewWithOptions(store, Options{MaxEntries: 2}, logrus.StandardLogger())
+
+			_, err := cache.Get(CacheForever(), "a", fetch([]byte("a")))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cache.Get(CacheForever(), "b", fetch([]byte("b")))
+			Expect(err).ToNot(HaveOccurred())
+
+			// Use "a" so that "b" is the least recently used.
+			_, err = cache.Get(CacheForever(), "a", fetch([]byte("a")))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cache.Get(CacheForever(), "c", fetch([]byte("c")))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cache.Stats().Entries).To(Equal(2))
+			resp, err := cache.Get(CacheForever(), "b", fetch([]byte("refetched")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("refetched")))
+			resp, err = cache.Get(CacheForever(), "c", fetch([]byte("refetched")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("c")))
+		})
+	})
+
+	Context("when the cache has a maximum number of bytes", func() {
+		It("should stay within the limit", func() {
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			cache := NewWithOptions(store, Options{MaxBytes: 1024}, logrus.StandardLogger())
+
+			data := make([]byte, 100)
+			for i := 0; i < 100; i++ {
+				_, err := cache.Get(CacheForever(), fmt.Sprintf("%v", i), fetch(data))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			stats := cache.Stats()
+			Expect(stats.Bytes).To(BeNumerically("<=", 1024))
+			Expect(stats.Entries).To(BeNumerically(">", 0))
+
+			size, err := store.Size()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(size).To(Equal(stats.Entries))
+		})
+
+		It("should count the size of the data as it is encoded in the store", func() {
+			store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+			cache := NewWithOptions(store, Options{MaxBytes: 1024}, logrus.StandardLogger())
+
+			_, err := cache.Get(CacheForever(), "key", fetch(make([]byte, 300)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cache.Stats().Bytes).To(BeNumerically(">=", 400))
+		})
+	})
+
+	Context("when the cache uses an on-disk backend", func() {
+		It("should keep responses across restarts", func() {
+			path, err := ioutil.TempDir("", "mercury-cache")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(path)
+
+			db, err := OpenDB(BackendLevelDB, path)
+			Expect(err).ToNot(HaveOccurred())
+			cache := New(kv.NewTable(db, "test"), logrus.StandardLogger())
+			_, err = cache.Get(CacheForever(), "hash", fetch([]byte("response")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(db.Close()).To(Succeed())
+
+			db, err = OpenDB(BackendLevelDB, path)
+			Expect(err).ToNot(HaveOccurred())
+			defer db.Close()
+			cache = New(kv.NewTable(db, "test"), logrus.StandardLogger())
+			Expect(cache.Stats().Entries).To(Equal(1))
+
+			resp, err := cache.Get(CacheForever(), "hash", fetch([]byte("refetched")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("response")))
+		})
+
+		It("should return an error for unknown backends", func() {
+			_, err := OpenDB(Backend("unknown"), "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
 
-func getResponse(url string, numRequests *int) func() ([]byte, error) {
-	return func() ([]byte, error) {
+func getResponse(url string, numRequests *int) Fetcher {
+	return func() ([]byte, bool, error) {
 		*numRequests++
 
 		req := map[string]string{"": ""}
@@ -146,6 +345,6 @@ func getResponse(url string, numRequests *int) func() ([]byte, error) {
 		// Add 3 second timeout to simulate latency.
 		time.Sleep(3 * time.Second)
 
-		return data, nil
+		return data, true, nil
 	}
 }
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Stats describes the contents of a Cache, and how requests to it were answered since it was created.
+type Stats struct {
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Coalesced uint64 `json:"coalesced"`
+}
+
+// lru keeps track of the keys in the store in order of use, along with their sizes, so that the least recently used
+// entries can be evicted once the store grows beyond its limits.
+type lru struct {
+	mu       *sync.Mutex
+	order    *list.List
+	elements map[string]*list.Element
+	bytes    int64
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+}
+
+func newLRU() *lru {
+	return &lru{
+		mu:       new(sync.Mutex),
+		order:    list.New(),
+		elements: map[string]*list.Element{},
+	}
+}
+
+// touch marks the key as the most recently used.
+func (l *lru) touch(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, ok := l.elements[key]; ok {
+		l.order.MoveToFront(elem)
+	}
+}
+
+// add records the key as the most recently used with the given size, replacing any previous record of it.
+func (l *lru) add(key string, size int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, ok := l.elements[key]; ok {
+		l.bytes -= elem.Value.(lruEntry).size
+		l.order.Remove(elem)
+	}
+	l.elements[key] = l.order.PushFront(lruEntry{key: key, size: size})
+	l.bytes += size
+}
+
+// remove forgets the key.
+func (l *lru) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, ok := l.elements[key]; ok {
+		l.bytes -= elem.Value.(lruEntry).size
+		l.order.Remove(elem)
+		delete(l.elements, key)
+	}
+}
+
+// evict forgets the least recently used keys until there are at most maxEntries keys using at most maxBytes bytes, and
+// returns the keys that were forgotten. Limits that are zero are ignored.
+func (l *lru) evict(maxEntries int, maxBytes int64) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var evicted []string
+	for l.order.Len() > 0 && ((maxEntries > 0 && l.order.Len() > maxEntries) || (maxBytes > 0 && l.bytes > maxBytes)) {
+		elem := l.order.Back()
+		e := elem.Value.(lruEntry)
+		l.bytes -= e.size
+		l.order.Remove(elem)
+		delete(l.elements, e.key)
+		evicted = append(evicted, e.key)
+	}
+	return evicted
+}
+
+// stats returns the number of keys and their total size.
+func (l *lru) stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Stats{
+		Entries: l.order.Len(),
+		Bytes:   l.bytes,
+	}
+}
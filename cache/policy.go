@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PolicyKind is the kind of a cache policy.
+type PolicyKind uint8
+
+const (
+	// PolicyNone never stores responses.
+	PolicyNone PolicyKind = 0
+	// PolicyTTL stores responses for a fixed amount of time.
+	PolicyTTL PolicyKind = 1
+	// PolicyFinal stores responses indefinitely once they are final (e.g. a transaction with enough confirmations).
+	PolicyFinal PolicyKind = 2
+	// PolicyBlockNumber stores responses indefinitely if the request is for a specific block with enough confirmations,
+	// and never stores them if the request is for a recent block or a block tag such as "latest" or "pending". It must
+	// be resolved against the request params and the chain tip before it is used.
+	PolicyBlockNumber PolicyKind = 3
+	// PolicyForever stores responses indefinitely.
+	PolicyForever PolicyKind = 4
+	// PolicyTip stores responses until the chain tip changes. Responses are not stored while the tip is unknown.
+	PolicyTip PolicyKind = 5
+	// PolicyConfirmed stores responses indefinitely once the block they were included in has enough confirmations. It
+	// must be resolved against the chain tip before it is used.
+	PolicyConfirmed PolicyKind = 6
+	// PolicyConfirmations stores responses indefinitely once they report enough confirmations themselves, such as
+	// verbose Bitcoin transactions. It must be resolved against the number of confirmations before it is used.
+	PolicyConfirmations PolicyKind = 7
+)
+
+// Policy determines whether a response can be stored in the cache, and for how long.
+type Policy struct {
+	Kind PolicyKind
+
+	// TTL is how long responses are stored for by PolicyTTL. For PolicyFinal, it is how long responses that are not yet
+	// final are stored for; if it is zero they are not stored at all.
+	TTL time.Duration
+
+	// Final returns whether a response is final. It is used by PolicyFinal. For PolicyBlockNumber, it returns whether
+	// a response can be stored at all, so that null results for blocks that do not exist yet are not stored.
+	Final func(data []byte) bool
+
+	// BlockParam is the index of the block parameter in the request params. It is only used by PolicyBlockNumber.
+	BlockParam int
+
+	// Height returns the height of the block a response was included in, if it has been included in one. It is only
+	// used by PolicyConfirmed.
+	Height func(data []byte) (uint64, bool)
+
+	// Confirmed returns whether a response has at least the given number of confirmations. It is only used by
+	// PolicyConfirmations.
+	Confirmed func(data []byte, confirmations uint64) bool
+}
+
+// NoCache returns a policy that never stores responses.
+func NoCache() Policy {
+	return Policy{Kind: PolicyNone}
+}
+
+// CacheFor returns a policy that stores responses for the given duration.
+func CacheFor(ttl time.Duration) Policy {
+	return Policy{Kind: PolicyTTL, TTL: ttl}
+}
+
+// CacheOnceFinal returns a policy that stores responses indefinitely once final returns true for them. Responses that
+// are not final are stored for the given duration, or not at all if it is zero.
+func CacheOnceFinal(final func(data []byte) bool, ttl time.Duration) Policy {
+	return Policy{Kind: PolicyFinal, TTL: ttl, Final: final}
+}
+
+// CacheByBlockNumber returns a policy that stores responses for requests with a block hash, or a block number with
+// enough confirmations, at the given param index. Responses for requests using a block tag or for recent blocks are
+// not stored. Responses are only stored if valid returns true for them; if it is nil every response is stored.
+func CacheByBlockNumber(param int, valid func(data []byte) bool) Policy {
+	return Policy{Kind: PolicyBlockNumber, BlockParam: param, Final: valid}
+}
+
+// CacheOnceConfirmed returns a policy that stores responses indefinitely once the block they were included in, as
+// returned by height, has enough confirmations. Other responses are not stored.
+func CacheOnceConfirmed(height func(data []byte) (uint64, bool)) Policy {
+	return Policy{Kind: PolicyConfirmed, Height: height}
+}
+
+// CacheOnceConfirmations returns a policy that stores responses indefinitely once confirmed returns true for them, given
+// the number of confirmations the policy is resolved with. Other responses are not stored.
+func CacheOnceConfirmations(confirmed func(data []byte, confirmations uint64) bool) Policy {
+	return Policy{Kind: PolicyConfirmations, Confirmed: confirmed}
+}
+
+// CacheForever returns a policy that stores responses indefinitely.
+func CacheForever() Policy {
+	return Policy{Kind: PolicyForever}
+}
+
+// CacheUntilNewBlock returns a policy that stores responses until the chain tip set using `Cache.SetTip` changes.
+func CacheUntilNewBlock() Policy {
+	return Policy{Kind: PolicyTip}
+}
+
+// Resolve returns the policy to use for a request with the given params, when the chain tip is at the given height.
+// Blocks are final once the tip is at least the given number of confirmations above them, and no block is final while
+// the tip is unknown (zero). Only PolicyBlockNumber, PolicyConfirmed and PolicyConfirmations depend on the request,
+// the tip or the confirmations; all other policies are returned unchanged.
+func (policy Policy) Resolve(params json.RawMessage, tip, confirmations uint64) Policy {
+	switch policy.Kind {
+	case PolicyBlockNumber:
+	case PolicyConfirmed:
+		height := policy.Height
+		return CacheOnceFinal(func(data []byte) bool {
+			included, ok := height(data)
+			return ok && confirmed(included, tip, confirmations)
+		}, 0)
+	case PolicyConfirmations:
+		confirmedFn := policy.Confirmed
+		return CacheOnceFinal(func(data []byte) bool {
+			return confirmedFn(data, confirmations)
+		}, 0)
+	default:
+		return policy
+	}
+
+	var values []json.RawMessage
+	if err := json.Unmarshal(params, &values); err != nil {
+		return NoCache()
+	}
+	if policy.BlockParam >= len(values) {
+		// The block parameter defaults to "latest" when it is omitted.
+		return NoCache()
+	}
+	height, fixed := blockHeight(values[policy.BlockParam])
+	if !fixed || (height > 0 && !confirmed(height, tip, confirmations)) {
+		return NoCache()
+	}
+	if policy.Final == nil {
+		return CacheForever()
+	}
+	return CacheOnceFinal(policy.Final, 0)
+}
+
+// confirmed returns whether the block at the given height has at least the given number of confirmations, counted as
+// the distance from the tip.
+func confirmed(height, tip, confirmations uint64) bool {
+	return tip != 0 && height <= tip && tip-height >= confirmations
+}
+
+// expiry returns when a response should be removed from the store, and whether it should be stored at all. A zero
+// time means the response never expires.
+func (policy Policy) expiry(data []byte, now time.Time) (time.Time, bool) {
+	switch policy.Kind {
+	case PolicyTTL:
+		return now.Add(policy.TTL), policy.TTL > 0
+	case PolicyFinal:
+		if policy.Final != nil && policy.Final(data) {
+			return time.Time{}, true
+		}
+		return now.Add(policy.TTL), policy.TTL > 0
+	case PolicyForever, PolicyTip:
+		return time.Time{}, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// blockHeight returns whether the block parameter refers to a block that will not change, and the height of the block
+// if it is given by number. Block numbers, block hashes and the "earliest" tag are fixed; all other tags are not. The
+// height is zero for block hashes and the "earliest" tag, which do not depend on the chain tip, as for the genesis block.
+func blockHeight(param json.RawMessage) (uint64, bool) {
+	var tag string
+	if err := json.Unmarshal(param, &tag); err == nil {
+		switch strings.ToLower(tag) {
+		case "earliest":
+			return 0, true
+		case "latest", "pending", "safe", "finalized", "":
+			return 0, false
+		default:
+			if !strings.HasPrefix(tag, "0x") {
+				return 0, false
+			}
+			if len(tag) == 66 {
+				// Some methods also accept a block hash in place of a block number.
+				return 0, true
+			}
+			height, err := strconv.ParseUint(tag[2:], 16, 64)
+			return height, err == nil
+		}
+	}
+
+	// EIP-1898 allows the block to be specified as an object with either a block hash or a block number.
+	block := struct {
+		BlockHash   string          `json:"blockHash"`
+		BlockNumber json.RawMessage `json:"blockNumber"`
+	}{}
+	if err := json.Unmarshal(param, &block); err != nil {
+		return 0, false
+	}
+	if block.BlockHash != "" {
+		return 0, true
+	}
+	if len(block.BlockNumber) > 0 {
+		return blockHeight(block.BlockNumber)
+	}
+	return 0, false
+}
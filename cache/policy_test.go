@@ -0,0 +1,176 @@
+package cache_test
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/cache"
+
+	"github.com/renproject/kv"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Cache policies", func() {
+	newCache := func() *Cache {
+		store := kv.NewTable(kv.NewMemDB(kv.JSONCodec), "test")
+		return New(store, logrus.StandardLogger())
+	}
+
+	counter := func(numRequests *int, data []byte) Fetcher {
+		return func() ([]byte, bool, error) {
+			*numRequests++
+			return data, true, nil
+		}
+	}
+
+	Context("when the policy does not allow caching", func() {
+		It("should retrieve the response for every request", func() {
+			cache := newCache()
+			numRequests := 0
+			for i := 0; i < 3; i++ {
+				_, err := cache.Get(NoCache(), "hash", counter(&numRequests, []byte("response")))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(numRequests).To(Equal(3))
+		})
+	})
+
+	Context("when the policy has a time-to-live", func() {
+		It("should retrieve the response again once it expires", func() {
+			cache := newCache()
+			numRequests := 0
+			policy := CacheFor(100 * time.Millisecond)
+
+			_, err := cache.Get(policy, "hash", counter(&numRequests, []byte("response")))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cache.Get(policy, "hash", counter(&numRequests, []byte("response")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(numRequests).To(Equal(1))
+
+			time.Sleep(200 * time.Millisecond)
+			_, err = cache.Get(policy, "hash", counter(&numRequests, []byte("response")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(numRequests).To(Equal(2))
+		})
+	})
+
+	Context("when the policy caches final responses", func() {
+		It("should only store responses once they are final", func() {
+			cache := newCache()
+			numRequests := 0
+			policy := CacheOnceFinal(func(data []byte) bool {
+				return string(data) == "final"
+			}, 0)
+
+			resp, err := cache.Get(policy, "hash", counter(&numRequests, []byte("pending")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("pending")))
+
+			resp, err = cache.Get(policy, "hash", counter(&numRequests, []byte("final")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("final")))
+
+			resp, err = cache.Get(policy, "hash", counter(&numRequests, []byte("other")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("final")))
+			Expect(numRequests).To(Equal(2))
+		})
+	})
+
+	Context("when the policy depends on the block number", func() {
+		It("should not cache block tags", func() {
+			policy := CacheByBlockNumber(1, nil)
+			for _, params := range []string{`["0x1"]`, `["0x1","latest"]`, `["0x1","pending"]`, `["0x1",{"blockNumber":"latest"}]`} {
+				Expect(policy.Resolve(json.RawMessage(params), 100, 6).Kind).To(Equal(PolicyNone))
+			}
+		})
+
+		It("should cache block hashes and block numbers with enough confirmations", func() {
+			policy := CacheByBlockNumber(1, nil)
+			for _, params := range []string{`["0x1","0x10"]`, `["0x1","0x5e"]`, `["0x1","earliest"]`, `["0x1",{"blockHash":"0xabc"}]`, `["0x1",{"blockNumber":"0x10"}]`} {
+				Expect(policy.Resolve(json.RawMessage(params), 100, 6).Kind).To(Equal(PolicyForever))
+			}
+		})
+
+		It("should not cache recent blocks, or any block while the tip is unknown", func() {
+			policy := CacheByBlockNumber(1, nil)
+			for _, params := range []string{`["0x1","0x5f"]`, `["0x1","0x64"]`, `["0x1","0x65"]`} {
+				Expect(policy.Resolve(json.RawMessage(params), 100, 6).Kind).To(Equal(PolicyNone))
+			}
+			Expect(policy.Resolve(json.RawMessage(`["0x1","0x10"]`), 0, 6).Kind).To(Equal(PolicyNone))
+		})
+
+		It("should only store valid responses", func() {
+			cache := newCache()
+			numRequests := 0
+			policy := CacheByBlockNumber(0, func(data []byte) bool {
+				return string(data) != "null"
+			}).Resolve(json.RawMessage(`["0x10"]`), 100, 6)
+
+			_, err := cache.Get(policy, "hash", counter(&numRequests, []byte("null")))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = cache.Get(policy, "hash", counter(&numRequests, []byte("block")))
+			Expect(err).ToNot(HaveOccurred())
+			resp, err := cache.Get(policy, "hash", counter(&numRequests, []byte("other")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("block")))
+			Expect(numRequests).To(Equal(2))
+		})
+	})
+
+	Context("when the policy caches once confirmed", func() {
+		It("should only store responses included in a block with enough confirmations", func() {
+			height := func(data []byte) (uint64, bool) {
+				return 90, string(data) != "pending"
+			}
+			Expect(CacheOnceConfirmed(height).Resolve(nil, 95, 6).Final([]byte("mined"))).To(BeFalse())
+			Expect(CacheOnceConfirmed(height).Resolve(nil, 96, 6).Final([]byte("mined"))).To(BeTrue())
+			Expect(CacheOnceConfirmed(height).Resolve(nil, 96, 6).Final([]byte("pending"))).To(BeFalse())
+			Expect(CacheOnceConfirmed(height).Resolve(nil, 0, 6).Final([]byte("mined"))).To(BeFalse())
+		})
+	})
+
+	Context("when the policy caches once the response has enough confirmations", func() {
+		It("should use the confirmations the policy is resolved with", func() {
+			confirmed := func(data []byte, confirmations uint64) bool {
+				return confirmations <= 3
+			}
+			Expect(CacheOnceConfirmations(confirmed).Resolve(nil, 0, 3).Final([]byte("tx"))).To(BeTrue())
+			Expect(CacheOnceConfirmations(confirmed).Resolve(nil, 0, 6).Final([]byte("tx"))).To(BeFalse())
+		})
+	})
+
+	Context("when the policy caches until a new block", func() {
+		It("should not store responses until the tip is known", func() {
+			cache := newCache()
+			numRequests := 0
+			for i := 0; i < 2; i++ {
+				_, err := cache.Get(CacheUntilNewBlock(), "hash", counter(&numRequests, []byte("response")))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(numRequests).To(Equal(2))
+		})
+
+		It("should retrieve the response again once the tip changes", func() {
+			cache := newCache()
+			numRequests := 0
+			cache.SetTip("0x1")
+
+			resp, err := cache.Get(CacheUntilNewBlock(), "hash", counter(&numRequests, []byte("first")))
+			Expect(err).ToNot(HaveOccurred())
+			resp, err = cache.Get(CacheUntilNewBlock(), "hash", counter(&numRequests, []byte("other")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("first")))
+			Expect(numRequests).To(Equal(1))
+
+			cache.SetTip("0x2")
+			resp, err = cache.Get(CacheUntilNewBlock(), "hash", counter(&numRequests, []byte("second")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp).To(Equal([]byte("second")))
+			Expect(numRequests).To(Equal(2))
+			Expect(cache.Stats().Entries).To(Equal(1))
+		})
+	})
+})
@@ -0,0 +1,424 @@
+// Package chain follows the chain tip of Bitcoin-family networks, whose nodes cannot push new blocks to their callers. A
+// Follower polls the best block hash of the upstreams, remembers the most recent blocks of the best chain, and detects
+// reorgs by walking back from each new tip until it reaches a block it already knows. Callers subscribe to the
+// resulting `newBlock`, `reorg` and `gap` events instead of polling the nodes themselves.
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/renproject/mercury/proxy"
+	"github.com/renproject/mercury/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of events.
+const (
+	// EventNewBlock is published for each block added to the best chain, in order of height.
+	EventNewBlock = "newBlock"
+	// EventReorg is published when blocks are removed from the best chain, before the blocks replacing them.
+	EventReorg = "reorg"
+	// EventGap is published when the tip has moved further than the remembered blocks, so that some of the blocks
+	// added to the best chain are not published. Callers that need every block should resync.
+	EventGap = "gap"
+)
+
+// DefaultBufferSize is the number of events a subscription can fall behind by before it is closed.
+const DefaultBufferSize = 64
+
+// ErrTooSlow closes subscriptions whose events are not read quickly enough.
+var ErrTooSlow = errors.New("events are not being read quickly enough")
+
+// Block is a block of the best chain.
+type Block struct {
+	Hash         string `json:"hash"`
+	Height       uint64 `json:"height"`
+	PreviousHash string `json:"previousHash"`
+	Time         int64  `json:"time"`
+}
+
+// Event is a change to the best chain. For `newBlock` events, Block is the new block. For `reorg` events, Block is the
+// last block that is still in the best chain, and Removed are the blocks that are not, from the lowest. If the reorg is
+// deeper than the blocks remembered by the Follower, Block is empty. For `gap` events, Block is the first block that is
+// published after the gap, and the blocks between it and the previous tip, or the last block still in the best chain
+// after a reorg, are not published.
+type Event struct {
+	Type    string  `json:"type"`
+	Block   Block   `json:"block"`
+	Removed []Block `json:"removed,omitempty"`
+}
+
+// ErrRPC is a JSON-RPC error returned by the upstreams in response to a request.
+type ErrRPC struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+// Error implements the error interface.
+func (err ErrRPC) Error() string {
+	return fmt.Sprintf("%v failed: %v", err.Method, err.Message)
+}
+
+// Caller sends a JSON-RPC request to the upstreams of a network, and returns its result. Errors returned by the
+// upstreams in response to the request are returned as ErrRPC.
+type Caller func(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error)
+
+// ProxyCaller returns a Caller which sends requests using the proxy.
+func ProxyCaller(p *proxy.Proxy) Caller {
+	return func(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+		if params == nil {
+			params = []interface{}{}
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      1,
+			"method":  method,
+			"params":  params,
+		})
+		if err != nil {
+			return nil, err
+		}
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			return nil, err
+		}
+		response, err := p.ProxyRequest(ctx, r.WithContext(ctx), data)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read response: %v", err)
+		}
+		if err := proxy.Classify(response.StatusCode, body); err != nil {
+			return nil, err
+		}
+		var resp types.JSONResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, fmt.Errorf("invalid response: %v", err)
+		}
+		if resp.Error != nil {
+			return nil, ErrRPC{Method: method, Code: resp.Error.Code, Message: resp.Error.Message}
+		}
+		return resp.Result, nil
+	}
+}
+
+// Options configure a Follower.
+type Options struct {
+	// Interval is the time between polls.
+	Interval time.Duration
+	// Timeout limits how long each poll can take.
+	Timeout time.Duration
+	// Depth is the number of recent blocks that are remembered, which is the deepest reorg that can be described.
+	Depth int
+}
+
+// DefaultOptions returns the options used for Bitcoin-family networks: the tip is polled every 10 seconds, and the
+// last 100 blocks are remembered.
+func DefaultOptions() Options {
+	return Options{
+		Interval: 10 * time.Second,
+		Timeout:  10 * time.Second,
+		Depth:    100,
+	}
+}
+
+// Follower follows the best chain of the upstreams of a network.
+type Follower struct {
+	call    Caller
+	options Options
+	logger  logrus.FieldLogger
+
+	mu          *sync.Mutex
+	blocks      []Block
+	subscribers map[*Subscription]struct{}
+	onTip       []func(Block)
+}
+
+// New returns a new Follower which uses the caller to query the upstreams. It does not poll until Run is called.
+func New(call Caller, options Options, logger logrus.FieldLogger) *Follower {
+	defaults := DefaultOptions()
+	if options.Interval <= 0 {
+		options.Interval = defaults.Interval
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaults.Timeout
+	}
+	if options.Depth <= 0 {
+		options.Depth = defaults.Depth
+	}
+	return &Follower{
+		call:        call,
+		options:     options,
+		logger:      logger,
+		mu:          new(sync.Mutex),
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Tip returns the tip of the best chain, and false if it is not known yet.
+func (follower *Follower) Tip() (Block, bool) {
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+	if len(follower.blocks) == 0 {
+		return Block{}, false
+	}
+	return follower.blocks[len(follower.blocks)-1], true
+}
+
+// OnTip registers a function which is called with the new tip whenever it changes. It is called after the events of
+// the change have been published, and must not block.
+func (follower *Follower) OnTip(f func(Block)) {
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+	follower.onTip = append(follower.onTip, f)
+}
+
+// Run polls the upstreams until the context is done.
+func (follower *Follower) Run(ctx context.Context) {
+	ticker := time.NewTicker(follower.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := follower.Poll(ctx); err != nil && ctx.Err() == nil {
+			follower.logger.Warnf("cannot follow the chain tip: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll queries the best block hash and publishes the events that lead from the previous tip to the new one. Nothing is
+// published by the first poll, which only finds the tip. Polls must not be made concurrently.
+func (follower *Follower) Poll(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, follower.options.Timeout)
+	defer cancel()
+
+	var hash string
+	if err := follower.get(ctx, &hash, "getbestblockhash"); err != nil {
+		return err
+	}
+	if hash == "" {
+		return errors.New("empty best block hash")
+	}
+
+	follower.mu.Lock()
+	known := follower.blocks
+	follower.mu.Unlock()
+	if len(known) > 0 && known[len(known)-1].Hash == hash {
+		return nil
+	}
+
+	// Walk back from the new tip until reaching a block that is already known.
+	index := make(map[string]int, len(known))
+	for i, block := range known {
+		index[block.Hash] = i
+	}
+	if _, ok := index[hash]; ok {
+		// A reorg never moves the tip back to a block that is already in the best chain, so the upstream that answered
+		// is lagging behind the others and is ignored.
+		follower.logger.Debugf("ignoring best block %v below the tip", hash)
+		return nil
+	}
+	ancestor := -1
+	added := []Block{}
+	for next := hash; next != ""; {
+		if i, ok := index[next]; ok {
+			ancestor = i
+			break
+		}
+		if len(added) >= follower.options.Depth {
+			break
+		}
+		block, err := follower.header(ctx, next)
+		if err != nil {
+			return err
+		}
+		added = append(added, block)
+		if len(known) == 0 {
+			break
+		}
+		next = block.PreviousHash
+	}
+	for i, j := 0, len(added)-1; i < j; i, j = i+1, j-1 {
+		added[i], added[j] = added[j], added[i]
+	}
+
+	if len(known) == 0 {
+		follower.publish(added, nil)
+		return nil
+	}
+	if ancestor < 0 {
+		// The tip has moved further than the remembered blocks, so the remembered blocks that are still in the best
+		// chain are found by their height instead.
+		for i := len(known) - 1; i >= 0; i-- {
+			var current string
+			if err := follower.get(ctx, &current, "getblockhash", known[i].Height); err != nil {
+				return err
+			}
+			if current == known[i].Hash {
+				ancestor = i
+				break
+			}
+		}
+		follower.logger.Warnf("new tip %v is more than %d blocks from the previous tip", hash, follower.options.Depth)
+	}
+
+	events := []Event{}
+	if removed := known[ancestor+1:]; len(removed) > 0 {
+		event := Event{Type: EventReorg, Removed: removed}
+		if ancestor >= 0 {
+			event.Block = known[ancestor]
+		}
+		events = append(events, event)
+	}
+	if len(added) > 0 && (ancestor < 0 || added[0].PreviousHash != known[ancestor].Hash) {
+		events = append(events, Event{Type: EventGap, Block: added[0]})
+	}
+	for _, block := range added {
+		events = append(events, Event{Type: EventNewBlock, Block: block})
+	}
+
+	blocks := append(append([]Block{}, known[:ancestor+1]...), added...)
+	if len(blocks) > follower.options.Depth {
+		blocks = blocks[len(blocks)-follower.options.Depth:]
+	}
+	follower.publish(blocks, events)
+	return nil
+}
+
+// publish replaces the remembered blocks, sends the events to each subscriber, and then notifies the OnTip functions
+// of the new tip.
+func (follower *Follower) publish(blocks []Block, events []Event) {
+	follower.mu.Lock()
+	follower.blocks = blocks
+	for sub := range follower.subscribers {
+		for _, event := range events {
+			if !follower.send(sub, event) {
+				break
+			}
+		}
+	}
+	onTip := follower.onTip
+	follower.mu.Unlock()
+
+	tip := blocks[len(blocks)-1]
+	for _, f := range onTip {
+		f(tip)
+	}
+}
+
+// send sends the event to the subscriber, and closes the subscription if it has fallen too far behind. The caller must
+// hold the mutex.
+func (follower *Follower) send(sub *Subscription, event Event) bool {
+	select {
+	case sub.ch <- event:
+		return true
+	default:
+		follower.unsubscribe(sub, ErrTooSlow)
+		return false
+	}
+}
+
+// header returns the block with the given hash.
+func (follower *Follower) header(ctx context.Context, hash string) (Block, error) {
+	header := struct {
+		Hash              string `json:"hash"`
+		Height            uint64 `json:"height"`
+		PreviousBlockHash string `json:"previousblockhash"`
+		Time              int64  `json:"time"`
+	}{}
+	if err := follower.get(ctx, &header, "getblockheader", hash, true); err != nil {
+		return Block{}, err
+	}
+	if header.Hash != hash {
+		return Block{}, fmt.Errorf("invalid header for block %v", hash)
+	}
+	return Block{
+		Hash:         header.Hash,
+		Height:       header.Height,
+		PreviousHash: header.PreviousBlockHash,
+		Time:         header.Time,
+	}, nil
+}
+
+// get calls the method and decodes its result into the value.
+func (follower *Follower) get(ctx context.Context, value interface{}, method string, params ...interface{}) error {
+	result, err := follower.call(ctx, method, params...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(result, value); err != nil {
+		return fmt.Errorf("invalid result for %v: %v", method, err)
+	}
+	return nil
+}
+
+// Subscribe returns a subscription to the events published after it is made. It must be closed using Unsubscribe once
+// it is no longer needed.
+func (follower *Follower) Subscribe() *Subscription {
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+	sub := &Subscription{follower: follower, ch: make(chan Event, DefaultBufferSize)}
+	follower.subscribers[sub] = struct{}{}
+	return sub
+}
+
+// Subscribers returns the number of open subscriptions.
+func (follower *Follower) Subscribers() int {
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+	return len(follower.subscribers)
+}
+
+// unsubscribe closes the subscription. The caller must hold the mutex.
+func (follower *Follower) unsubscribe(sub *Subscription, err error) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	sub.err = err
+	close(sub.ch)
+	delete(follower.subscribers, sub)
+}
+
+// Subscription is a subscription of a caller to the events of a Follower.
+type Subscription struct {
+	follower *Follower
+	ch       chan Event
+	closed   bool
+	err      error
+}
+
+// Events returns the events of the subscription. The channel is closed when the subscription is closed.
+func (sub *Subscription) Events() <-chan Event {
+	return sub.ch
+}
+
+// Err returns why the subscription was closed, or nil if it is open or was closed using Unsubscribe.
+func (sub *Subscription) Err() error {
+	sub.follower.mu.Lock()
+	defer sub.follower.mu.Unlock()
+	return sub.err
+}
+
+// Unsubscribe closes the subscription.
+func (sub *Subscription) Unsubscribe() {
+	sub.follower.mu.Lock()
+	defer sub.follower.mu.Unlock()
+	sub.follower.unsubscribe(sub, nil)
+}
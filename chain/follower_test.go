@@ -0,0 +1,306 @@
+package chain_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/chain"
+
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Follower", func() {
+	var (
+		node     *fakeChain
+		follower *Follower
+	)
+
+	BeforeEach(func() {
+		node = newFakeChain()
+		follower = New(node.Call, Options{Depth: 10}, logrus.StandardLogger())
+	})
+
+	poll := func() {
+		Expect(follower.Poll(context.Background())).To(Succeed())
+	}
+	receive := func(sub *Subscription) []Event {
+		events := []Event{}
+		for {
+			select {
+			case event := <-sub.Events():
+				events = append(events, event)
+			default:
+				return events
+			}
+		}
+	}
+
+	Context("when following the chain", func() {
+		It("should only find the tip on the first poll", func() {
+			node.Mine("a", 3)
+			sub := follower.Subscribe()
+			defer sub.Unsubscribe()
+
+			poll()
+			tip, ok := follower.Tip()
+			Expect(ok).To(BeTrue())
+			Expect(tip).To(Equal(node.Block("a", 3)))
+			Expect(receive(sub)).To(BeEmpty())
+		})
+
+		It("should publish each new block in order", func() {
+			node.Mine("a", 1)
+			poll()
+			sub := follower.Subscribe()
+			defer sub.Unsubscribe()
+
+			node.Mine("a", 3)
+			poll()
+			Expect(receive(sub)).To(Equal([]Event{
+				{Type: EventNewBlock, Block: node.Block("a", 2)},
+				{Type: EventNewBlock, Block: node.Block("a", 3)},
+			}))
+
+			poll()
+			Expect(receive(sub)).To(BeEmpty())
+		})
+
+		It("should publish reorgs before the blocks replacing the removed blocks", func() {
+			node.Mine("a", 1)
+			poll()
+			node.Mine("a", 3)
+			poll()
+			sub := follower.Subscribe()
+			defer sub.Unsubscribe()
+
+			node.Fork("b", 1, 4)
+			poll()
+			Expect(receive(sub)).To(Equal([]Event{
+				{Type: EventReorg, Block: node.Block("a", 1), Removed: []Block{node.Block("a", 2), node.Block("a", 3)}},
+				{Type: EventNewBlock, Block: node.Block("b", 2)},
+				{Type: EventNewBlock, Block: node.Block("b", 3)},
+				{Type: EventNewBlock, Block: node.Block("b", 4)},
+			}))
+		})
+
+		It("should tell the tip to its observers", func() {
+			node.Mine("a", 1)
+			tips := make(chan Block, 2)
+			follower.OnTip(func(tip Block) { tips <- tip })
+
+			poll()
+			Expect(tips).To(Receive(Equal(node.Block("a", 1))))
+			poll()
+			Expect(tips).ToNot(Receive())
+		})
+	})
+
+	Context("when the tip moves further than the remembered blocks", func() {
+		It("should publish a gap before the most recent blocks", func() {
+			node.Mine("a", 1)
+			poll()
+			sub := follower.Subscribe()
+			defer sub.Unsubscribe()
+
+			node.Mine("a", 20)
+			poll()
+			events := receive(sub)
+			Expect(events).To(HaveLen(11))
+			Expect(events[0]).To(Equal(Event{Type: EventGap, Block: node.Block("a", 11)}))
+			Expect(events[1]).To(Equal(Event{Type: EventNewBlock, Block: node.Block("a", 11)}))
+			Expect(events[10]).To(Equal(Event{Type: EventNewBlock, Block: node.Block("a", 20)}))
+		})
+
+		It("should not publish a gap if the tip moves by exactly the remembered blocks", func() {
+			node.Mine("a", 1)
+			poll()
+			sub := follower.Subscribe()
+			defer sub.Unsubscribe()
+
+			node.Mine("a", 11)
+			poll()
+			events := receive(sub)
+			Expect(events).To(HaveLen(10))
+			Expect(events[0]).To(Equal(Event{Type: EventNewBlock, Block: node.Block("a", 2)}))
+		})
+
+		It("should find the remembered blocks that are still in the best chain", func() {
+			node.Mine("a", 1)
+			poll()
+			node.Mine("a", 3)
+			poll()
+			sub := follower.Subscribe()
+			defer sub.Unsubscribe()
+
+			node.Fork("b", 1, 20)
+			poll()
+			events := receive(sub)
+			Expect(events).To(HaveLen(12))
+			Expect(events[0]).To(Equal(Event{Type: EventReorg, Block: node.Block("a", 1), Removed: []Block{node.Block("a", 2), node.Block("a", 3)}}))
+			Expect(events[1]).To(Equal(Event{Type: EventGap, Block: node.Block("b", 11)}))
+			Expect(events[2]).To(Equal(Event{Type: EventNewBlock, Block: node.Block("b", 11)}))
+		})
+
+		It("should publish a reorg without an ancestor if no remembered block is still in the best chain", func() {
+			node.Mine("a", 1)
+			poll()
+			node.Mine("a", 2)
+			poll()
+			sub := follower.Subscribe()
+			defer sub.Unsubscribe()
+
+			node.Fork("b", 0, 20)
+			poll()
+			events := receive(sub)
+			Expect(events).To(HaveLen(12))
+			Expect(events[0]).To(Equal(Event{Type: EventReorg, Removed: []Block{node.Block("a", 1), node.Block("a", 2)}}))
+			Expect(events[1]).To(Equal(Event{Type: EventGap, Block: node.Block("b", 11)}))
+			Expect(events[11]).To(Equal(Event{Type: EventNewBlock, Block: node.Block("b", 20)}))
+		})
+	})
+
+	Context("when the upstreams disagree about the tip", func() {
+		It("should ignore upstreams that are behind the tip", func() {
+			lagging := false
+			follower = New(func(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+				if method == "getbestblockhash" && lagging {
+					return json.Marshal(node.Block("a", 2).Hash)
+				}
+				return node.Call(ctx, method, params...)
+			}, Options{Depth: 10}, logrus.StandardLogger())
+			tips := make(chan Block, 10)
+			follower.OnTip(func(tip Block) { tips <- tip })
+
+			node.Mine("a", 2)
+			poll()
+			node.Mine("a", 3)
+			poll()
+			Expect(tips).To(Receive(Equal(node.Block("a", 2))))
+			Expect(tips).To(Receive(Equal(node.Block("a", 3))))
+			sub := follower.Subscribe()
+			defer sub.Unsubscribe()
+
+			for i := 0; i < 4; i++ {
+				lagging = !lagging
+				poll()
+			}
+			Expect(receive(sub)).To(BeEmpty())
+			Expect(tips).ToNot(Receive())
+			tip, _ := follower.Tip()
+			Expect(tip).To(Equal(node.Block("a", 3)))
+		})
+	})
+
+	Context("when subscribers do not read their events", func() {
+		It("should close their subscriptions", func() {
+			node.Mine("a", 1)
+			poll()
+			sub := follower.Subscribe()
+			for i := 2; i <= DefaultBufferSize+2; i++ {
+				node.Mine("a", uint64(i))
+				poll()
+			}
+			Expect(sub.Err()).To(Equal(ErrTooSlow))
+			Expect(follower.Subscribers()).To(Equal(0))
+		})
+	})
+
+	Context("when the upstreams fail", func() {
+		It("should return the error and keep the tip", func() {
+			node.Mine("a", 1)
+			poll()
+			node.Fail(true)
+			Expect(follower.Poll(context.Background())).ToNot(Succeed())
+			tip, _ := follower.Tip()
+			Expect(tip).To(Equal(node.Block("a", 1)))
+		})
+	})
+})
+
+// fakeChain is a chain of blocks served using the methods of a Bitcoin node. Blocks are named by their branch and
+// height, and every branch starts from the same genesis block.
+type fakeChain struct {
+	mu     *sync.Mutex
+	blocks map[string]Block
+	best   []string
+	failed bool
+}
+
+func newFakeChain() *fakeChain {
+	genesis := Block{Hash: "genesis", Time: 1}
+	return &fakeChain{
+		mu:     new(sync.Mutex),
+		blocks: map[string]Block{genesis.Hash: genesis},
+		best:   []string{genesis.Hash},
+	}
+}
+
+// Block returns the block of the branch at the height.
+func (node *fakeChain) Block(branch string, height uint64) Block {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.blocks[fmt.Sprintf("%s%d", branch, height)]
+}
+
+// Mine extends the best chain on the branch up to the height.
+func (node *fakeChain) Mine(branch string, height uint64) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for h := uint64(len(node.best)); h <= height; h++ {
+		block := Block{
+			Hash:         fmt.Sprintf("%s%d", branch, h),
+			Height:       h,
+			PreviousHash: node.best[h-1],
+			Time:         int64(h + 1),
+		}
+		node.blocks[block.Hash] = block
+		node.best = append(node.best, block.Hash)
+	}
+}
+
+// Fork replaces the best chain after the height with the branch up to the tip.
+func (node *fakeChain) Fork(branch string, height, tip uint64) {
+	node.mu.Lock()
+	node.best = node.best[:height+1]
+	node.mu.Unlock()
+	node.Mine(branch, tip)
+}
+
+// Fail makes every call fail.
+func (node *fakeChain) Fail(failed bool) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.failed = failed
+}
+
+// Call implements the Caller type.
+func (node *fakeChain) Call(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.failed {
+		return nil, fmt.Errorf("upstream unavailable")
+	}
+
+	var result interface{}
+	switch method {
+	case "getbestblockhash":
+		result = node.best[len(node.best)-1]
+	case "getblockhash":
+		result = node.best[params[0].(uint64)]
+	case "getblockheader":
+		block := node.blocks[params[0].(string)]
+		result = map[string]interface{}{
+			"hash":              block.Hash,
+			"height":            block.Height,
+			"previousblockhash": block.PreviousHash,
+			"time":              block.Time,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported method %v", method)
+	}
+	return json.Marshal(result)
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/renproject/kv"
 	"github.com/renproject/mercury/api"
+	"github.com/renproject/mercury/auth"
 	"github.com/renproject/mercury/cache"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/config"
 	"github.com/renproject/mercury/proxy"
-	"github.com/renproject/mercury/rpc"
-	"github.com/renproject/mercury/types/btctypes"
-	"github.com/renproject/mercury/types/ethtypes"
+	"github.com/renproject/mercury/stats"
+	"github.com/renproject/mercury/subscription"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/watch"
 	"github.com/sirupsen/logrus"
 )
 
@@ -17,96 +27,230 @@ func main() {
 	// Initialise logger.
 	logger := logrus.StandardLogger()
 
-	db := kv.NewMemDB(kv.JSONCodec)
-
-	// Initialise stores.
-	ethRinkebyCache := cache.New(kv.NewTable(db, "ethRinkeby"), logger)
-	ethKovanCache := cache.New(kv.NewTable(db, "ethKovan"), logger)
-	btcTestCache := cache.New(kv.NewTable(db, "btcTest"), logger)
-	zecTestCache := cache.New(kv.NewTable(db, "zecTest"), logger)
-	bchTestCache := cache.New(kv.NewTable(db, "bchTest"), logger)
-	ethCache := cache.New(kv.NewTable(db, "eth"), logger)
-	btcCache := cache.New(kv.NewTable(db, "btc"), logger)
-	zecCache := cache.New(kv.NewTable(db, "zec"), logger)
-	bchCache := cache.New(kv.NewTable(db, "bch"), logger)
-
-	// Initialise Bitcoin API.
-	btcTestnetURL := os.Getenv("BITCOIN_TESTNET_RPC_URL")
-	btcTestnetUser := os.Getenv("BITCOIN_TESTNET_RPC_USERNAME")
-	btcTestnetPassword := os.Getenv("BITCOIN_TESTNET_RPC_PASSWORD")
-	btcTestnetNodeClient := rpc.NewClient(btcTestnetURL, btcTestnetUser, btcTestnetPassword)
-	btcTestnetProxy := proxy.NewProxy(btcTestnetNodeClient)
-	btcTestnetAPI := api.NewApi(btctypes.BtcTestnet, btcTestnetProxy, btcTestCache, logger)
-
-	btcMainnetURL := os.Getenv("BITCOIN_MAINNET_RPC_URL")
-	btcMainnetUser := os.Getenv("BITCOIN_MAINNET_RPC_USERNAME")
-	btcMainnetPassword := os.Getenv("BITCOIN_MAINNET_RPC_PASSWORD")
-	btcMainnetNodeClient := rpc.NewClient(btcMainnetURL, btcMainnetUser, btcMainnetPassword)
-	btcMainnetProxy := proxy.NewProxy(btcMainnetNodeClient)
-	btcMainnetAPI := api.NewApi(btctypes.BtcMainnet, btcMainnetProxy, btcCache, logger)
-
-	// Initialise ZCash API.
-	zecTestnetURL := os.Getenv("ZCASH_TESTNET_RPC_URL")
-	zecTestnetUser := os.Getenv("ZCASH_TESTNET_RPC_USERNAME")
-	zecTestnetPassword := os.Getenv("ZCASH_TESTNET_RPC_PASSWORD")
-	zecTestnetNodeClient := rpc.NewClient(zecTestnetURL, zecTestnetUser, zecTestnetPassword)
-	zecTestnetProxy := proxy.NewProxy(zecTestnetNodeClient)
-	zecTestnetAPI := api.NewApi(btctypes.ZecTestnet, zecTestnetProxy, zecTestCache, logger)
-
-	zecMainnetURL := os.Getenv("ZCASH_MAINNET_RPC_URL")
-	zecMainnetUser := os.Getenv("ZCASH_MAINNET_RPC_USERNAME")
-	zecMainnetPassword := os.Getenv("ZCASH_MAINNET_RPC_PASSWORD")
-	zecMainnetNodeClient := rpc.NewClient(zecMainnetURL, zecMainnetUser, zecMainnetPassword)
-	zecMainnetProxy := proxy.NewProxy(zecMainnetNodeClient)
-	zecMainnetAPI := api.NewApi(btctypes.ZecMainnet, zecMainnetProxy, zecCache, logger)
-
-	// Initialise BCash API.
-	bchTestnetURL := os.Getenv("BCASH_TESTNET_RPC_URL")
-	bchTestnetUser := os.Getenv("BCASH_TESTNET_RPC_USERNAME")
-	bchTestnetPassword := os.Getenv("BCASH_TESTNET_RPC_PASSWORD")
-	bchTestnetNodeClient := rpc.NewClient(bchTestnetURL, bchTestnetUser, bchTestnetPassword)
-	bchTestnetProxy := proxy.NewProxy(bchTestnetNodeClient)
-	bchTestnetAPI := api.NewApi(btctypes.BchTestnet, bchTestnetProxy, bchTestCache, logger)
-
-	bchMainnetURL := os.Getenv("BCASH_MAINNET_RPC_URL")
-	bchMainnetUser := os.Getenv("BCASH_MAINNET_RPC_USERNAME")
-	bchMainnetPassword := os.Getenv("BCASH_MAINNET_RPC_PASSWORD")
-	bchMainnetNodeClient := rpc.NewClient(bchMainnetURL, bchMainnetUser, bchMainnetPassword)
-	bchMainnetProxy := proxy.NewProxy(bchMainnetNodeClient)
-	bchMainnetAPI := api.NewApi(btctypes.BchMainnet, bchMainnetProxy, bchCache, logger)
-
-	// Initialize Ethereum API.
-	taggedKeys := map[string]string{
-		"":         os.Getenv("INFURA_KEY_DEFAULT"),
-		"swapperd": os.Getenv("INFURA_KEY_SWAPPERD"),
-		"darknode": os.Getenv("INFURA_KEY_DARKNODE"),
-		"renex":    os.Getenv("INFURA_KEY_RENEX"),
-		"renex-ui": os.Getenv("INFURA_KEY_RENEX_UI"),
-		"dcc":      os.Getenv("INFURA_KEY_DCC"),
-	}
-	infuraMainnetClient := rpc.NewInfuraClient(ethtypes.Mainnet, taggedKeys)
-	ethMainnetProxy := proxy.NewProxy(infuraMainnetClient)
-	ethMainnetAPI := api.NewApi(ethtypes.Mainnet, ethMainnetProxy, ethCache, logger)
-
-	infuraRinkebyClient := rpc.NewInfuraClient(ethtypes.Rinkeby, taggedKeys)
-	ethRinkebyProxy := proxy.NewProxy(infuraRinkebyClient)
-	ethRinkebyAPI := api.NewApi(ethtypes.Rinkeby, ethRinkebyProxy, ethRinkebyCache, logger)
-
-	var testnetClient rpc.Client
-	ethKovanRPCURL := os.Getenv("ETH_KOVAN_RPC_URL")
-	if ethKovanRPCURL == "" {
-		logger.Infof("Using Infura")
-		testnetClient = rpc.NewInfuraClient(ethtypes.Kovan, taggedKeys)
-	} else {
-		logger.Infof("Using local ETH node at: %s", ethKovanRPCURL)
-		ethKovanUser := os.Getenv("ETH_KOVAN_RPC_USERNAME")
-		ethKovanPassword := os.Getenv("ETH_KOVAN_RPC_PASSWORD")
-		testnetClient = rpc.NewClient(ethKovanRPCURL, ethKovanUser, ethKovanPassword)
-	}
-	ethTestnetProxy := proxy.NewProxy(testnetClient)
-	ethTestnetAPI := api.NewApi(ethtypes.Kovan, ethTestnetProxy, ethKovanCache, logger)
-
-	// Set-up and start the server.
-	server := api.NewServer(logger, "5000", btcMainnetAPI, zecMainnetAPI, bchMainnetAPI, btcTestnetAPI, zecTestnetAPI, bchTestnetAPI, ethMainnetAPI, ethTestnetAPI, ethRinkebyAPI)
-	server.Run()
+	// Load the configuration from the file given by the -config flag or MERCURY_CONFIG.
+	path := flag.String("config", envOrDefault("MERCURY_CONFIG", "cmd/mercury/mercury.yml"), "path to the configuration file")
+	flag.Parse()
+	conf, err := config.Load(*path)
+	if err != nil {
+		logger.Fatalf("invalid config %v: %v", *path, err)
+	}
+
+	// Stop on SIGINT or SIGTERM.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-term
+		logger.Infof("received %v, stopping", sig)
+		cancel()
+	}()
+
+	// Open the cache database using the configured backend.
+	db, err := cache.OpenDB(cache.Backend(conf.Cache.Backend), conf.Cache.Path)
+	if err != nil {
+		logger.Fatalf("cannot open cache: %v", err)
+	}
+
+	// The limits apply to the cache of each network.
+	cacheOptions := cache.Options{
+		MaxEntries: conf.Cache.MaxEntriesPerNetwork,
+		MaxBytes:   conf.Cache.MaxBytesPerNetwork,
+	}
+
+	// Count requests in the stats table of the cache database, flushing them periodically.
+	statsStore := stats.New(kv.NewTable(db, "stats"), conf.StatsOptions(), logger)
+	statsDone := make(chan struct{})
+	go func() {
+		statsStore.Run(ctx)
+		close(statsDone)
+	}()
+
+	// Limit callers by their API keys, storing their daily usage in the cache database.
+	authenticator := auth.New(kv.NewTable(db, "usage"), conf.AuthOptions(), logger)
+	authDone := make(chan struct{})
+	go func() {
+		authenticator.Run(ctx)
+		close(authDone)
+	}()
+
+	// Send webhooks for the activity of watched addresses, keeping the watches and pending deliveries in the cache
+	// database. Networks are added below, before it starts running.
+	notifier := watch.New(kv.NewTable(db, "watches"), kv.NewTable(db, "deliveries"), conf.WatchOptions(), logger)
+
+	reloader := &reloader{
+		mu:       new(sync.Mutex),
+		path:     *path,
+		conf:     conf,
+		networks: map[string]*network{},
+		auth:     authenticator,
+		logger:   logger,
+	}
+	apis := make([]api.BlockchainApi, 0, len(conf.Networks))
+	for _, networkConf := range conf.Networks {
+		store := cache.NewWithOptions(kv.NewTable(db, tables[networkConf.Route]), cacheOptions, logger)
+		n := &network{
+			ctx:    ctx,
+			proxy:  networkConf.NewProxy(),
+			logger: logger.WithField("network", networkConf.Route),
+		}
+		n.api = api.NewApiWithWhitelist(networkConf.Network(), n.proxy, store, networkConf.Whitelist(), logger)
+		n.api.SetMaxLogRange(networkConf.MaxLogRange)
+		n.api.SetConfirmations(networkConf.Confirmations)
+		if networkConf.Network().Chain() == types.Ethereum {
+			// Subscriptions are shared between callers over a connection to one of the upstreams.
+			n.hub = subscription.New(networkConf.WebsocketURLs(), n.logger)
+			n.api.SetHub(n.hub)
+			go n.hub.Run(ctx)
+		} else {
+			// New blocks and reorgs are streamed to callers, and invalidate responses cached until a new block.
+			n.follower = chain.New(chain.ProxyCaller(n.proxy), networkConf.FollowerOptions(), n.logger)
+			n.api.SetFollower(n.follower)
+			go n.follower.Run(ctx)
+		}
+		notifier.AddNetwork(networkConf.Network(), chain.ProxyCaller(n.proxy), networkConf.FollowerOptions().Interval)
+		n.monitor(networkConf)
+		reloader.networks[networkConf.Route] = n
+		apis = append(apis, n.api)
+	}
+
+	watchDone := make(chan struct{})
+	go func() {
+		notifier.Run(ctx)
+		close(watchDone)
+	}()
+
+	// Reload the config when receiving SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloader.Reload(); err != nil {
+				logger.Errorf("cannot reload config %v: %v", *path, err)
+				continue
+			}
+			logger.Infof("reloaded config %v", *path)
+		}
+	}()
+
+	// Set-up and run the server until it is stopped, then flush the stats and usage and close the cache once requests in
+	// flight have finished.
+	server := api.NewServer(logger, conf.Port, apis...)
+	server.SetStats(statsStore)
+	server.SetAuth(authenticator)
+	server.SetWatches(notifier)
+	server.EnableReload(conf.Admin.Token, reloader.Reload)
+	err = server.Run(ctx)
+	cancel()
+	<-statsDone
+	if flushErr := statsStore.Flush(); flushErr != nil {
+		logger.Errorf("cannot flush stats: %v", flushErr)
+	}
+	<-authDone
+	if flushErr := authenticator.Flush(); flushErr != nil {
+		logger.Errorf("cannot flush usage: %v", flushErr)
+	}
+	<-watchDone
+	if closeErr := db.Close(); closeErr != nil {
+		logger.Errorf("cannot close cache: %v", closeErr)
+	}
+	if err != nil {
+		logger.Fatalf("server stopped: %v", err)
+	}
+	logger.Infof("stopped")
+}
+
+// network is a network served by mercury.
+type network struct {
+	ctx      context.Context
+	proxy    *proxy.Proxy
+	api      *api.Api
+	hub      *subscription.Hub
+	follower *chain.Follower
+	cancel   context.CancelFunc
+	logger   logrus.FieldLogger
+}
+
+// monitor starts monitoring the chain tip of the upstreams of the network, so that lagging nodes are not used. It stops
+// the previous monitor, if there is one.
+func (n *network) monitor(conf config.NetworkConfig) {
+	if n.cancel != nil {
+		n.cancel()
+	}
+	var ctx context.Context
+	ctx, n.cancel = context.WithCancel(n.ctx)
+	go proxy.NewTipMonitor(n.proxy, conf.TipOptions(), n.logger).Run(ctx)
+}
+
+// reloader applies changes to the config file to the running networks.
+type reloader struct {
+	mu       *sync.Mutex
+	path     string
+	conf     config.Config
+	networks map[string]*network
+	auth     *auth.Authenticator
+	logger   logrus.FieldLogger
+}
+
+// Reload reads the config file, and replaces the upstreams, proxy options, whitelist and websocket upstreams of each
+// network, and the API keys and their limits. Requests that are in flight, the contents of the cache, and the daily usage of each key are
+// kept. Nothing is changed if the config is invalid or adds or removes a network.
+func (reloader *reloader) Reload() error {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	conf, err := config.Load(reloader.path)
+	if err != nil {
+		return err
+	}
+	if len(conf.Networks) != len(reloader.networks) {
+		return fmt.Errorf("networks cannot be added or removed without a restart")
+	}
+	for _, networkConf := range conf.Networks {
+		if _, ok := reloader.networks[networkConf.Route]; !ok {
+			return fmt.Errorf("networks cannot be added or removed without a restart: %v", networkConf.Route)
+		}
+	}
+	if conf.Port != reloader.conf.Port || conf.Cache != reloader.conf.Cache || conf.Stats != reloader.conf.Stats || conf.Watches != reloader.conf.Watches || conf.Admin != reloader.conf.Admin {
+		reloader.logger.Warningf("changes to the port, cache, stats, watches and admin token only take effect after a restart")
+	}
+
+	for _, networkConf := range conf.Networks {
+		n := reloader.networks[networkConf.Route]
+		n.proxy.Reload(networkConf.ProxyOptions(), networkConf.NewUpstreams()...)
+		n.api.SetWhitelist(networkConf.Whitelist())
+		n.api.SetMaxLogRange(networkConf.MaxLogRange)
+		n.api.SetConfirmations(networkConf.Confirmations)
+		if n.hub != nil {
+			n.hub.SetURLs(networkConf.WebsocketURLs())
+		}
+		n.monitor(networkConf)
+		n.logger.Infof("using %d upstreams", len(networkConf.Upstreams))
+	}
+	reloader.auth.SetOptions(conf.AuthOptions())
+	reloader.logger.Infof("using %d api keys", len(conf.Auth.Keys))
+	reloader.conf.Networks = conf.Networks
+	reloader.conf.Auth = conf.Auth
+	return nil
+}
+
+// tables are the names of the cache table of each network, which are kept so that caches on disk are reused.
+var tables = map[string]string{
+	"btc/mainnet": "btc",
+	"btc/testnet": "btcTest",
+	"zec/mainnet": "zec",
+	"zec/testnet": "zecTest",
+	"bch/mainnet": "bch",
+	"bch/testnet": "bchTest",
+	"eth/mainnet": "eth",
+	"eth/kovan":   "ethKovan",
+	"eth/rinkeby": "ethRinkeby",
+}
+
+// envOrDefault returns the value of the environment variable, or the default value if it is not set.
+func envOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
 }
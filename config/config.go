@@ -0,0 +1,732 @@
+// Package config loads the configuration of mercury from a YAML file. The file lists the networks served by mercury,
+// the upstream nodes of each network and how requests are routed between them, the cache and the port to listen on.
+// Environment variables can be referenced anywhere outside of comments as `${NAME}`, or `${NAME:-default}` to fall
+// back to a default value when the variable is not set.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/renproject/mercury/api"
+	"github.com/renproject/mercury/auth"
+	"github.com/renproject/mercury/cache"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/proxy"
+	"github.com/renproject/mercury/rpc"
+	"github.com/renproject/mercury/stats"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/types/btctypes"
+	"github.com/renproject/mercury/types/ethtypes"
+	"github.com/renproject/mercury/watch"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultPort is the port mercury listens on if none is configured.
+const DefaultPort = "5000"
+
+// networks are the networks that can be configured, by their route.
+var networks = map[string]types.Network{
+	"btc/mainnet": btctypes.BtcMainnet,
+	"btc/testnet": btctypes.BtcTestnet,
+	"zec/mainnet": btctypes.ZecMainnet,
+	"zec/testnet": btctypes.ZecTestnet,
+	"bch/mainnet": btctypes.BchMainnet,
+	"bch/testnet": btctypes.BchTestnet,
+	"eth/mainnet": ethtypes.Mainnet,
+	"eth/kovan":   ethtypes.Kovan,
+	"eth/rinkeby": ethtypes.Rinkeby,
+}
+
+// accessLevels are the access levels that can be given to a method.
+var accessLevels = map[string]types.AccessLevel{
+	"full":   types.FullAccess,
+	"cached": types.CachedAccess,
+	"none":   types.NoAccess,
+}
+
+// envPattern matches references to environment variables, with an optional default value.
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// Config is the configuration of mercury.
+type Config struct {
+	Port  string      `yaml:"port"`
+	Admin AdminConfig `yaml:"admin"`
+	Cache CacheConfig `yaml:"cache"`
+	Stats StatsConfig `yaml:"stats"`
+	Auth  AuthConfig  `yaml:"auth"`
+	// Watches configures the delivery of the webhooks of watches.
+	Watches WatchesConfig `yaml:"watches"`
+	// Infura maps each tag to the Infura key used for requests with that tag. The default key uses the tag "".
+	Infura   map[string]string `yaml:"infura"`
+	Networks []NetworkConfig   `yaml:"networks"`
+}
+
+// AdminConfig configures the admin endpoints, which are disabled if the token is empty.
+type AdminConfig struct {
+	Token string `yaml:"token"`
+}
+
+// CacheConfig configures the storage of cached responses. The limits apply to the cache of each network separately, so
+// the database can hold as many times more as there are networks. Sizes are measured as stored by the database.
+type CacheConfig struct {
+	Backend              string `yaml:"backend"`
+	Path                 string `yaml:"path"`
+	MaxEntriesPerNetwork int    `yaml:"maxEntriesPerNetwork"`
+	MaxBytesPerNetwork   int64  `yaml:"maxBytesPerNetwork"`
+}
+
+// StatsConfig configures the request stats, which are stored alongside the cache. Retention defaults to the retention
+// of `stats.DefaultOptions`.
+type StatsConfig struct {
+	Retention time.Duration `yaml:"retention"`
+}
+
+// WatchesConfig configures how the webhooks of watches are delivered. Unset fields default to the options of
+// `watch.DefaultOptions`.
+type WatchesConfig struct {
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"maxAttempts"`
+	MinBackoff  time.Duration `yaml:"minBackoff"`
+	MaxBackoff  time.Duration `yaml:"maxBackoff"`
+	Workers     int           `yaml:"workers"`
+}
+
+// AuthConfig configures the API keys of callers and their rate limits. Callers are not authenticated or limited if no
+// keys are configured and keys are not required.
+type AuthConfig struct {
+	Required bool `yaml:"required"`
+	// TrustProxy identifies anonymous callers by the X-Forwarded-For header set by a proxy in front of mercury.
+	TrustProxy bool `yaml:"trustProxy"`
+	// Anonymous are the limits of callers without a key, which apply to each IP address.
+	Anonymous []LimitConfig `yaml:"anonymous"`
+	// AnonymousRole is the role of callers without a key: `public`, `internal` or `admin`. It defaults to `public`.
+	AnonymousRole string      `yaml:"anonymousRole"`
+	Keys          []KeyConfig `yaml:"keys"`
+}
+
+// KeyConfig configures an API key. Keys are skipped if the key is empty, so that they can be enabled by an environment
+// variable.
+type KeyConfig struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	// Tag is the Infura tag used for requests with the key. It must be one of the tags of the Infura keys.
+	Tag string `yaml:"tag"`
+	// Role decides the methods the caller can call: `public`, `internal` or `admin`. It defaults to `public`.
+	Role string `yaml:"role"`
+	// Quota is the number of requests allowed per UTC day. Zero means there is no quota.
+	Quota int64 `yaml:"quota"`
+	// Limits are checked in order, and the first that matches a request applies.
+	Limits []LimitConfig `yaml:"limits"`
+}
+
+// LimitConfig configures a rate limit. Empty networks and classes match every network and class of method.
+type LimitConfig struct {
+	Network string `yaml:"network"`
+	// Class is `cached` or `full`, matching the access level of the method.
+	Class string `yaml:"class"`
+	// Rate is the number of requests per second, and Burst is the number of requests that can be made at once.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// NetworkConfig configures a network and its upstreams.
+type NetworkConfig struct {
+	// Route is the route of the network, such as `btc/mainnet` or `eth/kovan`.
+	Route     string                  `yaml:"network"`
+	Strategy  string                  `yaml:"strategy"`
+	Retry     RetryConfig             `yaml:"retry"`
+	Breaker   BreakerConfig           `yaml:"breaker"`
+	Tip       TipConfig               `yaml:"tip"`
+	Events    EventsConfig            `yaml:"events"`
+	Quorum    QuorumConfig            `yaml:"quorum"`
+	Upstreams []UpstreamConfig        `yaml:"upstreams"`
+	Methods   map[string]MethodConfig `yaml:"whitelist"`
+	// MaxLogRange is the number of blocks that callers below the internal role can query logs over in a single
+	// eth_getLogs request. It defaults to `api.DefaultMaxLogRange`.
+	MaxLogRange uint64 `yaml:"maxLogRange"`
+	// Confirmations is the number of blocks that must be mined on top of a block before responses about it, and about
+	// the transactions included in it, are cached indefinitely. It defaults to `api.MinConfirmations`.
+	Confirmations uint64 `yaml:"confirmations"`
+}
+
+// EventsConfig configures how the chain tip of a Bitcoin-family network is followed to stream new blocks and reorgs.
+// Zero values keep the defaults.
+type EventsConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	// Depth is the number of recent blocks that are remembered to describe reorgs.
+	Depth int `yaml:"depth"`
+}
+
+// RetryConfig configures how requests are retried. Zero values keep the defaults. However many attempts are allowed,
+// the API stops retrying a request after 50 seconds, so that it can still respond before the server's write timeout.
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	AttemptTimeout time.Duration `yaml:"attemptTimeout"`
+}
+
+// BreakerConfig configures the circuit breaker of each upstream. Zero values keep the defaults.
+type BreakerConfig struct {
+	FailureThreshold int           `yaml:"failureThreshold"`
+	Cooldown         time.Duration `yaml:"cooldown"`
+}
+
+// TipConfig configures how far behind the best known tip an upstream can be. Zero values keep the defaults of the
+// network.
+type TipConfig struct {
+	MaxLag   uint64        `yaml:"maxLag"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// QuorumConfig configures the quorum needed by methods whose results are used to move funds. Quorums are disabled if
+// the threshold is zero.
+type QuorumConfig struct {
+	Size      int `yaml:"size"`
+	Threshold int `yaml:"threshold"`
+}
+
+// UpstreamConfig configures an upstream node. Ethereum upstreams can use Infura instead of a URL.
+type UpstreamConfig struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Infura   bool   `yaml:"infura"`
+	Weight   int    `yaml:"weight"`
+	// WS is the websocket URL of an Ethereum upstream, which is used for subscriptions. Infura upstreams use the
+	// websocket endpoint of Infura with the default key.
+	WS string `yaml:"ws"`
+	// Optional upstreams are skipped if their URL is empty, so that they can be enabled by an environment variable.
+	Optional bool `yaml:"optional"`
+
+	infuraKeys map[string]string
+}
+
+// MethodConfig overrides how a method is served. Empty values keep the defaults of the method.
+type MethodConfig struct {
+	// Access is `full`, `cached` or `none`.
+	Access string `yaml:"access"`
+	// Cache is `none`, `forever`, or how long responses are cached for, such as `30s`.
+	Cache string `yaml:"cache"`
+	// Role is the role a caller needs to call the method: `public`, `internal` or `admin`.
+	Role string `yaml:"role"`
+}
+
+// Load reads the configuration file at the given path.
+func Load(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("cannot read config: %v", err)
+	}
+	return Parse(data)
+}
+
+// Parse parses and validates the configuration, after expanding references to environment variables in its values.
+func Parse(data []byte) (Config, error) {
+	var document interface{}
+	if err := yaml.UnmarshalStrict(data, &document); err != nil {
+		return Config{}, fmt.Errorf("cannot parse config: %v", err)
+	}
+	document, err := expandEnv(document)
+	if err != nil {
+		return Config{}, err
+	}
+	expanded, err := yaml.Marshal(document)
+	if err != nil {
+		return Config{}, fmt.Errorf("cannot parse config: %v", err)
+	}
+
+	var config Config
+	if err := yaml.UnmarshalStrict(expanded, &config); err != nil {
+		return Config{}, fmt.Errorf("cannot parse config: %v", err)
+	}
+	if config.Port == "" {
+		config.Port = DefaultPort
+	}
+	if config.Stats.Retention == 0 {
+		config.Stats.Retention = stats.DefaultOptions().Retention
+	}
+	config.Auth.Keys = enabledKeys(config.Auth.Keys)
+	for i := range config.Networks {
+		config.Networks[i].Upstreams = enabled(config.Networks[i].Upstreams)
+		if config.Networks[i].MaxLogRange == 0 {
+			config.Networks[i].MaxLogRange = api.DefaultMaxLogRange
+		}
+		if config.Networks[i].Confirmations == 0 {
+			config.Networks[i].Confirmations = api.MinConfirmations
+		}
+		for j := range config.Networks[i].Upstreams {
+			config.Networks[i].Upstreams[j].infuraKeys = config.Infura
+		}
+	}
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Validate returns a `types.ErrList` describing every problem with the configuration, or nil if it is valid.
+func (config Config) Validate() error {
+	errs := types.ErrList{}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch cache.Backend(config.Cache.Backend) {
+	case "", cache.BackendMemory, cache.BackendLevelDB, cache.BackendBadgerDB:
+	default:
+		fail("cache: unknown backend %q", config.Cache.Backend)
+	}
+	if config.Cache.MaxEntriesPerNetwork < 0 || config.Cache.MaxBytesPerNetwork < 0 {
+		fail("cache: limits cannot be negative")
+	}
+	if config.Stats.Retention < 0 {
+		fail("stats: retention cannot be negative")
+	}
+	if config.Watches.Timeout < 0 || config.Watches.MaxAttempts < 0 || config.Watches.MinBackoff < 0 || config.Watches.MaxBackoff < 0 || config.Watches.Workers < 0 {
+		fail("watches: options cannot be negative")
+	}
+	for i, limit := range config.Auth.Anonymous {
+		validateLimit(fmt.Sprintf("auth: anonymous[%d]", i), limit, fail)
+	}
+	if _, ok := parseRole(config.Auth.AnonymousRole); !ok {
+		fail("auth: unknown anonymous role %q, expected public, internal or admin", config.Auth.AnonymousRole)
+	}
+	keyNames, apiKeys := map[string]bool{}, map[string]bool{}
+	for i, key := range config.Auth.Keys {
+		keyPrefix := fmt.Sprintf("auth: keys[%d]", i)
+		if key.Name != "" {
+			keyPrefix = fmt.Sprintf("auth: keys[%d] (%v)", i, key.Name)
+		}
+		if key.Name == "" {
+			fail("%v: missing name", keyPrefix)
+		} else if keyNames[key.Name] {
+			fail("%v: name is used more than once", keyPrefix)
+		}
+		keyNames[key.Name] = true
+		if apiKeys[key.Key] {
+			fail("%v: key is used more than once", keyPrefix)
+		}
+		apiKeys[key.Key] = true
+		if _, ok := config.Infura[key.Tag]; key.Tag != "" && !ok {
+			fail("%v: tag %q does not have an infura key", keyPrefix, key.Tag)
+		}
+		if _, ok := parseRole(key.Role); !ok {
+			fail("%v: unknown role %q, expected public, internal or admin", keyPrefix, key.Role)
+		}
+		if key.Quota < 0 {
+			fail("%v: quota cannot be negative", keyPrefix)
+		}
+		for j, limit := range key.Limits {
+			validateLimit(fmt.Sprintf("%v: limits[%d]", keyPrefix, j), limit, fail)
+		}
+	}
+	if len(config.Networks) == 0 {
+		fail("networks: at least one network must be configured")
+	}
+
+	seen := map[string]bool{}
+	for i, network := range config.Networks {
+		prefix := fmt.Sprintf("networks[%d]", i)
+		if network.Route != "" {
+			prefix = fmt.Sprintf("networks[%d] (%v)", i, network.Route)
+		}
+		if _, ok := networks[network.Route]; !ok {
+			fail("%v: unknown network %q, expected one of %v", prefix, network.Route, strings.Join(routes(), ", "))
+		}
+		if seen[network.Route] {
+			fail("%v: network is configured more than once", prefix)
+		}
+		seen[network.Route] = true
+
+		if _, ok := proxy.NewStrategy(network.Strategy); !ok {
+			fail("%v: unknown strategy %q", prefix, network.Strategy)
+		}
+		if network.Quorum.Threshold < 0 || network.Quorum.Size < 0 {
+			fail("%v: quorum cannot be negative", prefix)
+		}
+		if network.Quorum.Size > 0 && network.Quorum.Threshold > network.Quorum.Size {
+			fail("%v: quorum threshold %d is larger than its size %d", prefix, network.Quorum.Threshold, network.Quorum.Size)
+		}
+		if network.Quorum.Threshold > len(network.Upstreams) {
+			fail("%v: quorum threshold %d is larger than the number of upstreams", prefix, network.Quorum.Threshold)
+		}
+
+		if len(network.Upstreams) == 0 {
+			fail("%v: at least one upstream must be configured", prefix)
+		}
+		names := map[string]bool{}
+		for j, upstream := range network.Upstreams {
+			upstreamPrefix := fmt.Sprintf("%v: upstreams[%d]", prefix, j)
+			if upstream.Name == "" {
+				fail("%v: missing name", upstreamPrefix)
+			} else if names[upstream.Name] {
+				fail("%v: name %q is used more than once", upstreamPrefix, upstream.Name)
+			}
+			names[upstream.Name] = true
+
+			switch {
+			case upstream.URL == "" && !upstream.Infura:
+				fail("%v: missing url", upstreamPrefix)
+			case upstream.URL != "" && upstream.Infura:
+				fail("%v: url and infura cannot both be set", upstreamPrefix)
+			case upstream.Infura && !strings.HasPrefix(network.Route, "eth/"):
+				fail("%v: infura can only be used for ethereum networks", upstreamPrefix)
+			case upstream.Infura && config.Infura[""] == "":
+				fail("%v: infura is missing the default key, which uses the tag \"\"", upstreamPrefix)
+			}
+			if upstream.Weight < 0 {
+				fail("%v: weight cannot be negative", upstreamPrefix)
+			}
+			switch {
+			case upstream.WS == "":
+			case !strings.HasPrefix(network.Route, "eth/"):
+				fail("%v: ws can only be used for ethereum networks", upstreamPrefix)
+			case upstream.Infura:
+				fail("%v: ws and infura cannot both be set", upstreamPrefix)
+			case !strings.HasPrefix(upstream.WS, "ws://") && !strings.HasPrefix(upstream.WS, "wss://"):
+				fail("%v: ws must be a ws:// or wss:// url", upstreamPrefix)
+			}
+		}
+
+		for method, override := range network.Methods {
+			methodPrefix := fmt.Sprintf("%v: whitelist: %v", prefix, method)
+			if _, ok := accessLevels[override.Access]; !ok && override.Access != "" {
+				fail("%v: unknown access %q, expected full, cached or none", methodPrefix, override.Access)
+			}
+			if _, err := parsePolicy(override.Cache); err != nil {
+				fail("%v: %v", methodPrefix, err)
+			}
+			if _, ok := parseRole(override.Role); !ok {
+				fail("%v: unknown role %q, expected public, internal or admin", methodPrefix, override.Role)
+			}
+			if route, ok := networks[network.Route]; ok && override.Access == "" {
+				if _, ok := api.DefaultWhitelist(route)[method]; !ok {
+					fail("%v: methods that are not whitelisted by default must be given an access level", methodPrefix)
+				}
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateLimit checks the rate limit, calling fail with each problem.
+func validateLimit(prefix string, limit LimitConfig, fail func(format string, args ...interface{})) {
+	if _, ok := networks[limit.Network]; !ok && limit.Network != "" {
+		fail("%v: unknown network %q", prefix, limit.Network)
+	}
+	if limit.Class != "" && limit.Class != auth.ClassCached && limit.Class != auth.ClassFull {
+		fail("%v: unknown class %q, expected cached or full", prefix, limit.Class)
+	}
+	if limit.Rate <= 0 {
+		fail("%v: rate must be positive", prefix)
+	}
+	if limit.Burst < 0 {
+		fail("%v: burst cannot be negative", prefix)
+	}
+}
+
+// AuthOptions returns the options of the Authenticator.
+func (config Config) AuthOptions() auth.Options {
+	options := auth.Options{
+		Required:   config.Auth.Required,
+		TrustProxy: config.Auth.TrustProxy,
+		Anonymous:  limits(config.Auth.Anonymous),
+		Keys:       make([]auth.Key, len(config.Auth.Keys)),
+	}
+	options.AnonymousRole, _ = parseRole(config.Auth.AnonymousRole)
+	for i, key := range config.Auth.Keys {
+		role, _ := parseRole(key.Role)
+		options.Keys[i] = auth.Key{
+			Name:       key.Name,
+			Key:        key.Key,
+			Tag:        key.Tag,
+			Role:       role,
+			Limits:     limits(key.Limits),
+			DailyQuota: key.Quota,
+		}
+	}
+	return options
+}
+
+func limits(configs []LimitConfig) []auth.Limit {
+	limits := make([]auth.Limit, len(configs))
+	for i, limit := range configs {
+		limits[i] = auth.Limit{Network: limit.Network, Class: limit.Class, Rate: limit.Rate, Burst: limit.Burst}
+	}
+	return limits
+}
+
+// StatsOptions returns the options of the request stats store.
+func (config Config) StatsOptions() stats.Options {
+	options := stats.DefaultOptions()
+	options.Retention = config.Stats.Retention
+	return options
+}
+
+// WatchOptions returns the options of the delivery of webhooks.
+func (config Config) WatchOptions() watch.Options {
+	options := watch.DefaultOptions()
+	if config.Watches.Timeout > 0 {
+		options.Timeout = config.Watches.Timeout
+	}
+	if config.Watches.MaxAttempts > 0 {
+		options.MaxAttempts = config.Watches.MaxAttempts
+	}
+	if config.Watches.MinBackoff > 0 {
+		options.MinBackoff = config.Watches.MinBackoff
+	}
+	if config.Watches.MaxBackoff > 0 {
+		options.MaxBackoff = config.Watches.MaxBackoff
+	}
+	if config.Watches.Workers > 0 {
+		options.Workers = config.Watches.Workers
+	}
+	return options
+}
+
+// Network returns the network. It must only be called on a valid configuration.
+func (network NetworkConfig) Network() types.Network {
+	return networks[network.Route]
+}
+
+// ProxyOptions returns the options of the proxy of the network. It must only be called on a valid configuration.
+func (network NetworkConfig) ProxyOptions() proxy.Options {
+	options := proxy.DefaultOptions()
+	options.Strategy, _ = proxy.NewStrategy(network.Strategy)
+	if network.Retry.MaxAttempts > 0 {
+		options.Retry.MaxAttempts = network.Retry.MaxAttempts
+	}
+	if network.Retry.AttemptTimeout > 0 {
+		options.Retry.AttemptTimeout = network.Retry.AttemptTimeout
+	}
+	if network.Breaker.FailureThreshold > 0 {
+		options.Breaker.FailureThreshold = network.Breaker.FailureThreshold
+	}
+	if network.Breaker.Cooldown > 0 {
+		options.Breaker.Cooldown = network.Breaker.Cooldown
+	}
+	if network.Quorum.Threshold > 0 {
+		options.Quorum = api.QuorumMethods(network.Network(), network.Quorum.Size, network.Quorum.Threshold)
+	}
+	options.Validator = proxy.NewTxValidator(network.Network())
+	return options
+}
+
+// NewProxy returns a proxy for the upstreams of the network. It must only be called on a valid configuration.
+func (network NetworkConfig) NewProxy() *proxy.Proxy {
+	return proxy.NewProxyWithOptions(network.ProxyOptions(), network.NewUpstreams()...)
+}
+
+// NewUpstreams returns the upstreams of the network. It must only be called on a valid configuration.
+func (network NetworkConfig) NewUpstreams() []*proxy.Upstream {
+	upstreams := make([]*proxy.Upstream, len(network.Upstreams))
+	for i, upstream := range network.Upstreams {
+		weight := upstream.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		upstreams[i] = proxy.NewUpstream(upstream.Name, upstream.Client(network.Network()), weight)
+		upstreams[i].URL = upstream.URL
+	}
+	return upstreams
+}
+
+// WebsocketURLs returns the websocket URLs of the upstreams of the network which can be used for subscriptions. It must
+// only be called on a valid configuration.
+func (network NetworkConfig) WebsocketURLs() []string {
+	urls := []string{}
+	for _, upstream := range network.Upstreams {
+		switch {
+		case upstream.WS != "":
+			urls = append(urls, upstream.WS)
+		case upstream.Infura:
+			urls = append(urls, rpc.InfuraWebsocketURL(network.Network().(ethtypes.Network), upstream.infuraKeys[""]))
+		}
+	}
+	return urls
+}
+
+// TipOptions returns how the chain tips of the upstreams of the network are monitored. It must only be called on a
+// valid configuration.
+func (network NetworkConfig) TipOptions() proxy.TipOptions {
+	options := api.TipOptions(network.Network())
+	if network.Tip.MaxLag > 0 {
+		options.MaxLag = network.Tip.MaxLag
+	}
+	if network.Tip.Interval > 0 {
+		options.Interval = network.Tip.Interval
+	}
+	return options
+}
+
+// FollowerOptions returns how the chain tip of the network is followed to stream its events.
+func (network NetworkConfig) FollowerOptions() chain.Options {
+	options := chain.DefaultOptions()
+	if network.Events.Interval > 0 {
+		options.Interval = network.Events.Interval
+	}
+	if network.Events.Depth > 0 {
+		options.Depth = network.Events.Depth
+	}
+	return options
+}
+
+// Whitelist returns the default whitelist of the network with the overrides applied. It must only be called on a
+// valid configuration.
+func (network NetworkConfig) Whitelist() api.Whitelist {
+	defaults := api.DefaultWhitelist(network.Network())
+	overrides := make(api.Whitelist, len(network.Methods))
+	for name, override := range network.Methods {
+		method := defaults[name]
+		if override.Access != "" {
+			method.Level = accessLevels[override.Access]
+		}
+		if override.Cache != "" {
+			method.Policy, _ = parsePolicy(override.Cache)
+		}
+		if override.Role != "" {
+			method.Role, _ = parseRole(override.Role)
+		}
+		overrides[name] = method
+	}
+	return defaults.Merge(overrides)
+}
+
+// Client returns a client for the upstream. It must only be called on a valid configuration.
+func (upstream UpstreamConfig) Client(network types.Network) rpc.Client {
+	if upstream.Infura {
+		return rpc.NewInfuraClient(network.(ethtypes.Network), upstream.infuraKeys)
+	}
+	return rpc.NewClient(upstream.URL, upstream.Username, upstream.Password)
+}
+
+// parseRole parses a role. An empty role is the public role.
+func parseRole(role string) (types.Role, bool) {
+	if role == "" {
+		return types.RolePublic, true
+	}
+	return types.ParseRole(role)
+}
+
+// parsePolicy parses a cache policy. An empty policy is valid, and keeps the default.
+func parsePolicy(policy string) (cache.Policy, error) {
+	switch policy {
+	case "", "none":
+		return cache.NoCache(), nil
+	case "forever":
+		return cache.CacheForever(), nil
+	}
+	ttl, err := time.ParseDuration(policy)
+	if err != nil || ttl <= 0 {
+		return cache.Policy{}, fmt.Errorf("invalid cache policy %q, expected none, forever or a duration", policy)
+	}
+	return cache.CacheFor(ttl), nil
+}
+
+// expandEnv replaces references to environment variables in the string values of the parsed config, so that the
+// values of the variables are never parsed as YAML and can contain any character. A value that is a single reference
+// becomes a number or boolean if its expansion is written as one, so that those fields can be set from the environment
+// too. It returns an error listing the variables that are not set and have no default.
+func expandEnv(document interface{}) (interface{}, error) {
+	missing := []string{}
+	expand := func(ref string) string {
+		match := envPattern.FindStringSubmatch(ref)
+		if value, ok := os.LookupEnv(match[1]); ok {
+			return value
+		}
+		if match[2] != "" {
+			return match[3]
+		}
+		missing = append(missing, match[1])
+		return ""
+	}
+
+	var walk func(value interface{}) interface{}
+	walk = func(value interface{}) interface{} {
+		switch value := value.(type) {
+		case map[interface{}]interface{}:
+			for key, elem := range value {
+				value[key] = walk(elem)
+			}
+		case []interface{}:
+			for i, elem := range value {
+				value[i] = walk(elem)
+			}
+		case string:
+			expanded := envPattern.ReplaceAllStringFunc(value, expand)
+			if envPattern.FindString(value) == value {
+				return scalar(expanded)
+			}
+			return expanded
+		}
+		return value
+	}
+	document = walk(document)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables are not set: %v", strings.Join(missing, ", "))
+	}
+	return document, nil
+}
+
+// scalar returns the number or boolean that the text is written as, or otherwise the text itself. Texts that YAML
+// would read differently from how they are written, such as numbers with leading zeros, are kept as text. An empty text
+// is null, as an empty value in the config file would be.
+func scalar(text string) interface{} {
+	if text == "" {
+		return nil
+	}
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(text), &value); err != nil {
+		return text
+	}
+	switch value.(type) {
+	case int, int64, uint64, float64, bool:
+		if written, err := yaml.Marshal(value); err == nil && strings.TrimSpace(string(written)) == text {
+			return value
+		}
+	}
+	return text
+}
+
+// enabled returns the upstreams, without the optional upstreams that have no URL.
+func enabled(upstreams []UpstreamConfig) []UpstreamConfig {
+	filtered := make([]UpstreamConfig, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if upstream.Optional && upstream.URL == "" && !upstream.Infura {
+			continue
+		}
+		filtered = append(filtered, upstream)
+	}
+	return filtered
+}
+
+// enabledKeys returns the API keys, without the keys that are empty.
+func enabledKeys(keys []KeyConfig) []KeyConfig {
+	filtered := make([]KeyConfig, 0, len(keys))
+	for _, key := range keys {
+		if key.Key != "" {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered
+}
+
+// routes returns the routes of the networks that can be configured.
+func routes() []string {
+	routes := make([]string, 0, len(networks))
+	for route := range networks {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	return routes
+}
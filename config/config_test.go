@@ -0,0 +1,471 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/config"
+
+	"github.com/renproject/mercury/auth"
+	"github.com/renproject/mercury/cache"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/stats"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/types/btctypes"
+	"github.com/renproject/mercury/types/ethtypes"
+	"github.com/renproject/mercury/watch"
+)
+
+var _ = Describe("Config", func() {
+	Context("when parsing a valid config", func() {
+		It("should read every network and its upstreams", func() {
+			conf, err := Parse([]byte(`
+port: "8080"
+cache:
+  backend: leveldb
+  path: /tmp/mercury
+  maxEntriesPerNetwork: 1000
+stats:
+  retention: 168h
+watches:
+  maxAttempts: 5
+  workers: 4
+infura:
+  "": default-key
+  darknode: darknode-key
+networks:
+  - network: btc/testnet
+    strategy: round-robin
+    retry:
+      maxAttempts: 4
+      attemptTimeout: 5s
+    breaker:
+      failureThreshold: 10
+    events:
+      depth: 20
+    upstreams:
+      - name: primary
+        url: http://127.0.0.1:18332
+        username: user
+        password: pass
+      - name: backup
+        url: http://127.0.0.1:18333
+        weight: 3
+  - network: eth/kovan
+    upstreams:
+      - name: infura
+        infura: true
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Port).To(Equal("8080"))
+			Expect(conf.Cache).To(Equal(CacheConfig{Backend: "leveldb", Path: "/tmp/mercury", MaxEntriesPerNetwork: 1000}))
+			Expect(conf.StatsOptions().Retention).To(Equal(7 * 24 * time.Hour))
+			Expect(conf.WatchOptions().MaxAttempts).To(Equal(5))
+			Expect(conf.WatchOptions().Workers).To(Equal(4))
+			Expect(conf.WatchOptions().Timeout).To(Equal(watch.DefaultOptions().Timeout))
+			Expect(conf.Networks).To(HaveLen(2))
+
+			btc := conf.Networks[0]
+			Expect(btc.Network()).To(Equal(btctypes.BtcTestnet))
+			Expect(btc.Upstreams).To(HaveLen(2))
+			Expect(btc.Upstreams[0].Username).To(Equal("user"))
+			Expect(btc.Upstreams[1].Weight).To(Equal(3))
+
+			options := btc.ProxyOptions()
+			Expect(options.Retry.MaxAttempts).To(Equal(4))
+			Expect(options.Retry.AttemptTimeout).To(Equal(5 * time.Second))
+			Expect(options.Breaker.FailureThreshold).To(Equal(10))
+			Expect(options.Quorum).To(BeEmpty())
+			Expect(btc.FollowerOptions().Depth).To(Equal(20))
+			Expect(btc.FollowerOptions().Interval).To(Equal(chain.DefaultOptions().Interval))
+
+			proxy := btc.NewProxy()
+			Expect(proxy.Upstreams()).To(HaveLen(2))
+			Expect(proxy.Upstreams()[1].Name).To(Equal("backup"))
+
+			eth := conf.Networks[1]
+			Expect(eth.Network()).To(Equal(ethtypes.Kovan))
+			Expect(eth.Upstreams[0].Infura).To(BeTrue())
+		})
+
+		It("should apply defaults", func() {
+			conf, err := Parse([]byte(`
+networks:
+  - network: btc/mainnet
+    upstreams:
+      - name: node
+        url: http://127.0.0.1:8332
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Port).To(Equal(DefaultPort))
+			Expect(conf.StatsOptions()).To(Equal(stats.DefaultOptions()))
+			Expect(conf.WatchOptions()).To(Equal(watch.DefaultOptions()))
+			Expect(conf.Networks[0].NewProxy().Upstreams()[0].Weight).To(Equal(1))
+			Expect(conf.Networks[0].TipOptions().MaxLag).To(Equal(uint64(1)))
+			Expect(conf.Networks[0].FollowerOptions()).To(Equal(chain.DefaultOptions()))
+		})
+
+		It("should apply whitelist overrides to the default whitelist", func() {
+			conf, err := Parse([]byte(`
+networks:
+  - network: eth/mainnet
+    whitelist:
+      eth_getLogs:
+        access: cached
+        cache: 30s
+        role: internal
+      eth_gasPrice:
+        access: none
+      eth_syncing:
+        access: full
+    upstreams:
+      - name: node
+        url: http://127.0.0.1:8545
+`))
+			Expect(err).ToNot(HaveOccurred())
+			whitelist := conf.Networks[0].Whitelist()
+			Expect(whitelist["eth_getLogs"].Level).To(Equal(types.CachedAccess))
+			Expect(whitelist["eth_getLogs"].Policy).To(Equal(cache.CacheFor(30 * time.Second)))
+			Expect(whitelist["eth_getLogs"].Role).To(Equal(types.RoleInternal))
+			Expect(whitelist["eth_sendRawTransaction"].Role).To(Equal(types.RoleInternal))
+			Expect(whitelist["eth_blockNumber"].Role).To(Equal(types.RolePublic))
+			Expect(whitelist["eth_gasPrice"].Level).To(Equal(types.NoAccess))
+			Expect(whitelist["eth_syncing"].Level).To(Equal(types.FullAccess))
+			Expect(whitelist["eth_blockNumber"].Level).To(Equal(types.FullAccess))
+		})
+
+		It("should list the websocket urls of ethereum upstreams", func() {
+			conf, err := Parse([]byte(`
+infura:
+  "": default-key
+networks:
+  - network: eth/kovan
+    upstreams:
+      - {name: local, url: "http://local:8545", ws: "ws://local:8546"}
+      - {name: http, url: "http://node:8545"}
+      - {name: infura, infura: true}
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Networks[0].WebsocketURLs()).To(Equal([]string{
+				"ws://local:8546",
+				"wss://kovan.infura.io/ws/v3/default-key",
+			}))
+		})
+
+		It("should reject websocket urls that cannot be used", func() {
+			_, err := Parse([]byte(`
+infura:
+  "": default-key
+networks:
+  - network: btc/mainnet
+    upstreams:
+      - {name: node, url: "http://node", ws: "ws://node"}
+  - network: eth/kovan
+    upstreams:
+      - {name: local, url: "http://local:8545", ws: "http://local:8546"}
+      - {name: infura, infura: true, ws: "wss://node"}
+`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("networks[0] (btc/mainnet): upstreams[0]: ws can only be used for ethereum networks"))
+			Expect(err.Error()).To(ContainSubstring("networks[1] (eth/kovan): upstreams[0]: ws must be a ws:// or wss:// url"))
+			Expect(err.Error()).To(ContainSubstring("networks[1] (eth/kovan): upstreams[1]: ws and infura cannot both be set"))
+		})
+
+		It("should set the quorum of methods that move funds", func() {
+			conf, err := Parse([]byte(`
+networks:
+  - network: btc/mainnet
+    quorum:
+      size: 3
+      threshold: 2
+    upstreams:
+      - {name: a, url: "http://a"}
+      - {name: b, url: "http://b"}
+      - {name: c, url: "http://c"}
+`))
+			Expect(err).ToNot(HaveOccurred())
+			quorum := conf.Networks[0].ProxyOptions().Quorum
+			Expect(quorum).ToNot(BeEmpty())
+			for _, q := range quorum {
+				Expect(q.Size).To(Equal(3))
+				Expect(q.Threshold).To(Equal(2))
+			}
+		})
+	})
+
+	Context("when configuring api keys", func() {
+		It("should convert the keys and limits, skipping empty keys", func() {
+			conf, err := Parse([]byte(`
+auth:
+  required: true
+  anonymousRole: internal
+  anonymous:
+    - {class: full, rate: 2, burst: 5}
+  keys:
+    - name: darknode
+      key: secret
+      tag: darknode
+      role: admin
+      quota: 1000
+      limits:
+        - {network: eth/mainnet, class: full, rate: 5}
+    - name: disabled
+      key: ""
+infura:
+  "": default-key
+  darknode: darknode-key
+networks:
+  - network: eth/mainnet
+    upstreams:
+      - name: infura
+        infura: true
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.AuthOptions()).To(Equal(auth.Options{
+				Required:      true,
+				Anonymous:     []auth.Limit{{Class: auth.ClassFull, Rate: 2, Burst: 5}},
+				AnonymousRole: types.RoleInternal,
+				Keys: []auth.Key{{
+					Name:       "darknode",
+					Key:        "secret",
+					Tag:        "darknode",
+					Role:       types.RoleAdmin,
+					Limits:     []auth.Limit{{Network: "eth/mainnet", Class: auth.ClassFull, Rate: 5}},
+					DailyQuota: 1000,
+				}},
+			}))
+		})
+
+		It("should list every problem with the keys", func() {
+			_, err := Parse([]byte(`
+auth:
+  anonymousRole: root
+  anonymous:
+    - {network: doge/mainnet, rate: 0}
+  keys:
+    - {name: a, key: one, tag: unknown, role: owner, quota: -1}
+    - {name: a, key: one, limits: [{class: archive, rate: 1, burst: -1}]}
+networks:
+  - network: btc/mainnet
+    upstreams:
+      - {name: node, url: "http://node"}
+`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`auth: anonymous[0]: unknown network "doge/mainnet"`))
+			Expect(err.Error()).To(ContainSubstring("auth: anonymous[0]: rate must be positive"))
+			Expect(err.Error()).To(ContainSubstring(`auth: keys[0] (a): tag "unknown" does not have an infura key`))
+			Expect(err.Error()).To(ContainSubstring(`auth: unknown anonymous role "root"`))
+			Expect(err.Error()).To(ContainSubstring(`auth: keys[0] (a): unknown role "owner"`))
+			Expect(err.Error()).To(ContainSubstring("auth: keys[0] (a): quota cannot be negative"))
+			Expect(err.Error()).To(ContainSubstring("auth: keys[1] (a): name is used more than once"))
+			Expect(err.Error()).To(ContainSubstring("auth: keys[1] (a): key is used more than once"))
+			Expect(err.Error()).To(ContainSubstring(`auth: keys[1] (a): limits[0]: unknown class "archive"`))
+			Expect(err.Error()).To(ContainSubstring("auth: keys[1] (a): limits[0]: burst cannot be negative"))
+		})
+	})
+
+	Context("when the config references environment variables", func() {
+		BeforeEach(func() {
+			os.Setenv("MERCURY_TEST_URL", "http://127.0.0.1:8332")
+		})
+
+		AfterEach(func() {
+			os.Unsetenv("MERCURY_TEST_URL")
+		})
+
+		It("should expand variables and defaults", func() {
+			conf, err := Parse([]byte(`
+# Comments are not expanded: ${MERCURY_TEST_MISSING}
+port: ${MERCURY_TEST_PORT:-6000}
+networks:
+  - network: btc/mainnet
+    upstreams:
+      - name: node
+        url: ${MERCURY_TEST_URL}
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Port).To(Equal("6000"))
+			Expect(conf.Networks[0].Upstreams[0].URL).To(Equal("http://127.0.0.1:8332"))
+		})
+
+		It("should not parse the values of variables as YAML", func() {
+			os.Setenv("MERCURY_TEST_PASSWORD", `p#ss: "word' *x &y !z`)
+			defer os.Unsetenv("MERCURY_TEST_PASSWORD")
+			os.Setenv("MERCURY_TEST_USERNAME", "0123")
+			defer os.Unsetenv("MERCURY_TEST_USERNAME")
+
+			conf, err := Parse([]byte(`
+cache:
+  maxEntriesPerNetwork: ${MERCURY_TEST_MAX_ENTRIES:-100}
+auth:
+  required: ${MERCURY_TEST_REQUIRED:-true}
+networks:
+  - network: btc/mainnet
+    upstreams:
+      - name: node
+        url: ${MERCURY_TEST_URL}/wallet
+        username: ${MERCURY_TEST_USERNAME}
+        password: ${MERCURY_TEST_PASSWORD}
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Cache.MaxEntriesPerNetwork).To(Equal(100))
+			Expect(conf.Auth.Required).To(BeTrue())
+			Expect(conf.Networks[0].Upstreams[0].URL).To(Equal("http://127.0.0.1:8332/wallet"))
+			Expect(conf.Networks[0].Upstreams[0].Username).To(Equal("0123"))
+			Expect(conf.Networks[0].Upstreams[0].Password).To(Equal(`p#ss: "word' *x &y !z`))
+		})
+
+		It("should skip optional upstreams without a url", func() {
+			conf, err := Parse([]byte(`
+networks:
+  - network: btc/mainnet
+    upstreams:
+      - name: local
+        url: ${MERCURY_TEST_LOCAL_URL:-}
+        optional: true
+      - name: node
+        url: ${MERCURY_TEST_URL}
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Networks[0].Upstreams).To(HaveLen(1))
+			Expect(conf.Networks[0].Upstreams[0].Name).To(Equal("node"))
+		})
+
+		It("should return an error if a variable is not set", func() {
+			_, err := Parse([]byte(`
+networks:
+  - network: btc/mainnet
+    upstreams:
+      - name: node
+        url: ${MERCURY_TEST_MISSING}
+`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("MERCURY_TEST_MISSING"))
+		})
+	})
+
+	Context("when parsing an invalid config", func() {
+		It("should reject unknown fields", func() {
+			_, err := Parse([]byte(`
+networks:
+  - network: btc/mainnet
+    upstream:
+      - name: node
+`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("upstream"))
+		})
+
+		It("should list every problem", func() {
+			_, err := Parse([]byte(`
+cache:
+  backend: redis
+stats:
+  retention: -1h
+watches:
+  timeout: -1s
+networks:
+  - network: doge/mainnet
+    strategy: random
+    upstreams:
+      - name: node
+  - network: btc/mainnet
+    quorum:
+      threshold: 2
+    whitelist:
+      getblockcount:
+        access: some
+        cache: sometimes
+        role: everyone
+      getnewaddress:
+        cache: forever
+    upstreams:
+      - {name: a, url: "http://a", infura: true}
+      - {name: a, url: "http://b"}
+`))
+			Expect(err).To(HaveOccurred())
+			errs, ok := err.(types.ErrList)
+			Expect(ok).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring(`cache: unknown backend "redis"`))
+			Expect(err.Error()).To(ContainSubstring("stats: retention cannot be negative"))
+			Expect(err.Error()).To(ContainSubstring("watches: options cannot be negative"))
+			Expect(err.Error()).To(ContainSubstring(`networks[0] (doge/mainnet): unknown network "doge/mainnet"`))
+			Expect(err.Error()).To(ContainSubstring(`unknown strategy "random"`))
+			Expect(err.Error()).To(ContainSubstring("networks[0] (doge/mainnet): upstreams[0]: missing url"))
+			Expect(err.Error()).To(ContainSubstring("url and infura cannot both be set"))
+			Expect(err.Error()).To(ContainSubstring(`name "a" is used more than once`))
+			Expect(err.Error()).To(ContainSubstring(`whitelist: getblockcount: unknown access "some"`))
+			Expect(err.Error()).To(ContainSubstring(`whitelist: getblockcount: invalid cache policy "sometimes"`))
+			Expect(err.Error()).To(ContainSubstring(`whitelist: getblockcount: unknown role "everyone"`))
+			Expect(err.Error()).To(ContainSubstring("whitelist: getnewaddress: methods that are not whitelisted by default must be given an access level"))
+			Expect(len(errs)).To(BeNumerically(">=", 9))
+		})
+
+		It("should require at least one network", func() {
+			_, err := Parse([]byte(`port: "5000"`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("at least one network"))
+		})
+
+		It("should require a default infura key", func() {
+			_, err := Parse([]byte(`
+infura:
+  darknode: key
+networks:
+  - network: eth/mainnet
+    upstreams:
+      - name: infura
+        infura: true
+`))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("infura is missing the default key"))
+		})
+	})
+
+	Context("when loading a file", func() {
+		It("should parse its contents", func() {
+			dir, err := ioutil.TempDir("", "mercury")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "mercury.yml")
+			Expect(ioutil.WriteFile(path, []byte(`
+networks:
+  - network: zec/testnet
+    upstreams:
+      - name: node
+        url: http://127.0.0.1:18232
+`), 0600)).To(Succeed())
+
+			conf, err := Load(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Networks[0].Network()).To(Equal(btctypes.ZecTestnet))
+		})
+
+		It("should accept the config shipped with mercury", func() {
+			vars := []string{
+				"INFURA_KEY_DEFAULT",
+				"BITCOIN_MAINNET_RPC_URL", "BITCOIN_TESTNET_RPC_URL",
+				"ZCASH_MAINNET_RPC_URL", "ZCASH_TESTNET_RPC_URL",
+				"BCASH_MAINNET_RPC_URL", "BCASH_TESTNET_RPC_URL",
+			}
+			for _, name := range vars {
+				os.Setenv(name, "http://127.0.0.1")
+				defer os.Unsetenv(name)
+			}
+
+			conf, err := Load("../cmd/mercury/mercury.yml")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(conf.Networks).To(HaveLen(9))
+		})
+
+		It("should return an error if the file does not exist", func() {
+			_, err := Load(filepath.Join(os.TempDir(), "mercury-missing.yml"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
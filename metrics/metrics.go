@@ -0,0 +1,138 @@
+// Package metrics records metrics about the requests served by mercury, and exposes them in the Prometheus text
+// exposition format.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// StatusOK is the status of requests that were answered with a result rather than an error. Other requests have the
+// JSON-RPC error code of their response as their status.
+const StatusOK = "ok"
+
+// Results of requests to the cache.
+const (
+	CacheHit       = "hit"
+	CacheMiss      = "miss"
+	CacheCoalesced = "coalesced"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets of the upstream latency histogram.
+var LatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Metrics are the metrics exposed by mercury. Requests and upstream attempts are recorded as they happen, while the
+// metrics of the caches and upstreams are maintained by the caches and proxies themselves, and are read by the
+// collector added using OnCollect whenever the metrics are scraped.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	// Requests counts the JSON-RPC requests served, by network, method and status. Batch requests count each of their
+	// elements.
+	Requests *prometheus.CounterVec
+	// InFlight is the number of HTTP requests being served, by network.
+	InFlight *prometheus.GaugeVec
+
+	// UpstreamLatency is the duration of requests to each upstream, by network and upstream.
+	UpstreamLatency *prometheus.HistogramVec
+	// UpstreamErrors counts the failed requests to each upstream, by network and upstream.
+	UpstreamErrors *prometheus.CounterVec
+
+	// CacheRequests counts the requests to the cache, by network and result.
+	CacheRequests *prometheus.Desc
+	// CacheEntries and CacheBytes describe the contents of the cache of each network.
+	CacheEntries *prometheus.Desc
+	CacheBytes   *prometheus.Desc
+
+	// UpstreamBreaker is one for the current state of the circuit breaker of each upstream, by network, upstream and
+	// state, and zero for the other states.
+	UpstreamBreaker *prometheus.Desc
+	// UpstreamHealthy is one if the upstream can be used, and zero if its breaker is open or it is lagging.
+	UpstreamHealthy *prometheus.Desc
+	// UpstreamOutstanding is the number of requests being handled by each upstream.
+	UpstreamOutstanding *prometheus.Desc
+	// UpstreamLag is the number of blocks each upstream is behind the best known tip.
+	UpstreamLag *prometheus.Desc
+}
+
+// New returns a new set of metrics, in a registry of their own.
+func New() *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mercury_requests_total",
+			Help: "JSON-RPC requests served, by network, method and status.",
+		}, []string{"network", "method", "status"}),
+		InFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mercury_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}, []string{"network"}),
+
+		UpstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mercury_upstream_request_duration_seconds",
+			Help:    "Duration of requests to upstreams.",
+			Buckets: LatencyBuckets,
+		}, []string{"network", "upstream"}),
+		UpstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mercury_upstream_errors_total",
+			Help: "Failed requests to upstreams.",
+		}, []string{"network", "upstream"}),
+
+		CacheRequests: prometheus.NewDesc("mercury_cache_requests_total",
+			"Requests to the cache, by result: hit, miss, or coalesced with a request already being fetched.", []string{"network", "result"}, nil),
+		CacheEntries: prometheus.NewDesc("mercury_cache_entries",
+			"Responses stored in the cache.", []string{"network"}, nil),
+		CacheBytes: prometheus.NewDesc("mercury_cache_bytes",
+			"Size of the responses stored in the cache.", []string{"network"}, nil),
+
+		UpstreamBreaker: prometheus.NewDesc("mercury_upstream_breaker_state",
+			"State of the circuit breaker of each upstream.", []string{"network", "upstream", "state"}, nil),
+		UpstreamHealthy: prometheus.NewDesc("mercury_upstream_healthy",
+			"Whether the upstream can be used.", []string{"network", "upstream"}, nil),
+		UpstreamOutstanding: prometheus.NewDesc("mercury_upstream_outstanding_requests",
+			"Requests currently being handled by the upstream.", []string{"network", "upstream"}, nil),
+		UpstreamLag: prometheus.NewDesc("mercury_upstream_lag_blocks",
+			"Blocks the upstream is behind the best known tip.", []string{"network", "upstream"}, nil),
+	}
+	metrics.registry.MustRegister(metrics.Requests, metrics.InFlight, metrics.UpstreamLatency, metrics.UpstreamErrors)
+	return metrics
+}
+
+// OnCollect registers a collector for the metrics of the caches and upstreams, which calls the function whenever the
+// metrics are scraped. The function sends the current value of each of their series, using
+// `prometheus.MustNewConstMetric`. It must only be called once.
+func (metrics *Metrics) OnCollect(collect func(ch chan<- prometheus.Metric)) {
+	metrics.registry.MustRegister(collector{
+		descs: []*prometheus.Desc{
+			metrics.CacheRequests, metrics.CacheEntries, metrics.CacheBytes,
+			metrics.UpstreamBreaker, metrics.UpstreamHealthy, metrics.UpstreamOutstanding, metrics.UpstreamLag,
+		},
+		collect: collect,
+	})
+}
+
+// Handler returns a handler which writes the metrics in the Prometheus text format.
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+// collector implements the `prometheus.Collector` interface for metrics which are maintained elsewhere.
+type collector struct {
+	descs   []*prometheus.Desc
+	collect func(ch chan<- prometheus.Metric)
+}
+
+// Describe implements the `prometheus.Collector` interface.
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements the `prometheus.Collector` interface.
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	c.collect(ch)
+}
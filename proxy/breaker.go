@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned when a request is not sent to an upstream because its circuit breaker is open.
+var ErrBreakerOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState uint8
+
+const (
+	// BreakerClosed lets all requests through.
+	BreakerClosed BreakerState = 0
+	// BreakerOpen lets no requests through until the cooldown has elapsed.
+	BreakerOpen BreakerState = 1
+	// BreakerHalfOpen lets a limited number of requests through to probe whether the upstream has recovered.
+	BreakerHalfOpen BreakerState = 2
+)
+
+// String implements the `Stringer` interface.
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText implements the `encoding.TextMarshaler` interface.
+func (state BreakerState) MarshalText() ([]byte, error) {
+	return []byte(state.String()), nil
+}
+
+// BreakerOptions configure a circuit breaker.
+type BreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures after which the breaker opens.
+	FailureThreshold int
+	// Cooldown is how long the breaker stays open before it becomes half-open.
+	Cooldown time.Duration
+	// HalfOpenRequests is the number of requests that can be in flight while the breaker is half-open.
+	HalfOpenRequests int
+	// SuccessThreshold is the number of consecutive successes needed while half-open to close the breaker.
+	SuccessThreshold int
+}
+
+// Ticket is handed out by a breaker for each request it allows, and records whether the request was sent as a probe
+// while the breaker was half-open. Only the outcome of probes is counted towards closing or re-opening a half-open
+// breaker, so that requests allowed while it was closed cannot release places reserved for probes.
+type Ticket struct {
+	probe      bool
+	generation uint64
+}
+
+// Breaker is a circuit breaker. After a number of consecutive failures it opens and stops requests from being sent,
+// until a cooldown has elapsed. It then lets a limited number of requests through, and closes again once enough of
+// them succeed.
+type Breaker struct {
+	mu       *sync.Mutex
+	options  BreakerOptions
+	state    BreakerState
+	failures int
+	// successes is the number of consecutive successes while half-open.
+	successes int
+	// probes is the number of requests in flight while half-open.
+	probes int
+	// generation changes whenever the breaker opens or closes, so that probes from an earlier half-open period are not
+	// counted.
+	generation uint64
+	openedAt   time.Time
+}
+
+// NewBreaker returns a new closed Breaker. Thresholds less than one are treated as one.
+func NewBreaker(options BreakerOptions) *Breaker {
+	return &Breaker{
+		mu:      new(sync.Mutex),
+		options: options.withDefaults(),
+		state:   BreakerClosed,
+	}
+}
+
+// withDefaults returns the options with thresholds less than one replaced by one.
+func (options BreakerOptions) withDefaults() BreakerOptions {
+	if options.FailureThreshold < 1 {
+		options.FailureThreshold = 1
+	}
+	if options.HalfOpenRequests < 1 {
+		options.HalfOpenRequests = 1
+	}
+	if options.SuccessThreshold < 1 {
+		options.SuccessThreshold = 1
+	}
+	return options
+}
+
+// setOptions replaces the options of the breaker, keeping its state.
+func (breaker *Breaker) setOptions(options BreakerOptions) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.options = options.withDefaults()
+}
+
+// State returns the current state of the breaker.
+func (breaker *Breaker) State() BreakerState {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.update(time.Now())
+	return breaker.state
+}
+
+// Failures returns the number of consecutive failures.
+func (breaker *Breaker) Failures() int {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	return breaker.failures
+}
+
+// Ready returns whether a request would be allowed through, without reserving a place for it.
+func (breaker *Breaker) Ready() bool {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.update(time.Now())
+	switch breaker.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		return breaker.probes < breaker.options.HalfOpenRequests
+	default:
+		return false
+	}
+}
+
+// Allow returns whether a request can be sent. If it returns true, the outcome of the request must be reported by
+// passing the ticket to Success, Failure or Release.
+func (breaker *Breaker) Allow() (Ticket, bool) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.update(time.Now())
+	switch breaker.state {
+	case BreakerClosed:
+		return Ticket{generation: breaker.generation}, true
+	case BreakerHalfOpen:
+		if breaker.probes >= breaker.options.HalfOpenRequests {
+			return Ticket{}, false
+		}
+		breaker.probes++
+		return Ticket{probe: true, generation: breaker.generation}, true
+	default:
+		return Ticket{}, false
+	}
+}
+
+// Success reports that a request allowed by the breaker succeeded.
+func (breaker *Breaker) Success(ticket Ticket) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.failures = 0
+	if !breaker.isProbe(ticket) {
+		return
+	}
+	breaker.probes--
+	breaker.successes++
+	if breaker.successes >= breaker.options.SuccessThreshold {
+		breaker.close()
+	}
+}
+
+// Failure reports that a request allowed by the breaker failed. While half-open, only failed probes open the breaker
+// again.
+func (breaker *Breaker) Failure(ticket Ticket) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	breaker.failures++
+	switch breaker.state {
+	case BreakerHalfOpen:
+		if breaker.isProbe(ticket) {
+			breaker.open(time.Now())
+		}
+	case BreakerClosed:
+		if breaker.failures >= breaker.options.FailureThreshold {
+			breaker.open(time.Now())
+		}
+	}
+}
+
+// Release reports that a request allowed by the breaker was abandoned before it completed, so that its outcome says
+// nothing about the upstream.
+func (breaker *Breaker) Release(ticket Ticket) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if breaker.isProbe(ticket) {
+		breaker.probes--
+	}
+}
+
+// isProbe returns whether the ticket is for a probe of the current half-open period, which holds one of its places.
+// It must be called while holding the lock.
+func (breaker *Breaker) isProbe(ticket Ticket) bool {
+	return ticket.probe && ticket.generation == breaker.generation && breaker.state == BreakerHalfOpen
+}
+
+// open opens the breaker. It must be called while holding the lock.
+func (breaker *Breaker) open(now time.Time) {
+	breaker.state = BreakerOpen
+	breaker.openedAt = now
+	breaker.successes = 0
+	breaker.probes = 0
+	breaker.generation++
+}
+
+// close closes the breaker. It must be called while holding the lock.
+func (breaker *Breaker) close() {
+	breaker.state = BreakerClosed
+	breaker.successes = 0
+	breaker.probes = 0
+	breaker.generation++
+}
+
+// update moves an open breaker to half-open once the cooldown has elapsed. It must be called while holding the lock.
+func (breaker *Breaker) update(now time.Time) {
+	if breaker.state == BreakerOpen && !now.Before(breaker.openedAt.Add(breaker.options.Cooldown)) {
+		breaker.state = BreakerHalfOpen
+	}
+}
@@ -0,0 +1,161 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+
+	"github.com/renproject/mercury/types"
+)
+
+var _ = Describe("Circuit breaker", func() {
+	options := BreakerOptions{
+		FailureThreshold: 3,
+		Cooldown:         100 * time.Millisecond,
+		HalfOpenRequests: 1,
+		SuccessThreshold: 2,
+	}
+
+	Context("when requests keep failing", func() {
+		It("should open after the failure threshold", func() {
+			breaker := NewBreaker(options)
+			for i := 0; i < 2; i++ {
+				ticket, ok := breaker.Allow()
+				Expect(ok).To(BeTrue())
+				breaker.Failure(ticket)
+			}
+			Expect(breaker.State()).To(Equal(BreakerClosed))
+
+			ticket, ok := breaker.Allow()
+			Expect(ok).To(BeTrue())
+			breaker.Failure(ticket)
+			Expect(breaker.State()).To(Equal(BreakerOpen))
+			_, ok = breaker.Allow()
+			Expect(ok).To(BeFalse())
+			Expect(breaker.Failures()).To(Equal(3))
+		})
+
+		It("should reset the count of failures after a success", func() {
+			breaker := NewBreaker(options)
+			breaker.Failure(Ticket{})
+			breaker.Failure(Ticket{})
+			breaker.Success(Ticket{})
+			breaker.Failure(Ticket{})
+			Expect(breaker.State()).To(Equal(BreakerClosed))
+			Expect(breaker.Failures()).To(Equal(1))
+		})
+	})
+
+	Context("when the cooldown has elapsed", func() {
+		open := func() *Breaker {
+			breaker := NewBreaker(options)
+			for i := 0; i < options.FailureThreshold; i++ {
+				breaker.Failure(Ticket{})
+			}
+			time.Sleep(150 * time.Millisecond)
+			return breaker
+		}
+
+		It("should limit the number of probes while half-open", func() {
+			breaker := open()
+			Expect(breaker.State()).To(Equal(BreakerHalfOpen))
+			Expect(breaker.Ready()).To(BeTrue())
+			_, ok := breaker.Allow()
+			Expect(ok).To(BeTrue())
+			Expect(breaker.Ready()).To(BeFalse())
+			_, ok = breaker.Allow()
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should close once enough probes succeed", func() {
+			breaker := open()
+			ticket, ok := breaker.Allow()
+			Expect(ok).To(BeTrue())
+			breaker.Success(ticket)
+			Expect(breaker.State()).To(Equal(BreakerHalfOpen))
+			ticket, ok = breaker.Allow()
+			Expect(ok).To(BeTrue())
+			breaker.Success(ticket)
+			Expect(breaker.State()).To(Equal(BreakerClosed))
+		})
+
+		It("should open again if a probe fails", func() {
+			breaker := open()
+			ticket, ok := breaker.Allow()
+			Expect(ok).To(BeTrue())
+			breaker.Failure(ticket)
+			Expect(breaker.State()).To(Equal(BreakerOpen))
+			_, ok = breaker.Allow()
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should only count the outcome of probes", func() {
+			breaker := NewBreaker(options)
+			stale, ok := breaker.Allow()
+			Expect(ok).To(BeTrue())
+			for i := 0; i < options.FailureThreshold; i++ {
+				breaker.Failure(Ticket{})
+			}
+			time.Sleep(150 * time.Millisecond)
+			probe, ok := breaker.Allow()
+			Expect(ok).To(BeTrue())
+
+			// A request allowed while the breaker was closed neither frees the place of the probe nor closes the breaker.
+			breaker.Success(stale)
+			Expect(breaker.State()).To(Equal(BreakerHalfOpen))
+			Expect(breaker.Ready()).To(BeFalse())
+			breaker.Failure(stale)
+			Expect(breaker.State()).To(Equal(BreakerHalfOpen))
+			breaker.Release(stale)
+			Expect(breaker.Ready()).To(BeFalse())
+
+			breaker.Success(probe)
+			Expect(breaker.Ready()).To(BeTrue())
+			probe, ok = breaker.Allow()
+			Expect(ok).To(BeTrue())
+			breaker.Success(probe)
+			Expect(breaker.State()).To(Equal(BreakerClosed))
+		})
+	})
+
+	Context("when every upstream is open", func() {
+		It("should fail fast without contacting the clients", func() {
+			fst, snd := newCountingClient("fst", 1, 0), newCountingClient("snd", 1, 0)
+			atomic.StoreInt32(&fst.fail, 1)
+			atomic.StoreInt32(&snd.fail, 1)
+
+			proxyOptions := DefaultOptions()
+			proxyOptions.Breaker = BreakerOptions{FailureThreshold: 1, Cooldown: time.Minute}
+			proxyOptions.Retry.InitialBackoff = time.Millisecond
+			proxy := NewProxyWithOptions(proxyOptions, NewUpstream("fst", fst, 1), NewUpstream("snd", snd, 1))
+
+			req, err := http.NewRequest("POST", "", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = proxy.ProxyRequest(context.Background(), req, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(fst.Calls() + snd.Calls()).To(Equal(int64(2)))
+
+			_, err = proxy.ProxyRequest(context.Background(), req, nil)
+			Expect(fst.Calls() + snd.Calls()).To(Equal(int64(2)))
+			errs, ok := err.(types.ErrList)
+			Expect(ok).To(BeTrue())
+			Expect(errs).To(HaveLen(2))
+			for _, err := range errs {
+				Expect(err.(types.ErrUpstream).Err).To(Equal(ErrBreakerOpen))
+			}
+
+			status := proxy.Status()
+			Expect(status).To(HaveLen(2))
+			Expect(status[0].Breaker).To(Equal(BreakerOpen))
+			data, err := json.Marshal(status[0])
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring(`"breaker":"open"`))
+		})
+	})
+})
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/renproject/mercury/types"
+)
+
+const (
+	// BroadcastAccepted means the upstream accepted the transaction.
+	BroadcastAccepted = "accepted"
+	// BroadcastKnown means the upstream already had the transaction in its mempool or chain.
+	BroadcastKnown = "known"
+	// BroadcastRejected means the upstream rejected the transaction.
+	BroadcastRejected = "rejected"
+	// BroadcastFailed means the upstream could not be reached, or failed to handle the request.
+	BroadcastFailed = "failed"
+)
+
+// broadcastMethods are the methods that submit a transaction, along with how to compute the hash of the submitted
+// transaction.
+var broadcastMethods = map[string]func(string) (string, error){
+	"sendrawtransaction":     btcTxHash,
+	"eth_sendRawTransaction": ethTxHash,
+}
+
+// knownMessages are fragments of the errors returned by nodes that already have the transaction.
+var knownMessages = []string{
+	"already known",
+	"known transaction",
+	"already in mempool",
+	"already-in-mempool",
+	"already in block chain",
+	"already have transaction",
+}
+
+// BroadcastReport describes how an upstream handled a broadcast transaction.
+type BroadcastReport struct {
+	Upstream string `json:"upstream"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// broadcast sends the transaction to every available upstream in parallel. It succeeds if any upstream accepts the
+// transaction or already knows it, and the response includes a report of how each upstream handled it. If every
+// upstream rejects the transaction, the first rejection is returned.
+func (proxy *Proxy) broadcast(ctx context.Context, r *http.Request, req request, data []byte) (*http.Response, error) {
+	upstreams, options := proxy.current()
+	upstreams = order(upstreams, options)
+	if len(upstreams) == 0 {
+		_, response, err := proxy.send(ctx, r, data)
+		return response, err
+	}
+
+	reports := make([]BroadcastReport, len(upstreams))
+	responses := make([]*http.Response, len(upstreams))
+	errs := make([]error, len(upstreams))
+	wg := new(sync.WaitGroup)
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func(i int, upstream *Upstream) {
+			defer wg.Done()
+			responses[i], errs[i] = proxy.sendTo(ctx, options, upstream, r, data)
+			reports[i] = report(upstream.Name, responses[i], errs[i])
+		}(i, upstream)
+	}
+	wg.Wait()
+
+	accepted, known, rejected := -1, -1, -1
+	for i := len(reports) - 1; i >= 0; i-- {
+		switch reports[i].Status {
+		case BroadcastAccepted:
+			accepted = i
+		case BroadcastKnown:
+			known = i
+		case BroadcastRejected:
+			rejected = i
+		}
+	}
+
+	switch {
+	case accepted >= 0:
+		return rewriteResponse(responses[accepted], "broadcast", reports)
+	case known >= 0:
+		// No upstream returned the hash of the transaction, so compute it.
+		hash, err := txHash(req)
+		if err != nil {
+			return nil, err
+		}
+		response, err := syntheticResponse(req.ID, hash)
+		if err != nil {
+			return nil, err
+		}
+		return rewriteResponse(response, "broadcast", reports)
+	case rejected >= 0:
+		return rewriteResponse(responses[rejected], "broadcast", reports)
+	}
+
+	list := make(types.ErrList, len(errs))
+	for i, err := range errs {
+		list[i] = types.NewErrUpstream(upstreams[i].Name, 1, false, err)
+	}
+	return nil, list
+}
+
+// report classifies the response of an upstream to a broadcast transaction.
+func report(upstream string, response *http.Response, err error) BroadcastReport {
+	if err != nil {
+		return BroadcastReport{Upstream: upstream, Status: BroadcastFailed, Error: err.Error()}
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return BroadcastReport{Upstream: upstream, Status: BroadcastFailed, Error: err.Error()}
+	}
+
+	resp := struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return BroadcastReport{Upstream: upstream, Status: BroadcastFailed, Error: fmt.Sprintf("invalid response: %v", err)}
+	}
+	if resp.Error == nil {
+		return BroadcastReport{Upstream: upstream, Status: BroadcastAccepted}
+	}
+	message := strings.ToLower(resp.Error.Message)
+	for _, known := range knownMessages {
+		if strings.Contains(message, known) {
+			return BroadcastReport{Upstream: upstream, Status: BroadcastKnown, Error: resp.Error.Message}
+		}
+	}
+	return BroadcastReport{Upstream: upstream, Status: BroadcastRejected, Error: resp.Error.Message}
+}
+
+// txHash returns the hash of the transaction submitted by the request.
+func txHash(req request) (string, error) {
+	if len(req.Params) == 0 {
+		return "", fmt.Errorf("missing transaction")
+	}
+	var tx string
+	if err := json.Unmarshal(req.Params[0], &tx); err != nil {
+		return "", fmt.Errorf("invalid transaction: %v", err)
+	}
+	return broadcastMethods[req.Method](tx)
+}
+
+// btcTxHash returns the ID of a serialized Bitcoin, Bitcoin Cash or ZCash transaction. The witness of SegWit
+// transactions is not part of their ID.
+func btcTxHash(tx string) (string, error) {
+	data, err := hex.DecodeString(tx)
+	if err != nil {
+		return "", fmt.Errorf("invalid transaction: %v", err)
+	}
+	if len(data) > 6 && data[4] == 0x00 && data[5] == 0x01 {
+		// The transaction has a SegWit marker and flag after its version.
+		msgTx := wire.NewMsgTx(wire.TxVersion)
+		if err := msgTx.Deserialize(bytes.NewReader(data)); err != nil {
+			return "", fmt.Errorf("invalid transaction: %v", err)
+		}
+		return msgTx.TxHash().String(), nil
+	}
+
+	first := sha256.Sum256(data)
+	hash := sha256.Sum256(first[:])
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// ethTxHash returns the hash of a serialized Ethereum transaction.
+func ethTxHash(tx string) (string, error) {
+	data, err := hex.DecodeString(strings.TrimPrefix(tx, "0x"))
+	if err != nil {
+		return "", fmt.Errorf("invalid transaction: %v", err)
+	}
+	return crypto.Keccak256Hash(data).Hex(), nil
+}
@@ -0,0 +1,105 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var _ = Describe("Broadcast", func() {
+	type response struct {
+		Result    json.RawMessage   `json:"result"`
+		Error     json.RawMessage   `json:"error"`
+		Broadcast []BroadcastReport `json:"broadcast"`
+	}
+
+	submit := func(proxy *Proxy, method, tx string) response {
+		data := []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":7,"method":"%v","params":["%v"]}`, method, tx))
+		req, err := http.NewRequest("POST", "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := proxy.ProxyRequest(context.Background(), req, data)
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		var r response
+		Expect(json.Unmarshal(body, &r)).To(Succeed())
+		return r
+	}
+
+	btcTx := func(segwit bool) (string, string) {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		in := wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil)
+		if segwit {
+			in.Witness = wire.TxWitness{[]byte{1, 2, 3}}
+		}
+		tx.AddTxIn(in)
+		tx.AddTxOut(wire.NewTxOut(10000, []byte{0x51}))
+		buf := new(bytes.Buffer)
+		Expect(tx.Serialize(buf)).To(Succeed())
+		return hex.EncodeToString(buf.Bytes()), tx.TxHash().String()
+	}
+
+	Context("when a transaction is submitted", func() {
+		It("should send it to every upstream and report how each handled it", func() {
+			accepting := newResponseClient(200, `{"jsonrpc":"2.0","id":7,"result":"abcd"}`)
+			known := newResponseClient(200, `{"jsonrpc":"2.0","id":7,"error":{"code":-27,"message":"txn-already-in-mempool"}}`)
+			failing := newResponseClient(502, `bad gateway`)
+			proxy := NewProxy(accepting, known, failing)
+
+			tx, _ := btcTx(false)
+			resp := submit(proxy, "sendrawtransaction", tx)
+			Expect(string(resp.Result)).To(Equal(`"abcd"`))
+			Expect(accepting.Calls() + known.Calls() + failing.Calls()).To(Equal(int64(3)))
+			Expect(resp.Broadcast).To(Equal([]BroadcastReport{
+				{Upstream: "0", Status: BroadcastAccepted},
+				{Upstream: "1", Status: BroadcastKnown, Error: "txn-already-in-mempool"},
+				{Upstream: "2", Status: BroadcastFailed, Error: resp.Broadcast[2].Error},
+			}))
+		})
+
+		It("should return the first rejection if no upstream accepts it", func() {
+			rejecting := newResponseClient(200, `{"jsonrpc":"2.0","id":7,"error":{"code":-25,"message":"bad-txns-inputs-missingorspent"}}`)
+			failing := newResponseClient(502, `bad gateway`)
+			proxy := NewProxy(failing, rejecting)
+
+			tx, _ := btcTx(false)
+			resp := submit(proxy, "sendrawtransaction", tx)
+			Expect(string(resp.Error)).To(ContainSubstring("missingorspent"))
+			Expect(resp.Broadcast[1].Status).To(Equal(BroadcastRejected))
+		})
+	})
+
+	Context("when every upstream already knows the transaction", func() {
+		It("should compute the ID of a Bitcoin transaction", func() {
+			for _, segwit := range []bool{false, true} {
+				known := newResponseClient(200, `{"jsonrpc":"2.0","id":7,"error":{"code":-27,"message":"Transaction already in block chain"}}`)
+				proxy := NewProxy(known)
+
+				tx, hash := btcTx(segwit)
+				resp := submit(proxy, "sendrawtransaction", tx)
+				Expect(string(resp.Result)).To(Equal(fmt.Sprintf(`"%v"`, hash)))
+				Expect(resp.Error).To(BeNil())
+			}
+		})
+
+		It("should compute the hash of an Ethereum transaction", func() {
+			known := newResponseClient(200, `{"jsonrpc":"2.0","id":7,"error":{"code":-32000,"message":"already known"}}`)
+			proxy := NewProxy(known)
+
+			resp := submit(proxy, "eth_sendRawTransaction", "0x")
+			// The hash of an empty transaction is the Keccak256 hash of no data.
+			Expect(string(resp.Result)).To(Equal(`"0xc5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"`))
+		})
+	})
+})
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/renproject/mercury/types"
+)
+
+// infrastructureCodes are JSON-RPC error codes that indicate a problem with the upstream rather than the request.
+var infrastructureCodes = map[int]bool{
+	-28:    true, // Bitcoin: the node is warming up (e.g. loading the block index).
+	-9:     true, // Bitcoin: the node is not connected to the network.
+	-10:    true, // Bitcoin: the node is still downloading the initial blocks.
+	-32603: true, // Internal error.
+	-32005: true, // Ethereum: the request rate limit has been exceeded.
+}
+
+// infrastructureMessages are fragments of JSON-RPC error messages that indicate a problem with the upstream rather
+// than the request, for upstreams that do not use specific error codes.
+var infrastructureMessages = []string{
+	"loading block index",
+	"rate limit",
+	"too many requests",
+	"header not found",
+	"missing trie node",
+	"request timed out",
+}
+
+// ErrBadResponse is returned when an upstream responds with an error that is specific to the upstream, such as a
+// server error, a rate limit or a node that is still starting up. Another upstream may be able to serve the request.
+type ErrBadResponse struct {
+	StatusCode int
+	// Code and Message are set if the response contained a JSON-RPC error.
+	Code    int
+	Message string
+}
+
+// Error implements the error interface.
+func (err ErrBadResponse) Error() string {
+	if err.Message != "" {
+		return fmt.Sprintf("bad response: status=%v code=%v message=%v", err.StatusCode, err.Code, err.Message)
+	}
+	return fmt.Sprintf("bad response: status=%v", err.StatusCode)
+}
+
+// RateLimited returns whether the upstream rejected the request because of a rate limit.
+func (err ErrBadResponse) RateLimited() bool {
+	if err.StatusCode == http.StatusTooManyRequests || err.Code == types.ErrorCodeRateLimited {
+		return true
+	}
+	message := strings.ToLower(err.Message)
+	return strings.Contains(message, "rate limit") || strings.Contains(message, "too many requests")
+}
+
+// Classify returns an ErrBadResponse if the response should cause the proxy to move on to the next upstream, or nil
+// if the response should be returned to the caller. Successful responses and JSON-RPC errors caused by the request
+// itself (e.g. invalid params, or a transaction that is already in the chain) are returned to the caller, regardless
+// of the status code; Bitcoin nodes respond to such errors with a server error status. Other server errors, rate
+// limits and JSON-RPC errors caused by the state of the upstream are not.
+func Classify(statusCode int, body []byte) error {
+	resp := struct {
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Error != nil {
+		if infrastructureError(resp.Error.Code, resp.Error.Message) {
+			return ErrBadResponse{
+				StatusCode: statusCode,
+				Code:       resp.Error.Code,
+				Message:    resp.Error.Message,
+			}
+		}
+		return nil
+	}
+
+	if statusCode < 200 || statusCode >= 300 {
+		return ErrBadResponse{StatusCode: statusCode}
+	}
+	return nil
+}
+
+func infrastructureError(code int, message string) bool {
+	if infrastructureCodes[code] {
+		return true
+	}
+	message = strings.ToLower(message)
+	for _, fragment := range infrastructureMessages {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+	return false
+}
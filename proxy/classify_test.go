@@ -0,0 +1,95 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+)
+
+var _ = Describe("Response classification", func() {
+	Context("when classifying responses", func() {
+		It("should return successful responses to the caller", func() {
+			Expect(Classify(http.StatusOK, []byte(`{"jsonrpc":"2.0","id":1,"result":"0x1"}`))).To(Succeed())
+			Expect(Classify(http.StatusOK, []byte(`{"result":"0x1","error":null,"id":1}`))).To(Succeed())
+		})
+
+		It("should return errors caused by the request to the caller", func() {
+			Expect(Classify(http.StatusOK, []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid params"}}`))).To(Succeed())
+			Expect(Classify(http.StatusInternalServerError, []byte(`{"result":null,"error":{"code":-27,"message":"transaction already in block chain"},"id":1}`))).To(Succeed())
+			Expect(Classify(http.StatusOK, []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"nonce too low"}}`))).To(Succeed())
+		})
+
+		It("should move on from errors caused by the upstream", func() {
+			Expect(Classify(http.StatusBadGateway, []byte(`<html>bad gateway</html>`))).To(HaveOccurred())
+			Expect(Classify(http.StatusTooManyRequests, nil)).To(HaveOccurred())
+			Expect(Classify(http.StatusInternalServerError, []byte(`{"result":null,"error":{"code":-28,"message":"Loading block index..."},"id":1}`))).To(HaveOccurred())
+			Expect(Classify(http.StatusOK, []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32005,"message":"daily request count exceeded, request rate limited"}}`))).To(HaveOccurred())
+			Expect(Classify(http.StatusOK, []byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"header not found"}}`))).To(HaveOccurred())
+		})
+	})
+
+	Context("when proxying requests", func() {
+		send := func(proxy *Proxy) (*http.Response, error) {
+			req, err := http.NewRequest("POST", "", nil)
+			Expect(err).ToNot(HaveOccurred())
+			return proxy.ProxyRequest(context.Background(), req, nil)
+		}
+
+		It("should fail over when the first client is unavailable", func() {
+			warming := newResponseClient(http.StatusInternalServerError, `{"result":null,"error":{"code":-28,"message":"Loading block index..."},"id":1}`)
+			working := newResponseClient(http.StatusOK, `{"result":"ok","error":null,"id":1}`)
+			proxy := NewProxy(warming, working)
+
+			resp, err := send(proxy)
+			Expect(err).ToNot(HaveOccurred())
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(body)).To(Equal(`{"result":"ok","error":null,"id":1}`))
+			Expect(warming.Calls()).To(Equal(int64(1)))
+			Expect(working.Calls()).To(Equal(int64(1)))
+		})
+
+		It("should return errors caused by the request immediately", func() {
+			invalid := newResponseClient(http.StatusInternalServerError, `{"result":null,"error":{"code":-8,"message":"Invalid parameter"},"id":1}`)
+			working := newResponseClient(http.StatusOK, `{"result":"ok","error":null,"id":1}`)
+			proxy := NewProxy(invalid, working)
+
+			resp, err := send(proxy)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusInternalServerError))
+			Expect(working.Calls()).To(Equal(int64(0)))
+		})
+	})
+})
+
+// responseClient responds to every request with the same response.
+type responseClient struct {
+	statusCode int
+	body       string
+	calls      int64
+}
+
+func newResponseClient(statusCode int, body string) *responseClient {
+	return &responseClient{
+		statusCode: statusCode,
+		body:       body,
+	}
+}
+
+func (client *responseClient) Calls() int64 {
+	return atomic.LoadInt64(&client.calls)
+}
+
+func (client *responseClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	atomic.AddInt64(&client.calls, 1)
+	return &http.Response{
+		StatusCode: client.statusCode,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(client.body)),
+	}, nil
+}
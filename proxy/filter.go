@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFilterTTL is how long an Ethereum filter can go unused before it is forgotten. Nodes uninstall filters that
+// have not been polled for about five minutes.
+const DefaultFilterTTL = 5 * time.Minute
+
+// filterCreationMethods are the Ethereum methods that install a filter on the node that serves them.
+var filterCreationMethods = map[string]bool{
+	"eth_newFilter":                   true,
+	"eth_newBlockFilter":              true,
+	"eth_newPendingTransactionFilter": true,
+}
+
+// filterMethods are the Ethereum methods that take the ID of a filter as their first parameter, and so must be sent to
+// the node that created it.
+var filterMethods = map[string]bool{
+	"eth_getFilterChanges": true,
+	"eth_getFilterLogs":    true,
+	"eth_uninstallFilter":  true,
+}
+
+// errUpstreamRemoved is the error of requests for filters whose upstream has been removed by a reload.
+var errUpstreamRemoved = errors.New("upstream has been removed")
+
+// ErrFilterLost is returned when the upstream that created a filter can no longer serve it, and the filter cannot be
+// created on another upstream.
+type ErrFilterLost struct {
+	ID  string
+	Err error
+}
+
+// Error implements the error interface.
+func (err ErrFilterLost) Error() string {
+	return fmt.Sprintf("filter %v is no longer available and cannot be re-created: %v", err.ID, err.Err)
+}
+
+// filter is an Ethereum filter installed on an upstream.
+type filter struct {
+	upstream *Upstream
+	// upstreamID is the ID of the filter on the upstream, which is hidden from the caller so that the filter can be
+	// re-created elsewhere without changing its ID.
+	upstreamID string
+	// creation is the request that created the filter.
+	creation []byte
+	lastUsed time.Time
+}
+
+// filterTable remembers which upstream created each filter.
+type filterTable struct {
+	mu      *sync.Mutex
+	ttl     time.Duration
+	filters map[string]*filter
+}
+
+func newFilterTable(ttl time.Duration) *filterTable {
+	return &filterTable{
+		mu:      new(sync.Mutex),
+		ttl:     ttl,
+		filters: map[string]*filter{},
+	}
+}
+
+// get returns a copy of the filter with the given ID, and marks it as used.
+func (table *filterTable) get(id string) (filter, bool) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	f, ok := table.filters[id]
+	if !ok {
+		return filter{}, false
+	}
+	now := time.Now()
+	if now.Sub(f.lastUsed) > table.ttl {
+		delete(table.filters, id)
+		return filter{}, false
+	}
+	f.lastUsed = now
+	return *f, true
+}
+
+// put stores the filter, and forgets filters that have not been used within the TTL.
+func (table *filterTable) put(id string, f filter) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	now := time.Now()
+	for id, f := range table.filters {
+		if now.Sub(f.lastUsed) > table.ttl {
+			delete(table.filters, id)
+		}
+	}
+	f.lastUsed = now
+	table.filters[id] = &f
+}
+
+// remove forgets the filter with the given ID.
+func (table *filterTable) remove(id string) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	delete(table.filters, id)
+}
+
+// setTTL changes how long filters can go unused before they are forgotten.
+func (table *filterTable) setTTL(ttl time.Duration) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	table.ttl = ttl
+}
+
+// len returns the number of filters.
+func (table *filterTable) len() int {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	return len(table.filters)
+}
+
+// Filters returns the number of Ethereum filters the proxy is routing.
+func (proxy *Proxy) Filters() int {
+	return proxy.filters.len()
+}
+
+// newFilter creates a filter on one of the upstreams and returns a new ID for it, which is used to route subsequent
+// requests for the filter to the same upstream.
+func (proxy *Proxy) newFilter(ctx context.Context, r *http.Request, data []byte) (*http.Response, error) {
+	upstream, response, upstreamID, err := proxy.installFilter(ctx, r, data)
+	if err != nil || upstreamID == "" {
+		return response, err
+	}
+
+	id, err := newFilterID()
+	if err != nil {
+		return nil, err
+	}
+	proxy.filters.put(id, filter{
+		upstream:   upstream,
+		upstreamID: upstreamID,
+		creation:   data,
+	})
+	return rewriteResponse(response, "result", id)
+}
+
+// installFilter sends the request that creates a filter, and returns the ID of the filter on the upstream that served
+// it. The ID is empty if the upstream did not create a filter.
+func (proxy *Proxy) installFilter(ctx context.Context, r *http.Request, data []byte) (*Upstream, *http.Response, string, error) {
+	upstream, response, err := proxy.send(ctx, r, data)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("cannot read response: %v", err)
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	resp := struct {
+		Result string `json:"result"`
+	}{}
+	json.Unmarshal(body, &resp)
+	return upstream, response, resp.Result, nil
+}
+
+// useFilter sends a request for a filter to the upstream that created it. If that upstream fails, or no longer knows
+// the filter, the filter is re-created on another upstream and the request is sent there instead. Filters that were
+// not created through the proxy are routed like any other request.
+func (proxy *Proxy) useFilter(ctx context.Context, r *http.Request, req request, data []byte) (*http.Response, error) {
+	if len(req.Params) == 0 {
+		_, response, err := proxy.send(ctx, r, data)
+		return response, err
+	}
+	var id string
+	if err := json.Unmarshal(req.Params[0], &id); err != nil {
+		_, response, err := proxy.send(ctx, r, data)
+		return response, err
+	}
+	f, ok := proxy.filters.get(id)
+	if !ok {
+		_, response, err := proxy.send(ctx, r, data)
+		return response, err
+	}
+
+	// Filters created on an upstream that has been removed by a reload are re-created on one of the current upstreams,
+	// rather than being sent to an upstream that is no longer monitored.
+	var response *http.Response
+	err := errUpstreamRemoved
+	if upstream, ok := proxy.currentUpstream(f.upstream); ok {
+		if upstream != f.upstream {
+			f.upstream = upstream
+			proxy.filters.put(id, f)
+		}
+		response, err = proxy.sendFilter(ctx, r, f, req, data)
+	}
+	if req.Method == "eth_uninstallFilter" {
+		proxy.filters.remove(id)
+		if err != nil || filterNotFound(response) {
+			// The filter is gone either way, which is what the caller wanted.
+			return syntheticResponse(req.ID, true)
+		}
+		return response, nil
+	}
+	if err == nil && !filterNotFound(response) {
+		return response, nil
+	}
+
+	// The upstream is unavailable or has forgotten the filter, so create it again on any upstream.
+	upstream, _, upstreamID, createErr := proxy.installFilter(ctx, r, f.creation)
+	if createErr != nil || upstreamID == "" {
+		proxy.filters.remove(id)
+		if createErr == nil {
+			createErr = fmt.Errorf("upstream %v did not create a filter", upstream.Name)
+		}
+		return nil, ErrFilterLost{ID: id, Err: createErr}
+	}
+	f.upstream, f.upstreamID = upstream, upstreamID
+	proxy.filters.put(id, f)
+
+	response, err = proxy.sendFilter(ctx, r, f, req, data)
+	if err != nil {
+		return nil, ErrFilterLost{ID: id, Err: err}
+	}
+	return response, nil
+}
+
+// currentUpstream returns the upstream with the same name as the given one among the upstreams the proxy currently
+// uses, which is a different instance once the proxy has been reloaded. It returns false if the upstream has been
+// removed.
+func (proxy *Proxy) currentUpstream(upstream *Upstream) (*Upstream, bool) {
+	upstreams, _ := proxy.current()
+	for _, current := range upstreams {
+		if current == upstream || current.Name == upstream.Name {
+			return current, true
+		}
+	}
+	return nil, false
+}
+
+// sendFilter sends a request for the filter to the upstream that created it, replacing the ID of the filter with the
+// one known by the upstream.
+func (proxy *Proxy) sendFilter(ctx context.Context, r *http.Request, f filter, req request, data []byte) (*http.Response, error) {
+	params := make([]interface{}, len(req.Params))
+	for i, param := range req.Params {
+		params[i] = param
+	}
+	params[0] = f.upstreamID
+	data, err := rewrite(data, "params", params)
+	if err != nil {
+		return nil, err
+	}
+	_, options := proxy.current()
+	return proxy.sendTo(ctx, options, f.upstream, r, data)
+}
+
+// filterNotFound returns whether the response is an error saying that the upstream does not know the filter, which
+// happens when the node has restarted or uninstalled the filter.
+func filterNotFound(response *http.Response) bool {
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	resp := struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Error == nil {
+		return false
+	}
+	return strings.Contains(strings.ToLower(resp.Error.Message), "filter not found")
+}
+
+// newFilterID returns a random filter ID in the format used by Ethereum nodes.
+func newFilterID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("cannot generate filter id: %v", err)
+	}
+	return "0x" + hex.EncodeToString(id), nil
+}
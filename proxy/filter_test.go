@@ -0,0 +1,240 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+)
+
+var _ = Describe("Filters", func() {
+	newProxy := func(clients ...*filterClient) *Proxy {
+		upstreams := make([]*Upstream, len(clients))
+		for i, client := range clients {
+			upstreams[i] = NewUpstream(client.name, client, 1)
+		}
+		options := DefaultOptions()
+		options.Strategy = RoundRobin()
+		return NewProxyWithOptions(options, upstreams...)
+	}
+
+	call := func(proxy *Proxy, method string, params ...interface{}) (json.RawMessage, error) {
+		if params == nil {
+			params = []interface{}{}
+		}
+		data, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+		Expect(err).ToNot(HaveOccurred())
+		req, err := http.NewRequest("POST", "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := proxy.ProxyRequest(context.Background(), req, data)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		response := struct {
+			Result json.RawMessage `json:"result"`
+			Error  *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		Expect(json.Unmarshal(body, &response)).To(Succeed())
+		if response.Error != nil {
+			return nil, errors.New(response.Error.Message)
+		}
+		return response.Result, nil
+	}
+
+	newFilter := func(proxy *Proxy) string {
+		result, err := call(proxy, "eth_newBlockFilter")
+		Expect(err).ToNot(HaveOccurred())
+		var id string
+		Expect(json.Unmarshal(result, &id)).To(Succeed())
+		return id
+	}
+
+	Context("when a filter is created", func() {
+		It("should send requests for the filter to the upstream that created it", func() {
+			fst, snd := newFilterClient("fst"), newFilterClient("snd")
+			proxy := newProxy(fst, snd)
+
+			id := newFilter(proxy)
+			for i := 0; i < 5; i++ {
+				result, err := call(proxy, "eth_getFilterChanges", id)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(result)).To(Equal(`["fst"]`))
+			}
+			Expect(snd.Calls()).To(Equal(int64(0)))
+			Expect(proxy.Filters()).To(Equal(1))
+
+			result, err := call(proxy, "eth_uninstallFilter", id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(result)).To(Equal("true"))
+			Expect(proxy.Filters()).To(Equal(0))
+		})
+
+		It("should not expose the id used by the upstream", func() {
+			fst := newFilterClient("fst")
+			proxy := newProxy(fst)
+
+			id := newFilter(proxy)
+			Expect(id).To(HavePrefix("0x"))
+			Expect(id).ToNot(ContainSubstring("fst"))
+		})
+	})
+
+	Context("when the upstream that created a filter fails", func() {
+		It("should re-create the filter on another upstream", func() {
+			fst, snd := newFilterClient("fst"), newFilterClient("snd")
+			proxy := newProxy(fst, snd)
+
+			id := newFilter(proxy)
+			atomic.StoreInt32(&fst.fail, 1)
+
+			result, err := call(proxy, "eth_getFilterChanges", id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(result)).To(Equal(`["snd"]`))
+			result, err = call(proxy, "eth_getFilterChanges", id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(result)).To(Equal(`["snd"]`))
+		})
+
+		It("should re-create the filter if the upstream has forgotten it", func() {
+			fst := newFilterClient("fst")
+			proxy := newProxy(fst)
+
+			id := newFilter(proxy)
+			fst.Reset()
+
+			result, err := call(proxy, "eth_getFilterChanges", id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(result)).To(Equal(`["fst"]`))
+		})
+
+		It("should return a clear error if the filter cannot be re-created", func() {
+			fst := newFilterClient("fst")
+			proxy := newProxy(fst)
+
+			id := newFilter(proxy)
+			atomic.StoreInt32(&fst.fail, 1)
+
+			_, err := call(proxy, "eth_getFilterChanges", id)
+			Expect(err).To(HaveOccurred())
+			errFilterLost, ok := err.(ErrFilterLost)
+			Expect(ok).To(BeTrue())
+			Expect(errFilterLost.ID).To(Equal(id))
+			Expect(proxy.Filters()).To(Equal(0))
+		})
+	})
+
+	Context("when the proxy is reloaded", func() {
+		It("should re-create filters whose upstream has been removed", func() {
+			fst, snd := newFilterClient("fst"), newFilterClient("snd")
+			proxy := newProxy(fst, snd)
+
+			id := newFilter(proxy)
+			calls := fst.Calls()
+			proxy.Reload(DefaultOptions(), NewUpstream(snd.name, snd, 1))
+
+			result, err := call(proxy, "eth_getFilterChanges", id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(result)).To(Equal(`["snd"]`))
+			Expect(fst.Calls()).To(Equal(calls))
+		})
+
+		It("should keep filters whose upstream is kept", func() {
+			fst, snd := newFilterClient("fst"), newFilterClient("snd")
+			proxy := newProxy(fst, snd)
+
+			id := newFilter(proxy)
+			calls := fst.Calls()
+			proxy.Reload(DefaultOptions(), NewUpstream(fst.name, fst, 1), NewUpstream(snd.name, snd, 1))
+
+			result, err := call(proxy, "eth_getFilterChanges", id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(result)).To(Equal(`["fst"]`))
+			Expect(fst.Calls()).To(Equal(calls + 1))
+			Expect(snd.Calls()).To(Equal(int64(0)))
+		})
+	})
+})
+
+// filterClient is a node that supports block filters.
+type filterClient struct {
+	name  string
+	fail  int32
+	calls int64
+
+	mu      *sync.Mutex
+	next    int
+	filters map[string]bool
+}
+
+func newFilterClient(name string) *filterClient {
+	return &filterClient{
+		name:    name,
+		mu:      new(sync.Mutex),
+		filters: map[string]bool{},
+	}
+}
+
+func (client *filterClient) Calls() int64 {
+	return atomic.LoadInt64(&client.calls)
+}
+
+// Reset forgets every filter, as if the node had restarted.
+func (client *filterClient) Reset() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.filters = map[string]bool{}
+}
+
+func (client *filterClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	atomic.AddInt64(&client.calls, 1)
+	if atomic.LoadInt32(&client.fail) == 1 {
+		return nil, errors.New("connection refused")
+	}
+
+	req := struct {
+		Method string   `json:"method"`
+		Params []string `json:"params"`
+	}{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	var body string
+	switch req.Method {
+	case "eth_newBlockFilter":
+		client.next++
+		id := fmt.Sprintf("%v-%d", client.name, client.next)
+		client.filters[id] = true
+		body = fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":"%v"}`, id)
+	case "eth_getFilterChanges":
+		if !client.filters[req.Params[0]] {
+			body = `{"jsonrpc":"2.0","id":1,"error":{"code":-32000,"message":"filter not found"}}`
+		} else {
+			body = fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"result":["%v"]}`, client.name)
+		}
+	case "eth_uninstallFilter":
+		delete(client.filters, req.Params[0])
+		body = `{"jsonrpc":"2.0","id":1,"result":true}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+	}, nil
+}
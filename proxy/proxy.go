@@ -1,42 +1,305 @@
-// Package proxy proxies requests to given clients. If a client returns an error for a given request, the next client is
-// used. If all clients return errors, it returns each of the errors concatenated.
+// Package proxy proxies requests to given clients. The order in which clients are tried is chosen by a strategy, and
+// clients that keep failing are temporarily removed from rotation by a circuit breaker. If a client returns an error for
+// a given request, the next client is used, backing off between passes over the clients. If all attempts fail, it
+// returns each of the errors.
 package proxy
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/renproject/mercury/rpc"
 	"github.com/renproject/mercury/types"
 )
 
+// ErrNoUpstreams is returned when a request is sent to a proxy without any upstreams.
+var ErrNoUpstreams = errors.New("no upstreams available")
+
+// Options configure a Proxy.
+type Options struct {
+	Strategy Strategy
+	Breaker  BreakerOptions
+	Retry    RetryPolicy
+	// Quorum maps the methods that must be served by a quorum of upstreams to the quorum they need.
+	Quorum map[string]Quorum
+	// Validator checks requests before they are forwarded. Requests that fail validation are answered with an
+	// "invalid params" error without contacting any upstream.
+	Validator Validator
+	// Broadcast sends transaction submissions to every available upstream, rather than the first that succeeds.
+	Broadcast bool
+	// FilterTTL is how long an Ethereum filter can go unused before the proxy forgets which upstream created it.
+	FilterTTL time.Duration
+}
+
+// DefaultOptions returns the options used by NewProxy: upstreams are tried in order, their circuit breakers open for
+// 30 seconds after 3 consecutive failures, requests are retried using the default retry policy, and transactions are
+// broadcast to every upstream.
+func DefaultOptions() Options {
+	return Options{
+		Strategy: Ordered(),
+		Breaker: BreakerOptions{
+			FailureThreshold: 3,
+			Cooldown:         30 * time.Second,
+			HalfOpenRequests: 1,
+			SuccessThreshold: 1,
+		},
+		Retry:     DefaultRetryPolicy(),
+		Broadcast: true,
+		FilterTTL: DefaultFilterTTL,
+	}
+}
+
+// Observer is notified of each attempt to send a request to an upstream, such as to record metrics. Attempts that are
+// cancelled by the proxy, or not sent because the circuit breaker of the upstream is open, are not observed.
+type Observer interface {
+	ObserveAttempt(upstream string, duration time.Duration, err error)
+}
+
 // Proxy proxies the request to different clients.
 type Proxy struct {
-	Clients []rpc.Client
+	mu        *sync.RWMutex
+	upstreams []*Upstream
+	options   Options
+	observer  Observer
+	filters   *filterTable
 }
 
-// NewProxy returns a new Proxy.
+// NewProxy returns a new Proxy using the default options. The clients are named by their index.
 func NewProxy(clients ...rpc.Client) *Proxy {
+	upstreams := make([]*Upstream, len(clients))
+	for i, client := range clients {
+		upstreams[i] = NewUpstream(fmt.Sprintf("%d", i), client, 1)
+	}
+	return NewProxyWithOptions(DefaultOptions(), upstreams...)
+}
+
+// NewProxyWithOptions returns a new Proxy with the given options.
+func NewProxyWithOptions(options Options, upstreams ...*Upstream) *Proxy {
+	options = setup(options, upstreams)
 	return &Proxy{
-		Clients: clients,
+		mu:        new(sync.RWMutex),
+		upstreams: upstreams,
+		options:   options,
+		filters:   newFilterTable(options.FilterTTL),
 	}
 }
 
+// Reload replaces the options and upstreams of the proxy. Requests that are in flight finish using the upstreams they
+// started with, and later requests use the new upstreams. New upstreams with the same name and URL as a current one
+// keep its circuit breaker, latency and chain tip. Ethereum filters created on an upstream that was removed are
+// re-created on one of the new upstreams when they are next used.
+func (proxy *Proxy) Reload(options Options, upstreams ...*Upstream) {
+	options = setup(options, upstreams)
+	proxy.filters.setTTL(options.FilterTTL)
+
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	for _, upstream := range upstreams {
+		for _, previous := range proxy.upstreams {
+			if previous.Name == upstream.Name && previous.URL == upstream.URL {
+				upstream.inherit(previous, options.Breaker)
+				break
+			}
+		}
+	}
+	proxy.upstreams = upstreams
+	proxy.options = options
+}
+
+// SetObserver sets the observer notified of each attempt to send a request to an upstream. It is kept when the proxy is
+// reloaded.
+func (proxy *Proxy) SetObserver(observer Observer) {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	proxy.observer = observer
+}
+
+// setup fills in the defaults of the options, and gives each upstream its index and circuit breaker.
+func setup(options Options, upstreams []*Upstream) Options {
+	if options.Strategy == nil {
+		options.Strategy = Ordered()
+	}
+	for i := range upstreams {
+		upstreams[i].index = i
+		upstreams[i].breaker = NewBreaker(options.Breaker)
+	}
+	if options.FilterTTL <= 0 {
+		options.FilterTTL = DefaultFilterTTL
+	}
+	return options
+}
+
+// current returns the upstreams and options that requests are currently served with.
+func (proxy *Proxy) current() ([]*Upstream, Options) {
+	proxy.mu.RLock()
+	defer proxy.mu.RUnlock()
+	return proxy.upstreams, proxy.options
+}
+
+// Upstreams returns the upstreams used by the proxy.
+func (proxy *Proxy) Upstreams() []*Upstream {
+	upstreams, _ := proxy.current()
+	return upstreams
+}
+
+// Status returns the current state of each upstream.
+func (proxy *Proxy) Status() []UpstreamStatus {
+	upstreams := proxy.Upstreams()
+	status := make([]UpstreamStatus, len(upstreams))
+	for i, upstream := range upstreams {
+		status[i] = upstream.Status()
+	}
+	return status
+}
+
+// Tip returns the height of the best chain tip reported by the upstreams, as chosen by the TipMonitor, or zero if it is
+// not known, e.g. because the tip is not being monitored.
+func (proxy *Proxy) Tip() uint64 {
+	upstreams := proxy.Upstreams()
+	heights := make([]uint64, len(upstreams))
+	for i, upstream := range upstreams {
+		heights[i] = upstream.Height()
+	}
+	return bestHeight(heights)
+}
+
+// ProxyRequest sends the request to the upstreams until one of them succeeds, following the retry policy. If every
+// attempt fails, it returns a `types.ErrList` of `types.ErrUpstream` describing each failure. Methods that need a
+// quorum are instead sent to several upstreams at once, and an `ErrNoQuorum` is returned if not enough of them agree.
+// Transactions are broadcast to every upstream, and requests that use an Ethereum filter are sent to the upstream that
+// created it.
 func (proxy *Proxy) ProxyRequest(ctx context.Context, r *http.Request, data []byte) (*http.Response, error) {
-	errs := types.NewErrList(len(proxy.Clients))
-	for {
-		for i, client := range proxy.Clients {
-			select {
-			case <-ctx.Done():
-				return nil, errs
-			default:
-				response, err := client.HandleRequest(r, data)
-				if err != nil {
-					errs[i] = err
-					continue
+	upstreams, options := proxy.current()
+	if len(upstreams) == 0 {
+		return nil, ErrNoUpstreams
+	}
+
+	req := parseRequest(data)
+	if options.Validator != nil {
+		if err := options.Validator.Validate(req.Method, req.Params); err != nil {
+			return syntheticError(req.ID, types.ErrorCodeInvalidParams, err.Error())
+		}
+	}
+	if quorum, ok := options.Quorum[req.Method]; ok {
+		return proxy.proxyQuorum(ctx, r, data, req.Method, quorum)
+	}
+	if _, ok := broadcastMethods[req.Method]; ok && options.Broadcast {
+		return proxy.broadcast(ctx, r, req, data)
+	}
+	if filterCreationMethods[req.Method] {
+		return proxy.newFilter(ctx, r, data)
+	}
+	if filterMethods[req.Method] {
+		return proxy.useFilter(ctx, r, req, data)
+	}
+	_, response, err := proxy.send(ctx, r, data)
+	return response, err
+}
+
+// send sends the request to the upstreams until one of them succeeds, following the retry policy, and returns the
+// upstream that served it.
+func (proxy *Proxy) send(ctx context.Context, r *http.Request, data []byte) (*Upstream, *http.Response, error) {
+	upstreams, options := proxy.current()
+	policy := options.Retry
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = len(upstreams)
+	}
+
+	errs := types.ErrList{}
+	attempt := 0
+	for pass := 0; attempt < maxAttempts; pass++ {
+		if err := sleep(ctx, policy.backoff(pass)); err != nil {
+			return nil, nil, append(errs, err)
+		}
+
+		order := order(upstreams, options)
+		if len(order) == 0 {
+			// No upstream can be used, so fail fast rather than waiting for one to recover.
+			for _, upstream := range upstreams {
+				err := ErrBreakerOpen
+				if upstream.Lagging() {
+					err = ErrLagging
 				}
-				return response, nil
+				errs = append(errs, types.NewErrUpstream(upstream.Name, attempt, true, err))
+			}
+			return nil, nil, errs
+		}
+		for _, upstream := range order {
+			if attempt >= maxAttempts {
+				break
+			}
+
+			response, err := proxy.sendTo(ctx, options, upstream, r, data)
+			if err == ErrBreakerOpen {
+				// The breaker opened after the order was chosen, so this does not count as an attempt.
+				continue
+			}
+			attempt++
+			if err == nil {
+				return upstream, response, nil
+			}
+
+			retryable := policy.retryable(err) && ctx.Err() == nil
+			errs = append(errs, types.NewErrUpstream(upstream.Name, attempt, retryable, err))
+			if !retryable {
+				return nil, nil, errs
 			}
 		}
 	}
+	return nil, nil, errs
+}
+
+// sendTo sends the request to a single upstream, limited by the attempt timeout of the retry policy.
+func (proxy *Proxy) sendTo(ctx context.Context, options Options, upstream *Upstream, r *http.Request, data []byte) (*http.Response, error) {
+	if timeout := options.Retry.AttemptTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	response, err := upstream.handleRequest(ctx, r, data)
+	if err == ErrBreakerOpen || ctx.Err() == context.Canceled {
+		return response, err
+	}
+	proxy.mu.RLock()
+	observer := proxy.observer
+	proxy.mu.RUnlock()
+	if observer != nil {
+		observer.ObserveAttempt(upstream.Name, time.Since(start), err)
+	}
+	return response, err
+}
+
+// order returns the upstreams whose circuit breakers allow requests and that are not lagging behind the best known
+// tip, in the order chosen by the strategy.
+func order(upstreams []*Upstream, options Options) []*Upstream {
+	available := make([]*Upstream, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		if upstream.breaker.Ready() && !upstream.Lagging() {
+			available = append(available, upstream)
+		}
+	}
+	return options.Strategy.Order(available)
+}
+
+// request is the part of a JSON-RPC request used to route it.
+type request struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+// parseRequest returns the method and parameters of the request. Requests that cannot be parsed are routed like any
+// other, and rejected by the upstream.
+func parseRequest(data []byte) request {
+	var req request
+	json.Unmarshal(data, &req)
+	return req
 }
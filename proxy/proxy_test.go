@@ -11,6 +11,7 @@ import (
 	. "github.com/renproject/mercury/proxy"
 
 	"github.com/renproject/mercury/rpc"
+	"github.com/sirupsen/logrus"
 )
 
 var _ = Describe("Proxies", func() {
@@ -68,6 +69,71 @@ var _ = Describe("Proxies", func() {
 			Expect(err).To(HaveOccurred())
 		})
 	})
+
+	Context("when reloading a proxy", func() {
+		It("should finish requests in flight and send new requests to the new upstreams", func() {
+			old := newCountingClient("old", 1, 200*time.Millisecond)
+			replacement := newCountingClient("new", 1, 0)
+			proxy := NewProxy(old)
+
+			req, err := http.NewRequest("POST", "", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := proxy.ProxyRequest(context.Background(), req, nil)
+				done <- err
+			}()
+			Eventually(old.Calls).Should(Equal(int64(1)))
+
+			proxy.Reload(DefaultOptions(), NewUpstream("new", replacement, 1))
+			Expect(proxy.Upstreams()).To(HaveLen(1))
+			Expect(proxy.Upstreams()[0].Name).To(Equal("new"))
+
+			_, err = proxy.ProxyRequest(context.Background(), req, nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(replacement.Calls()).To(Equal(int64(1)))
+
+			Expect(<-done).ToNot(HaveOccurred())
+			Expect(old.Calls()).To(Equal(int64(1)))
+		})
+
+		It("should keep the state of upstreams whose name and URL are unchanged", func() {
+			newUpstream := func(name, url string) *Upstream {
+				upstream := NewUpstream(name, newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":100}`), 1)
+				upstream.URL = url
+				return upstream
+			}
+			options := DefaultOptions()
+			options.Breaker.Cooldown = 50 * time.Millisecond
+			proxy := NewProxyWithOptions(options, newUpstream("fst", "http://fst"), newUpstream("snd", "http://snd"))
+			NewTipMonitor(proxy, TipOptions{Method: "getblockcount"}, logrus.StandardLogger()).Poll(context.Background())
+			for _, upstream := range proxy.Upstreams() {
+				for i := 0; i < options.Breaker.FailureThreshold; i++ {
+					upstream.Breaker().Failure(Ticket{})
+				}
+			}
+
+			options.Breaker.FailureThreshold = 10
+			proxy.Reload(options, newUpstream("fst", "http://fst"), newUpstream("snd", "http://moved"), newUpstream("thd", "http://thd"))
+			Expect(proxy.Upstreams()[0].Healthy()).To(BeFalse())
+			Expect(proxy.Upstreams()[0].Height()).To(Equal(uint64(100)))
+			Expect(proxy.Upstreams()[1].Healthy()).To(BeTrue())
+			Expect(proxy.Upstreams()[1].Height()).To(BeZero())
+			Expect(proxy.Upstreams()[2].Healthy()).To(BeTrue())
+
+			// The breaker that was kept uses the new options once it closes again.
+			breaker := proxy.Upstreams()[0].Breaker()
+			Eventually(breaker.State).Should(Equal(BreakerHalfOpen))
+			ticket, ok := breaker.Allow()
+			Expect(ok).To(BeTrue())
+			breaker.Success(ticket)
+			for i := 0; i < 9; i++ {
+				breaker.Failure(Ticket{})
+			}
+			Expect(breaker.State()).To(Equal(BreakerClosed))
+		})
+	})
 })
 
 type mockClient struct {
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxQuorumResultLength is the length after which results are truncated when describing a disagreement.
+const maxQuorumResultLength = 96
+
+// Quorum configures a method to be sent to several upstreams at once, so that a single lagging or malicious upstream
+// cannot decide the result on its own.
+type Quorum struct {
+	// Size is the number of upstreams the request is sent to. If it is zero, or larger than the number of upstreams,
+	// the request is sent to every available upstream.
+	Size int
+	// Threshold is the number of upstreams that must return the same result. If it is zero, a majority of the size is
+	// needed. It does not depend on how many upstreams are available, so requests fail if fewer are available.
+	Threshold int
+	// Ignore lists fields that are expected to differ between upstreams, such as the number of confirmations. They are
+	// removed at any depth of the result before comparing it.
+	Ignore []string
+}
+
+// QuorumResponse is the normalized result returned by an upstream for a method that needs a quorum.
+type QuorumResponse struct {
+	Upstream string `json:"upstream"`
+	Result   string `json:"result,omitempty"`
+	Err      error  `json:"-"`
+}
+
+// ErrNoQuorum is returned when not enough upstreams agree on the result of a method that needs a quorum.
+type ErrNoQuorum struct {
+	Method    string
+	Threshold int
+	Responses []QuorumResponse
+}
+
+// Error implements the error interface.
+func (err ErrNoQuorum) Error() string {
+	if len(err.Responses) < err.Threshold {
+		return fmt.Sprintf("no quorum for %v: %d upstreams must agree, but %d are available", err.Method, err.Threshold, len(err.Responses))
+	}
+	responses := make([]string, len(err.Responses))
+	for i, response := range err.Responses {
+		if response.Err != nil {
+			responses[i] = fmt.Sprintf("%v: %v", response.Upstream, response.Err)
+			continue
+		}
+		result := response.Result
+		if len(result) > maxQuorumResultLength {
+			result = result[:maxQuorumResultLength] + "..."
+		}
+		responses[i] = fmt.Sprintf("%v: %v", response.Upstream, result)
+	}
+	return fmt.Sprintf("no quorum for %v: %d upstreams must agree, got [%v]", err.Method, err.Threshold, strings.Join(responses, ", "))
+}
+
+// proxyQuorum sends the request to several upstreams in parallel and returns the first response whose result is
+// shared by enough of them. The remaining requests are cancelled once a quorum is reached.
+func (proxy *Proxy) proxyQuorum(ctx context.Context, r *http.Request, data []byte, method string, quorum Quorum) (*http.Response, error) {
+	// The size and threshold are derived from every upstream rather than the available ones, so that the quorum does
+	// not shrink to a single upstream while the others are unavailable.
+	upstreams, options := proxy.current()
+	size := quorum.Size
+	if size <= 0 || size > len(upstreams) {
+		size = len(upstreams)
+	}
+	threshold := quorum.Threshold
+	if threshold <= 0 {
+		threshold = size/2 + 1
+	}
+	upstreams = order(upstreams, options)
+	if len(upstreams) > size {
+		upstreams = upstreams[:size]
+	}
+
+	responses := make([]QuorumResponse, len(upstreams))
+	for i, upstream := range upstreams {
+		responses[i].Upstream = upstream.Name
+	}
+	if len(upstreams) < threshold {
+		return nil, ErrNoQuorum{Method: method, Threshold: threshold, Responses: responses}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		index    int
+		response *http.Response
+		result   string
+		err      error
+	}
+	outcomes := make(chan outcome, len(upstreams))
+	for i, upstream := range upstreams {
+		go func(i int, upstream *Upstream) {
+			response, err := proxy.sendTo(ctx, options, upstream, r, data)
+			o := outcome{index: i, response: response, err: err}
+			if err == nil {
+				o.result, o.err = normalize(response, quorum.Ignore)
+			}
+			outcomes <- o
+		}(i, upstream)
+	}
+
+	agreed := map[string]int{}
+	for n := 0; n < len(upstreams); n++ {
+		o := <-outcomes
+		responses[o.index].Result, responses[o.index].Err = o.result, o.err
+		if o.err != nil {
+			continue
+		}
+		agreed[o.result]++
+		if agreed[o.result] >= threshold {
+			return o.response, nil
+		}
+	}
+	return nil, ErrNoQuorum{Method: method, Threshold: threshold, Responses: responses}
+}
+
+// normalize returns a canonical representation of the result of a response, without the ignored fields, so that it
+// can be compared with the results of other upstreams. JSON-RPC errors are represented by their code, since different
+// nodes word their messages differently. The body of the response can still be read afterwards.
+func normalize(response *http.Response, ignore []string) (string, error) {
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot read response: %v", err)
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	resp := struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code int `json:"code"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", fmt.Errorf("invalid response: %v", err)
+	}
+	if resp.Error != nil {
+		return fmt.Sprintf(`{"error":%d}`, resp.Error.Code), nil
+	}
+	if len(resp.Result) == 0 {
+		return "null", nil
+	}
+
+	var result interface{}
+	decoder := json.NewDecoder(bytes.NewReader(resp.Result))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return "", fmt.Errorf("invalid result: %v", err)
+	}
+	if len(ignore) > 0 {
+		fields := make(map[string]bool, len(ignore))
+		for _, field := range ignore {
+			fields[field] = true
+		}
+		result = removeFields(result, fields)
+	}
+	normalized, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("invalid result: %v", err)
+	}
+	return string(normalized), nil
+}
+
+// removeFields removes the given fields from every object in the value.
+func removeFields(value interface{}, fields map[string]bool) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, v := range value {
+			if fields[key] {
+				delete(value, key)
+				continue
+			}
+			value[key] = removeFields(v, fields)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = removeFields(v, fields)
+		}
+	}
+	return value
+}
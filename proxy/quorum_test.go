@@ -0,0 +1,143 @@
+package proxy_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+)
+
+var _ = Describe("Quorum", func() {
+	request := []byte(`{"jsonrpc":"2.0","id":1,"method":"gettxout","params":["abcd",0]}`)
+
+	newProxy := func(quorum Quorum, clients ...*responseClient) *Proxy {
+		options := DefaultOptions()
+		options.Quorum = map[string]Quorum{"gettxout": quorum}
+		upstreams := make([]*Upstream, len(clients))
+		for i, client := range clients {
+			upstreams[i] = NewUpstream(string('a'+rune(i)), client, 1)
+		}
+		return NewProxyWithOptions(options, upstreams...)
+	}
+
+	send := func(proxy *Proxy, data []byte) (string, error) {
+		req, err := http.NewRequest("POST", "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := proxy.ProxyRequest(context.Background(), req, data)
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return string(body), nil
+	}
+
+	Context("when enough upstreams agree", func() {
+		It("should return the agreed result, ignoring volatile fields", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":{"value":1.5,"confirmations":10}}`)
+			snd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":{"confirmations":11,"value":1.5}}`)
+			thd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			proxy := newProxy(Quorum{Threshold: 2, Ignore: []string{"confirmations"}}, fst, snd, thd)
+
+			body, err := send(proxy, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(ContainSubstring(`"value":1.5`))
+		})
+
+		It("should only send the request to the configured number of upstreams", func() {
+			clients := []*responseClient{
+				newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`),
+				newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`),
+				newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`),
+			}
+			proxy := newProxy(Quorum{Size: 2, Threshold: 2}, clients...)
+
+			_, err := send(proxy, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(clients[0].Calls() + clients[1].Calls() + clients[2].Calls()).To(Equal(int64(2)))
+		})
+	})
+
+	Context("when the upstreams disagree", func() {
+		It("should return an error describing each result", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":{"value":1.5}}`)
+			snd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			thd := newResponseClient(500, `bad gateway`)
+			proxy := newProxy(Quorum{Threshold: 2}, fst, snd, thd)
+
+			_, err := send(proxy, request)
+			Expect(err).To(HaveOccurred())
+			errNoQuorum, ok := err.(ErrNoQuorum)
+			Expect(ok).To(BeTrue())
+			Expect(errNoQuorum.Method).To(Equal("gettxout"))
+			Expect(errNoQuorum.Responses).To(HaveLen(3))
+			Expect(errNoQuorum.Responses[0].Result).To(Equal(`{"value":1.5}`))
+			Expect(errNoQuorum.Responses[1].Result).To(Equal("null"))
+			Expect(errNoQuorum.Responses[2].Err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`a: {"value":1.5}`))
+			Expect(err.Error()).To(ContainSubstring("b: null"))
+		})
+
+		It("should fail if fewer upstreams are available than the threshold", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			proxy := newProxy(Quorum{Threshold: 2}, fst)
+
+			_, err := send(proxy, request)
+			Expect(err).To(HaveOccurred())
+			Expect(fst.Calls()).To(Equal(int64(0)))
+		})
+
+		It("should need a majority of every upstream while some are unavailable", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			snd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			thd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			options := DefaultOptions()
+			options.Quorum = map[string]Quorum{"gettxout": {}}
+			options.Breaker.FailureThreshold = 1
+			proxy := NewProxyWithOptions(options, NewUpstream("a", fst, 1), NewUpstream("b", snd, 1), NewUpstream("c", thd, 1))
+			proxy.Upstreams()[1].Breaker().Failure(Ticket{})
+			proxy.Upstreams()[2].Breaker().Failure(Ticket{})
+
+			_, err := send(proxy, request)
+			Expect(err).To(BeAssignableToTypeOf(ErrNoQuorum{}))
+			Expect(err.(ErrNoQuorum).Threshold).To(Equal(2))
+			Expect(fst.Calls()).To(Equal(int64(0)))
+		})
+	})
+
+	Context("when the method does not need a quorum", func() {
+		It("should use the first upstream that succeeds", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":"a"}`)
+			snd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":"b"}`)
+			proxy := newProxy(Quorum{Threshold: 2}, fst, snd)
+
+			body, err := send(proxy, []byte(`{"jsonrpc":"2.0","id":1,"method":"getblockcount","params":[]}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(ContainSubstring(`"a"`))
+			Expect(snd.Calls()).To(Equal(int64(0)))
+		})
+	})
+
+	Context("when a quorum is reached before every upstream responds", func() {
+		It("should not count the cancelled request as a failure of the slow upstream", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			snd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":null}`)
+			slow := &hangingClient{}
+			options := DefaultOptions()
+			options.Quorum = map[string]Quorum{"gettxout": {Threshold: 2}}
+			options.Breaker.FailureThreshold = 1
+			proxy := NewProxyWithOptions(options, NewUpstream("a", fst, 1), NewUpstream("b", snd, 1), NewUpstream("slow", slow, 1))
+
+			start := time.Now()
+			_, err := send(proxy, request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Eventually(func() int { return proxy.Upstreams()[2].Outstanding() }).Should(Equal(0))
+			Expect(proxy.Upstreams()[2].Healthy()).To(BeTrue())
+		})
+	})
+})
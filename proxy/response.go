@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/renproject/mercury/types"
+)
+
+// rewrite returns the JSON object with the given field replaced.
+func rewrite(data []byte, field string, value interface{}) ([]byte, error) {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, fmt.Errorf("invalid json: %v", err)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	object[field] = raw
+	return json.Marshal(object)
+}
+
+// rewriteResponse replaces a field of the body of the response.
+func rewriteResponse(response *http.Response, field string, value interface{}) (*http.Response, error) {
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response: %v", err)
+	}
+	body, err = rewrite(body, field, value)
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+	return response, nil
+}
+
+// syntheticResponse returns a successful JSON-RPC response that was not sent by an upstream.
+func syntheticResponse(id json.RawMessage, result interface{}) (*http.Response, error) {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	body, err := json.Marshal(struct {
+		Version string          `json:"jsonrpc"`
+		ID      json.RawMessage `json:"id"`
+		Result  interface{}     `json:"result"`
+	}{"2.0", id, result})
+	if err != nil {
+		return nil, err
+	}
+	return newResponse(body), nil
+}
+
+// syntheticError returns a JSON-RPC error response that was not sent by an upstream.
+func syntheticError(id json.RawMessage, code int, message string) (*http.Response, error) {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	body, err := json.Marshal(types.JSONResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error: &types.JSONError{
+			Code:    code,
+			Message: message,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newResponse(body), nil
+}
+
+// newResponse returns a successful HTTP response with the given JSON body.
+func newResponse(body []byte) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/renproject/mercury/rpc"
+)
+
+// RetryPolicy determines how many times a request is attempted, and how long the proxy waits between attempts. Each
+// attempt sends the request to one upstream, in the order chosen by the strategy. Once every upstream has been tried,
+// the proxy backs off before starting the next pass.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts for a request. If it is zero, each upstream is tried once.
+	MaxAttempts int
+	// InitialBackoff is how long the proxy waits after the first pass over the upstreams.
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum time the proxy waits between passes.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the backoff grows after each pass.
+	Multiplier float64
+	// Jitter is the fraction by which the backoff is randomly increased or decreased, so that requests that failed
+	// together are not retried together.
+	Jitter float64
+	// AttemptTimeout is how long each attempt can take. If it is zero, attempts are only limited by the context of the
+	// request.
+	AttemptTimeout time.Duration
+	// Retryable returns whether a request that failed with the given error may succeed if it is sent again.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy returns the retry policy used by NewProxy: each request is attempted at most 3 times with an
+// exponential backoff starting at 100 milliseconds, and each attempt can take at most 15 seconds.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     2 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		AttemptTimeout: 15 * time.Second,
+		Retryable:      IsRetryable,
+	}
+}
+
+// IsRetryable returns whether a request that failed with the given error may succeed if it is sent again. Requests
+// that could not be constructed, or whose context was cancelled, are not retryable. All other failures are assumed to
+// be specific to the upstream, or transient.
+func IsRetryable(err error) bool {
+	switch err.(type) {
+	case rpc.ErrInvalidRequest:
+		return false
+	}
+	return err != context.Canceled
+}
+
+// backoff returns how long to wait before the given pass over the upstreams. The first pass starts immediately.
+func (policy RetryPolicy) backoff(pass int) time.Duration {
+	if pass <= 0 {
+		return 0
+	}
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(policy.InitialBackoff) * math.Pow(multiplier, float64(pass-1))
+	if policy.MaxBackoff > 0 && backoff > float64(policy.MaxBackoff) {
+		backoff = float64(policy.MaxBackoff)
+	}
+	if policy.Jitter > 0 {
+		backoff *= 1 + policy.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(backoff)
+}
+
+// retryable returns whether the error is retryable according to the policy.
+func (policy RetryPolicy) retryable(err error) bool {
+	if policy.Retryable == nil {
+		return IsRetryable(err)
+	}
+	return policy.Retryable(err)
+}
+
+// sleep waits for the given duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
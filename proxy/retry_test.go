@@ -0,0 +1,117 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+
+	"github.com/renproject/mercury/rpc"
+	"github.com/renproject/mercury/types"
+)
+
+var _ = Describe("Retries", func() {
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest("POST", "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		return req
+	}
+
+	Context("when every client fails", func() {
+		It("should stop after the maximum number of attempts and describe each failure", func() {
+			fst, snd := newCountingClient("fst", 1, 0), newCountingClient("snd", 1, 0)
+			fst.fail, snd.fail = 1, 1
+
+			options := DefaultOptions()
+			options.Retry.MaxAttempts = 5
+			options.Retry.InitialBackoff = 10 * time.Millisecond
+			proxy := NewProxyWithOptions(options, NewUpstream("fst", fst, 1), NewUpstream("snd", snd, 1))
+
+			resp, err := proxy.ProxyRequest(context.Background(), newRequest(), nil)
+			Expect(resp).To(BeNil())
+			Expect(fst.Calls() + snd.Calls()).To(Equal(int64(5)))
+
+			errs, ok := err.(types.ErrList)
+			Expect(ok).To(BeTrue())
+			Expect(errs).To(HaveLen(5))
+			for i, err := range errs {
+				upstreamErr, ok := err.(types.ErrUpstream)
+				Expect(ok).To(BeTrue())
+				Expect(upstreamErr.Attempt).To(Equal(i + 1))
+				Expect(upstreamErr.Retryable).To(BeTrue())
+				Expect(upstreamErr.Upstream).To(BeElementOf("fst", "snd"))
+			}
+		})
+
+		It("should back off between passes over the clients", func() {
+			client := newCountingClient("client", 1, 0)
+			client.fail = 1
+
+			options := DefaultOptions()
+			options.Retry.MaxAttempts = 4
+			options.Retry.InitialBackoff = 50 * time.Millisecond
+			options.Retry.Jitter = 0
+			options.Breaker.FailureThreshold = 5
+			proxy := NewProxyWithOptions(options, NewUpstream("client", client, 1))
+
+			start := time.Now()
+			_, err := proxy.ProxyRequest(context.Background(), newRequest(), nil)
+			Expect(err).To(HaveOccurred())
+
+			// The backoffs are 50ms, 100ms and 200ms.
+			Expect(time.Since(start)).To(BeNumerically(">=", 350*time.Millisecond))
+			Expect(client.Calls()).To(Equal(int64(4)))
+		})
+	})
+
+	Context("when a client hangs", func() {
+		It("should time out the attempt and use the next client", func() {
+			hanging := &hangingClient{}
+			working := newCountingClient("working", 1, 0)
+
+			options := DefaultOptions()
+			options.Retry.AttemptTimeout = 50 * time.Millisecond
+			proxy := NewProxyWithOptions(options, NewUpstream("hanging", hanging, 1), NewUpstream("working", working, 1))
+
+			resp, err := proxy.ProxyRequest(context.Background(), newRequest(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(atomic.LoadInt64(&hanging.calls)).To(Equal(int64(1)))
+		})
+	})
+
+	Context("when a failure is not retryable", func() {
+		It("should return immediately", func() {
+			invalid := &invalidClient{}
+			working := newCountingClient("working", 1, 0)
+			proxy := NewProxyWithOptions(DefaultOptions(), NewUpstream("invalid", invalid, 1), NewUpstream("working", working, 1))
+
+			_, err := proxy.ProxyRequest(context.Background(), newRequest(), nil)
+			Expect(err).To(HaveOccurred())
+			Expect(working.Calls()).To(Equal(int64(0)))
+		})
+	})
+})
+
+// hangingClient never responds until the request is cancelled.
+type hangingClient struct {
+	calls int64
+}
+
+func (client *hangingClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	atomic.AddInt64(&client.calls, 1)
+	<-r.Context().Done()
+	return nil, r.Context().Err()
+}
+
+// invalidClient cannot construct requests.
+type invalidClient struct{}
+
+func (client *invalidClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	return nil, rpc.NewErrInvalidRequest(errors.New("invalid url"))
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+// Strategy selects the order in which upstreams are tried for a request.
+type Strategy interface {
+	// Order returns the upstreams in the order they should be tried. It must not modify the given slice.
+	Order(upstreams []*Upstream) []*Upstream
+}
+
+// Ordered returns a strategy that always tries upstreams in the order they were given to the proxy.
+func Ordered() Strategy {
+	return ordered{}
+}
+
+type ordered struct{}
+
+func (ordered) Order(upstreams []*Upstream) []*Upstream {
+	return upstreams
+}
+
+// RoundRobin returns a strategy that starts each request at the next upstream in turn.
+func RoundRobin() Strategy {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+func (strategy *roundRobin) Order(upstreams []*Upstream) []*Upstream {
+	if len(upstreams) == 0 {
+		return upstreams
+	}
+	start := int((atomic.AddUint64(&strategy.next, 1) - 1) % uint64(len(upstreams)))
+	order := make([]*Upstream, 0, len(upstreams))
+	order = append(order, upstreams[start:]...)
+	return append(order, upstreams[:start]...)
+}
+
+// Weighted returns a strategy that picks upstreams at random, in proportion to their weights.
+func Weighted() Strategy {
+	return weighted{}
+}
+
+type weighted struct{}
+
+func (weighted) Order(upstreams []*Upstream) []*Upstream {
+	remaining := make([]*Upstream, len(upstreams))
+	copy(remaining, upstreams)
+
+	order := make([]*Upstream, 0, len(upstreams))
+	for len(remaining) > 0 {
+		total := 0
+		for _, upstream := range remaining {
+			total += upstream.Weight
+		}
+		pick := rand.Intn(total)
+		for i, upstream := range remaining {
+			pick -= upstream.Weight
+			if pick < 0 {
+				order = append(order, upstream)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return order
+}
+
+// LeastOutstanding returns a strategy that prefers the upstreams currently handling the fewest requests.
+func LeastOutstanding() Strategy {
+	return leastOutstanding{}
+}
+
+type leastOutstanding struct{}
+
+func (leastOutstanding) Order(upstreams []*Upstream) []*Upstream {
+	outstanding := make(map[*Upstream]int, len(upstreams))
+	for _, upstream := range upstreams {
+		outstanding[upstream] = upstream.Outstanding()
+	}
+	return sortedBy(upstreams, func(a, b *Upstream) bool {
+		return outstanding[a] < outstanding[b]
+	})
+}
+
+// LowestLatency returns a strategy that prefers the upstreams with the lowest moving average latency. Upstreams that
+// have not been measured yet are preferred, so that every upstream gets measured.
+func LowestLatency() Strategy {
+	return lowestLatency{}
+}
+
+type lowestLatency struct{}
+
+func (lowestLatency) Order(upstreams []*Upstream) []*Upstream {
+	latency := make(map[*Upstream]int64, len(upstreams))
+	for _, upstream := range upstreams {
+		latency[upstream] = int64(upstream.Latency())
+	}
+	return sortedBy(upstreams, func(a, b *Upstream) bool {
+		return latency[a] < latency[b]
+	})
+}
+
+// NewStrategy returns the strategy with the given name: "ordered", "round-robin", "weighted", "least-outstanding" or
+// "lowest-latency". It returns false if the name is unknown.
+func NewStrategy(name string) (Strategy, bool) {
+	switch name {
+	case "ordered", "":
+		return Ordered(), true
+	case "round-robin":
+		return RoundRobin(), true
+	case "weighted":
+		return Weighted(), true
+	case "least-outstanding":
+		return LeastOutstanding(), true
+	case "lowest-latency":
+		return LowestLatency(), true
+	default:
+		return nil, false
+	}
+}
+
+// sortedBy returns a sorted copy of the upstreams. Upstreams that compare equal keep their original order.
+func sortedBy(upstreams []*Upstream, less func(a, b *Upstream) bool) []*Upstream {
+	order := make([]*Upstream, len(upstreams))
+	copy(order, upstreams)
+	sort.SliceStable(order, func(i, j int) bool {
+		return less(order[i], order[j])
+	})
+	return order
+}
@@ -0,0 +1,153 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+)
+
+var _ = Describe("Strategies", func() {
+	send := func(proxy *Proxy) {
+		req, err := http.NewRequest("POST", "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = proxy.ProxyRequest(context.Background(), req, nil)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	newProxy := func(strategy Strategy, clients ...*countingClient) *Proxy {
+		options := DefaultOptions()
+		options.Strategy = strategy
+		upstreams := make([]*Upstream, len(clients))
+		for i, client := range clients {
+			upstreams[i] = NewUpstream(client.name, client, client.weight)
+		}
+		return NewProxyWithOptions(options, upstreams...)
+	}
+
+	Context("when using the ordered strategy", func() {
+		It("should send every request to the first client", func() {
+			fst, snd := newCountingClient("fst", 1, 0), newCountingClient("snd", 1, 0)
+			proxy := newProxy(Ordered(), fst, snd)
+			for i := 0; i < 10; i++ {
+				send(proxy)
+			}
+			Expect(fst.Calls()).To(Equal(int64(10)))
+			Expect(snd.Calls()).To(Equal(int64(0)))
+		})
+	})
+
+	Context("when using the round-robin strategy", func() {
+		It("should spread requests evenly", func() {
+			clients := []*countingClient{newCountingClient("a", 1, 0), newCountingClient("b", 1, 0), newCountingClient("c", 1, 0)}
+			proxy := newProxy(RoundRobin(), clients...)
+			for i := 0; i < 30; i++ {
+				send(proxy)
+			}
+			for _, client := range clients {
+				Expect(client.Calls()).To(Equal(int64(10)))
+			}
+		})
+	})
+
+	Context("when using the weighted strategy", func() {
+		It("should spread requests in proportion to the weights", func() {
+			light, heavy := newCountingClient("light", 1, 0), newCountingClient("heavy", 9, 0)
+			proxy := newProxy(Weighted(), light, heavy)
+			for i := 0; i < 1000; i++ {
+				send(proxy)
+			}
+			Expect(heavy.Calls()).To(BeNumerically(">", 800))
+			Expect(light.Calls()).To(BeNumerically(">", 0))
+		})
+	})
+
+	Context("when using the least-outstanding strategy", func() {
+		It("should avoid clients that are busy", func() {
+			slow, fast := newCountingClient("slow", 1, 500*time.Millisecond), newCountingClient("fast", 1, 0)
+			proxy := newProxy(LeastOutstanding(), slow, fast)
+
+			go send(proxy)
+			time.Sleep(100 * time.Millisecond)
+			for i := 0; i < 10; i++ {
+				send(proxy)
+			}
+			Expect(slow.Calls()).To(Equal(int64(1)))
+			Expect(fast.Calls()).To(Equal(int64(10)))
+		})
+	})
+
+	Context("when using the lowest-latency strategy", func() {
+		It("should prefer the fastest client once both are measured", func() {
+			slow, fast := newCountingClient("slow", 1, 50*time.Millisecond), newCountingClient("fast", 1, 0)
+			proxy := newProxy(LowestLatency(), slow, fast)
+			for i := 0; i < 10; i++ {
+				send(proxy)
+			}
+			Expect(slow.Calls()).To(Equal(int64(1)))
+			Expect(fast.Calls()).To(Equal(int64(9)))
+			Expect(proxy.Upstreams()[0].Latency()).To(BeNumerically(">", proxy.Upstreams()[1].Latency()))
+		})
+	})
+
+	Context("when a client keeps failing", func() {
+		It("should remove it from rotation and probe it again after the cooldown", func() {
+			failing, healthy := newCountingClient("failing", 1, 0), newCountingClient("healthy", 1, 0)
+			failing.fail = 1
+
+			options := DefaultOptions()
+			options.Breaker = BreakerOptions{FailureThreshold: 2, Cooldown: 200 * time.Millisecond}
+			proxy := NewProxyWithOptions(options, NewUpstream("failing", failing, 1), NewUpstream("healthy", healthy, 1))
+
+			for i := 0; i < 10; i++ {
+				send(proxy)
+			}
+			Expect(failing.Calls()).To(Equal(int64(2)))
+			Expect(proxy.Upstreams()[0].Healthy()).To(BeFalse())
+
+			// Once the cooldown has elapsed, the next request probes the failing client.
+			atomic.StoreInt32(&failing.fail, 0)
+			time.Sleep(300 * time.Millisecond)
+			send(proxy)
+			Expect(failing.Calls()).To(Equal(int64(3)))
+			Expect(proxy.Upstreams()[0].Healthy()).To(BeTrue())
+		})
+	})
+})
+
+// countingClient counts the requests it receives and responds after a delay.
+type countingClient struct {
+	name   string
+	weight int
+	delay  time.Duration
+	fail   int32
+	calls  int64
+}
+
+func newCountingClient(name string, weight int, delay time.Duration) *countingClient {
+	return &countingClient{
+		name:   name,
+		weight: weight,
+		delay:  delay,
+	}
+}
+
+func (client *countingClient) Calls() int64 {
+	return atomic.LoadInt64(&client.calls)
+}
+
+func (client *countingClient) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
+	atomic.AddInt64(&client.calls, 1)
+	time.Sleep(client.delay)
+	if atomic.LoadInt32(&client.fail) != 0 {
+		return nil, errors.New("error")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+	}, nil
+}
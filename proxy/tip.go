@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrLagging is returned when a request is not sent to an upstream because it is too far behind the best known tip.
+var ErrLagging = errors.New("upstream is behind the chain tip")
+
+// TipOptions configure a TipMonitor.
+type TipOptions struct {
+	// Method returns the height of the chain tip known by a node, such as `getblockcount` or `eth_blockNumber`.
+	Method string
+	// Interval is the time between polls.
+	Interval time.Duration
+	// Timeout limits how long each upstream has to respond to a poll.
+	Timeout time.Duration
+	// MaxLag is the number of blocks an upstream can be behind the best known tip before it is taken out of rotation.
+	MaxLag uint64
+}
+
+// TipMonitor polls the upstreams of a proxy for the height of their chain tip, and takes upstreams that are too far
+// behind the best known tip out of rotation until they catch up.
+type TipMonitor struct {
+	proxy   *Proxy
+	options TipOptions
+	logger  logrus.FieldLogger
+}
+
+// NewTipMonitor returns a new TipMonitor for the upstreams of the proxy.
+func NewTipMonitor(proxy *Proxy, options TipOptions, logger logrus.FieldLogger) *TipMonitor {
+	if options.Interval <= 0 {
+		options.Interval = 15 * time.Second
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 10 * time.Second
+	}
+	return &TipMonitor{
+		proxy:   proxy,
+		options: options,
+		logger:  logger,
+	}
+}
+
+// Run polls the upstreams until the context is done.
+func (monitor *TipMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(monitor.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		monitor.Poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll queries every upstream for the height of its tip and updates how far each of them is behind the best tip. The
+// best tip is found using bestHeight from the heights reported in this poll; upstreams that do not respond keep their
+// previous height.
+func (monitor *TipMonitor) Poll(ctx context.Context) {
+	upstreams := monitor.proxy.Upstreams()
+	heights := make([]uint64, len(upstreams))
+	errs := make([]error, len(upstreams))
+
+	wg := new(sync.WaitGroup)
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func(i int, upstream *Upstream) {
+			defer wg.Done()
+			heights[i], errs[i] = monitor.height(ctx, upstream)
+		}(i, upstream)
+	}
+	wg.Wait()
+
+	reported := make([]uint64, 0, len(upstreams))
+	for i := range upstreams {
+		if errs[i] == nil {
+			reported = append(reported, heights[i])
+		}
+	}
+	best := bestHeight(reported)
+	if best == 0 {
+		monitor.logger.Warnf("cannot get the chain tip from any upstream")
+		return
+	}
+	for i, upstream := range upstreams {
+		if errs[i] != nil {
+			monitor.logger.Debugf("cannot get the chain tip from upstream %v: %v", upstream.Name, errs[i])
+			upstream.setTip(upstream.Height(), best, monitor.options.MaxLag)
+			continue
+		}
+		upstream.setTip(heights[i], best, monitor.options.MaxLag)
+	}
+}
+
+// bestHeight returns the height of the best chain tip, or zero if no height is known. When three or more upstreams
+// report a height, it is the highest height reached by at least two of them, so that a single upstream reporting a
+// bogus height cannot take the others out of rotation, or make recent blocks look final.
+func bestHeight(heights []uint64) uint64 {
+	known := make([]uint64, 0, len(heights))
+	for _, height := range heights {
+		if height > 0 {
+			known = append(known, height)
+		}
+	}
+	if len(known) == 0 {
+		return 0
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i] > known[j] })
+	if len(known) >= 3 {
+		return known[1]
+	}
+	return known[0]
+}
+
+// height returns the height of the chain tip known by the upstream.
+func (monitor *TipMonitor) height(ctx context.Context, upstream *Upstream) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, monitor.options.Timeout)
+	defer cancel()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  monitor.options.Method,
+		"params":  []interface{}{},
+	})
+	if err != nil {
+		return 0, err
+	}
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := upstream.Client.HandleRequest(r.WithContext(ctx), data)
+	if err != nil {
+		return 0, err
+	}
+	if response.Body == nil {
+		return 0, fmt.Errorf("empty response")
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read response: %v", err)
+	}
+	if err := Classify(response.StatusCode, body); err != nil {
+		return 0, err
+	}
+	resp := struct {
+		Result json.RawMessage `json:"result"`
+	}{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, fmt.Errorf("invalid response: %v", err)
+	}
+	return parseHeight(resp.Result)
+}
+
+// parseHeight parses a block height returned as a number, or as a hex string by Ethereum nodes.
+func parseHeight(result json.RawMessage) (uint64, error) {
+	var hex string
+	if err := json.Unmarshal(result, &hex); err == nil {
+		if !strings.HasPrefix(hex, "0x") {
+			return 0, fmt.Errorf("invalid height: %v", hex)
+		}
+		return strconv.ParseUint(strings.TrimPrefix(hex, "0x"), 16, 64)
+	}
+	var height uint64
+	if err := json.Unmarshal(result, &height); err != nil {
+		return 0, fmt.Errorf("invalid height: %s", result)
+	}
+	return height, nil
+}
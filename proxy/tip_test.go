@@ -0,0 +1,109 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+
+	"github.com/renproject/mercury/types"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Tip monitor", func() {
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest("POST", "", nil)
+		Expect(err).ToNot(HaveOccurred())
+		return req
+	}
+
+	Context("when an upstream is behind the best tip", func() {
+		It("should take it out of rotation until it catches up", func() {
+			lagging := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":100}`)
+			synced := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":110}`)
+			proxy := NewProxy(lagging, synced)
+			monitor := NewTipMonitor(proxy, TipOptions{Method: "getblockcount", MaxLag: 5}, logrus.StandardLogger())
+
+			monitor.Poll(context.Background())
+			Expect(proxy.Upstreams()[0].Lagging()).To(BeTrue())
+			Expect(proxy.Upstreams()[1].Lagging()).To(BeFalse())
+
+			status := proxy.Status()
+			Expect(status[0].Height).To(Equal(uint64(100)))
+			Expect(status[0].Lag).To(Equal(uint64(10)))
+			Expect(status[1].Lag).To(Equal(uint64(0)))
+
+			_, err := proxy.ProxyRequest(context.Background(), newRequest(), nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lagging.Calls()).To(Equal(int64(1)))
+			Expect(synced.Calls()).To(Equal(int64(2)))
+
+			lagging.body = `{"jsonrpc":"2.0","id":1,"result":108}`
+			monitor.Poll(context.Background())
+			Expect(proxy.Upstreams()[0].Lagging()).To(BeFalse())
+			Expect(proxy.Upstreams()[0].Lag()).To(Equal(uint64(2)))
+		})
+
+		It("should parse hex heights returned by Ethereum nodes", func() {
+			lagging := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":"0x10"}`)
+			synced := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":"0x20"}`)
+			proxy := NewProxy(lagging, synced)
+			NewTipMonitor(proxy, TipOptions{Method: "eth_blockNumber", MaxLag: 5}, logrus.StandardLogger()).Poll(context.Background())
+
+			Expect(proxy.Upstreams()[0].Height()).To(Equal(uint64(16)))
+			Expect(proxy.Upstreams()[0].Lag()).To(Equal(uint64(16)))
+			Expect(proxy.Upstreams()[0].Lagging()).To(BeTrue())
+		})
+	})
+
+	Context("when an upstream reports a height far ahead of the others", func() {
+		It("should not take the others out of rotation", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":100}`)
+			snd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":101}`)
+			bogus := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":1000000}`)
+			proxy := NewProxy(fst, snd, bogus)
+			NewTipMonitor(proxy, TipOptions{Method: "getblockcount", MaxLag: 5}, logrus.StandardLogger()).Poll(context.Background())
+
+			Expect(proxy.Upstreams()[0].Lagging()).To(BeFalse())
+			Expect(proxy.Upstreams()[1].Lagging()).To(BeFalse())
+			Expect(proxy.Upstreams()[0].Lag()).To(Equal(uint64(1)))
+			Expect(proxy.Tip()).To(Equal(uint64(101)))
+		})
+	})
+
+	Context("when the best upstream stops responding", func() {
+		It("should measure the lag against the upstreams that respond", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":100}`)
+			snd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":110}`)
+			proxy := NewProxy(fst, snd)
+			monitor := NewTipMonitor(proxy, TipOptions{Method: "getblockcount", MaxLag: 5}, logrus.StandardLogger())
+			monitor.Poll(context.Background())
+			Expect(proxy.Upstreams()[0].Lagging()).To(BeTrue())
+
+			snd.statusCode, snd.body = 502, "bad gateway"
+			monitor.Poll(context.Background())
+			Expect(proxy.Upstreams()[0].Lagging()).To(BeFalse())
+			Expect(proxy.Upstreams()[1].Height()).To(Equal(uint64(110)))
+		})
+	})
+
+	Context("when every upstream is lagging or unavailable", func() {
+		It("should fail fast and say why", func() {
+			fst := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":100}`)
+			snd := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":110}`)
+			proxy := NewProxy(fst, snd)
+			NewTipMonitor(proxy, TipOptions{Method: "getblockcount", MaxLag: 5}, logrus.StandardLogger()).Poll(context.Background())
+			for i := 0; i < 3; i++ {
+				proxy.Upstreams()[1].Breaker().Failure(Ticket{})
+			}
+
+			_, err := proxy.ProxyRequest(context.Background(), newRequest(), nil)
+			errs, ok := err.(types.ErrList)
+			Expect(ok).To(BeTrue())
+			Expect(errs[0].(types.ErrUpstream).Err).To(Equal(ErrLagging))
+			Expect(errs[1].(types.ErrUpstream).Err).To(Equal(ErrBreakerOpen))
+		})
+	})
+})
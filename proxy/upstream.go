@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/renproject/mercury/rpc"
+)
+
+// latencyDecay is the weight given to the latest observation when updating the moving average of the latency of an
+// upstream.
+const latencyDecay = 0.3
+
+// Upstream is a client used by a Proxy, along with the state used to select between clients.
+type Upstream struct {
+	Name   string
+	Client rpc.Client
+	Weight int
+	// URL is the address of the node behind the client, if it is known. Together with the name, it identifies the
+	// upstream when the proxy is reloaded.
+	URL string
+
+	index   int
+	breaker *Breaker
+
+	mu          *sync.Mutex
+	outstanding int
+	latency     time.Duration
+	height      uint64
+	lag         uint64
+	lagging     bool
+}
+
+// UpstreamStatus describes the state of an upstream.
+type UpstreamStatus struct {
+	Name        string       `json:"name"`
+	Breaker     BreakerState `json:"breaker"`
+	Failures    int          `json:"failures"`
+	Outstanding int          `json:"outstanding"`
+	LatencyMs   float64      `json:"latencyMs"`
+	Height      uint64       `json:"height"`
+	Lag         uint64       `json:"lag"`
+	Lagging     bool         `json:"lagging"`
+}
+
+// NewUpstream returns a new Upstream. The weight is only used by the weighted strategy; weights less than one are
+// treated as one.
+func NewUpstream(name string, client rpc.Client, weight int) *Upstream {
+	if weight < 1 {
+		weight = 1
+	}
+	return &Upstream{
+		Name:    name,
+		Client:  client,
+		Weight:  weight,
+		breaker: NewBreaker(DefaultOptions().Breaker),
+		mu:      new(sync.Mutex),
+	}
+}
+
+// Outstanding returns the number of requests currently being handled by the upstream.
+func (upstream *Upstream) Outstanding() int {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	return upstream.outstanding
+}
+
+// Latency returns the exponentially weighted moving average of the latency of successful requests. It is zero if no
+// request has succeeded yet.
+func (upstream *Upstream) Latency() time.Duration {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	return upstream.latency
+}
+
+// Height returns the height of the chain tip last reported by the upstream. It is zero if the chain tip is not
+// monitored.
+func (upstream *Upstream) Height() uint64 {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	return upstream.height
+}
+
+// Lag returns the number of blocks the upstream was behind the best known tip when it was last polled.
+func (upstream *Upstream) Lag() uint64 {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	return upstream.lag
+}
+
+// Lagging returns whether the upstream is too far behind the best known tip to be used.
+func (upstream *Upstream) Lagging() bool {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	return upstream.lagging
+}
+
+// Breaker returns the circuit breaker of the upstream.
+func (upstream *Upstream) Breaker() *Breaker {
+	return upstream.breaker
+}
+
+// Healthy returns whether the circuit breaker of the upstream is closed.
+func (upstream *Upstream) Healthy() bool {
+	return upstream.breaker.State() == BreakerClosed
+}
+
+// Status returns the current state of the upstream.
+func (upstream *Upstream) Status() UpstreamStatus {
+	status := UpstreamStatus{
+		Name:     upstream.Name,
+		Breaker:  upstream.breaker.State(),
+		Failures: upstream.breaker.Failures(),
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	status.Outstanding = upstream.outstanding
+	status.LatencyMs = float64(upstream.latency) / float64(time.Millisecond)
+	status.Height = upstream.height
+	status.Lag = upstream.lag
+	status.Lagging = upstream.lagging
+	return status
+}
+
+// inherit takes over the circuit breaker, latency and chain tip of an upstream which it replaces, so that reloading the
+// proxy does not send requests to upstreams that are known to be failing or behind. The breaker is given the options
+// of the new upstream.
+func (upstream *Upstream) inherit(previous *Upstream, options BreakerOptions) {
+	previous.breaker.setOptions(options)
+	upstream.breaker = previous.breaker
+
+	previous.mu.Lock()
+	latency, height, lag, lagging := previous.latency, previous.height, previous.lag, previous.lagging
+	previous.mu.Unlock()
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	upstream.latency, upstream.height, upstream.lag, upstream.lagging = latency, height, lag, lagging
+}
+
+// setTip records the height of the chain tip of the upstream, and whether it is too far behind the best tip.
+func (upstream *Upstream) setTip(height, best, maxLag uint64) {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	upstream.height = height
+	upstream.lag = 0
+	if best > height {
+		upstream.lag = best - height
+	}
+	upstream.lagging = upstream.lag > maxLag
+}
+
+// handleRequest forwards the request to the client if its circuit breaker allows it, and records the outcome. The
+// response body is read before returning, so that the attempt can be cancelled as soon as it completes.
+func (upstream *Upstream) handleRequest(ctx context.Context, r *http.Request, data []byte) (*http.Response, error) {
+	ticket, ok := upstream.breaker.Allow()
+	if !ok {
+		return nil, ErrBreakerOpen
+	}
+
+	upstream.mu.Lock()
+	upstream.outstanding++
+	upstream.mu.Unlock()
+
+	start := time.Now()
+	response, err := upstream.send(ctx, r, data)
+	if err != nil && ctx.Err() == context.Canceled {
+		// The request was abandoned by the caller, which says nothing about the health of the upstream.
+		upstream.release(ticket)
+		return nil, err
+	}
+	upstream.record(ticket, err == nil, time.Since(start))
+	return response, err
+}
+
+// send forwards the request to the client and reads the response body. Responses that indicate a problem with the
+// upstream are returned as errors.
+func (upstream *Upstream) send(ctx context.Context, r *http.Request, data []byte) (*http.Response, error) {
+	response, err := upstream.Client.HandleRequest(r.WithContext(ctx), data)
+	if err != nil {
+		return nil, err
+	}
+	if response.Body == nil {
+		response.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response: %v", err)
+	}
+	if err := Classify(response.StatusCode, body); err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return response, nil
+}
+
+// release updates the state of the upstream after a request has been abandoned.
+func (upstream *Upstream) release(ticket Ticket) {
+	upstream.breaker.Release(ticket)
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	upstream.outstanding--
+}
+
+// record updates the state of the upstream after a request has been handled.
+func (upstream *Upstream) record(ticket Ticket, success bool, latency time.Duration) {
+	if success {
+		upstream.breaker.Success(ticket)
+	} else {
+		upstream.breaker.Failure(ticket)
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	upstream.outstanding--
+	if !success {
+		return
+	}
+	if upstream.latency == 0 {
+		upstream.latency = latency
+	} else {
+		upstream.latency = time.Duration(latencyDecay*float64(latency) + (1-latencyDecay)*float64(upstream.latency))
+	}
+}
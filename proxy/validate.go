@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	coretypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/types/ethtypes"
+)
+
+const (
+	// MaxBtcTxSize is the largest Bitcoin-family transaction, in bytes, that nodes relay by default.
+	MaxBtcTxSize = 100000
+	// MaxEthTxSize is the largest Ethereum transaction, in bytes, that nodes accept into their pool.
+	MaxEthTxSize = 128 * 1024
+
+	// btcDustLimit is the smallest value, in satoshis, of an output that nodes relay by default. Outputs to SegWit
+	// public key hashes are cheaper to spend, and so have a lower limit.
+	btcDustLimit        = 546
+	btcWitnessDustLimit = 294
+
+	// maxEthTxType is the largest type of a typed Ethereum transaction (EIP-2718). Legacy transactions are RLP lists,
+	// which start with a byte of at least 0xc0.
+	maxEthTxType = 0x7f
+)
+
+// Validator checks the parameters of a request before it is forwarded, so that requests that would be rejected by
+// every upstream do not use up their quota.
+type Validator interface {
+	// Validate returns an error describing why the request is invalid, or nil if it can be forwarded.
+	Validate(method string, params []json.RawMessage) error
+}
+
+// ErrInvalidTx is returned when a submitted transaction fails validation.
+type ErrInvalidTx struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (err ErrInvalidTx) Error() string {
+	return fmt.Sprintf("invalid transaction: %v", err.Reason)
+}
+
+func newErrInvalidTx(format string, args ...interface{}) error {
+	return ErrInvalidTx{Reason: fmt.Sprintf(format, args...)}
+}
+
+// NewTxValidator returns a Validator for the transactions submitted on the network. Requests other than transaction
+// submissions are not checked.
+func NewTxValidator(network types.Network) Validator {
+	switch network.Chain() {
+	case types.Ethereum:
+		if network, ok := network.(ethtypes.Network); ok {
+			return ethValidator{network: network}
+		}
+		return ethValidator{}
+	case types.ZCash:
+		// ZCash transactions cannot be decoded by `wire`, so only their encoding and size are checked.
+		return btcValidator{decode: false}
+	default:
+		return btcValidator{decode: true}
+	}
+}
+
+// btcValidator validates Bitcoin-family transactions submitted using `sendrawtransaction`.
+type btcValidator struct {
+	decode bool
+}
+
+// Validate implements the `Validator` interface.
+func (validator btcValidator) Validate(method string, params []json.RawMessage) error {
+	if method != "sendrawtransaction" {
+		return nil
+	}
+	data, err := rawTx(params, false)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxBtcTxSize {
+		return newErrInvalidTx("size of %d bytes exceeds the maximum of %d bytes", len(data), MaxBtcTxSize)
+	}
+	if !validator.decode {
+		return nil
+	}
+
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(data)); err != nil {
+		// A transaction without inputs looks like the start of a SegWit transaction, so try decoding it without one.
+		tx = wire.NewMsgTx(wire.TxVersion)
+		if tx.DeserializeNoWitness(bytes.NewReader(data)) != nil {
+			return newErrInvalidTx("cannot decode: %v", err)
+		}
+	}
+	if len(tx.TxIn) == 0 {
+		return newErrInvalidTx("no inputs")
+	}
+	if len(tx.TxOut) == 0 {
+		return newErrInvalidTx("no outputs")
+	}
+	for i, out := range tx.TxOut {
+		class := txscript.GetScriptClass(out.PkScript)
+		if class == txscript.NullDataTy {
+			continue
+		}
+		limit := int64(btcDustLimit)
+		if class == txscript.WitnessV0PubKeyHashTy {
+			limit = btcWitnessDustLimit
+		}
+		if out.Value < limit {
+			return newErrInvalidTx("output %d of %d satoshis is below the dust limit of %d satoshis", i, out.Value, limit)
+		}
+	}
+	return nil
+}
+
+// ethValidator validates Ethereum transactions submitted using `eth_sendRawTransaction`.
+type ethValidator struct {
+	network ethtypes.Network
+}
+
+// Validate implements the `Validator` interface.
+func (validator ethValidator) Validate(method string, params []json.RawMessage) error {
+	if method != "eth_sendRawTransaction" {
+		return nil
+	}
+	data, err := rawTx(params, true)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxEthTxSize {
+		return newErrInvalidTx("size of %d bytes exceeds the maximum of %d bytes", len(data), MaxEthTxSize)
+	}
+
+	if data[0] <= maxEthTxType {
+		// Typed transactions (EIP-2718), such as those with dynamic fees (EIP-1559), start with their type rather than
+		// an RLP list. This version of go-ethereum cannot decode them, so they are left for the upstreams to validate.
+		return nil
+	}
+
+	tx := new(coretypes.Transaction)
+	if err := rlp.DecodeBytes(data, tx); err != nil {
+		return newErrInvalidTx("cannot decode: %v", err)
+	}
+	if validator.network == nil || validator.network.ChainID() == nil || !tx.Protected() {
+		// Transactions signed without a chain ID are valid on every chain, and local networks can use any chain ID.
+		return nil
+	}
+	chainID := validator.network.ChainID()
+	if tx.ChainId().Cmp(chainID) != 0 {
+		return newErrInvalidTx("signed for chain %v, but %v has chain id %v", tx.ChainId(), validator.network, chainID)
+	}
+	if _, err := coretypes.Sender(coretypes.NewEIP155Signer(chainID), tx); err != nil {
+		return newErrInvalidTx("invalid signature: %v", err)
+	}
+	return nil
+}
+
+// rawTx returns the decoded transaction in the first parameter. Ethereum transactions are prefixed with "0x".
+func rawTx(params []json.RawMessage, prefixed bool) ([]byte, error) {
+	if len(params) == 0 {
+		return nil, newErrInvalidTx("missing transaction")
+	}
+	var tx string
+	if err := json.Unmarshal(params[0], &tx); err != nil {
+		return nil, newErrInvalidTx("expected a hex string")
+	}
+	if prefixed {
+		if !strings.HasPrefix(tx, "0x") {
+			return nil, newErrInvalidTx("missing 0x prefix")
+		}
+		tx = tx[2:]
+	}
+	data, err := hex.DecodeString(tx)
+	if err != nil {
+		return nil, newErrInvalidTx("malformed hex: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, newErrInvalidTx("empty transaction")
+	}
+	return data, nil
+}
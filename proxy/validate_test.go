@@ -0,0 +1,147 @@
+package proxy_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/proxy"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/ethereum/go-ethereum/common"
+	coretypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/types/btctypes"
+	"github.com/renproject/mercury/types/ethtypes"
+)
+
+var _ = Describe("Transaction validation", func() {
+	params := func(tx string) []json.RawMessage {
+		return []json.RawMessage{json.RawMessage(fmt.Sprintf(`"%v"`, tx))}
+	}
+
+	btcTx := func(inputs int, values ...int64) string {
+		tx := wire.NewMsgTx(wire.TxVersion)
+		for i := 0; i < inputs; i++ {
+			tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, uint32(i)), []byte{0x51}, nil))
+		}
+		for _, value := range values {
+			tx.AddTxOut(wire.NewTxOut(value, []byte{0x76, 0xa9, 0x14, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x88, 0xac}))
+		}
+		buf := new(bytes.Buffer)
+		Expect(tx.Serialize(buf)).To(Succeed())
+		return hex.EncodeToString(buf.Bytes())
+	}
+
+	ethTx := func(chainID int64) string {
+		key, err := crypto.GenerateKey()
+		Expect(err).ToNot(HaveOccurred())
+		tx := coretypes.NewTransaction(0, common.Address{}, big.NewInt(1), 21000, big.NewInt(1), nil)
+		tx, err = coretypes.SignTx(tx, coretypes.NewEIP155Signer(big.NewInt(chainID)), key)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := rlp.EncodeToBytes(tx)
+		Expect(err).ToNot(HaveOccurred())
+		return "0x" + hex.EncodeToString(data)
+	}
+
+	typedEthTx := func(txType byte, chainID int64) string {
+		fields := []interface{}{big.NewInt(chainID), uint64(0), big.NewInt(1), big.NewInt(1), uint64(21000), common.Address{}, big.NewInt(1), []byte{}, []interface{}{}, uint64(1), big.NewInt(1), big.NewInt(1)}
+		data, err := rlp.EncodeToBytes(fields)
+		Expect(err).ToNot(HaveOccurred())
+		return "0x" + hex.EncodeToString(append([]byte{txType}, data...))
+	}
+
+	Context("when validating Bitcoin transactions", func() {
+		validator := NewTxValidator(btctypes.BtcTestnet)
+
+		It("should accept a valid transaction", func() {
+			Expect(validator.Validate("sendrawtransaction", params(btcTx(1, 10000)))).To(Succeed())
+		})
+
+		It("should reject malformed transactions", func() {
+			Expect(validator.Validate("sendrawtransaction", params("zz"))).To(MatchError(ContainSubstring("malformed hex")))
+			Expect(validator.Validate("sendrawtransaction", params("0100"))).To(MatchError(ContainSubstring("cannot decode")))
+			Expect(validator.Validate("sendrawtransaction", nil)).To(MatchError(ContainSubstring("missing transaction")))
+		})
+
+		It("should reject transactions without inputs", func() {
+			Expect(validator.Validate("sendrawtransaction", params(btcTx(0, 10000)))).To(MatchError(ContainSubstring("no inputs")))
+		})
+
+		It("should reject dust outputs", func() {
+			Expect(validator.Validate("sendrawtransaction", params(btcTx(1, 10000, 100)))).To(MatchError(ContainSubstring("dust")))
+		})
+
+		It("should reject oversize transactions", func() {
+			tx := strings.Repeat("00", MaxBtcTxSize+1)
+			Expect(validator.Validate("sendrawtransaction", params(tx))).To(MatchError(ContainSubstring("exceeds")))
+		})
+
+		It("should not check other methods", func() {
+			Expect(validator.Validate("getrawtransaction", params("zz"))).To(Succeed())
+		})
+	})
+
+	Context("when validating Ethereum transactions", func() {
+		validator := NewTxValidator(ethtypes.Kovan)
+
+		It("should accept a transaction signed for the network", func() {
+			Expect(validator.Validate("eth_sendRawTransaction", params(ethTx(42)))).To(Succeed())
+		})
+
+		It("should reject a transaction signed for another network", func() {
+			err := validator.Validate("eth_sendRawTransaction", params(ethTx(1)))
+			Expect(err).To(MatchError(ContainSubstring("signed for chain 1")))
+		})
+
+		It("should accept transactions signed for any chain on local networks", func() {
+			validator := NewTxValidator(ethtypes.Ganache)
+			Expect(validator.Validate("eth_sendRawTransaction", params(ethTx(1337)))).To(Succeed())
+		})
+
+		It("should leave typed transactions to the upstreams", func() {
+			Expect(validator.Validate("eth_sendRawTransaction", params(typedEthTx(0x02, 42)))).To(Succeed())
+			Expect(validator.Validate("eth_sendRawTransaction", params(typedEthTx(0x01, 42)))).To(Succeed())
+		})
+
+		It("should reject malformed transactions", func() {
+			Expect(validator.Validate("eth_sendRawTransaction", params("abcd"))).To(MatchError(ContainSubstring("0x prefix")))
+			Expect(validator.Validate("eth_sendRawTransaction", params("0xabcd"))).To(MatchError(ContainSubstring("cannot decode")))
+		})
+	})
+
+	Context("when a proxy has a validator", func() {
+		It("should answer invalid transactions without contacting the upstreams", func() {
+			client := newResponseClient(200, `{"jsonrpc":"2.0","id":1,"result":"abcd"}`)
+			options := DefaultOptions()
+			options.Validator = NewTxValidator(ethtypes.Mainnet)
+			proxy := NewProxyWithOptions(options, NewUpstream("0", client, 1))
+
+			data := []byte(fmt.Sprintf(`{"jsonrpc":"2.0","id":3,"method":"eth_sendRawTransaction","params":["%v"]}`, ethTx(42)))
+			req, err := http.NewRequest("POST", "", nil)
+			Expect(err).ToNot(HaveOccurred())
+			resp, err := proxy.ProxyRequest(context.Background(), req, data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.Calls()).To(Equal(int64(0)))
+
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			var response types.JSONResponse
+			Expect(json.Unmarshal(body, &response)).To(Succeed())
+			Expect(response.ID).To(Equal(float64(3)))
+			Expect(response.Error.Code).To(Equal(types.ErrorCodeInvalidParams))
+			Expect(response.Error.Message).To(ContainSubstring("signed for chain 42"))
+		})
+	})
+})
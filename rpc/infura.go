@@ -34,7 +34,13 @@ func (infura *infuraClient) HandleRequest(r *http.Request, data []byte) (*http.R
 	client := http.Client{}
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%s", infura.url, apiKey), bytes.NewBuffer(data))
 	if err != nil {
-		return nil, fmt.Errorf("cannot construct post request for infura: %v", err)
+		return nil, NewErrInvalidRequest(fmt.Errorf("cannot construct post request for infura: %v", err))
 	}
+	req = req.WithContext(r.Context())
 	return client.Do(req)
 }
+
+// InfuraWebsocketURL returns the URL of the websocket endpoint of Infura for the network, using the given key.
+func InfuraWebsocketURL(network ethtypes.Network, apiKey string) string {
+	return fmt.Sprintf("wss://%s.infura.io/ws/v3/%s", network.String(), apiKey)
+}
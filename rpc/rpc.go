@@ -8,11 +8,22 @@ import (
 
 // Client is a RPC client which can send and retrieve information from a blockchain through JSON-RPC. `data` is the
 // request data we want to send to the ZCash node, and `r` is the original request in case we need to access any query
-// parameters or other fields.
+// parameters or other fields. The request to the node is cancelled when the context of `r` is done.
 type Client interface {
 	HandleRequest(r *http.Request, data []byte) (*http.Response, error)
 }
 
+// ErrInvalidRequest is returned when the request to the node cannot be constructed. Sending the same request again
+// will fail in the same way.
+type ErrInvalidRequest struct {
+	error
+}
+
+// NewErrInvalidRequest returns a new ErrInvalidRequest.
+func NewErrInvalidRequest(err error) error {
+	return ErrInvalidRequest{err}
+}
+
 // client implements the `Client` interface.
 type client struct {
 	host     string
@@ -33,10 +44,11 @@ func NewClient(host, username, password string) Client {
 func (node *client) HandleRequest(r *http.Request, data []byte) (*http.Response, error) {
 	client := http.Client{}
 	req, err := http.NewRequest("POST", node.host, bytes.NewBuffer(data))
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(node.username, node.password)
 	if err != nil {
-		return nil, fmt.Errorf("cannot construct post request for zcash node: %v", err)
+		return nil, NewErrInvalidRequest(fmt.Errorf("cannot construct post request for node: %v", err))
 	}
+	req = req.WithContext(r.Context())
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(node.username, node.password)
 	return client.Do(req)
 }
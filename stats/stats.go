@@ -0,0 +1,378 @@
+// Package stats keeps counts of the requests served by mercury in one-minute buckets, so that they can be queried over
+// arbitrary windows for capacity planning and billing. Counts are recorded in memory and periodically flushed to a kv
+// table, so they survive restarts when an on-disk backend is used. Buckets older than the retention are removed.
+package stats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/renproject/kv"
+	"github.com/sirupsen/logrus"
+)
+
+// Dimensions by which counts can be grouped.
+const (
+	DimensionNetwork = "network"
+	DimensionMethod  = "method"
+	DimensionTag     = "tag"
+	DimensionKey     = "key"
+	DimensionStatus  = "status"
+)
+
+// bucketSize is the duration covered by each bucket, and step is the difference between the keys of consecutive
+// buckets.
+const (
+	bucketSize = time.Minute
+	step       = int64(bucketSize / time.Second)
+)
+
+// MaxWindow is the longest window that can be queried. Every bucket in the window is read from the table.
+const MaxWindow = 31 * 24 * time.Hour
+
+// Options configure a Store.
+type Options struct {
+	// Retention is how long buckets are kept for. Zero means they are kept forever.
+	Retention time.Duration
+	// FlushInterval is how often counts are written to the table by Run.
+	FlushInterval time.Duration
+}
+
+// DefaultOptions returns options which keep buckets for 30 days and flush them every minute.
+func DefaultOptions() Options {
+	return Options{
+		Retention:     30 * 24 * time.Hour,
+		FlushInterval: time.Minute,
+	}
+}
+
+// Labels identify the requests counted together within a bucket.
+type Labels struct {
+	Network string `json:"network"`
+	Method  string `json:"method"`
+	Tag     string `json:"tag"`
+	Key     string `json:"key,omitempty"`
+	Status  string `json:"status"`
+}
+
+// value returns the value of the given dimension.
+func (labels Labels) value(dimension string) string {
+	switch dimension {
+	case DimensionNetwork:
+		return labels.Network
+	case DimensionMethod:
+		return labels.Method
+	case DimensionTag:
+		return labels.Tag
+	case DimensionKey:
+		return labels.Key
+	case DimensionStatus:
+		return labels.Status
+	default:
+		return ""
+	}
+}
+
+// count is the number of requests with the given labels in a bucket, as stored in the table.
+type count struct {
+	Labels
+	Count uint64 `json:"count"`
+}
+
+// Store records and queries the number of requests in each bucket.
+type Store struct {
+	// mu guards the counts which have not been flushed. tableMu is held while writing to the table, so that queries do
+	// not see counts which have been moved from pending to the table twice, and is never held while recording.
+	mu      *sync.Mutex
+	pending map[int64]map[Labels]uint64
+	tableMu *sync.RWMutex
+	table   kv.Table
+	options Options
+	logger  logrus.FieldLogger
+}
+
+// New returns a Store which persists buckets in the given table.
+func New(table kv.Table, options Options, logger logrus.FieldLogger) *Store {
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultOptions().FlushInterval
+	}
+	return &Store{
+		mu:      new(sync.Mutex),
+		pending: map[int64]map[Labels]uint64{},
+		tableMu: new(sync.RWMutex),
+		table:   table,
+		options: options,
+		logger:  logger,
+	}
+}
+
+// Record counts a request made at the given time.
+func (store *Store) Record(t time.Time, labels Labels) {
+	bucket := bucketOf(t)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	counts, ok := store.pending[bucket]
+	if !ok {
+		counts = map[Labels]uint64{}
+		store.pending[bucket] = counts
+	}
+	counts[labels]++
+}
+
+// Run flushes the recorded counts and removes expired buckets periodically until the context is done. Counts recorded
+// after the last flush must be flushed by calling Flush.
+func (store *Store) Run(ctx context.Context) {
+	ticker := time.NewTicker(store.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := store.Flush(); err != nil {
+			store.logger.Errorf("cannot flush stats: %v", err)
+		}
+		store.prune(time.Now())
+	}
+}
+
+// Flush adds the counts recorded since the last flush to the buckets in the table. Counts which cannot be written are
+// kept and written by the next flush.
+func (store *Store) Flush() error {
+	store.tableMu.Lock()
+	defer store.tableMu.Unlock()
+
+	store.mu.Lock()
+	pending := store.pending
+	store.pending = map[int64]map[Labels]uint64{}
+	store.mu.Unlock()
+
+	var err error
+	for bucket, counts := range pending {
+		if err = store.add(bucket, counts); err != nil {
+			break
+		}
+		delete(pending, bucket)
+	}
+
+	// Keep the counts that were not written.
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for bucket, counts := range pending {
+		if store.pending[bucket] == nil {
+			store.pending[bucket] = map[Labels]uint64{}
+		}
+		for labels, n := range counts {
+			store.pending[bucket][labels] += n
+		}
+	}
+	return err
+}
+
+// add adds the counts to the bucket in the table.
+func (store *Store) add(bucket int64, counts map[Labels]uint64) error {
+	stored, err := store.get(bucket)
+	if err != nil {
+		return err
+	}
+	for labels, n := range counts {
+		stored[labels] += n
+	}
+	if err := store.table.Insert(key(bucket), encode(stored)); err != nil {
+		return fmt.Errorf("cannot write bucket %v: %v", time.Unix(bucket, 0).UTC(), err)
+	}
+	return nil
+}
+
+// prune removes the buckets which are older than the retention.
+func (store *Store) prune(now time.Time) {
+	if store.options.Retention <= 0 {
+		return
+	}
+	oldest := bucketOf(now.Add(-store.options.Retention))
+
+	store.tableMu.Lock()
+	defer store.tableMu.Unlock()
+
+	var expired []string
+	iter := store.table.Iterator()
+	for iter.Next() {
+		k, err := iter.Key()
+		if err != nil {
+			store.logger.Errorf("cannot read stats bucket: %v", err)
+			continue
+		}
+		if bucket, err := strconv.ParseInt(k, 10, 64); err != nil || bucket < oldest {
+			expired = append(expired, k)
+		}
+	}
+	iter.Close()
+
+	for _, k := range expired {
+		if err := store.table.Delete(k); err != nil {
+			store.logger.Errorf("cannot remove stats bucket: %v", err)
+		}
+	}
+}
+
+// get returns the counts stored in the table for the bucket.
+func (store *Store) get(bucket int64) (map[Labels]uint64, error) {
+	var counts []count
+	if err := store.table.Get(key(bucket), &counts); err != nil && err != kv.ErrKeyNotFound {
+		return nil, fmt.Errorf("cannot read bucket %v: %v", time.Unix(bucket, 0).UTC(), err)
+	}
+	return decode(counts), nil
+}
+
+// Query selects the buckets to count and how the counts are grouped.
+type Query struct {
+	// From and To are the start and end of the window. Every bucket which overlaps [From, To) is counted.
+	From time.Time
+	To   time.Time
+	// Network only counts requests for the given network, if it is not empty.
+	Network string
+	// GroupBy are the dimensions by which counts are grouped. If it is empty, only the total is returned.
+	GroupBy []string
+}
+
+// Result is the number of requests matching a query.
+type Result struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Total  uint64    `json:"total"`
+	Groups []Group   `json:"groups"`
+}
+
+// Group is the number of requests with the same value for each of the dimensions that were grouped by.
+type Group struct {
+	Labels map[string]string `json:"labels"`
+	Count  uint64            `json:"count"`
+}
+
+// Query returns the number of requests matching the query, including those that have not been flushed yet. Groups are
+// sorted by count, largest first. The window ends no later than the current bucket, and cannot be longer than
+// MaxWindow.
+func (store *Store) Query(query Query) (Result, error) {
+	for _, dimension := range query.GroupBy {
+		switch dimension {
+		case DimensionNetwork, DimensionMethod, DimensionTag, DimensionKey, DimensionStatus:
+		default:
+			return Result{}, fmt.Errorf("cannot group by %q", dimension)
+		}
+	}
+	if !query.From.Before(query.To) {
+		return Result{}, fmt.Errorf("from must be before to")
+	}
+
+	from, to := bucketOf(query.From), bucketOf(query.To)
+	if !query.To.Truncate(bucketSize).Equal(query.To) {
+		to += step
+	}
+	if latest := bucketOf(time.Now()) + step; to > latest {
+		to = latest
+	}
+	if from > to {
+		from = to
+	}
+	if time.Duration(to-from)*time.Second > MaxWindow {
+		return Result{}, fmt.Errorf("window cannot be longer than %v", MaxWindow)
+	}
+	result := Result{
+		From:   time.Unix(from, 0).UTC(),
+		To:     time.Unix(to, 0).UTC(),
+		Groups: []Group{},
+	}
+	if store.options.Retention > 0 {
+		if oldest := bucketOf(time.Now().Add(-store.options.Retention)); from < oldest {
+			from = oldest
+		}
+	}
+
+	store.tableMu.RLock()
+	defer store.tableMu.RUnlock()
+
+	groups := map[string]*Group{}
+	for bucket := from; bucket < to; bucket += step {
+		counts, err := store.get(bucket)
+		if err != nil {
+			return Result{}, err
+		}
+		store.mu.Lock()
+		for labels, n := range store.pending[bucket] {
+			counts[labels] += n
+		}
+		store.mu.Unlock()
+
+		for labels, n := range counts {
+			if query.Network != "" && labels.Network != query.Network {
+				continue
+			}
+			result.Total += n
+			if len(query.GroupBy) == 0 {
+				continue
+			}
+
+			values := make([]string, len(query.GroupBy))
+			for i, dimension := range query.GroupBy {
+				values[i] = labels.value(dimension)
+			}
+			k := fmt.Sprintf("%q", values)
+			group, ok := groups[k]
+			if !ok {
+				group = &Group{Labels: map[string]string{}}
+				for i, dimension := range query.GroupBy {
+					group.Labels[dimension] = values[i]
+				}
+				groups[k] = group
+			}
+			group.Count += n
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		result.Groups = append(result.Groups, *groups[k])
+	}
+	sort.SliceStable(result.Groups, func(i, j int) bool {
+		return result.Groups[i].Count > result.Groups[j].Count
+	})
+	return result, nil
+}
+
+// bucketOf returns the bucket containing the given time, as the unix time in seconds at which it starts.
+func bucketOf(t time.Time) int64 {
+	return t.Truncate(bucketSize).Unix()
+}
+
+// key returns the key of the bucket in the table.
+func key(bucket int64) string {
+	return strconv.FormatInt(bucket, 10)
+}
+
+func encode(counts map[Labels]uint64) []count {
+	encoded := make([]count, 0, len(counts))
+	for labels, n := range counts {
+		encoded = append(encoded, count{Labels: labels, Count: n})
+	}
+	return encoded
+}
+
+func decode(counts []count) map[Labels]uint64 {
+	decoded := make(map[Labels]uint64, len(counts))
+	for _, c := range counts {
+		decoded[c.Labels] += c.Count
+	}
+	return decoded
+}
@@ -0,0 +1,157 @@
+package stats_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/stats"
+
+	"github.com/renproject/kv"
+	"github.com/renproject/phi"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Stats", func() {
+	newTable := func() kv.Table {
+		return kv.NewTable(kv.NewMemDB(kv.JSONCodec), "stats")
+	}
+	kovan := Labels{Network: "eth/kovan", Method: "eth_blockNumber", Status: "ok"}
+	mainnet := Labels{Network: "eth/mainnet", Method: "eth_gasPrice", Tag: "darknode", Status: "ok"}
+
+	Context("when querying a window", func() {
+		It("should only count the buckets which overlap the window", func() {
+			store := New(newTable(), DefaultOptions(), logrus.StandardLogger())
+			now := time.Now().Truncate(time.Minute)
+			store.Record(now.Add(-90*time.Minute), kovan)
+			store.Record(now.Add(-30*time.Minute), kovan)
+			store.Record(now.Add(-30*time.Minute+59*time.Second), kovan)
+			store.Record(now, kovan)
+
+			result, err := store.Query(Query{From: now.Add(-time.Hour), To: now})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Total).To(Equal(uint64(2)))
+			Expect(result.Groups).To(BeEmpty())
+
+			// Windows are extended to whole buckets.
+			result, err = store.Query(Query{From: now.Add(-30*time.Minute + 30*time.Second), To: now.Add(time.Second)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Total).To(Equal(uint64(3)))
+			Expect(result.From).To(Equal(now.Add(-30 * time.Minute).UTC()))
+			Expect(result.To).To(Equal(now.Add(time.Minute).UTC()))
+		})
+
+		It("should filter by network and group by the given dimensions", func() {
+			store := New(newTable(), DefaultOptions(), logrus.StandardLogger())
+			now := time.Now()
+			store.Record(now, kovan)
+			store.Record(now, mainnet)
+			store.Record(now, mainnet)
+
+			result, err := store.Query(Query{From: now.Add(-time.Hour), To: now, GroupBy: []string{DimensionNetwork, DimensionTag}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Total).To(Equal(uint64(3)))
+			Expect(result.Groups).To(Equal([]Group{
+				{Labels: map[string]string{"network": "eth/mainnet", "tag": "darknode"}, Count: 2},
+				{Labels: map[string]string{"network": "eth/kovan", "tag": ""}, Count: 1},
+			}))
+
+			result, err = store.Query(Query{From: now.Add(-time.Hour), To: now, Network: "eth/kovan", GroupBy: []string{DimensionMethod}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Groups).To(Equal([]Group{
+				{Labels: map[string]string{"method": "eth_blockNumber"}, Count: 1},
+			}))
+		})
+
+		It("should reject invalid queries", func() {
+			store := New(newTable(), DefaultOptions(), logrus.StandardLogger())
+			now := time.Now()
+			_, err := store.Query(Query{From: now, To: now.Add(-time.Hour)})
+			Expect(err).To(HaveOccurred())
+			_, err = store.Query(Query{From: now.Add(-time.Hour), To: now, GroupBy: []string{"upstream"}})
+			Expect(err).To(HaveOccurred())
+			_, err = store.Query(Query{From: now.Add(-MaxWindow - time.Hour), To: now})
+			Expect(err).To(MatchError(ContainSubstring("window cannot be longer")))
+		})
+
+		It("should not count buckets after the current one", func() {
+			store := New(newTable(), Options{}, logrus.StandardLogger())
+			now := time.Now().Truncate(time.Minute)
+			store.Record(now, kovan)
+			store.Record(now.Add(time.Hour), kovan)
+
+			result, err := store.Query(Query{From: now, To: now.Add(100 * 365 * 24 * time.Hour)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Total).To(Equal(uint64(1)))
+			Expect(result.To).To(BeTemporally("<=", time.Now().Add(time.Minute)))
+
+			// Windows which start in the future are empty.
+			result, err = store.Query(Query{From: now.Add(time.Hour), To: now.Add(2 * time.Hour)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Total).To(BeZero())
+		})
+
+		It("should not count buckets older than the retention", func() {
+			store := New(newTable(), Options{Retention: time.Hour}, logrus.StandardLogger())
+			now := time.Now()
+			store.Record(now.Add(-2*time.Hour), kovan)
+			store.Record(now, kovan)
+
+			result, err := store.Query(Query{From: now.Add(-3 * time.Hour), To: now.Add(time.Minute)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Total).To(Equal(uint64(1)))
+		})
+	})
+
+	Context("when flushing counts", func() {
+		It("should keep the counts across restarts", func() {
+			table := newTable()
+			store := New(table, DefaultOptions(), logrus.StandardLogger())
+			now := time.Now()
+			store.Record(now, kovan)
+			Expect(store.Flush()).To(Succeed())
+			store.Record(now, kovan)
+			Expect(store.Flush()).To(Succeed())
+			store.Record(now, mainnet)
+
+			query := Query{From: now.Add(-time.Hour), To: now.Add(time.Minute), GroupBy: []string{DimensionNetwork}}
+			result, err := store.Query(query)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Total).To(Equal(uint64(3)))
+
+			// Counts which have not been flushed are lost.
+			restarted := New(table, DefaultOptions(), logrus.StandardLogger())
+			result, err = restarted.Query(query)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Groups).To(Equal([]Group{
+				{Labels: map[string]string{"network": "eth/kovan"}, Count: 2},
+			}))
+		})
+
+		It("should count every request recorded while flushing", func() {
+			store := New(newTable(), Options{FlushInterval: 10 * time.Millisecond}, logrus.StandardLogger())
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				store.Run(ctx)
+				close(done)
+			}()
+
+			now := time.Now()
+			phi.ParForAll(1000, func(i int) {
+				store.Record(now, kovan)
+				if i%100 == 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+			})
+			cancel()
+			<-done
+			Expect(store.Flush()).To(Succeed())
+
+			result, err := store.Query(Query{From: now.Add(-time.Hour), To: now.Add(time.Minute)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Total).To(Equal(uint64(1000)))
+		})
+	})
+})
@@ -0,0 +1,199 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// message is a JSON-RPC message received from the upstream: either a response to a request, or a notification.
+type message struct {
+	ID     *uint64         `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *ErrUpstream    `json:"error"`
+}
+
+// connection is a WebSocket connection to an upstream, over which requests are matched to their responses by ID.
+type connection struct {
+	url     string
+	ws      *websocket.Conn
+	writeMu *sync.Mutex
+
+	mu      *sync.Mutex
+	nextID  uint64
+	pending map[uint64]*call
+	closed  bool
+}
+
+// call is a request waiting for its response. Subscriptions also have the feed being subscribed to.
+type call struct {
+	feed *feed
+	done chan message
+}
+
+func dial(ctx context.Context, url string) (*connection, error) {
+	ctx, cancel := context.WithTimeout(ctx, DefaultCallTimeout)
+	defer cancel()
+
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &connection{
+		url:     url,
+		ws:      ws,
+		writeMu: new(sync.Mutex),
+		mu:      new(sync.Mutex),
+		pending: map[uint64]*call{},
+	}, nil
+}
+
+// read handles each message received until the connection is lost, and then fails the requests waiting for a
+// response.
+func (conn *connection) read(handle func(*connection, message)) {
+	defer func() {
+		conn.close()
+		conn.mu.Lock()
+		for id, c := range conn.pending {
+			close(c.done)
+			delete(conn.pending, id)
+		}
+		conn.mu.Unlock()
+	}()
+
+	conn.ws.SetReadDeadline(time.Now().Add(2 * DefaultPingInterval))
+	conn.ws.SetPongHandler(func(string) error {
+		return conn.ws.SetReadDeadline(time.Now().Add(2 * DefaultPingInterval))
+	})
+	for {
+		_, data, err := conn.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.ws.SetReadDeadline(time.Now().Add(2 * DefaultPingInterval))
+
+		var msg message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		handle(conn, msg)
+	}
+}
+
+// ping pings the upstream until done is closed, so that lost connections are detected.
+func (conn *connection) ping(done <-chan struct{}) {
+	ticker := time.NewTicker(DefaultPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(DefaultCallTimeout)); err != nil {
+			conn.close()
+			return
+		}
+	}
+}
+
+// respond delivers a response to the request waiting for it. Successful subscriptions are passed to subscribed before
+// any further messages are handled.
+func (conn *connection) respond(msg message, subscribed func(*connection, *feed, json.RawMessage)) {
+	if msg.ID == nil {
+		return
+	}
+	conn.mu.Lock()
+	c, ok := conn.pending[*msg.ID]
+	delete(conn.pending, *msg.ID)
+	conn.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if c.feed != nil && msg.Error == nil {
+		subscribed(conn, c.feed, msg.Result)
+	}
+	c.done <- msg
+}
+
+// call sends a request and waits for its result. The feed is given when subscribing.
+func (conn *connection) call(ctx context.Context, method string, params interface{}, f *feed) (json.RawMessage, error) {
+	c := &call{feed: f, done: make(chan message, 1)}
+	conn.mu.Lock()
+	if conn.closed {
+		conn.mu.Unlock()
+		return nil, ErrDisconnected
+	}
+	conn.nextID++
+	id := conn.nextID
+	conn.pending[id] = c
+	conn.mu.Unlock()
+
+	if err := conn.write(id, method, params); err != nil {
+		conn.mu.Lock()
+		delete(conn.pending, id)
+		conn.mu.Unlock()
+		return nil, err
+	}
+
+	select {
+	case msg, ok := <-c.done:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		if msg.Error != nil {
+			return nil, *msg.Error
+		}
+		return msg.Result, nil
+	case <-ctx.Done():
+		conn.mu.Lock()
+		delete(conn.pending, id)
+		conn.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// notify sends a request without waiting for its response.
+func (conn *connection) notify(method string, params interface{}) {
+	conn.mu.Lock()
+	conn.nextID++
+	id := conn.nextID
+	conn.mu.Unlock()
+	conn.write(id, method, params)
+}
+
+func (conn *connection) write(id uint64, method string, params interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	conn.ws.SetWriteDeadline(time.Now().Add(DefaultCallTimeout))
+	if err := conn.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("cannot write to upstream: %v", err)
+	}
+	return nil
+}
+
+// close closes the connection, which stops read.
+func (conn *connection) close() {
+	conn.mu.Lock()
+	conn.closed = true
+	conn.mu.Unlock()
+	conn.ws.Close()
+}
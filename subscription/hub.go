@@ -0,0 +1,405 @@
+// Package subscription shares Ethereum subscriptions between the callers of mercury. A Hub keeps a single WebSocket
+// connection to an upstream node and a single upstream subscription for each distinct `eth_subscribe` request, and
+// delivers each notification to every caller subscribed with the same parameters. Subscriptions are resubscribed
+// automatically when the connection to the upstream is lost and reconnected.
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBufferSize is the number of notifications a subscription can fall behind by before it is closed.
+const DefaultBufferSize = 64
+
+// DefaultPingInterval is how often the connection to the upstream is checked. The connection is considered lost if
+// nothing is received from the upstream for two intervals.
+const DefaultPingInterval = 30 * time.Second
+
+// DefaultCallTimeout limits how long the upstream has to respond to a request.
+const DefaultCallTimeout = 10 * time.Second
+
+// Reconnection backoff, which doubles after each failed attempt.
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	// ErrUnavailable is returned when subscribing while the Hub is not connected to an upstream.
+	ErrUnavailable = errors.New("subscriptions are unavailable: not connected to an upstream")
+	// ErrDisconnected is returned when the connection to the upstream is lost while waiting for a response.
+	ErrDisconnected = errors.New("connection to the upstream was lost")
+	// ErrTooSlow closes subscriptions whose notifications are not read quickly enough.
+	ErrTooSlow = errors.New("notifications are not being read quickly enough")
+)
+
+// ErrUpstream is an error returned by the upstream in response to a request.
+type ErrUpstream struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error implements the error interface.
+func (err ErrUpstream) Error() string {
+	return fmt.Sprintf("upstream error %d: %v", err.Code, err.Message)
+}
+
+// Hub multiplexes subscriptions over a connection to one of its upstreams.
+type Hub struct {
+	mu      *sync.Mutex
+	urls    []string
+	changed chan struct{}
+	conn    *connection
+	feeds   map[string]*feed
+	byID    map[string]*feed
+	logger  logrus.FieldLogger
+}
+
+// New returns a Hub which connects to the first available WebSocket URL. It does not connect until Run is called.
+func New(urls []string, logger logrus.FieldLogger) *Hub {
+	return &Hub{
+		mu:      new(sync.Mutex),
+		urls:    urls,
+		changed: make(chan struct{}, 1),
+		feeds:   map[string]*feed{},
+		byID:    map[string]*feed{},
+		logger:  logger,
+	}
+}
+
+// SetURLs replaces the URLs of the upstreams. If the Hub is connected to an upstream which is no longer listed, it
+// disconnects and resubscribes using the new upstreams.
+func (hub *Hub) SetURLs(urls []string) {
+	hub.mu.Lock()
+	hub.urls = urls
+	conn := hub.conn
+	hub.mu.Unlock()
+
+	if conn != nil && !contains(urls, conn.url) {
+		conn.close()
+	}
+	select {
+	case hub.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Connected returns whether the Hub is connected to an upstream.
+func (hub *Hub) Connected() bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return hub.conn != nil
+}
+
+// Feeds returns the number of subscriptions to the upstream, which is the number of distinct subscriptions of the
+// callers.
+func (hub *Hub) Feeds() int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.feeds)
+}
+
+// Run connects to the upstreams until the context is done, trying each of them in turn and backing off after failed
+// attempts. Existing subscriptions are resubscribed whenever the Hub reconnects.
+func (hub *Hub) Run(ctx context.Context) {
+	backoff := minBackoff
+	for i := 0; ; i++ {
+		hub.mu.Lock()
+		urls := hub.urls
+		hub.mu.Unlock()
+
+		if len(urls) > 0 {
+			url := urls[i%len(urls)]
+			conn, err := dial(ctx, url)
+			if err != nil {
+				hub.logger.Warnf("cannot connect to upstream websocket: %v", err)
+			} else {
+				backoff = minBackoff
+				hub.serve(ctx, conn)
+				if ctx.Err() == nil {
+					hub.logger.Warnf("lost connection to upstream websocket, reconnecting")
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-hub.changed:
+		case <-time.After(backoff):
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// serve uses the connection until it is lost or the context is done.
+func (hub *Hub) serve(ctx context.Context, conn *connection) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.read(hub.handle)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.close()
+		case <-done:
+		}
+	}()
+
+	hub.mu.Lock()
+	hub.conn = conn
+	feeds := make([]*feed, 0, len(hub.feeds))
+	for _, f := range hub.feeds {
+		feeds = append(feeds, f)
+	}
+	hub.mu.Unlock()
+
+	for _, f := range feeds {
+		if err := hub.resubscribe(conn, f); err != nil {
+			hub.logger.Errorf("cannot resubscribe to %s: %v", f.params, err)
+		}
+	}
+
+	go conn.ping(done)
+	<-done
+
+	hub.mu.Lock()
+	hub.conn = nil
+	for _, f := range hub.feeds {
+		delete(hub.byID, f.upstreamID)
+		f.upstreamID = ""
+	}
+	hub.mu.Unlock()
+}
+
+// resubscribe subscribes to the feed again after reconnecting. If the upstream rejects the subscription, its
+// subscribers are closed with the error.
+func (hub *Hub) resubscribe(conn *connection, f *feed) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+
+	if _, err := conn.call(ctx, "eth_subscribe", f.params, f); err != nil {
+		if _, ok := err.(ErrUpstream); ok {
+			hub.mu.Lock()
+			hub.remove(f, err)
+			hub.mu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// handle handles a message received from the upstream.
+func (hub *Hub) handle(conn *connection, msg message) {
+	if msg.Method != "eth_subscription" {
+		conn.respond(msg, hub.subscribed)
+		return
+	}
+
+	var params struct {
+		Subscription string          `json:"subscription"`
+		Result       json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		hub.logger.Warnf("invalid notification from upstream: %v", err)
+		return
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	f, ok := hub.byID[params.Subscription]
+	if !ok {
+		return
+	}
+	for sub := range f.subscribers {
+		select {
+		case sub.ch <- params.Result:
+		default:
+			hub.unsubscribe(sub, ErrTooSlow)
+		}
+	}
+}
+
+// subscribed records the upstream ID of a feed as soon as the response to its subscription is received, so that no
+// notifications are missed. Subscriptions of feeds that were removed in the meantime are cancelled.
+func (hub *Hub) subscribed(conn *connection, f *feed, result json.RawMessage) {
+	var id string
+	if err := json.Unmarshal(result, &id); err != nil {
+		return
+	}
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.feeds[f.key] != f {
+		go conn.notify("eth_unsubscribe", []string{id})
+		return
+	}
+	delete(hub.byID, f.upstreamID)
+	f.upstreamID = id
+	hub.byID[id] = f
+}
+
+// Subscribe subscribes to notifications from the upstream using the parameters of an `eth_subscribe` request. If
+// another caller is subscribed with the same parameters, the subscription is shared. The subscription must be closed
+// using Unsubscribe once it is no longer needed.
+func (hub *Hub) Subscribe(ctx context.Context, params json.RawMessage) (*Subscription, error) {
+	key, err := canonical(params)
+	if err != nil {
+		return nil, fmt.Errorf("invalid params: %v", err)
+	}
+
+	hub.mu.Lock()
+	conn := hub.conn
+	if conn == nil {
+		hub.mu.Unlock()
+		return nil, ErrUnavailable
+	}
+	f, ok := hub.feeds[key]
+	if !ok {
+		f = &feed{key: key, params: params, subscribers: map[*Subscription]struct{}{}, ready: make(chan struct{})}
+		hub.feeds[key] = f
+	}
+	sub := &Subscription{hub: hub, feed: f, ch: make(chan json.RawMessage, DefaultBufferSize)}
+	f.subscribers[sub] = struct{}{}
+	hub.mu.Unlock()
+
+	if ok {
+		// The feed is being subscribed to by another caller.
+		select {
+		case <-f.ready:
+		case <-ctx.Done():
+			sub.Unsubscribe()
+			return nil, ctx.Err()
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+		return sub, nil
+	}
+
+	_, err = conn.call(ctx, "eth_subscribe", params, f)
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if err != nil {
+		hub.remove(f, err)
+	}
+	f.err = err
+	close(f.ready)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// unsubscribe closes the subscription, and removes its feed if it has no other subscribers. The caller must hold the
+// mutex.
+func (hub *Hub) unsubscribe(sub *Subscription, err error) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	sub.err = err
+	close(sub.ch)
+
+	f := sub.feed
+	delete(f.subscribers, sub)
+	if len(f.subscribers) > 0 || hub.feeds[f.key] != f {
+		return
+	}
+	delete(hub.feeds, f.key)
+	if f.upstreamID != "" {
+		delete(hub.byID, f.upstreamID)
+		if hub.conn != nil {
+			go hub.conn.notify("eth_unsubscribe", []string{f.upstreamID})
+		}
+	}
+}
+
+// remove removes the feed and closes its subscribers with the error. The caller must hold the mutex.
+func (hub *Hub) remove(f *feed, err error) {
+	if hub.feeds[f.key] == f {
+		delete(hub.feeds, f.key)
+	}
+	if f.upstreamID != "" {
+		delete(hub.byID, f.upstreamID)
+	}
+	for sub := range f.subscribers {
+		hub.unsubscribe(sub, err)
+	}
+}
+
+// feed is a subscription to the upstream, which is shared by every subscription with the same parameters.
+type feed struct {
+	key         string
+	params      json.RawMessage
+	upstreamID  string
+	subscribers map[*Subscription]struct{}
+
+	// ready is closed once the first subscription to the upstream has completed, with its error.
+	ready chan struct{}
+	err   error
+}
+
+// Subscription is a subscription of a caller to notifications from the upstream.
+type Subscription struct {
+	hub    *Hub
+	feed   *feed
+	ch     chan json.RawMessage
+	closed bool
+	err    error
+}
+
+// Notifications returns the results of the notifications for the subscription. The channel is closed when the
+// subscription is closed.
+func (sub *Subscription) Notifications() <-chan json.RawMessage {
+	return sub.ch
+}
+
+// Err returns why the subscription was closed, or nil if it is open or was closed using Unsubscribe.
+func (sub *Subscription) Err() error {
+	sub.hub.mu.Lock()
+	defer sub.hub.mu.Unlock()
+	return sub.err
+}
+
+// Unsubscribe closes the subscription. The upstream subscription is cancelled once it has no other subscribers.
+func (sub *Subscription) Unsubscribe() {
+	sub.hub.mu.Lock()
+	defer sub.hub.mu.Unlock()
+	sub.hub.unsubscribe(sub, nil)
+}
+
+// canonical returns the parameters with insignificant whitespace removed and the keys of objects sorted, so that
+// equivalent subscriptions are shared.
+func canonical(params json.RawMessage) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(params, &value); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func contains(urls []string, url string) bool {
+	for _, u := range urls {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package subscription_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/subscription"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("Hub", func() {
+	var (
+		node   *fakeNode
+		hub    *Hub
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		node = newFakeNode()
+		hub = New([]string{node.URL()}, logrus.StandardLogger())
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go hub.Run(ctx)
+		Eventually(hub.Connected).Should(BeTrue())
+	})
+
+	AfterEach(func() {
+		cancel()
+		node.Close()
+	})
+
+	subscribe := func(params string) *Subscription {
+		sub, err := hub.Subscribe(context.Background(), json.RawMessage(params))
+		Expect(err).ToNot(HaveOccurred())
+		return sub
+	}
+
+	Context("when callers subscribe", func() {
+		It("should share upstream subscriptions with the same parameters", func() {
+			first := subscribe(`["newHeads"]`)
+			second := subscribe(`[ "newHeads" ]`)
+			logs := subscribe(`["logs", {"address": "0x1", "topics": []}]`)
+			same := subscribe(`["logs", {"topics": [], "address": "0x1"}]`)
+			Expect(hub.Feeds()).To(Equal(2))
+			Expect(node.Subscriptions()).To(HaveLen(2))
+
+			node.Publish("newHeads", `{"number":"0x1"}`)
+			Eventually(first.Notifications()).Should(Receive(MatchJSON(`{"number":"0x1"}`)))
+			Eventually(second.Notifications()).Should(Receive(MatchJSON(`{"number":"0x1"}`)))
+			Consistently(logs.Notifications()).ShouldNot(Receive())
+
+			node.Publish("logs", `{"logIndex":"0x0"}`)
+			Eventually(logs.Notifications()).Should(Receive(MatchJSON(`{"logIndex":"0x0"}`)))
+			Eventually(same.Notifications()).Should(Receive(MatchJSON(`{"logIndex":"0x0"}`)))
+		})
+
+		It("should unsubscribe from the upstream once the last caller unsubscribes", func() {
+			first := subscribe(`["newHeads"]`)
+			second := subscribe(`["newHeads"]`)
+
+			first.Unsubscribe()
+			Expect(first.Notifications()).To(BeClosed())
+			Expect(first.Err()).ToNot(HaveOccurred())
+			Consistently(node.Subscriptions).Should(HaveLen(1))
+
+			second.Unsubscribe()
+			Expect(hub.Feeds()).To(Equal(0))
+			Eventually(node.Subscriptions).Should(BeEmpty())
+		})
+
+		It("should return errors from the upstream", func() {
+			_, err := hub.Subscribe(context.Background(), json.RawMessage(`["syncing"]`))
+			Expect(err).To(Equal(ErrUpstream{Code: -32602, Message: "unsupported subscription"}))
+			Expect(hub.Feeds()).To(Equal(0))
+		})
+
+		It("should close subscriptions that are not read", func() {
+			sub := subscribe(`["newHeads"]`)
+			for i := 0; i <= DefaultBufferSize; i++ {
+				node.Publish("newHeads", fmt.Sprintf(`{"number":"0x%x"}`, i))
+			}
+			Eventually(sub.Err).Should(Equal(ErrTooSlow))
+			Eventually(node.Subscriptions).Should(BeEmpty())
+		})
+	})
+
+	Context("when the connection to the upstream is lost", func() {
+		It("should resubscribe once it reconnects", func() {
+			sub := subscribe(`["newHeads"]`)
+			node.Disconnect()
+			Eventually(node.Connections, 5*time.Second).Should(Equal(2))
+			Eventually(node.Subscriptions).Should(HaveLen(1))
+
+			node.Publish("newHeads", `{"number":"0x2"}`)
+			Eventually(sub.Notifications()).Should(Receive(MatchJSON(`{"number":"0x2"}`)))
+		})
+
+		It("should not accept subscriptions while disconnected", func() {
+			hub.SetURLs(nil)
+			Eventually(hub.Connected).Should(BeFalse())
+			_, err := hub.Subscribe(context.Background(), json.RawMessage(`["newHeads"]`))
+			Expect(err).To(Equal(ErrUnavailable))
+		})
+	})
+})
+
+// fakeNode is an upstream which supports `newHeads` and `logs` subscriptions, and publishes notifications on demand.
+type fakeNode struct {
+	server *httptest.Server
+
+	mu            *sync.Mutex
+	conns         []*websocket.Conn
+	connections   int
+	nextID        int
+	subscriptions map[string]subscription
+}
+
+type subscription struct {
+	kind string
+	conn *websocket.Conn
+}
+
+func newFakeNode() *fakeNode {
+	node := &fakeNode{
+		mu:            new(sync.Mutex),
+		subscriptions: map[string]subscription{},
+	}
+	node.server = httptest.NewServer(http.HandlerFunc(node.serve))
+	return node
+}
+
+func (node *fakeNode) URL() string {
+	return "ws" + strings.TrimPrefix(node.server.URL, "http")
+}
+
+func (node *fakeNode) Close() {
+	node.Disconnect()
+	node.server.Close()
+}
+
+// Disconnect closes every connection to the node, which also removes their subscriptions.
+func (node *fakeNode) Disconnect() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for _, conn := range node.conns {
+		conn.Close()
+	}
+	node.conns = nil
+	node.subscriptions = map[string]subscription{}
+}
+
+func (node *fakeNode) Connections() int {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.connections
+}
+
+func (node *fakeNode) Subscriptions() []string {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	ids := []string{}
+	for id := range node.subscriptions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Publish sends a notification with the result to each subscription of the kind.
+func (node *fakeNode) Publish(kind, result string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	for id, sub := range node.subscriptions {
+		if sub.kind == kind {
+			sub.conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(
+				`{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":%q,"result":%s}}`, id, result)))
+		}
+	}
+}
+
+func (node *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	node.mu.Lock()
+	node.conns = append(node.conns, conn)
+	node.connections++
+	node.mu.Unlock()
+
+	for {
+		var req struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+		var param string
+		if len(req.Params) > 0 {
+			json.Unmarshal(req.Params[0], &param)
+		}
+
+		node.mu.Lock()
+		var resp string
+		switch {
+		case req.Method == "eth_subscribe" && (param == "newHeads" || param == "logs"):
+			node.nextID++
+			id := fmt.Sprintf("0x%x", node.nextID)
+			node.subscriptions[id] = subscription{kind: param, conn: conn}
+			resp = fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":%q}`, req.ID, id)
+		case req.Method == "eth_unsubscribe":
+			_, ok := node.subscriptions[param]
+			delete(node.subscriptions, param)
+			resp = fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"result":%v}`, req.ID, ok)
+		default:
+			resp = fmt.Sprintf(`{"jsonrpc":"2.0","id":%s,"error":{"code":-32602,"message":"unsupported subscription"}}`, req.ID)
+		}
+		conn.WriteMessage(websocket.TextMessage, []byte(resp))
+		node.mu.Unlock()
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -35,13 +36,43 @@ func NewErrList(n int) ErrList {
 	return make([]error, n)
 }
 
-// ErrList implements the error interface.
+// ErrList implements the error interface. Nil errors are skipped.
 func (errs ErrList) Error() string {
-	errMsg := ""
+	msgs := make([]string, 0, len(errs))
 	for i := range errs {
-		errMsg += fmt.Sprintf("[%v] %v, ", i, errs[i].Error())
+		if errs[i] == nil {
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("[%v] %v", i, errs[i].Error()))
 	}
-	return errMsg
+	return strings.Join(msgs, ", ")
+}
+
+// ErrUpstream is returned when an attempt to send a request to an upstream fails.
+type ErrUpstream struct {
+	// Upstream is the name of the upstream.
+	Upstream string
+	// Attempt is the number of the attempt, starting at one.
+	Attempt int
+	// Retryable is whether the request may succeed if it is sent again.
+	Retryable bool
+	// Err is the reason the attempt failed.
+	Err error
+}
+
+// NewErrUpstream returns a new ErrUpstream.
+func NewErrUpstream(upstream string, attempt int, retryable bool, err error) ErrUpstream {
+	return ErrUpstream{
+		Upstream:  upstream,
+		Attempt:   attempt,
+		Retryable: retryable,
+		Err:       err,
+	}
+}
+
+// Error implements the error interface.
+func (err ErrUpstream) Error() string {
+	return fmt.Sprintf("upstream %v failed on attempt %v: %v", err.Upstream, err.Attempt, err.Err)
 }
 
 // ErrUnknownNetwork is returned when the given network is unknown to us.
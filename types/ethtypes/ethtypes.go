@@ -37,8 +37,20 @@ func (network network) Chain() types.Chain {
 	return types.Ethereum
 }
 
+// ChainID returns the EIP-155 chain ID of the network, which transactions must be signed for. Local networks do not
+// have a fixed chain ID, so nil is returned for them.
+func (network network) ChainID() *big.Int {
+	switch network {
+	case Mainnet, Kovan, Rinkeby:
+		return big.NewInt(int64(network))
+	default:
+		return nil
+	}
+}
+
 type Network interface {
 	types.Network
+	ChainID() *big.Int
 }
 
 type network uint8
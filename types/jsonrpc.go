@@ -2,12 +2,45 @@ package types
 
 import "encoding/json"
 
+// Error codes defined by the JSON-RPC 2.0 specification.
+const (
+	ErrorCodeParse          = -32700
+	ErrorCodeInvalidRequest = -32600
+	ErrorCodeMethodNotFound = -32601
+	ErrorCodeInvalidParams  = -32602
+	ErrorCodeInternal       = -32603
+)
+
+// Error codes used by mercury when the upstreams cannot serve a request. They are in the range reserved for
+// implementation-defined server errors, and follow EIP-1474 where it defines an equivalent error.
+const (
+	// ErrorCodeUnavailable means no upstream is available, e.g. because every circuit breaker is open.
+	ErrorCodeUnavailable = -32002
+	// ErrorCodeRateLimited means the upstreams are rate limiting requests.
+	ErrorCodeRateLimited = -32005
+	// ErrorCodeUpstream means every attempt to serve the request from an upstream failed.
+	ErrorCodeUpstream = -32010
+	// ErrorCodeTimeout means the upstreams did not respond in time.
+	ErrorCodeTimeout = -32011
+	// ErrorCodeNoQuorum means not enough upstreams agreed on the result.
+	ErrorCodeNoQuorum = -32012
+)
+
+// Error codes used by mercury when the caller is not allowed to make a request.
+const (
+	// ErrorCodeUnauthorized means the API key of the caller is unknown, or a key is required and none was given.
+	ErrorCodeUnauthorized = -32020
+	// ErrorCodeLimitExceeded means the caller has exceeded a rate limit or its daily quota. The response has a
+	// Retry-After header.
+	ErrorCodeLimitExceeded = -32021
+)
+
 // JSONError defines a JSON error object that is compatible with the JSON-RPC 2.0 specification. See
 // https://www.jsonrpc.org/specification for more information.
 type JSONError struct {
 	Code    int             `json:"code"`
 	Message string          `json:"message"`
-	Data    json.RawMessage `json:"data"`
+	Data    json.RawMessage `json:"data,omitempty"`
 }
 
 // JSONRequest defines a JSON request object that is compatible with the JSON-RPC 2.0 specification. See
@@ -27,3 +60,18 @@ type JSONResponse struct {
 	Result  json.RawMessage `json:"result,omitempty"`
 	ID      interface{}     `json:"id"`
 }
+
+// ErrorData is the data of a JSON-RPC error returned by mercury, describing the upstreams that failed to serve the
+// request.
+type ErrorData struct {
+	Upstreams []UpstreamError `json:"upstreams"`
+}
+
+// UpstreamError describes how an upstream failed to serve a request.
+type UpstreamError struct {
+	Upstream string `json:"upstream"`
+	Attempt  int    `json:"attempt,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Result is the normalized result returned by the upstream, if it disagreed with the others.
+	Result string `json:"result,omitempty"`
+}
@@ -7,3 +7,42 @@ const (
 	CachedAccess AccessLevel = 1
 	NoAccess     AccessLevel = 0
 )
+
+// Role is the role of a caller, which decides the methods it can call. Each role can call the methods of the roles
+// before it.
+type Role uint8
+
+const (
+	// RolePublic can call read-only methods.
+	RolePublic Role = 0
+	// RoleInternal is used by trusted services, such as darknodes, which can also submit transactions, query logs over
+	// wide ranges and call archive methods.
+	RoleInternal Role = 1
+	// RoleAdmin can also call debug methods.
+	RoleAdmin Role = 2
+)
+
+// roles are the names of the roles.
+var roles = map[Role]string{
+	RolePublic:   "public",
+	RoleInternal: "internal",
+	RoleAdmin:    "admin",
+}
+
+// String implements the `fmt.Stringer` interface.
+func (role Role) String() string {
+	if name, ok := roles[role]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseRole returns the role with the given name.
+func ParseRole(name string) (Role, bool) {
+	for role, roleName := range roles {
+		if roleName == name {
+			return role, true
+		}
+	}
+	return RolePublic, false
+}
@@ -0,0 +1,157 @@
+package watch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// delivery is a notification that has not been delivered to the webhook of its watch yet.
+type delivery struct {
+	ID      string          `json:"id"`
+	Watch   string          `json:"watch"`
+	Payload json.RawMessage `json:"payload"`
+	// Attempts is the number of failed attempts to deliver the notification.
+	Attempts int `json:"attempts"`
+	// NextAttempt is the unix time in milliseconds after which the notification is sent again.
+	NextAttempt int64 `json:"nextAttempt"`
+}
+
+// queue stores a notification of the activity reaching the depth, to be delivered immediately.
+func (notifier *Notifier) queue(w Watch, a Activity, depth uint64) error {
+	id, err := randomID(16)
+	if err != nil {
+		return err
+	}
+	payload, err := notification(id, w, a, depth)
+	if err != nil {
+		return err
+	}
+	if err := notifier.deliveries.Insert(id, delivery{ID: id, Watch: w.ID, Payload: payload}); err != nil {
+		return fmt.Errorf("cannot store notification: %v", err)
+	}
+	return nil
+}
+
+// Deliver sends each notification that is due to the webhook of its watch, using up to the configured number of
+// workers at once, and returns once they have all been attempted. Notifications that fail are retried after a backoff,
+// until they have been attempted the maximum number of times. Notifications of deleted watches are dropped.
+func (notifier *Notifier) Deliver(ctx context.Context) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	due := []delivery{}
+	iter := notifier.deliveries.Iterator()
+	for iter.Next() {
+		var d delivery
+		if err := iter.Value(&d); err != nil {
+			notifier.logger.Errorf("cannot read notification: %v", err)
+			continue
+		}
+		if d.NextAttempt <= now {
+			due = append(due, d)
+		}
+	}
+	iter.Close()
+
+	work := make(chan delivery)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < notifier.options.Workers && i < len(due); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				notifier.deliver(ctx, d)
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(work)
+
+	for _, d := range due {
+		select {
+		case <-ctx.Done():
+			return
+		case work <- d:
+		}
+	}
+}
+
+// deliver sends the notification, and removes it once it has been delivered or cannot be delivered.
+func (notifier *Notifier) deliver(ctx context.Context, d delivery) {
+	rec, err := notifier.record(d.Watch)
+	if err != nil {
+		if err != ErrNotFound {
+			notifier.logger.Errorf("cannot deliver notification %v: %v", d.ID, err)
+			return
+		}
+		notifier.drop(d)
+		return
+	}
+
+	err = notifier.send(ctx, rec.Watch, d.Payload)
+	if err == nil {
+		notifier.drop(d)
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	d.Attempts++
+	if d.Attempts >= notifier.options.MaxAttempts {
+		notifier.logger.Errorf("dropping notification %v of watch %v after %d attempts: %v", d.ID, d.Watch, d.Attempts, err)
+		notifier.drop(d)
+		return
+	}
+	notifier.logger.Warnf("cannot deliver notification %v of watch %v: %v", d.ID, d.Watch, err)
+	d.NextAttempt = time.Now().Add(notifier.backoff(d.Attempts)).UnixNano() / int64(time.Millisecond)
+	if err := notifier.deliveries.Insert(d.ID, d); err != nil {
+		notifier.logger.Errorf("cannot store notification %v: %v", d.ID, err)
+	}
+}
+
+// send posts the payload to the webhook of the watch. Any response other than a 2xx status is an error.
+func (notifier *Notifier) send(ctx context.Context, w Watch, payload []byte) error {
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(w.Secret, payload))
+
+	resp, err := notifier.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt, after the given number of failed attempts.
+func (notifier *Notifier) backoff(attempts int) time.Duration {
+	delay := notifier.options.MinBackoff
+	for i := 1; i < attempts && delay < notifier.options.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > notifier.options.MaxBackoff {
+		delay = notifier.options.MaxBackoff
+	}
+	return delay
+}
+
+// drop removes the notification.
+func (notifier *Notifier) drop(d delivery) {
+	if err := notifier.deliveries.Delete(d.ID); err != nil {
+		notifier.logger.Errorf("cannot delete notification %v: %v", d.ID, err)
+	}
+}
@@ -0,0 +1,308 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/renproject/kv"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/types"
+	"github.com/renproject/mercury/types/btctypes"
+	"github.com/sirupsen/logrus"
+)
+
+// Options configure how webhooks are delivered.
+type Options struct {
+	// Timeout limits how long a webhook has to respond.
+	Timeout time.Duration
+	// MaxAttempts is the number of times a notification is sent before it is dropped.
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry, which doubles after each failed attempt up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Workers is the number of notifications that are delivered at once, so that slow webhooks do not delay the
+	// others.
+	Workers int
+}
+
+// DefaultOptions returns the options used by New: webhooks have 10 seconds to respond, up to 10 are delivered at once,
+// and they are retried up to 12 times over about a day.
+func DefaultOptions() Options {
+	return Options{
+		Timeout:     10 * time.Second,
+		MaxAttempts: 12,
+		MinBackoff:  10 * time.Second,
+		MaxBackoff:  4 * time.Hour,
+		Workers:     10,
+	}
+}
+
+// deliveryInterval is how often deliveries that are due are sent.
+const deliveryInterval = time.Second
+
+// prepareTimeout limits how long the upstreams have to get ready for a watch when it is registered.
+const prepareTimeout = 30 * time.Second
+
+// Notifier polls the activity of the registered watches, and delivers their notifications.
+type Notifier struct {
+	watches    kv.Table
+	deliveries kv.Table
+	options    Options
+	client     *http.Client
+	logger     logrus.FieldLogger
+
+	// mu serialises the changes to the records of the watches, so that deleted watches are not written back by a poll.
+	mu       *sync.Mutex
+	networks map[string]*network
+}
+
+// network is a network whose watches are polled.
+type network struct {
+	source   source
+	interval time.Duration
+}
+
+// New returns a new Notifier which keeps the watches and their pending deliveries in the given tables. Networks must be
+// added using AddNetwork before watches can be registered for them.
+func New(watches, deliveries kv.Table, options Options, logger logrus.FieldLogger) *Notifier {
+	defaults := DefaultOptions()
+	if options.Timeout <= 0 {
+		options.Timeout = defaults.Timeout
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = defaults.MaxAttempts
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = defaults.MinBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = options.MinBackoff
+	}
+	if options.Workers <= 0 {
+		options.Workers = defaults.Workers
+	}
+	return &Notifier{
+		watches:    watches,
+		deliveries: deliveries,
+		options:    options,
+		client:     &http.Client{Timeout: options.Timeout},
+		logger:     logger,
+		mu:         new(sync.Mutex),
+		networks:   map[string]*network{},
+	}
+}
+
+// AddNetwork allows watches to be registered for the network, whose activity is found using the caller and polled at
+// the given interval. Networks of unsupported chains are ignored. It must be called before Run.
+func (notifier *Notifier) AddNetwork(n types.Network, call chain.Caller, interval time.Duration) {
+	var src source
+	switch n.Chain() {
+	case types.Bitcoin, types.ZCash, types.BitcoinCash:
+		btcNetwork, ok := n.(btctypes.Network)
+		if !ok {
+			return
+		}
+		src = utxoSource{network: btcNetwork, call: call}
+	case types.Ethereum:
+		src = erc20Source{call: call}
+	default:
+		return
+	}
+	notifier.networks[route(n)] = &network{source: src, interval: interval}
+}
+
+// Register validates the watch and stores it with a new ID and secret, which are returned. Activity is notified from
+// the next poll of its network. The addresses of Bitcoin-family watches are imported into the wallet of an upstream,
+// without a rescan, so only outputs sent after the watch is registered are found.
+func (notifier *Notifier) Register(w Watch) (Watch, error) {
+	n, ok := notifier.networks[w.Network]
+	if !ok {
+		return Watch{}, ErrInvalid{Reason: fmt.Sprintf("unsupported network %q", w.Network)}
+	}
+	if err := w.validate(); err != nil {
+		return Watch{}, err
+	}
+	if err := n.source.validate(&w); err != nil {
+		return Watch{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prepareTimeout)
+	defer cancel()
+	if err := n.source.prepare(ctx, w); err != nil {
+		return Watch{}, err
+	}
+
+	var err error
+	if w.ID, err = randomID(16); err != nil {
+		return Watch{}, err
+	}
+	if w.Secret, err = randomID(32); err != nil {
+		return Watch{}, err
+	}
+	w.Created = time.Now().Unix()
+
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	if err := notifier.watches.Insert(w.ID, record{Watch: w, State: state{Activity: map[string]*Activity{}}}); err != nil {
+		return Watch{}, fmt.Errorf("cannot store watch: %v", err)
+	}
+	return w, nil
+}
+
+// Get returns the watch with the given ID, without its secret.
+func (notifier *Notifier) Get(id string) (Watch, error) {
+	rec, err := notifier.record(id)
+	if err != nil {
+		return Watch{}, err
+	}
+	rec.Watch.Secret = ""
+	return rec.Watch, nil
+}
+
+// Delete removes the watch with the given ID. Its pending notifications are dropped when they are next due.
+func (notifier *Notifier) Delete(id string) error {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	if _, err := notifier.record(id); err != nil {
+		return err
+	}
+	if err := notifier.watches.Delete(id); err != nil {
+		return fmt.Errorf("cannot delete watch: %v", err)
+	}
+	return nil
+}
+
+// record returns the stored record of the watch with the given ID.
+func (notifier *Notifier) record(id string) (record, error) {
+	var rec record
+	if err := notifier.watches.Get(id, &rec); err != nil {
+		if err == kv.ErrKeyNotFound {
+			return record{}, ErrNotFound
+		}
+		return record{}, fmt.Errorf("cannot read watch: %v", err)
+	}
+	return rec, nil
+}
+
+// Run polls the watches of each network at its interval, and delivers their notifications, until the context is done.
+func (notifier *Notifier) Run(ctx context.Context) {
+	for name, n := range notifier.networks {
+		go func(name string, n *network) {
+			ticker := time.NewTicker(n.interval)
+			defer ticker.Stop()
+			for {
+				notifier.poll(ctx, name, n)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(name, n)
+	}
+
+	ticker := time.NewTicker(deliveryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notifier.Deliver(ctx)
+		}
+	}
+}
+
+// Poll polls the watches of every network once.
+func (notifier *Notifier) Poll(ctx context.Context) {
+	for name, n := range notifier.networks {
+		notifier.poll(ctx, name, n)
+	}
+}
+
+// poll updates the activity of each watch of the network, and queues the notifications that are due.
+func (notifier *Notifier) poll(ctx context.Context, name string, n *network) {
+	ids := []string{}
+	iter := notifier.watches.Iterator()
+	for iter.Next() {
+		var rec record
+		if err := iter.Value(&rec); err != nil {
+			notifier.logger.Errorf("cannot read watch: %v", err)
+			continue
+		}
+		if rec.Watch.Network == name {
+			ids = append(ids, rec.Watch.ID)
+		}
+	}
+	iter.Close()
+
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := notifier.update(ctx, id, n.source); err != nil {
+			notifier.logger.Warnf("cannot update watch %v on %v: %v", id, name, err)
+		}
+	}
+}
+
+// update finds the activity of the watch with the given ID, and queues a notification for each output or transfer that
+// is new or has reached a requested depth.
+func (notifier *Notifier) update(ctx context.Context, id string, src source) error {
+	rec, err := notifier.record(id)
+	if err != nil {
+		return err
+	}
+	if rec.State.Activity == nil {
+		rec.State.Activity = map[string]*Activity{}
+	}
+	w := rec.Watch
+	if err := src.update(ctx, w, &rec.State); err != nil {
+		return err
+	}
+
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	// The watch may have been deleted while it was being updated.
+	if _, err := notifier.record(id); err != nil {
+		return err
+	}
+	for _, a := range rec.State.Activity {
+		for ; !a.done(w) && a.Confirmations >= w.depth(a.Notified); a.Notified++ {
+			if err := notifier.queue(w, *a, w.depth(a.Notified)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := notifier.watches.Insert(id, rec); err != nil {
+		return fmt.Errorf("cannot store watch: %v", err)
+	}
+	return nil
+}
+
+// route returns the route of the network, such as `btc/mainnet`.
+func route(network types.Network) string {
+	return fmt.Sprintf("%s/%s", network.Chain(), network)
+}
+
+// notification returns the notification of the activity reaching the depth.
+func notification(id string, w Watch, a Activity, depth uint64) ([]byte, error) {
+	return json.Marshal(Notification{
+		ID:            id,
+		Watch:         w.ID,
+		Network:       w.Network,
+		Address:       w.Address,
+		Contract:      w.Contract,
+		Recipient:     w.Recipient,
+		TxHash:        a.TxHash,
+		Index:         a.Index,
+		Amount:        a.Amount,
+		Confirmations: a.Confirmations,
+		Depth:         depth,
+	})
+}
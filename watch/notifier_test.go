@@ -0,0 +1,630 @@
+package watch_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/renproject/mercury/watch"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/renproject/kv"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/types/btctypes"
+	"github.com/renproject/mercury/types/ethtypes"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	contract  = "0x0a9add98c076448cbcfacf5e457da12ddbef4a8f"
+	recipient = "0x00000000000000000000000000000000000000aa"
+)
+
+var _ = Describe("Notifier", func() {
+	var (
+		node       *fakeNode
+		receiver   *fakeReceiver
+		deliveries kv.Table
+		notifier   *Notifier
+		address    string
+	)
+
+	BeforeEach(func() {
+		node = newFakeNode()
+		receiver = newFakeReceiver()
+		db := kv.NewMemDB(kv.JSONCodec)
+		deliveries = kv.NewTable(db, "deliveries")
+		notifier = New(kv.NewTable(db, "watches"), deliveries, Options{
+			MaxAttempts: 3,
+			MinBackoff:  time.Millisecond,
+			MaxBackoff:  time.Millisecond,
+		}, logrus.StandardLogger())
+		notifier.AddNetwork(btctypes.BtcTestnet, node.Call, time.Second)
+		notifier.AddNetwork(ethtypes.Kovan, node.Call, time.Second)
+
+		addr, err := btcutil.NewAddressPubKeyHash(make([]byte, 20), &chaincfg.TestNet3Params)
+		Expect(err).ToNot(HaveOccurred())
+		address = addr.EncodeAddress()
+	})
+
+	AfterEach(func() {
+		receiver.Close()
+	})
+
+	// update polls the watches and delivers their notifications, returning the notifications that were received.
+	update := func() []Notification {
+		notifier.Poll(context.Background())
+		notifier.Deliver(context.Background())
+		return receiver.Take()
+	}
+	depths := func(notifications []Notification) []uint64 {
+		result := []uint64{}
+		for _, notification := range notifications {
+			result = append(result, notification.Depth)
+		}
+		return result
+	}
+
+	Context("when registering watches", func() {
+		It("should return the watch with its secret", func() {
+			w, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL, Confirmations: []uint64{6, 1}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.ID).ToNot(BeEmpty())
+			Expect(w.Secret).ToNot(BeEmpty())
+			Expect(w.Confirmations).To(Equal([]uint64{1, 6}))
+
+			stored, err := notifier.Get(w.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stored.Secret).To(BeEmpty())
+			Expect(stored.Address).To(Equal(address))
+		})
+
+		It("should use the default confirmations", func() {
+			w, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Confirmations).To(Equal(DefaultConfirmations))
+		})
+
+		It("should reject invalid watches", func() {
+			invalid := []Watch{
+				{Network: "ltc/mainnet", Address: address, URL: receiver.URL},
+				{Network: "btc/testnet", Address: "invalid", URL: receiver.URL},
+				{Network: "btc/testnet", Address: address, URL: "ftp://example.com"},
+				{Network: "btc/testnet", Address: address, URL: receiver.URL, Confirmations: []uint64{0}},
+				{Network: "btc/testnet", Address: address, URL: receiver.URL, Confirmations: []uint64{2, 2}},
+				{Network: "btc/testnet", Contract: contract, Recipient: recipient, URL: receiver.URL},
+				{Network: "eth/kovan", Contract: contract, URL: receiver.URL},
+				{Network: "eth/kovan", Address: address, URL: receiver.URL},
+			}
+			for _, w := range invalid {
+				_, err := notifier.Register(w)
+				Expect(err).To(BeAssignableToTypeOf(ErrInvalid{}), fmt.Sprintf("%+v", w))
+			}
+		})
+
+		It("should reject watches whose address cannot be imported", func() {
+			node.Fail("importaddress", chain.ErrRPC{Method: "importaddress", Code: -18, Message: "No wallet is loaded"})
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).To(BeAssignableToTypeOf(ErrInvalid{}))
+			Expect(err.Error()).To(ContainSubstring("No wallet is loaded"))
+		})
+
+		It("should delete watches", func() {
+			w, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(notifier.Delete(w.ID)).To(Succeed())
+			_, err = notifier.Get(w.ID)
+			Expect(err).To(Equal(ErrNotFound))
+			Expect(notifier.Delete(w.ID)).To(Equal(ErrNotFound))
+		})
+	})
+
+	Context("when watching a Bitcoin address", func() {
+		It("should notify each output when it is seen and at each depth", func() {
+			w, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL, Confirmations: []uint64{1, 3}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(update()).To(BeEmpty())
+
+			node.Send("tx1", 0, "0.5")
+			notifications := update()
+			Expect(notifications).To(HaveLen(1))
+			Expect(notifications[0]).To(matchNotification(w, "tx1", 0, "50000000", 0, 0))
+
+			node.Mine()
+			Expect(depths(update())).To(Equal([]uint64{1}))
+			node.Mine()
+			Expect(update()).To(BeEmpty())
+			node.Mine()
+			notifications = update()
+			Expect(notifications).To(HaveLen(1))
+			Expect(notifications[0]).To(matchNotification(w, "tx1", 0, "50000000", 3, 3))
+
+			node.Mine()
+			Expect(update()).To(BeEmpty())
+		})
+
+		It("should notify every depth an output has already reached", func() {
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL, Confirmations: []uint64{1, 2}})
+			Expect(err).ToNot(HaveOccurred())
+
+			node.Send("tx1", 1, "1")
+			node.Mine()
+			node.Mine()
+			Expect(depths(update())).To(ConsistOf(uint64(0), uint64(1), uint64(2)))
+		})
+
+		It("should keep notifying outputs that are spent", func() {
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL, Confirmations: []uint64{2}})
+			Expect(err).ToNot(HaveOccurred())
+
+			node.Send("tx1", 0, "1")
+			Expect(depths(update())).To(Equal([]uint64{0}))
+			node.Spend("tx1")
+			node.Mine()
+			node.Mine()
+			Expect(depths(update())).To(Equal([]uint64{2}))
+		})
+
+		It("should keep outputs whose transactions cannot be read", func() {
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL, Confirmations: []uint64{2}})
+			Expect(err).ToNot(HaveOccurred())
+
+			node.Send("tx1", 0, "1")
+			Expect(depths(update())).To(Equal([]uint64{0}))
+			node.Spend("tx1")
+			node.Mine()
+			node.Mine()
+			node.Fail("gettransaction", chain.ErrRPC{Method: "gettransaction", Code: -28, Message: "Loading wallet..."})
+			Expect(update()).To(BeEmpty())
+			Expect(depths(update())).To(Equal([]uint64{2}))
+		})
+
+		It("should stop notifying outputs that are dropped from the chain", func() {
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).ToNot(HaveOccurred())
+
+			node.Send("tx1", 0, "1")
+			Expect(depths(update())).To(Equal([]uint64{0}))
+			node.Drop("tx1")
+			node.Mine()
+			Expect(update()).To(BeEmpty())
+		})
+
+		It("should stop notifying outputs that are not in the wallet, the mempool or the chain", func() {
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL, Confirmations: []uint64{2}})
+			Expect(err).ToNot(HaveOccurred())
+
+			node.Send("tx1", 0, "1")
+			Expect(depths(update())).To(Equal([]uint64{0}))
+			node.Spend("tx1")
+			node.Mine()
+			node.Mine()
+			node.Fail("gettransaction", chain.ErrRPC{Method: "gettransaction", Code: -5, Message: "Invalid or non-wallet transaction id"})
+			node.Fail("getrawtransaction", chain.ErrRPC{Method: "getrawtransaction", Code: -5, Message: "No such mempool or blockchain transaction"})
+			Expect(update()).To(BeEmpty())
+			Expect(update()).To(BeEmpty())
+		})
+	})
+
+	Context("when watching ERC20 transfers", func() {
+		It("should notify each transfer when it is seen and at each depth", func() {
+			node.MineTo(100)
+			w, err := notifier.Register(Watch{Network: "eth/kovan", Contract: contract, Recipient: recipient, URL: receiver.URL, Confirmations: []uint64{2}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(update()).To(BeEmpty())
+
+			node.Transfer("0xtx1", "1000")
+			notifications := update()
+			Expect(notifications).To(HaveLen(1))
+			Expect(notifications[0]).To(matchNotification(w, "0xtx1", 0, "1000", 1, 0))
+
+			node.Mine()
+			Expect(depths(update())).To(Equal([]uint64{2}))
+			node.Mine()
+			Expect(update()).To(BeEmpty())
+		})
+
+		It("should not notify transfers that are reorganised out of the chain", func() {
+			node.MineTo(100)
+			_, err := notifier.Register(Watch{Network: "eth/kovan", Contract: contract, Recipient: recipient, URL: receiver.URL, Confirmations: []uint64{2}})
+			Expect(err).ToNot(HaveOccurred())
+
+			node.Transfer("0xtx1", "1000")
+			Expect(depths(update())).To(Equal([]uint64{0}))
+			node.Drop("0xtx1")
+			node.Mine()
+			Expect(update()).To(BeEmpty())
+		})
+
+		It("should notify transfers in blocks that replace scanned blocks", func() {
+			node.MineTo(100)
+			w, err := notifier.Register(Watch{Network: "eth/kovan", Contract: contract, Recipient: recipient, URL: receiver.URL, Confirmations: []uint64{3}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(update()).To(BeEmpty())
+			node.Mine()
+			node.Mine()
+			Expect(update()).To(BeEmpty())
+
+			// A reorg replaces block 101, which has already been scanned, with a block that includes a transfer.
+			node.TransferAt("0xtx1", "1000", 101)
+			notifications := update()
+			Expect(notifications).To(HaveLen(1))
+			Expect(notifications[0]).To(matchNotification(w, "0xtx1", 0, "1000", 2, 0))
+			node.Mine()
+			Expect(depths(update())).To(Equal([]uint64{3}))
+			for i := 0; i < 20; i++ {
+				node.Mine()
+				Expect(update()).To(BeEmpty())
+			}
+		})
+	})
+
+	Context("when delivering notifications", func() {
+		It("should sign each notification", func() {
+			w, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).ToNot(HaveOccurred())
+			node.Send("tx1", 0, "1")
+			update()
+
+			requests := receiver.Requests()
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].signature).To(Equal(Sign(w.Secret, requests[0].body)))
+		})
+
+		It("should retry failed deliveries with the same notification", func() {
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).ToNot(HaveOccurred())
+			receiver.Fail(2)
+			node.Send("tx1", 0, "1")
+			Expect(update()).To(BeEmpty())
+
+			Eventually(func() []Notification {
+				notifier.Deliver(context.Background())
+				return receiver.Take()
+			}).Should(HaveLen(1))
+			requests := receiver.Requests()
+			Expect(requests).To(HaveLen(3))
+			Expect(requests[0].body).To(Equal(requests[2].body))
+			Expect(deliveries.Size()).To(Equal(0))
+		})
+
+		It("should drop notifications after the maximum number of attempts", func() {
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).ToNot(HaveOccurred())
+			receiver.Fail(100)
+			node.Send("tx1", 0, "1")
+			update()
+
+			Eventually(func() int {
+				notifier.Deliver(context.Background())
+				size, err := deliveries.Size()
+				Expect(err).ToNot(HaveOccurred())
+				return size
+			}).Should(Equal(0))
+			Expect(receiver.Requests()).To(HaveLen(3))
+		})
+
+		It("should deliver notifications concurrently", func() {
+			_, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).ToNot(HaveOccurred())
+			for i := uint32(0); i < 4; i++ {
+				node.Send("tx1", i, "1")
+			}
+			notifier.Poll(context.Background())
+
+			receiver.Delay(500 * time.Millisecond)
+			start := time.Now()
+			notifier.Deliver(context.Background())
+			Expect(time.Since(start)).To(BeNumerically("<", 1500*time.Millisecond))
+			Expect(receiver.Take()).To(HaveLen(4))
+			Expect(deliveries.Size()).To(Equal(0))
+		})
+
+		It("should drop notifications of deleted watches", func() {
+			w, err := notifier.Register(Watch{Network: "btc/testnet", Address: address, URL: receiver.URL})
+			Expect(err).ToNot(HaveOccurred())
+			node.Send("tx1", 0, "1")
+			notifier.Poll(context.Background())
+			Expect(notifier.Delete(w.ID)).To(Succeed())
+
+			notifier.Deliver(context.Background())
+			Expect(receiver.Requests()).To(BeEmpty())
+			Expect(deliveries.Size()).To(Equal(0))
+		})
+	})
+})
+
+// matchNotification matches a notification of the watch.
+func matchNotification(w Watch, txHash string, index uint32, amount string, confirmations, depth uint64) OmegaMatcher {
+	return WithTransform(func(n Notification) Notification {
+		n.ID = ""
+		return n
+	}, Equal(Notification{
+		Watch:         w.ID,
+		Network:       w.Network,
+		Address:       w.Address,
+		Contract:      w.Contract,
+		Recipient:     w.Recipient,
+		TxHash:        txHash,
+		Index:         index,
+		Amount:        amount,
+		Confirmations: confirmations,
+		Depth:         depth,
+	}))
+}
+
+// fakeNode is a chain of blocks with outputs and ERC20 transfers, served using the methods of Bitcoin and Ethereum
+// nodes.
+type fakeNode struct {
+	mu       *sync.Mutex
+	height   uint64
+	txs      []*fakeTx
+	imported map[string]bool
+	failures map[string]error
+}
+
+// fakeTx is an output or transfer, which is in the mempool while its height is zero.
+type fakeTx struct {
+	hash    string
+	index   uint32
+	amount  string
+	height  uint64
+	spent   bool
+	dropped bool
+}
+
+func newFakeNode() *fakeNode {
+	return &fakeNode{mu: new(sync.Mutex), height: 1, imported: map[string]bool{}, failures: map[string]error{}}
+}
+
+// Mine adds a block to the chain, which includes the transactions in the mempool.
+func (node *fakeNode) Mine() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.height++
+	for _, tx := range node.txs {
+		if tx.height == 0 {
+			tx.height = node.height
+		}
+	}
+}
+
+// MineTo adds empty blocks up to the height.
+func (node *fakeNode) MineTo(height uint64) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.height = height
+}
+
+// Send adds an output to the mempool.
+func (node *fakeNode) Send(hash string, index uint32, amount string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.txs = append(node.txs, &fakeTx{hash: hash, index: index, amount: amount})
+}
+
+// Transfer adds an ERC20 transfer to a new block.
+func (node *fakeNode) Transfer(hash, amount string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.height++
+	node.txs = append(node.txs, &fakeTx{hash: hash, amount: amount, height: node.height})
+}
+
+// TransferAt adds an ERC20 transfer to an existing block, as if the block had been replaced by a reorg.
+func (node *fakeNode) TransferAt(hash, amount string, height uint64) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.txs = append(node.txs, &fakeTx{hash: hash, amount: amount, height: height})
+}
+
+// Spend marks the output as spent.
+func (node *fakeNode) Spend(hash string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.tx(hash).spent = true
+}
+
+// Drop removes the transaction from the chain.
+func (node *fakeNode) Drop(hash string) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.tx(hash).dropped = true
+}
+
+// Fail makes the next call of the method return the error.
+func (node *fakeNode) Fail(method string, err error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.failures[method] = err
+}
+
+func (node *fakeNode) tx(hash string) *fakeTx {
+	for _, tx := range node.txs {
+		if tx.hash == hash {
+			return tx
+		}
+	}
+	panic(fmt.Sprintf("unknown tx %v", hash))
+}
+
+func (node *fakeNode) confirmations(tx *fakeTx) uint64 {
+	if tx.height == 0 {
+		return 0
+	}
+	return node.height - tx.height + 1
+}
+
+// Call implements the `chain.Caller` type.
+func (node *fakeNode) Call(ctx context.Context, method string, params ...interface{}) (json.RawMessage, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if err, ok := node.failures[method]; ok {
+		delete(node.failures, method)
+		return nil, err
+	}
+	switch method {
+	case "importaddress":
+		node.imported[params[0].(string)] = true
+		return json.RawMessage("null"), nil
+	case "listunspent":
+		maxConf := params[1].(uint64)
+		unspent := []map[string]interface{}{}
+		if !node.imported[params[2].([]string)[0]] {
+			// Nodes only list the outputs of addresses in their wallet.
+			return json.Marshal(unspent)
+		}
+		for _, tx := range node.txs {
+			if tx.spent || tx.dropped || node.confirmations(tx) > maxConf {
+				continue
+			}
+			unspent = append(unspent, map[string]interface{}{
+				"txid":          tx.hash,
+				"vout":          tx.index,
+				"amount":        json.Number(tx.amount),
+				"confirmations": node.confirmations(tx),
+			})
+		}
+		return json.Marshal(unspent)
+	case "gettransaction":
+		for _, tx := range node.txs {
+			if tx.hash == params[0] {
+				if tx.dropped {
+					// The transaction has been double spent.
+					return json.Marshal(map[string]interface{}{"confirmations": -1})
+				}
+				return json.Marshal(map[string]interface{}{"confirmations": node.confirmations(tx)})
+			}
+		}
+		return nil, chain.ErrRPC{Method: method, Code: -5, Message: "Invalid or non-wallet transaction id"}
+	case "getrawtransaction":
+		for _, tx := range node.txs {
+			if tx.hash == params[0] && !tx.dropped {
+				return json.Marshal(map[string]interface{}{"confirmations": node.confirmations(tx)})
+			}
+		}
+		return nil, chain.ErrRPC{Method: method, Code: -5, Message: "No such mempool or blockchain transaction"}
+	case "eth_blockNumber":
+		return json.Marshal(hexutil.Uint64(node.height))
+	case "eth_getLogs":
+		filter := params[0].(map[string]interface{})
+		from, _ := hexutil.DecodeUint64(filter["fromBlock"].(string))
+		to, _ := hexutil.DecodeUint64(filter["toBlock"].(string))
+		logs := []map[string]interface{}{}
+		for _, tx := range node.txs {
+			if tx.dropped || tx.height < from || tx.height > to || filter["address"] != contract {
+				continue
+			}
+			amount, _ := new(big.Int).SetString(tx.amount, 10)
+			logs = append(logs, map[string]interface{}{
+				"transactionHash": tx.hash,
+				"logIndex":        hexutil.Uint64(tx.index),
+				"blockNumber":     hexutil.Uint64(tx.height),
+				"blockHash":       fmt.Sprintf("block%d", tx.height),
+				"data":            hexutil.Bytes(amount.Bytes()),
+			})
+		}
+		return json.Marshal(logs)
+	case "eth_getTransactionReceipt":
+		for _, tx := range node.txs {
+			if tx.hash == params[0] && !tx.dropped {
+				return json.Marshal(map[string]interface{}{
+					"blockNumber": hexutil.Uint64(tx.height),
+					"blockHash":   fmt.Sprintf("block%d", tx.height),
+				})
+			}
+		}
+		return json.RawMessage("null"), nil
+	}
+	return nil, fmt.Errorf("unsupported request %v %v", method, params)
+}
+
+// fakeReceiver is a webhook which records the notifications it receives, and can be made to fail.
+type fakeReceiver struct {
+	*httptest.Server
+
+	mu        *sync.Mutex
+	delay     time.Duration
+	failures  int
+	requests  []request
+	delivered []Notification
+}
+
+// request is a request received by the webhook.
+type request struct {
+	signature string
+	body      []byte
+}
+
+func newFakeReceiver() *fakeReceiver {
+	receiver := &fakeReceiver{mu: new(sync.Mutex)}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		receiver.mu.Lock()
+		delay := receiver.delay
+		receiver.mu.Unlock()
+		time.Sleep(delay)
+
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, request{signature: r.Header.Get(SignatureHeader), body: body})
+		if receiver.failures > 0 {
+			receiver.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var notification Notification
+		if err := json.Unmarshal(body, &notification); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		receiver.delivered = append(receiver.delivered, notification)
+	}))
+	return receiver
+}
+
+// Fail makes the next requests fail.
+func (receiver *fakeReceiver) Fail(requests int) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.failures = requests
+}
+
+// Delay makes the webhook wait before responding to each request.
+func (receiver *fakeReceiver) Delay(delay time.Duration) {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	receiver.delay = delay
+}
+
+// Take returns the notifications delivered since it was last called.
+func (receiver *fakeReceiver) Take() []Notification {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	delivered := receiver.delivered
+	receiver.delivered = nil
+	return delivered
+}
+
+// Requests returns every request received.
+func (receiver *fakeReceiver) Requests() []request {
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	return append([]request{}, receiver.requests...)
+}
@@ -0,0 +1,339 @@
+package watch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/renproject/mercury/chain"
+	"github.com/renproject/mercury/types/btctypes"
+)
+
+// pruneMargin is the number of confirmations beyond the deepest requested depth for which notified outputs and
+// transfers are remembered, so that they are not notified again while the node still lists them.
+const pruneMargin = 10
+
+// rpcInvalidAddressOrKey is the code of the errors returned by Bitcoin-family nodes for unknown transactions, and
+// errNoSuchTransaction is the message of the error returned for transactions that are neither in the mempool nor in
+// the chain.
+const (
+	rpcInvalidAddressOrKey = -5
+	errNoSuchTransaction   = "No such mempool or blockchain transaction"
+)
+
+// maxLogRange is the number of blocks scanned for ERC20 transfers in a single request.
+const maxLogRange = 1000
+
+// transferTopic is the topic of ERC20 `Transfer(address,address,uint256)` events.
+var transferTopic = common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+
+// source finds the activity of the watches of a network.
+type source interface {
+	// validate checks the fields of the watch that depend on the network.
+	validate(w *Watch) error
+	// prepare makes the upstreams ready to find the activity of a watch that is being registered.
+	prepare(ctx context.Context, w Watch) error
+	// update adds new activity to the state of the watch, updates the confirmations of the existing activity, and
+	// removes activity that has been fully notified or is no longer in the chain.
+	update(ctx context.Context, w Watch, st *state) error
+}
+
+// utxoSource finds the outputs sent to Bitcoin, ZCash and Bitcoin Cash addresses. The addresses must be known to the
+// wallets of the nodes for `listunspent` to find their outputs, so they are imported when their watches are registered.
+type utxoSource struct {
+	network btctypes.Network
+	call    chain.Caller
+}
+
+func (source utxoSource) validate(w *Watch) error {
+	if w.Contract != "" || w.Recipient != "" {
+		return ErrInvalid{Reason: fmt.Sprintf("%v watches need an address, not a contract and recipient", w.Network)}
+	}
+	if _, err := btctypes.AddressFromBase58(w.Address, source.network); err != nil {
+		return ErrInvalid{Reason: fmt.Sprintf("invalid %v address %q", w.Network, w.Address)}
+	}
+	return nil
+}
+
+// prepare imports the address into the wallet of the upstream, without rescanning the chain, so that outputs sent to
+// it from now on are listed. Watches are rejected if the upstream cannot import addresses, such as when its wallet is
+// disabled.
+func (source utxoSource) prepare(ctx context.Context, w Watch) error {
+	_, err := source.call(ctx, "importaddress", w.Address, "", false)
+	if rpcErr, ok := err.(chain.ErrRPC); ok {
+		return ErrInvalid{Reason: fmt.Sprintf("cannot import %v address %q into the wallets of the upstreams: %v", w.Network, w.Address, rpcErr.Message)}
+	}
+	return err
+}
+
+func (source utxoSource) update(ctx context.Context, w Watch, st *state) error {
+	unspent := []struct {
+		TxID          string      `json:"txid"`
+		Vout          uint32      `json:"vout"`
+		Amount        json.Number `json:"amount"`
+		Confirmations uint64      `json:"confirmations"`
+	}{}
+	if err := get(ctx, source.call, &unspent, "listunspent", 0, w.maxDepth()+pruneMargin, []string{w.Address}); err != nil {
+		return err
+	}
+
+	listed := map[string]bool{}
+	for _, output := range unspent {
+		id := activityID(output.TxID, output.Vout)
+		listed[id] = true
+		a, ok := st.Activity[id]
+		if !ok {
+			amount, err := satoshis(output.Amount)
+			if err != nil {
+				return err
+			}
+			a = &Activity{TxHash: output.TxID, Index: output.Vout, Amount: amount}
+			st.Activity[id] = a
+		}
+		a.Confirmations = output.Confirmations
+	}
+
+	for id, a := range st.Activity {
+		if listed[id] {
+			continue
+		}
+		if a.done(w) {
+			// The output has been spent, or is deeper than the outputs that are listed, so it will not be listed again.
+			delete(st.Activity, id)
+			continue
+		}
+
+		// The output has been spent before it was fully notified, so its confirmations are read from its transaction.
+		txConfirmations, ok, err := source.txConfirmations(ctx, a.TxHash)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			delete(st.Activity, id)
+			continue
+		}
+		a.Confirmations = txConfirmations
+	}
+	return nil
+}
+
+// txConfirmations returns the confirmations of the transaction, and false if it is known to have left the chain. The
+// transaction is read from the wallet, which knows the transactions of the addresses imported into it, and otherwise
+// from the mempool and the transaction index.
+func (source utxoSource) txConfirmations(ctx context.Context, txHash string) (uint64, bool, error) {
+	wallet := struct {
+		Confirmations int64 `json:"confirmations"`
+	}{}
+	err := get(ctx, source.call, &wallet, "gettransaction", txHash, true)
+	if err == nil {
+		// Transactions that conflict with a transaction in the chain have negative confirmations.
+		return uint64(wallet.Confirmations), wallet.Confirmations >= 0, nil
+	}
+	if rpcErr, ok := err.(chain.ErrRPC); !ok || rpcErr.Code != rpcInvalidAddressOrKey {
+		return 0, false, err
+	}
+
+	tx := struct {
+		Confirmations uint64 `json:"confirmations"`
+	}{}
+	err = get(ctx, source.call, &tx, "getrawtransaction", txHash, 1)
+	if err == nil {
+		return tx.Confirmations, true, nil
+	}
+	if rpcErr, ok := err.(chain.ErrRPC); ok && rpcErr.Code == rpcInvalidAddressOrKey && strings.HasPrefix(rpcErr.Message, errNoSuchTransaction) {
+		// Nodes only return this error when they have a transaction index, and the transaction is neither in it nor in
+		// the mempool. Other nodes cannot tell whether the transaction is in the chain.
+		return 0, false, nil
+	}
+	return 0, false, err
+}
+
+// satoshis converts an amount in whole coins, as listed by the nodes, to the smallest unit.
+func satoshis(amount json.Number) (string, error) {
+	value, err := amount.Float64()
+	if err != nil {
+		return "", fmt.Errorf("invalid amount %v: %v", amount, err)
+	}
+	coins, err := btcutil.NewAmount(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid amount %v: %v", amount, err)
+	}
+	return strconv.FormatInt(int64(coins), 10), nil
+}
+
+// erc20Source finds the ERC20 transfers of a contract to a recipient, by scanning each block for their logs.
+type erc20Source struct {
+	call chain.Caller
+}
+
+func (source erc20Source) validate(w *Watch) error {
+	if w.Address != "" {
+		return ErrInvalid{Reason: fmt.Sprintf("%v watches need a contract and recipient, not an address", w.Network)}
+	}
+	if !common.IsHexAddress(w.Contract) {
+		return ErrInvalid{Reason: fmt.Sprintf("invalid contract %q", w.Contract)}
+	}
+	if !common.IsHexAddress(w.Recipient) {
+		return ErrInvalid{Reason: fmt.Sprintf("invalid recipient %q", w.Recipient)}
+	}
+	w.Contract = strings.ToLower(common.HexToAddress(w.Contract).Hex())
+	w.Recipient = strings.ToLower(common.HexToAddress(w.Recipient).Hex())
+	return nil
+}
+
+func (source erc20Source) prepare(ctx context.Context, w Watch) error {
+	return nil
+}
+
+func (source erc20Source) update(ctx context.Context, w Watch, st *state) error {
+	var number hexutil.Uint64
+	if err := get(ctx, source.call, &number, "eth_blockNumber"); err != nil {
+		return err
+	}
+	tip := uint64(number)
+
+	// Transfers made shortly before the watch was registered are found as well, as they are for other networks.
+	if st.Cursor == 0 {
+		st.Cursor = 1
+		if tip > w.maxDepth() {
+			st.Cursor = tip - w.maxDepth() + 1
+		}
+	}
+
+	// The blocks within the rescan window can be replaced by a reorg, and the replacements can include transfers that
+	// were not in the blocks they replaced, so they are scanned again by every update. Transfers that are found again
+	// are recognised by their ID.
+	window := rescanWindow(w)
+	from := uint64(1)
+	if tip > window {
+		from = tip - window + 1
+	}
+	if st.Cursor < from {
+		from = st.Cursor
+	}
+	if from <= tip {
+		to := tip
+		if to-from >= maxLogRange {
+			to = from + maxLogRange - 1
+		}
+		if err := source.scan(ctx, w, st, from, to); err != nil {
+			return err
+		}
+		st.Cursor = to + 1
+	}
+
+	for id, a := range st.Activity {
+		if a.done(w) {
+			// Transfers are remembered until they leave the rescan window, so that they are not notified again.
+			if confirmations(tip, a.Height) > window {
+				delete(st.Activity, id)
+			}
+			continue
+		}
+		a.Confirmations = confirmations(tip, a.Height)
+		if a.Notified == 0 || a.Confirmations < w.depth(a.Notified) {
+			continue
+		}
+
+		// Check that the transfer is still in the chain before notifying that it has reached a new depth.
+		ok, err := source.included(ctx, a)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			delete(st.Activity, id)
+			continue
+		}
+		a.Confirmations = confirmations(tip, a.Height)
+	}
+	return nil
+}
+
+// scan adds the transfers to the recipient within the blocks to the activity.
+func (source erc20Source) scan(ctx context.Context, w Watch, st *state, from, to uint64) error {
+	filter := map[string]interface{}{
+		"fromBlock": hexutil.EncodeUint64(from),
+		"toBlock":   hexutil.EncodeUint64(to),
+		"address":   w.Contract,
+		"topics":    []interface{}{transferTopic.Hex(), nil, common.BytesToHash(common.HexToAddress(w.Recipient).Bytes()).Hex()},
+	}
+	logs := []struct {
+		TxHash      string         `json:"transactionHash"`
+		LogIndex    hexutil.Uint64 `json:"logIndex"`
+		BlockNumber hexutil.Uint64 `json:"blockNumber"`
+		BlockHash   string         `json:"blockHash"`
+		Data        hexutil.Bytes  `json:"data"`
+		Removed     bool           `json:"removed"`
+	}{}
+	if err := get(ctx, source.call, &logs, "eth_getLogs", filter); err != nil {
+		return err
+	}
+
+	for _, log := range logs {
+		id := activityID(log.TxHash, uint32(log.LogIndex))
+		if _, ok := st.Activity[id]; ok || log.Removed {
+			continue
+		}
+		st.Activity[id] = &Activity{
+			TxHash:    log.TxHash,
+			Index:     uint32(log.LogIndex),
+			Amount:    new(big.Int).SetBytes(log.Data).String(),
+			Height:    uint64(log.BlockNumber),
+			BlockHash: log.BlockHash,
+		}
+	}
+	return nil
+}
+
+// included returns whether the transaction of the transfer is still in the chain, and updates the block it is in.
+func (source erc20Source) included(ctx context.Context, a *Activity) (bool, error) {
+	var receipt *struct {
+		BlockNumber hexutil.Uint64 `json:"blockNumber"`
+		BlockHash   string         `json:"blockHash"`
+	}
+	if err := get(ctx, source.call, &receipt, "eth_getTransactionReceipt", a.TxHash); err != nil {
+		return false, err
+	}
+	if receipt == nil {
+		return false, nil
+	}
+	a.Height, a.BlockHash = uint64(receipt.BlockNumber), receipt.BlockHash
+	return true, nil
+}
+
+// rescanWindow returns the number of blocks below the tip that are scanned for the transfers of the watch by every
+// update: the deepest requested depth and a margin, so that reorgs are found for as long as the transfers they affect
+// could still be notified.
+func rescanWindow(w Watch) uint64 {
+	window := w.maxDepth() + pruneMargin
+	if window > maxLogRange {
+		window = maxLogRange
+	}
+	return window
+}
+
+// confirmations returns the number of confirmations of a block at the given height.
+func confirmations(tip, height uint64) uint64 {
+	if height == 0 || height > tip {
+		return 0
+	}
+	return tip - height + 1
+}
+
+// get calls the method and decodes its result into the value.
+func get(ctx context.Context, call chain.Caller, value interface{}, method string, params ...interface{}) error {
+	result, err := call(ctx, method, params...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(result, value); err != nil {
+		return fmt.Errorf("invalid result for %v: %v", method, err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+// Package watch notifies callers of incoming activity on the addresses they watch, so that they do not need to poll the
+// nodes themselves. Callers register a Bitcoin, ZCash or Bitcoin Cash address, or an ERC20 contract and recipient,
+// along with the URL of a webhook. Each new incoming output or transfer is sent to the webhook when it is first seen,
+// and again when it reaches each requested number of confirmations. Webhooks are signed using the secret of the watch,
+// and failed deliveries are retried with backoff. Registrations, the activity of each watch and pending deliveries are
+// kept in the kv store, so they survive restarts.
+package watch
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// SignatureHeader is the header of each webhook which holds its signature.
+const SignatureHeader = "X-Mercury-Signature"
+
+// DefaultConfirmations are the confirmation depths used when a watch does not request any.
+var DefaultConfirmations = []uint64{1}
+
+// Limits of the confirmation depths of a watch.
+const (
+	MaxConfirmations = 1000
+	MaxDepths        = 10
+)
+
+// ErrNotFound is returned when a watch does not exist.
+var ErrNotFound = errors.New("watch not found")
+
+// ErrInvalid is returned when registering a watch that is not valid.
+type ErrInvalid struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (err ErrInvalid) Error() string {
+	return fmt.Sprintf("invalid watch: %v", err.Reason)
+}
+
+// Watch is the registration of a webhook for the activity of an address. Address is set for Bitcoin-family networks,
+// and Contract and Recipient for Ethereum networks.
+type Watch struct {
+	ID        string `json:"id"`
+	Network   string `json:"network"`
+	Address   string `json:"address,omitempty"`
+	Contract  string `json:"contract,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	URL       string `json:"url"`
+	// Confirmations are the depths at which each output or transfer is sent to the webhook again, in increasing
+	// order.
+	Confirmations []uint64 `json:"confirmations"`
+	// Secret signs the webhooks. It is only returned when the watch is registered.
+	Secret string `json:"secret,omitempty"`
+	// Owner is the name of the API key that registered the watch.
+	Owner   string `json:"owner,omitempty"`
+	Created int64  `json:"created"`
+}
+
+// validate checks the fields that do not depend on the network, and sorts the confirmation depths.
+func (w *Watch) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalid{Reason: fmt.Sprintf("url %q must be an absolute http or https url", w.URL)}
+	}
+
+	if len(w.Confirmations) == 0 {
+		w.Confirmations = DefaultConfirmations
+	}
+	if len(w.Confirmations) > MaxDepths {
+		return ErrInvalid{Reason: fmt.Sprintf("at most %d confirmation depths can be requested", MaxDepths)}
+	}
+	depths := make([]uint64, len(w.Confirmations))
+	copy(depths, w.Confirmations)
+	sort.Slice(depths, func(i, j int) bool { return depths[i] < depths[j] })
+	for i, depth := range depths {
+		if depth == 0 || depth > MaxConfirmations {
+			return ErrInvalid{Reason: fmt.Sprintf("confirmation depths must be between 1 and %d", MaxConfirmations)}
+		}
+		if i > 0 && depth == depths[i-1] {
+			return ErrInvalid{Reason: fmt.Sprintf("confirmation depth %d is repeated", depth)}
+		}
+	}
+	w.Confirmations = depths
+	return nil
+}
+
+// depth returns the depth of the given level of notifications: zero when an output or transfer is first seen, and
+// then each of the requested confirmation depths.
+func (w Watch) depth(level int) uint64 {
+	if level == 0 {
+		return 0
+	}
+	return w.Confirmations[level-1]
+}
+
+// levels returns the number of notifications sent for each output or transfer.
+func (w Watch) levels() int {
+	return len(w.Confirmations) + 1
+}
+
+// maxDepth returns the deepest requested confirmation depth.
+func (w Watch) maxDepth() uint64 {
+	return w.Confirmations[len(w.Confirmations)-1]
+}
+
+// Activity is an incoming output or transfer of a watch.
+type Activity struct {
+	TxHash string `json:"txHash"`
+	// Index is the index of the output in its transaction, or of the transfer log in its block.
+	Index uint32 `json:"index"`
+	// Amount is a decimal number of the smallest unit of the asset, such as satoshis or the base unit of a token.
+	Amount string `json:"amount"`
+	// Height and BlockHash are the block the transfer was included in. They are only kept for Ethereum networks.
+	Height    uint64 `json:"height,omitempty"`
+	BlockHash string `json:"blockHash,omitempty"`
+
+	Confirmations uint64 `json:"confirmations"`
+	// Notified is the number of levels of notifications that have been sent.
+	Notified int `json:"notified"`
+}
+
+// done returns whether every notification for the activity has been sent.
+func (a Activity) done(w Watch) bool {
+	return a.Notified >= w.levels()
+}
+
+// activityID returns the key of the output or transfer in the activity of a watch.
+func activityID(txHash string, index uint32) string {
+	return fmt.Sprintf("%s:%d", txHash, index)
+}
+
+// state is the activity of a watch that has not been fully notified, along with ERC20 transfers that have been fully
+// notified but are still within the rescan window. Cursor is the block after the last one scanned for Ethereum
+// networks, and zero until the first scan.
+type state struct {
+	Cursor   uint64               `json:"cursor"`
+	Activity map[string]*Activity `json:"activity"`
+}
+
+// record is a watch and its state, as kept in the store.
+type record struct {
+	Watch Watch `json:"watch"`
+	State state `json:"state"`
+}
+
+// Notification is the body of a webhook. Depth is zero when the output or transfer is first seen, and otherwise the
+// requested confirmation depth it has reached. The ID is the same for each attempt to deliver the notification.
+type Notification struct {
+	ID        string `json:"id"`
+	Watch     string `json:"watch"`
+	Network   string `json:"network"`
+	Address   string `json:"address,omitempty"`
+	Contract  string `json:"contract,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+
+	TxHash        string `json:"txHash"`
+	Index         uint32 `json:"index"`
+	Amount        string `json:"amount"`
+	Confirmations uint64 `json:"confirmations"`
+	Depth         uint64 `json:"depth"`
+}
+
+// Sign returns the signature of a webhook body: the hex encoded HMAC-SHA256 of the body, keyed by the secret of the
+// watch, prefixed by `sha256=`.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// randomID returns a random hex encoded identifier of the given number of bytes.
+func randomID(size int) (string, error) {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}